@@ -0,0 +1,88 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// exemplarSeries are the exemplars of a series as served by the exemplars
+// endpoint
+type exemplarSeries struct {
+	SeriesLabels labels.Labels  `json:"seriesLabels"`
+	Exemplars    []exemplarJSON `json:"exemplars"`
+}
+
+// exemplarJSON is an exemplar with its value as a string and its timestamp
+// in seconds, like Prometheus returns them
+type exemplarJSON struct {
+	Labels    labels.Labels `json:"labels"`
+	Value     string        `json:"value"`
+	Timestamp float64       `json:"timestamp"`
+}
+
+// handleQueryExemplars returns the exemplars in the optional start and end
+// range of the series matching any selector of the PromQL expression in
+// the query parameter, ordered by series
+func (s *Server) handleQueryExemplars(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		respondError(w, http.StatusBadRequest, errorBadData, err)
+		return
+	}
+
+	expr, err := parser.ParseExpr(r.FormValue("query"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, errorBadData, fmt.Errorf("invalid parameter \"query\": %w", err))
+		return
+	}
+	mint, maxt, _, err := parseTimeRange(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, errorBadData, err)
+		return
+	}
+
+	// Series matched by several selectors are listed once
+	seen := make(map[string]struct{})
+	res := []exemplarSeries{}
+	for _, ms := range parser.ExtractSelectors(expr) {
+		ss := s.head.Select(r.Context(), mint, maxt, ms...)
+		for ss.Next() {
+			series := ss.At()
+			es := series.Exemplars()
+			if len(es) == 0 {
+				continue
+			}
+			lset := series.Labels()
+			key := lset.String()
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+
+			out := exemplarSeries{SeriesLabels: lset, Exemplars: make([]exemplarJSON, 0, len(es))}
+			for _, e := range es {
+				out.Exemplars = append(out.Exemplars, exemplarJSON{
+					Labels:    labelsFromProto(e.Labels),
+					Value:     strconv.FormatFloat(e.Value, 'f', -1, 64),
+					Timestamp: float64(e.Timestamp) / 1000,
+				})
+			}
+			res = append(res, out)
+		}
+		if err := ss.Err(); err != nil {
+			respondError(w, http.StatusInternalServerError, errorInternal, err)
+			return
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool { return labels.Compare(res[i].SeriesLabels, res[j].SeriesLabels) < 0 })
+	respond(w, res)
+}
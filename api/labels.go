@@ -0,0 +1,226 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// handleLabels returns the sorted label names of the series matching any of
+// the match[] selectors, or of all series if there are none
+func (s *Server) handleLabels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		respondError(w, http.StatusBadRequest, errorBadData, err)
+		return
+	}
+
+	sets, err := parseMatcherSets(r.Form["match[]"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, errorBadData, err)
+		return
+	}
+	mint, maxt, bounded, err := parseTimeRange(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, errorBadData, err)
+		return
+	}
+	if len(sets) == 0 {
+		sets = [][]*labels.Matcher{nil}
+	}
+
+	// Without a time range the head index answers directly, otherwise only
+	// series with samples in the range count
+	names := make(map[string]struct{})
+	for _, ms := range sets {
+		if !bounded {
+			for _, name := range s.head.LabelNames(ms...) {
+				names[name] = struct{}{}
+			}
+			continue
+		}
+		ss := s.head.Select(r.Context(), mint, maxt, ms...)
+		for ss.Next() {
+			for _, l := range ss.At().Labels() {
+				names[l.Name] = struct{}{}
+			}
+		}
+		if err := ss.Err(); err != nil {
+			respondError(w, http.StatusInternalServerError, errorInternal, err)
+			return
+		}
+	}
+
+	respond(w, sortedSet(names))
+}
+
+// labelValuesPrefix is the path of the label values endpoint up to the
+// label name
+const labelValuesPrefix = "/api/v1/label/"
+
+// handleLabelValues returns the sorted values of the label named in the
+// path /api/v1/label/<name>/values across the series matching any of the
+// match[] selectors. An unknown label has no values, which is not an error.
+func (s *Server) handleLabelValues(w http.ResponseWriter, r *http.Request) {
+	name, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, labelValuesPrefix), "/values")
+	if !ok || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if name == "" {
+		respondError(w, http.StatusBadRequest, errorBadData, errors.New("invalid label name \"\""))
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		respondError(w, http.StatusBadRequest, errorBadData, err)
+		return
+	}
+
+	sets, err := parseMatcherSets(r.Form["match[]"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, errorBadData, err)
+		return
+	}
+	mint, maxt, bounded, err := parseTimeRange(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, errorBadData, err)
+		return
+	}
+	if len(sets) == 0 {
+		sets = [][]*labels.Matcher{nil}
+	}
+
+	values := make(map[string]struct{})
+	for _, ms := range sets {
+		if !bounded {
+			for _, v := range s.head.LabelValues(name, ms...) {
+				values[v] = struct{}{}
+			}
+			continue
+		}
+		ss := s.head.Select(r.Context(), mint, maxt, ms...)
+		for ss.Next() {
+			if v := ss.At().Labels().Get(name); v != "" {
+				values[v] = struct{}{}
+			}
+		}
+		if err := ss.Err(); err != nil {
+			respondError(w, http.StatusInternalServerError, errorInternal, err)
+			return
+		}
+	}
+
+	respond(w, sortedSet(values))
+}
+
+// handleSeries returns the sorted, distinct label sets of the series
+// matching any of the match[] selectors, of which there must be at least one
+func (s *Server) handleSeries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		respondError(w, http.StatusBadRequest, errorBadData, err)
+		return
+	}
+	if len(r.Form["match[]"]) == 0 {
+		respondError(w, http.StatusBadRequest, errorBadData, errors.New("no match[] parameter provided"))
+		return
+	}
+
+	sets, err := parseMatcherSets(r.Form["match[]"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, errorBadData, err)
+		return
+	}
+	mint, maxt, _, err := parseTimeRange(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, errorBadData, err)
+		return
+	}
+
+	var res []labels.Labels
+	for _, ms := range sets {
+		ss := s.head.Select(r.Context(), mint, maxt, ms...)
+		for ss.Next() {
+			res = append(res, ss.At().Labels())
+		}
+		if err := ss.Err(); err != nil {
+			respondError(w, http.StatusInternalServerError, errorInternal, err)
+			return
+		}
+	}
+
+	// Series matched by several selectors are listed once
+	sort.Slice(res, func(i, j int) bool { return labels.Compare(res[i], res[j]) < 0 })
+	distinct := make([]labels.Labels, 0, len(res))
+	for _, lset := range res {
+		if n := len(distinct); n == 0 || !labels.Equal(distinct[n-1], lset) {
+			distinct = append(distinct, lset)
+		}
+	}
+
+	respond(w, distinct)
+}
+
+// parseMatcherSets parses the series selectors of match[] parameters
+func parseMatcherSets(selectors []string) ([][]*labels.Matcher, error) {
+	sets := make([][]*labels.Matcher, 0, len(selectors))
+	for _, sel := range selectors {
+		ms, err := parser.ParseMetricSelector(sel)
+		if err != nil {
+			return nil, fmt.Errorf("invalid parameter \"match[]\": %w", err)
+		}
+		sets = append(sets, ms)
+	}
+	return sets, nil
+}
+
+// parseTimeRange parses the optional start and end parameters into a range
+// in milliseconds, unbounded on the side of a missing parameter. bounded
+// reports whether either was given.
+func parseTimeRange(r *http.Request) (mint, maxt int64, bounded bool, err error) {
+	mint, maxt = math.MinInt64, math.MaxInt64
+	if v := r.FormValue("start"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			return 0, 0, false, fmt.Errorf("invalid parameter \"start\": %w", err)
+		}
+		mint, bounded = t.UnixMilli(), true
+	}
+	if v := r.FormValue("end"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			return 0, 0, false, fmt.Errorf("invalid parameter \"end\": %w", err)
+		}
+		maxt, bounded = t.UnixMilli(), true
+	}
+	if mint > maxt {
+		return 0, 0, false, errors.New("end timestamp must not be before start time")
+	}
+	return mint, maxt, bounded, nil
+}
+
+// sortedSet returns the members of a string set in ascending order
+func sortedSet(set map[string]struct{}) []string {
+	res := make([]string, 0, len(set))
+	for k := range set {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/yuanhuiqu/protsdb/head"
+)
+
+// getData sends a GET request and decodes the data of a successful response
+// into data, returning the status code
+func getData(t *testing.T, s *Server, path string, form url.Values, data interface{}) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path+"?"+form.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		return rec.Code
+	}
+	resp := response{Data: data}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != "success" {
+		t.Fatalf("%s: status %q", path, resp.Status)
+	}
+	return rec.Code
+}
+
+// newLabelsServer returns a server holding series with differing label
+// names at 1s, 2s and 3s
+func newLabelsServer(t *testing.T) *Server {
+	t.Helper()
+	s := newTestServer(t, head.Options{}, Options{})
+	for i, lset := range []labels.Labels{
+		labels.FromStrings(labels.MetricName, "up", "job", "a", "instance", "x"),
+		labels.FromStrings(labels.MetricName, "up", "job", "b", "zone", "z1"),
+		labels.FromStrings(labels.MetricName, "build_info", "version", "1.0"),
+	} {
+		if err := s.head.Append(lset, prompb.Sample{Timestamp: int64(i+1) * 1000, Value: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func TestLabels(t *testing.T) {
+	s := newLabelsServer(t)
+	for _, tc := range []struct {
+		form url.Values
+		code int
+		want []string
+	}{
+		{url.Values{}, http.StatusOK, []string{labels.MetricName, "instance", "job", "version", "zone"}},
+		{url.Values{"match[]": {`up{job="a"}`}}, http.StatusOK, []string{labels.MetricName, "instance", "job"}},
+		{url.Values{"match[]": {`up{job="a"}`, "build_info"}}, http.StatusOK, []string{labels.MetricName, "instance", "job", "version"}},
+		{url.Values{"start": {"1.5"}, "end": {"2.5"}}, http.StatusOK, []string{labels.MetricName, "job", "zone"}},
+		{url.Values{"match[]": {"nothing"}}, http.StatusOK, []string{}},
+		{url.Values{"match[]": {"up{"}}, http.StatusBadRequest, nil},
+		{url.Values{"start": {"3"}, "end": {"1"}}, http.StatusBadRequest, nil},
+	} {
+		var got []string
+		code := getData(t, s, "/api/v1/labels", tc.form, &got)
+		if code != tc.code {
+			t.Fatalf("%v: status %d, want %d", tc.form, code, tc.code)
+		}
+		if code == http.StatusOK && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: label names %v, want %v", tc.form, got, tc.want)
+		}
+	}
+}
+
+func TestLabelValues(t *testing.T) {
+	s := newLabelsServer(t)
+	for _, tc := range []struct {
+		path string
+		form url.Values
+		code int
+		want []string
+	}{
+		{"/api/v1/label/job/values", url.Values{}, http.StatusOK, []string{"a", "b"}},
+		{"/api/v1/label/__name__/values", url.Values{}, http.StatusOK, []string{"build_info", "up"}},
+		{"/api/v1/label/job/values", url.Values{"match[]": {`{zone="z1"}`}}, http.StatusOK, []string{"b"}},
+		{"/api/v1/label/job/values", url.Values{"start": {"0"}, "end": {"1.5"}}, http.StatusOK, []string{"a"}},
+		{"/api/v1/label/unknown/values", url.Values{}, http.StatusOK, []string{}},
+		{"/api/v1/label/job/values", url.Values{"match[]": {"up{"}}, http.StatusBadRequest, nil},
+		{"/api/v1/label/job", url.Values{}, http.StatusNotFound, nil},
+		{"/api/v1/label/a/b/values", url.Values{}, http.StatusNotFound, nil},
+	} {
+		var got []string
+		code := getData(t, s, tc.path, tc.form, &got)
+		if code != tc.code {
+			t.Fatalf("%s %v: status %d, want %d", tc.path, tc.form, code, tc.code)
+		}
+		if code == http.StatusOK && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s %v: values %v, want %v", tc.path, tc.form, got, tc.want)
+		}
+	}
+}
+
+func TestSeries(t *testing.T) {
+	s := newLabelsServer(t)
+	a := map[string]string{labels.MetricName: "up", "job": "a", "instance": "x"}
+	b := map[string]string{labels.MetricName: "up", "job": "b", "zone": "z1"}
+	for _, tc := range []struct {
+		form url.Values
+		code int
+		want []map[string]string
+	}{
+		{url.Values{"match[]": {"up"}}, http.StatusOK, []map[string]string{a, b}},
+		// Series matched twice are listed once
+		{url.Values{"match[]": {"up", `{job="a"}`}}, http.StatusOK, []map[string]string{a, b}},
+		{url.Values{"match[]": {"up"}, "start": {"1.5"}}, http.StatusOK, []map[string]string{b}},
+		{url.Values{"match[]": {"nothing"}}, http.StatusOK, []map[string]string{}},
+		{url.Values{}, http.StatusBadRequest, nil},
+		{url.Values{"match[]": {"up{"}}, http.StatusBadRequest, nil},
+	} {
+		var got []map[string]string
+		code := getData(t, s, "/api/v1/series", tc.form, &got)
+		if code != tc.code {
+			t.Fatalf("%v: status %d, want %d", tc.form, code, tc.code)
+		}
+		if code == http.StatusOK && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: series %v, want %v", tc.form, got, tc.want)
+		}
+	}
+}
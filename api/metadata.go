@@ -0,0 +1,61 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// metadataEntry is the metadata of a metric family as served by the
+// metadata endpoint
+type metadataEntry struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+// handleMetadata returns the stored metadata by metric family name,
+// restricted to the family given by the metric parameter and to the first
+// limit families in name order if those are set
+func (s *Server) handleMetadata(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := -1
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			respondError(w, http.StatusBadRequest, errorBadData, fmt.Errorf("invalid limit %q", v))
+			return
+		}
+		limit = n
+	}
+	metric := r.FormValue("metric")
+
+	md := s.head.Metadata()
+	names := make([]string, 0, len(md))
+	for name := range md {
+		if metric == "" || name == metric {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if limit >= 0 && len(names) > limit {
+		names = names[:limit]
+	}
+
+	res := make(map[string][]metadataEntry, len(names))
+	for _, name := range names {
+		m := md[name]
+		res[name] = []metadataEntry{{
+			Type: strings.ToLower(m.Type.String()),
+			Help: m.Help,
+			Unit: m.Unit,
+		}}
+	}
+	respond(w, res)
+}
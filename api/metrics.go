@@ -0,0 +1,86 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+// metricsContentType is the content type of the Prometheus text format
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// handleMetrics exposes internal statistics in the Prometheus text format
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	hs := s.head.Stats()
+	ws := s.head.WALStats()
+
+	w.Header().Set("Content-Type", metricsContentType)
+	bw := bufio.NewWriter(w)
+	writeMetric(bw, "protsdb_head_series", "gauge", "Number of series in the head.", float64(hs.NumSeries))
+	if hs.MaxSeries > 0 {
+		writeMetric(bw, "protsdb_head_max_series", "gauge", "Maximum number of series the head may hold.", float64(hs.MaxSeries))
+	}
+	writeMetric(bw, "protsdb_head_series_created_total", "counter", "Series created in the head by appends.", float64(hs.SeriesCreated))
+	writeMetric(bw, "protsdb_head_series_removed_total", "counter", "Series removed from the head for holding no samples or going stale.", float64(hs.SeriesRemoved))
+	writeMetric(bw, "protsdb_head_samples_total", "counter", "Samples appended to the head.", float64(hs.SamplesAppended))
+	writeRejected(bw, hs.SamplesRejected)
+	writeMetric(bw, "protsdb_head_chunks", "gauge", "Number of chunks in the head.", float64(hs.NumChunks))
+	writeMetric(bw, "protsdb_head_samples", "gauge", "Number of samples held by the head.", float64(hs.NumSamples))
+	writeMetric(bw, "protsdb_head_size_bytes", "gauge", "Approximate memory held by the head.", float64(hs.HeadSizeBytes))
+	writeMetric(bw, "protsdb_head_interned_strings", "gauge", "Distinct label names and values interned by the head.", float64(hs.InternedStrings))
+	writeMetric(bw, "protsdb_wal_segments", "gauge", "Number of WAL segments.", float64(ws.Segments))
+	writeMetric(bw, "protsdb_wal_sealed_segments", "gauge", "Number of full WAL segments not checkpointed yet.", float64(ws.SealedSegments))
+	writeMetric(bw, "protsdb_wal_flushed_segments", "gauge", "Number of checkpointed WAL segments not removed yet.", float64(ws.FlushedSegments))
+	writeMetric(bw, "protsdb_wal_size_bytes", "gauge", "Total size of the WAL segments.", float64(ws.SizeBytes))
+	writeMetric(bw, "protsdb_wal_segment_rotations_total", "counter", "WAL segments sealed for a new one.", float64(ws.SegmentRotations))
+	writeSummary(bw, "protsdb_wal_fsync_duration_seconds", "Duration of WAL fsyncs.", ws.Fsyncs, ws.FsyncDuration.Seconds())
+	if !ws.LastCheckpoint.IsZero() {
+		writeMetric(bw, "protsdb_wal_last_checkpoint_timestamp_seconds", "gauge", "Time of the last successful WAL checkpoint.",
+			float64(ws.LastCheckpoint.UnixNano())/1e9)
+	}
+	writeMetric(bw, "protsdb_remote_write_samples_total", "counter", "Samples accepted through remote write.",
+		float64(atomic.LoadUint64(&s.remoteWriteSamples)))
+	writeMetric(bw, "protsdb_remote_write_rejected_total", "counter", "Remote write requests rejected for exceeding the concurrent write limit.",
+		float64(atomic.LoadUint64(&s.remoteWriteRejected)))
+	writeMetric(bw, "protsdb_http_handler_panics_total", "counter", "HTTP requests whose handler panicked.",
+		float64(atomic.LoadUint64(&s.handlerPanics)))
+	s.requests.write(bw)
+	bw.Flush()
+}
+
+// writeMetric writes a single unlabeled metric with its metadata
+func writeMetric(w *bufio.Writer, name, typ, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, typ, name, v)
+}
+
+// writeSummary writes a summary without quantiles, i.e. only its count and
+// sum, with its metadata
+func writeSummary(w *bufio.Writer, name, help string, count uint64, sum float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s summary\n%s_sum %g\n%s_count %d\n", name, help, name, name, sum, name, count)
+}
+
+// writeRejected writes the samples rejected by validation or the series
+// sample limit by reason, if there are any
+func writeRejected(w *bufio.Writer, rejected map[string]uint64) {
+	if len(rejected) == 0 {
+		return
+	}
+	reasons := make([]string, 0, len(rejected))
+	for reason := range rejected {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	fmt.Fprintf(w, "# HELP protsdb_head_samples_rejected_total Samples rejected by append-time validation or the per-series sample limit by reason.\n")
+	fmt.Fprintf(w, "# TYPE protsdb_head_samples_rejected_total counter\n")
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "protsdb_head_samples_rejected_total{reason=%q} %d\n", reason, rejected[reason])
+	}
+}
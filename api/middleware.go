@@ -0,0 +1,161 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// recoverPanics turns a panicking handler into a 500 response, so a single
+// bad request cannot take down the server
+func (s *Server) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			// Handlers abort responses deliberately with this one
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			atomic.AddUint64(&s.handlerPanics, 1)
+			s.logger.Error("Panic serving request", "path", r.URL.Path, "err", err, "stack", string(debug.Stack()))
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// durationBuckets are the upper bounds in seconds of the request duration
+// histogram buckets, the ones Prometheus client libraries default to
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// requestKey identifies the requests counted together: the route that
+// served them, so label values in paths do not add up, and their status
+type requestKey struct {
+	handler string
+	code    int
+}
+
+// requestStats is the duration histogram of the requests of a key
+type requestStats struct {
+	buckets []uint64 // requests per bucket, not cumulative
+	count   uint64
+	sum     float64 // seconds
+}
+
+// requestMetrics tracks the count and duration of served requests
+type requestMetrics struct {
+	mtx   sync.Mutex
+	stats map[requestKey]*requestStats
+}
+
+func newRequestMetrics() *requestMetrics {
+	return &requestMetrics{stats: make(map[requestKey]*requestStats)}
+}
+
+// observe records a request that took d
+func (m *requestMetrics) observe(k requestKey, d time.Duration) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	st := m.stats[k]
+	if st == nil {
+		st = &requestStats{buckets: make([]uint64, len(durationBuckets))}
+		m.stats[k] = st
+	}
+	secs := d.Seconds()
+	if i := sort.SearchFloat64s(durationBuckets, secs); i < len(durationBuckets) {
+		st.buckets[i]++
+	}
+	st.count++
+	st.sum += secs
+}
+
+// write writes the request counter and duration histogram in the
+// Prometheus text format, ordered by handler and code
+func (m *requestMetrics) write(w *bufio.Writer) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	keys := make([]requestKey, 0, len(m.stats))
+	for k := range m.stats {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].handler != keys[j].handler {
+			return keys[i].handler < keys[j].handler
+		}
+		return keys[i].code < keys[j].code
+	})
+
+	fmt.Fprintf(w, "# HELP protsdb_http_requests_total HTTP requests served by handler and status code.\n")
+	fmt.Fprintf(w, "# TYPE protsdb_http_requests_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(w, "protsdb_http_requests_total{handler=%q,code=\"%d\"} %d\n", k.handler, k.code, m.stats[k].count)
+	}
+
+	fmt.Fprintf(w, "# HELP protsdb_http_request_duration_seconds Duration of HTTP requests by handler and status code.\n")
+	fmt.Fprintf(w, "# TYPE protsdb_http_request_duration_seconds histogram\n")
+	for _, k := range keys {
+		st := m.stats[k]
+		var cum uint64
+		for i, le := range durationBuckets {
+			cum += st.buckets[i]
+			fmt.Fprintf(w, "protsdb_http_request_duration_seconds_bucket{handler=%q,code=\"%d\",le=\"%s\"} %d\n",
+				k.handler, k.code, strconv.FormatFloat(le, 'g', -1, 64), cum)
+		}
+		fmt.Fprintf(w, "protsdb_http_request_duration_seconds_bucket{handler=%q,code=\"%d\",le=\"+Inf\"} %d\n", k.handler, k.code, st.count)
+		fmt.Fprintf(w, "protsdb_http_request_duration_seconds_sum{handler=%q,code=\"%d\"} %g\n", k.handler, k.code, st.sum)
+		fmt.Fprintf(w, "protsdb_http_request_duration_seconds_count{handler=%q,code=\"%d\"} %d\n", k.handler, k.code, st.count)
+	}
+}
+
+// statusRecorder remembers the status code a handler responds with
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter { return r.ResponseWriter }
+
+// instrument counts and times requests by the route serving them and the
+// status of their response. Requests no route matches count as "other".
+func (s *Server) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, handler := s.mux.Handler(r)
+		if handler == "" {
+			handler = "other"
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+		s.requests.observe(requestKey{handler: handler, code: rec.code}, time.Since(start))
+	})
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/yuanhuiqu/protsdb/head"
+)
+
+// TestRecoverPanics checks that a panicking handler answers 500, is counted
+// and leaves the server serving
+func TestRecoverPanics(t *testing.T) {
+	s := newTestServer(t, head.Options{}, Options{
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	s.mux.HandleFunc("/panic", func(http.ResponseWriter, *http.Request) { panic("boom") })
+	s.mux.HandleFunc("/abort", func(http.ResponseWriter, *http.Request) { panic(http.ErrAbortHandler) })
+	serve := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := serve("/panic"); rec.Code != http.StatusInternalServerError {
+			t.Fatalf("panicking handler: status %d, want %d", rec.Code, http.StatusInternalServerError)
+		}
+		if rec := serve("/api/v1/health"); rec.Code != http.StatusOK {
+			t.Fatalf("request after a panic: status %d", rec.Code)
+		}
+	}
+	if body := serve("/metrics").Body.String(); !strings.Contains(body, "protsdb_http_handler_panics_total 2\n") {
+		t.Errorf("panics not counted in the metrics:\n%s", body)
+	}
+
+	// The server aborts the response of this one itself
+	func() {
+		defer func() {
+			if err := recover(); err != http.ErrAbortHandler {
+				t.Errorf("aborting handler: recovered %v, want %v", err, http.ErrAbortHandler)
+			}
+		}()
+		serve("/abort")
+	}()
+}
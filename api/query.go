@@ -0,0 +1,159 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// Error types of query failures, as returned by Prometheus
+const (
+	errorExec     = "execution"
+	errorTimeout  = "timeout"
+	errorCanceled = "canceled"
+)
+
+// queryData is the data of a successful query response
+type queryData struct {
+	ResultType parser.ValueType `json:"resultType"`
+	Result     parser.Value     `json:"result"`
+}
+
+// handleQuery evaluates a PromQL instant query
+func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ts := time.Now()
+	if v := r.FormValue("time"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, errorBadData, fmt.Errorf("invalid parameter \"time\": %w", err))
+			return
+		}
+		ts = t
+	}
+
+	q, err := s.engine.NewInstantQuery(r.Context(), s.queryable, nil, r.FormValue("query"), ts)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, errorBadData, fmt.Errorf("invalid parameter \"query\": %w", err))
+		return
+	}
+	defer q.Close()
+
+	res := q.Exec(r.Context())
+	if res.Err != nil {
+		respondQueryError(w, res.Err)
+		return
+	}
+	respondWarnings(w, queryData{ResultType: res.Value.Type(), Result: res.Value}, res.Warnings)
+}
+
+// handleQueryRange evaluates a PromQL range query
+func (s *Server) handleQueryRange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	start, err := parseTime(r.FormValue("start"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, errorBadData, fmt.Errorf("invalid parameter \"start\": %w", err))
+		return
+	}
+	end, err := parseTime(r.FormValue("end"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, errorBadData, fmt.Errorf("invalid parameter \"end\": %w", err))
+		return
+	}
+	if end.Before(start) {
+		respondError(w, http.StatusBadRequest, errorBadData, errors.New("end timestamp must not be before start time"))
+		return
+	}
+	step, err := parseDuration(r.FormValue("step"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, errorBadData, fmt.Errorf("invalid parameter \"step\": %w", err))
+		return
+	}
+	if step <= 0 {
+		respondError(w, http.StatusBadRequest, errorBadData, errors.New("zero or negative query resolution step widths are not accepted, try a positive integer"))
+		return
+	}
+	if points := int64(end.Sub(start)/step) + 1; points > int64(s.maxPoints) {
+		respondError(w, http.StatusBadRequest, errorBadData, fmt.Errorf("exceeded maximum resolution of %d points per timeseries, try decreasing the query resolution (?step=XX)", s.maxPoints))
+		return
+	}
+
+	q, err := s.engine.NewRangeQuery(r.Context(), s.queryable, nil, r.FormValue("query"), start, end, step)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, errorBadData, fmt.Errorf("invalid parameter \"query\": %w", err))
+		return
+	}
+	defer q.Close()
+
+	res := q.Exec(r.Context())
+	if res.Err != nil {
+		respondQueryError(w, res.Err)
+		return
+	}
+	respondWarnings(w, queryData{ResultType: res.Value.Type(), Result: res.Value}, res.Warnings)
+}
+
+// respondQueryError maps a query evaluation error to its error type and
+// status code the way Prometheus does
+func respondQueryError(w http.ResponseWriter, err error) {
+	var (
+		canceled promql.ErrQueryCanceled
+		timeout  promql.ErrQueryTimeout
+		storage  promql.ErrStorage
+	)
+	switch {
+	case errors.As(err, &canceled), errors.Is(err, context.Canceled):
+		respondError(w, http.StatusServiceUnavailable, errorCanceled, err)
+	case errors.As(err, &timeout):
+		respondError(w, http.StatusServiceUnavailable, errorTimeout, err)
+	case errors.As(err, &storage):
+		respondError(w, http.StatusInternalServerError, errorInternal, err)
+	default:
+		respondError(w, http.StatusUnprocessableEntity, errorExec, err)
+	}
+}
+
+// parseTime parses a query timestamp, either as Unix seconds with an
+// optional fraction or in RFC 3339 format
+func parseTime(s string) (time.Time, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(f)
+		frac = math.Round(frac*1000) / 1000
+		return time.Unix(int64(sec), int64(frac*float64(time.Second))).UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+// parseDuration parses a query step, either as seconds with an optional
+// fraction or as a Go duration string such as "15s"
+func parseDuration(s string) (time.Duration, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		d := f * float64(time.Second)
+		if d >= float64(math.MaxInt64) || d <= float64(math.MinInt64) {
+			return 0, fmt.Errorf("cannot parse %q to a valid duration, it overflows int64", s)
+		}
+		return time.Duration(d), nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+}
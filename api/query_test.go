@@ -0,0 +1,135 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/yuanhuiqu/protsdb/head"
+)
+
+// TestQuery evaluates instant queries over samples in the head
+func TestQuery(t *testing.T) {
+	s := newTestServer(t, head.Options{}, Options{})
+	lset := labels.FromStrings(labels.MetricName, "a", "job", "x")
+	for ts := int64(10_000); ts <= 100_000; ts += 10_000 {
+		if err := s.head.Append(lset, prompb.Sample{Timestamp: ts, Value: float64(ts / 1000)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		query, time string
+		code        int
+		value       string // of the single result, if any
+	}{
+		// The latest sample at or before the query time
+		{"a", "55", http.StatusOK, "50"},
+		{"a", "100", http.StatusOK, "100"},
+		// Seeks past the samples before the range
+		{"sum_over_time(a[25s])", "60", http.StatusOK, "150"},
+		{"count_over_time(a[1m])", "100", http.StatusOK, "7"},
+		{"a", "", http.StatusOK, ""}, // now, far past the lookback
+		{"a{", "55", http.StatusBadRequest, ""},
+		{"a", "yesterday", http.StatusBadRequest, ""},
+	} {
+		form := url.Values{"query": {tc.query}}
+		if tc.time != "" {
+			form.Set("time", tc.time)
+		}
+		rec := httptest.NewRecorder()
+		s.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query?"+form.Encode(), nil))
+		if rec.Code != tc.code {
+			t.Fatalf("%s at %q: status %d, want %d: %s", tc.query, tc.time, rec.Code, tc.code, rec.Body)
+		}
+		if tc.code != http.StatusOK {
+			continue
+		}
+
+		var resp struct {
+			Data struct {
+				ResultType string `json:"resultType"`
+				Result     []struct {
+					Value [2]interface{} `json:"value"`
+				} `json:"result"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Data.ResultType != "vector" {
+			t.Fatalf("%s: result type %q, want vector", tc.query, resp.Data.ResultType)
+		}
+		switch {
+		case tc.value == "" && len(resp.Data.Result) != 0:
+			t.Fatalf("%s at %q: %d results, want none", tc.query, tc.time, len(resp.Data.Result))
+		case tc.value == "":
+		case len(resp.Data.Result) != 1:
+			t.Fatalf("%s at %q: %d results, want 1", tc.query, tc.time, len(resp.Data.Result))
+		case resp.Data.Result[0].Value[1] != tc.value:
+			t.Fatalf("%s at %q = %v, want %s", tc.query, tc.time, resp.Data.Result[0].Value[1], tc.value)
+		}
+	}
+}
+
+// TestQueryRange evaluates range queries over samples in the head, and
+// rejects bad or too fine ranges
+func TestQueryRange(t *testing.T) {
+	s := newTestServer(t, head.Options{}, Options{QueryMaxPoints: 10})
+	lset := labels.FromStrings(labels.MetricName, "a")
+	for ts := int64(10_000); ts <= 100_000; ts += 10_000 {
+		if err := s.head.Append(lset, prompb.Sample{Timestamp: ts, Value: float64(ts / 1000)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		start, end, step string
+		code             int
+		values           []string
+	}{
+		{"10", "100", "30", http.StatusOK, []string{"10", "40", "70", "100"}},
+		{"25", "55", "15s", http.StatusOK, []string{"20", "40", "50"}},
+		{"100", "10", "30", http.StatusBadRequest, nil},
+		{"10", "100", "0", http.StatusBadRequest, nil},
+		{"10", "100", "5", http.StatusBadRequest, nil}, // 19 points
+		{"10", "100", "", http.StatusBadRequest, nil},
+	} {
+		form := url.Values{"query": {"a"}, "start": {tc.start}, "end": {tc.end}, "step": {tc.step}}
+		rec := httptest.NewRecorder()
+		s.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query_range?"+form.Encode(), nil))
+		if rec.Code != tc.code {
+			t.Fatalf("%v: status %d, want %d: %s", form, rec.Code, tc.code, rec.Body)
+		}
+		if tc.code != http.StatusOK {
+			continue
+		}
+
+		var resp struct {
+			Data struct {
+				ResultType string `json:"resultType"`
+				Result     []struct {
+					Values [][2]interface{} `json:"values"`
+				} `json:"result"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Data.ResultType != "matrix" || len(resp.Data.Result) != 1 {
+			t.Fatalf("%v: %d %s results, want one matrix", form, len(resp.Data.Result), resp.Data.ResultType)
+		}
+		var values []string
+		for _, p := range resp.Data.Result[0].Values {
+			values = append(values, p[1].(string))
+		}
+		if !reflect.DeepEqual(values, tc.values) {
+			t.Fatalf("%v: values %v, want %v", form, values, tc.values)
+		}
+	}
+}
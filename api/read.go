@@ -0,0 +1,326 @@
+package api
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	promchunkenc "github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/yuanhuiqu/protsdb/chunkenc"
+	"github.com/yuanhuiqu/protsdb/head"
+)
+
+// wantsJSON reports whether the Accept header of a remote read request asks
+// for JSON. The first media type naming either format wins, quality values
+// are ignored, and anything else gets the snappy protobuf Prometheus expects.
+func wantsJSON(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mt, _, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		switch mt {
+		case "application/json":
+			return true
+		case "application/x-protobuf":
+			return false
+		}
+	}
+	return false
+}
+
+// respondReadJSON answers remote read queries with one matrix per query in
+// the envelope and encoding of the query endpoints
+func (s *Server) respondReadJSON(w http.ResponseWriter, r *http.Request, queries []*prompb.Query) {
+	res := make([]queryData, 0, len(queries))
+	for _, q := range queries {
+		matchers, err := matchersFromProto(q.Matchers)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, errorBadData, err)
+			return
+		}
+		querier, err := s.queryable.Querier(r.Context(), q.StartTimestampMs, q.EndTimestampMs)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, errorInternal, err)
+			return
+		}
+
+		m := promql.Matrix{}
+		samples := 0
+		ss := querier.Select(true, nil, matchers...)
+		var it promchunkenc.Iterator
+		for ss.Next() {
+			series := ss.At()
+			ps := promql.Series{Metric: series.Labels()}
+			it = series.Iterator(it)
+			for vt := it.Next(); vt != promchunkenc.ValNone; vt = it.Next() {
+				samples++
+				if err := s.checkSampleLimit(samples); err != nil {
+					querier.Close()
+					respondReadError(w, err)
+					return
+				}
+				if vt == promchunkenc.ValFloat {
+					t, v := it.At()
+					ps.Floats = append(ps.Floats, promql.FPoint{T: t, F: v})
+					continue
+				}
+				t, h := it.AtFloatHistogram()
+				ps.Histograms = append(ps.Histograms, promql.HPoint{T: t, H: h})
+			}
+			if err := it.Err(); err != nil {
+				querier.Close()
+				respondReadError(w, err)
+				return
+			}
+			m = append(m, ps)
+		}
+		err = ss.Err()
+		querier.Close()
+		if err != nil {
+			respondReadError(w, err)
+			return
+		}
+		res = append(res, queryData{ResultType: parser.ValueTypeMatrix, Result: m})
+	}
+	respond(w, res)
+}
+
+// errSampleLimit is returned when a remote read query selects more samples
+// than the server allows
+var errSampleLimit = errors.New("exceeded sample limit")
+
+// checkSampleLimit returns an error once n samples selected by a remote
+// read query are more than allowed
+func (s *Server) checkSampleLimit(n int) error {
+	if s.maxSamplesPerQuery > 0 && n > s.maxSamplesPerQuery {
+		return fmt.Errorf("%w of %d samples per query", errSampleLimit, s.maxSamplesPerQuery)
+	}
+	return nil
+}
+
+// readErrorStatus maps an error of a remote read to its status code
+func readErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errSampleLimit):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// respondReadError writes an error of a remote read answered in JSON with
+// the error types of the query endpoints
+func respondReadError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errSampleLimit):
+		respondError(w, http.StatusUnprocessableEntity, errorExec, err)
+	case errors.Is(err, context.DeadlineExceeded):
+		respondError(w, http.StatusServiceUnavailable, errorTimeout, err)
+	case errors.Is(err, context.Canceled):
+		respondError(w, http.StatusServiceUnavailable, errorCanceled, err)
+	default:
+		respondError(w, http.StatusInternalServerError, errorInternal, err)
+	}
+}
+
+// limitIterator fails once the samples counted in n across the iterators
+// of a remote read query exceed the sample limit
+type limitIterator struct {
+	head.SampleIterator
+	n   *int
+	s   *Server
+	err error
+}
+
+func (it *limitIterator) Next() bool {
+	if it.err != nil || !it.SampleIterator.Next() {
+		return false
+	}
+	*it.n++
+	it.err = it.s.checkSampleLimit(*it.n)
+	return it.err == nil
+}
+
+func (it *limitIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.SampleIterator.Err()
+}
+
+// streamedContentType is the content type of STREAMED_XOR_CHUNKS responses
+const streamedContentType = "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse"
+
+// Limits of STREAMED_XOR_CHUNKS responses, as used by Prometheus. A series
+// with more chunk data than fits a frame is split over several frames.
+const (
+	streamedChunkSamples = 120
+	streamedFrameBytes   = 1 << 20
+)
+
+// errNoResponseType is returned when a read request accepts no response
+// type the server supports
+var errNoResponseType = errors.New("server does not support any of the requested response types")
+
+// negotiateResponseType picks the first supported type of those a remote
+// read request accepts, SAMPLES if it names none
+func negotiateResponseType(accepted []prompb.ReadRequest_ResponseType) (prompb.ReadRequest_ResponseType, error) {
+	if len(accepted) == 0 {
+		return prompb.ReadRequest_SAMPLES, nil
+	}
+	for _, t := range accepted {
+		switch t {
+		case prompb.ReadRequest_SAMPLES, prompb.ReadRequest_STREAMED_XOR_CHUNKS:
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %v", errNoResponseType, accepted)
+}
+
+// streamReadChunks answers remote read queries with a stream of
+// ChunkedReadResponse frames, one series at a time, so the response is
+// never held in memory as a whole. Float samples are encoded into XOR
+// chunks, histogram samples are only served by SAMPLES responses. Errors,
+// including hitting the sample limit, get a status until the first frame
+// is out and can only end the stream early after.
+func (s *Server) streamReadChunks(w http.ResponseWriter, r *http.Request, queries []*prompb.Query) {
+	// Matchers are checked upfront so bad requests still get a status
+	matchers := make([][]*labels.Matcher, 0, len(queries))
+	for _, q := range queries {
+		ms, err := matchersFromProto(q.Matchers)
+		if err != nil {
+			http.Error(w, "Error parsing matchers: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		matchers = append(matchers, ms)
+	}
+
+	w.Header().Set("Content-Type", streamedContentType)
+	rc := http.NewResponseController(w)
+	cw := &chunkedWriter{w: w}
+	fail := func(err error) {
+		if cw.frames == 0 {
+			http.Error(w, err.Error(), readErrorStatus(err))
+			return
+		}
+		s.logger.Warn("Error streaming remote read response", "err", err)
+	}
+	for i, q := range queries {
+		samples := 0
+		ss := s.head.Select(r.Context(), q.StartTimestampMs, q.EndTimestampMs, matchers[i]...)
+		for ss.Next() {
+			series := ss.At()
+			it := &limitIterator{SampleIterator: series.Iterator(), n: &samples, s: s}
+			err := encodeChunkedSeries(it, func(chks []prompb.Chunk) error {
+				if err := cw.write(&prompb.ChunkedReadResponse{
+					ChunkedSeries: []*prompb.ChunkedSeries{{Labels: labelsToProto(series.Labels()), Chunks: chks}},
+					QueryIndex:    int64(i),
+				}); err != nil {
+					return err
+				}
+				// Not every writer flushes, the frame then goes out later
+				if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+					return err
+				}
+				return nil
+			})
+			if err != nil {
+				fail(err)
+				return
+			}
+		}
+		if err := ss.Err(); err != nil {
+			fail(err)
+			return
+		}
+	}
+}
+
+// encodeChunkedSeries encodes the samples of it into XOR chunks, handing
+// them to emit in groups of at most about streamedFrameBytes
+func encodeChunkedSeries(it head.SampleIterator, emit func([]prompb.Chunk) error) error {
+	var (
+		chks  []prompb.Chunk
+		size  int
+		chk   *chunkenc.XORChunk
+		app   chunkenc.Appender
+		first int64
+		last  int64
+	)
+	cut := func() {
+		if chk == nil {
+			return
+		}
+		chks = append(chks, prompb.Chunk{MinTimeMs: first, MaxTimeMs: last, Type: prompb.Chunk_XOR, Data: chk.Bytes()})
+		size += len(chk.Bytes())
+		chk = nil
+	}
+	for it.Next() {
+		t, v := it.At()
+		if chk == nil {
+			chk = chunkenc.NewXORChunk()
+			a, err := chk.Appender()
+			if err != nil {
+				return err
+			}
+			app, first = a, t
+		}
+		app.Append(t, v)
+		last = t
+		if chk.NumSamples() < streamedChunkSamples {
+			continue
+		}
+		cut()
+		if size >= streamedFrameBytes {
+			if err := emit(chks); err != nil {
+				return err
+			}
+			chks, size = nil, 0
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	cut()
+	if len(chks) == 0 {
+		return nil
+	}
+	return emit(chks)
+}
+
+// chunkedWriter writes the frames of a streamed remote read response: the
+// uvarint size of the message, the message and its big endian CRC32
+// (Castagnoli)
+type chunkedWriter struct {
+	w      io.Writer
+	buf    []byte
+	frames int // frames written
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func (cw *chunkedWriter) write(msg *prompb.ChunkedReadResponse) error {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	cw.buf = binary.AppendUvarint(cw.buf[:0], uint64(len(data)))
+	cw.buf = append(cw.buf, data...)
+	cw.buf = binary.BigEndian.AppendUint32(cw.buf, crc32.Checksum(data, castagnoli))
+	cw.frames++
+	_, err = cw.w.Write(cw.buf)
+	return err
+}
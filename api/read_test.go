@@ -0,0 +1,131 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/yuanhuiqu/protsdb/head"
+)
+
+// remoteRead sends a remote read request for all samples of the series
+// whose name matches the regexp, with the given Accept header unless empty
+func remoteRead(t *testing.T, s *Server, name, accept string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := &prompb.ReadRequest{Queries: []*prompb.Query{{
+		StartTimestampMs: 0,
+		EndTimestampMs:   1 << 40,
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_RE, Name: labels.MetricName, Value: name}},
+	}}}
+	b, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/read", bytes.NewReader(snappy.Encode(nil, b)))
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	rec := httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, r)
+	return rec
+}
+
+// readSamples appends 20 samples to the series a and b
+func readSamples(t *testing.T, s *Server) {
+	t.Helper()
+	for _, name := range []string{"a", "b"} {
+		lset := labels.FromStrings(labels.MetricName, name)
+		for ts := int64(1000); ts < 1020; ts++ {
+			if err := s.head.Append(lset, prompb.Sample{Timestamp: ts, Value: float64(ts)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// TestRemoteReadContentType checks that remote read answers in snappy
+// compressed protobuf unless the Accept header names JSON first
+func TestRemoteReadContentType(t *testing.T) {
+	s := newTestServer(t, head.Options{}, Options{})
+	readSamples(t, s)
+
+	for _, accept := range []string{"", "application/x-protobuf", "application/x-protobuf, application/json"} {
+		rec := remoteRead(t, s, "a", accept)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Accept %q: status %d: %s", accept, rec.Code, rec.Body)
+		}
+		b, err := snappy.Decode(nil, rec.Body.Bytes())
+		if err != nil {
+			t.Fatalf("Accept %q: %v", accept, err)
+		}
+		var resp prompb.ReadResponse
+		if err := proto.Unmarshal(b, &resp); err != nil {
+			t.Fatalf("Accept %q: %v", accept, err)
+		}
+		if len(resp.Results) != 1 || len(resp.Results[0].Timeseries) != 1 || len(resp.Results[0].Timeseries[0].Samples) != 20 {
+			t.Errorf("Accept %q: got %+v, want 20 samples of a single series", accept, resp.Results)
+		}
+	}
+
+	for _, accept := range []string{"application/json", "application/json; charset=utf-8, application/x-protobuf"} {
+		rec := remoteRead(t, s, "a", accept)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Accept %q: status %d: %s", accept, rec.Code, rec.Body)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Accept %q: content type %q", accept, ct)
+		}
+		var resp struct {
+			Status string
+			Data   []struct {
+				ResultType string
+				Result     []struct {
+					Metric map[string]string
+					Values [][2]any
+				}
+			}
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Accept %q: %v", accept, err)
+		}
+		if resp.Status != "success" || len(resp.Data) != 1 || resp.Data[0].ResultType != "matrix" ||
+			len(resp.Data[0].Result) != 1 || resp.Data[0].Result[0].Metric[labels.MetricName] != "a" ||
+			len(resp.Data[0].Result[0].Values) != 20 {
+			t.Errorf("Accept %q: got %s", accept, rec.Body)
+		}
+	}
+}
+
+// TestRemoteReadLimits checks that remote reads over the sample limit or
+// the query timeout fail in every response format
+func TestRemoteReadLimits(t *testing.T) {
+	s := newTestServer(t, head.Options{}, Options{MaxSamplesPerQuery: 30})
+	readSamples(t, s)
+	for _, accept := range []string{"", "application/json"} {
+		if rec := remoteRead(t, s, "a", accept); rec.Code != http.StatusOK {
+			t.Errorf("Accept %q: 20 samples within the limit: status %d: %s", accept, rec.Code, rec.Body)
+		}
+		// Both series together are over the limit
+		rec := remoteRead(t, s, "a|b", accept)
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Accept %q: 40 samples over the limit: status %d, want %d", accept, rec.Code, http.StatusUnprocessableEntity)
+		}
+	}
+
+	s = newTestServer(t, head.Options{}, Options{QueryTimeout: time.Nanosecond})
+	readSamples(t, s)
+	for _, accept := range []string{"", "application/json"} {
+		rec := remoteRead(t, s, "a", accept)
+		if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "deadline exceeded") {
+			t.Errorf("Accept %q: read timing out: status %d, want %d: %s", accept, rec.Code, http.StatusServiceUnavailable, rec.Body)
+		}
+	}
+}
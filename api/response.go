@@ -0,0 +1,55 @@
+package api
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// Error types used in the Prometheus-style error envelope
+const (
+	errorBadData  = "bad_data"
+	errorInternal = "internal"
+)
+
+// response is the JSON envelope shared by all read endpoints
+type response struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Warnings  []string    `json:"warnings,omitempty"`
+}
+
+// respond writes a successful JSON response
+func respond(w http.ResponseWriter, data interface{}) {
+	writeJSON(w, http.StatusOK, response{Status: "success", Data: data})
+}
+
+// respondWarnings writes a successful JSON response carrying warnings
+func respondWarnings(w http.ResponseWriter, data interface{}, warnings []error) {
+	resp := response{Status: "success", Data: data}
+	for _, warn := range warnings {
+		resp.Warnings = append(resp.Warnings, warn.Error())
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// respondError writes an error JSON response with the given status code
+func respondError(w http.ResponseWriter, code int, typ string, err error) {
+	writeJSON(w, code, response{Status: "error", ErrorType: typ, Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, resp response) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, "Error encoding response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if _, err := w.Write(b); err != nil {
+		slog.Warn("Error writing response", "err", err)
+	}
+}
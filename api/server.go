@@ -1,67 +1,678 @@
 package api
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/yuanhuiqu/protsdb/head"
 )
 
+// seriesLimitRetryAfter is the Retry-After in seconds sent when the head
+// series limit rejects a write
+const seriesLimitRetryAfter = 30
+
+// overloadRetryAfter is the Retry-After in seconds sent when a write is
+// rejected for exceeding the concurrent write limit
+const overloadRetryAfter = 5
+
 // Server represents the API server
 type Server struct {
 	mux    *http.ServeMux
 	server *http.Server
+	head   *head.Head
+	logger *slog.Logger
+
+	// PromQL engine evaluating queries against the head
+	engine    *promql.Engine
+	queryable storage.Queryable
+	maxPoints int // points per series a range query may return
+
+	// Remote read limits, also applied by the engine to PromQL queries.
+	// maxSamplesPerQuery is per query of a read request, 0 is unlimited.
+	queryTimeout       time.Duration
+	maxSamplesPerQuery int
+
+	// Per request remote write limits, 0 is unlimited
+	maxSamplesPerWrite int
+	maxSeriesPerWrite  int
+	maxRequestBytes    int64 // compressed body size, always set
+	maxDecodedBytes    int64 // decompressed body size, always set
+
+	// Remote write requests being served and the limit beyond which they
+	// are rejected, 0 is unlimited. inflightWrites is accessed atomically.
+	inflightWrites      int64
+	maxConcurrentWrites int
+
+	// Certificate and key for HTTPS, both empty for plain HTTP
+	tlsCertFile, tlsKeyFile string
+
+	// Count and duration of served requests
+	requests *requestMetrics
+
+	// Whether the server should receive traffic, 1 if so, see SetReady.
+	// Accessed atomically.
+	ready int32
+
+	// Samples accepted through remote write, requests rejected for
+	// overload and handler panics, accessed atomically
+	remoteWriteSamples  uint64
+	remoteWriteRejected uint64
+	handlerPanics       uint64
 }
 
-// New creates a new API server
-func New() *Server {
+// Options for configuring the API server
+type Options struct {
+	// ListenAddr is the address the server listens on (default ":9090")
+	ListenAddr string
+	// ReadTimeout is the maximum duration for reading a request (default 30s)
+	ReadTimeout time.Duration
+	// WriteTimeout is the maximum duration for writing a response (default 30s)
+	WriteTimeout time.Duration
+	// TLSCertFile and TLSKeyFile enable HTTPS when both are set
+	TLSCertFile string
+	TLSKeyFile  string
+	// QueryTimeout is the maximum duration of a query evaluation or a
+	// remote read (default 2m)
+	QueryTimeout time.Duration
+	// QueryMaxSamples is the maximum number of samples a single query may
+	// load into memory (default 50000000)
+	QueryMaxSamples int
+	// QueryMaxPoints is the maximum number of points per series a range
+	// query may return, i.e. (end-start)/step+1 (default 11000)
+	QueryMaxPoints int
+	// MaxSamplesPerQuery is the maximum number of samples a single query of
+	// a remote read request may select, reads beyond it fail with 422
+	// Unprocessable Entity (default 50000000, negative is unlimited)
+	MaxSamplesPerQuery int
+	// MaxSamplesPerWrite and MaxSeriesPerWrite reject remote write requests
+	// carrying more samples or series as a whole (0 is unlimited)
+	MaxSamplesPerWrite int
+	MaxSeriesPerWrite  int
+	// MaxRequestBytes is the maximum size of a compressed remote write body
+	// (default 32MB)
+	MaxRequestBytes int64
+	// MaxDecodedBytes is the maximum size of a remote write body once
+	// decompressed, so a small body can't expand into an unbounded
+	// allocation (default 128MB)
+	MaxDecodedBytes int64
+	// MaxConcurrentWrites is how many remote write requests are served at
+	// once, further ones fail with 429 Too Many Requests until a slot frees
+	// up (0 is unlimited)
+	MaxConcurrentWrites int
+	// Logger receives the server's log messages (default slog.Default())
+	Logger *slog.Logger
+}
+
+// New creates a new API server backed by the given head
+func New(h *head.Head, opts Options) (*Server, error) {
+	if (opts.TLSCertFile == "") != (opts.TLSKeyFile == "") {
+		return nil, errors.New("api: TLSCertFile and TLSKeyFile must be set together")
+	}
+	if opts.ListenAddr == "" {
+		opts.ListenAddr = ":9090"
+	}
+	if opts.ReadTimeout == 0 {
+		opts.ReadTimeout = 30 * time.Second
+	}
+	if opts.WriteTimeout == 0 {
+		opts.WriteTimeout = 30 * time.Second
+	}
+	if opts.QueryTimeout == 0 {
+		opts.QueryTimeout = 2 * time.Minute
+	}
+	if opts.QueryMaxSamples == 0 {
+		opts.QueryMaxSamples = 50000000
+	}
+	if opts.QueryMaxPoints == 0 {
+		opts.QueryMaxPoints = 11000
+	}
+	if opts.MaxSamplesPerQuery == 0 {
+		opts.MaxSamplesPerQuery = 50000000
+	}
+	if opts.MaxRequestBytes == 0 {
+		opts.MaxRequestBytes = 32 << 20
+	}
+	if opts.MaxDecodedBytes == 0 {
+		opts.MaxDecodedBytes = 128 << 20
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+
 	mux := http.NewServeMux()
 
 	server := &Server{
-		mux: mux,
+		mux:                 mux,
+		head:                h,
+		logger:              opts.Logger,
+		queryable:           head.NewQueryable(h),
+		maxPoints:           opts.QueryMaxPoints,
+		queryTimeout:        opts.QueryTimeout,
+		maxSamplesPerQuery:  max(opts.MaxSamplesPerQuery, 0),
+		maxSamplesPerWrite:  opts.MaxSamplesPerWrite,
+		maxSeriesPerWrite:   opts.MaxSeriesPerWrite,
+		maxRequestBytes:     opts.MaxRequestBytes,
+		maxDecodedBytes:     opts.MaxDecodedBytes,
+		maxConcurrentWrites: opts.MaxConcurrentWrites,
+		tlsCertFile:         opts.TLSCertFile,
+		tlsKeyFile:          opts.TLSKeyFile,
+		requests:            newRequestMetrics(),
+		engine: promql.NewEngine(promql.EngineOpts{
+			MaxSamples: opts.QueryMaxSamples,
+			Timeout:    opts.QueryTimeout,
+		}),
 		server: &http.Server{
-			Addr:         ":9090",
-			Handler:      mux,
-			ReadTimeout:  30 * time.Second,
-			WriteTimeout: 30 * time.Second,
+			Addr:         opts.ListenAddr,
+			ReadTimeout:  opts.ReadTimeout,
+			WriteTimeout: opts.WriteTimeout,
 		},
 	}
 
 	// Set up routes
 	server.routes()
+	server.server.Handler = server.instrument(server.recoverPanics(mux))
 
-	return server
+	return server, nil
 }
 
 // routes sets up all the API routes
 func (s *Server) routes() {
 	s.mux.HandleFunc("/api/v1/write", s.handleRemoteWrite)
-	s.mux.HandleFunc("/api/v1/health", s.handleHealth)
+	s.mux.HandleFunc("/api/v1/read", s.handleRemoteRead)
+	s.mux.HandleFunc("/api/v1/query", s.handleQuery)
+	s.mux.HandleFunc("/api/v1/query_range", s.handleQueryRange)
+	s.mux.HandleFunc("/api/v1/query_exemplars", s.handleQueryExemplars)
+	s.mux.HandleFunc("/api/v1/labels", s.handleLabels)
+	s.mux.HandleFunc(labelValuesPrefix, s.handleLabelValues)
+	s.mux.HandleFunc("/api/v1/series", s.handleSeries)
+	s.mux.HandleFunc("/api/v1/metadata", s.handleMetadata)
+	s.mux.HandleFunc("/api/v1/health", s.handleHealthy)
+	s.mux.HandleFunc("/api/v1/-/healthy", s.handleHealthy)
+	s.mux.HandleFunc("/api/v1/-/ready", s.handleReady)
+	s.mux.HandleFunc("/api/v1/status/tsdb", s.handleTSDBStatus)
+	s.mux.HandleFunc("/api/v1/status/tsdb/cardinality", s.handleCardinality)
+	s.mux.HandleFunc("/metrics", s.handleMetrics)
 }
 
-// Start starts the HTTP server
+// Start starts the HTTP server, serving HTTPS if a certificate is configured
 func (s *Server) Start() error {
-	log.Printf("Server listening on %s", s.server.Addr)
+	if s.tlsCertFile != "" {
+		s.logger.Info("Server listening", "addr", s.server.Addr, "tls", true)
+		return s.server.ListenAndServeTLS(s.tlsCertFile, s.tlsKeyFile)
+	}
+	s.logger.Info("Server listening", "addr", s.server.Addr, "tls", false)
 	return s.server.ListenAndServe()
 }
 
-// Shutdown gracefully shuts down the server
+// Shutdown gracefully shuts down the server, which stops being ready first
 func (s *Server) Shutdown(ctx context.Context) error {
+	s.SetReady(false)
 	return s.server.Shutdown(ctx)
 }
 
-// handleRemoteWrite handles Prometheus remote write requests
+// SetReady marks the server as ready to receive traffic, or not. A new
+// server is not ready until its owner sets it once the head is initialized.
+func (s *Server) SetReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&s.ready, v)
+}
+
+// handleRemoteWrite handles Prometheus remote write 1.0 and 2.0 requests
 func (s *Server) handleRemoteWrite(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	if !s.acquireWriteSlot() {
+		atomic.AddUint64(&s.remoteWriteRejected, 1)
+		w.Header().Set("Retry-After", strconv.Itoa(overloadRetryAfter))
+		http.Error(w, "Too many concurrent writes", http.StatusTooManyRequests)
+		return
+	}
+	defer s.releaseWriteSlot()
+
+	msg, err := remoteWriteProto(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	seq, err := parseSequence(r.Header.Get(sequenceHeader))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxRequestBytes)
+	compressed, err := io.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("Request body exceeds %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+
+	reqBuf, err := decodeBody(r.Header.Get("Content-Encoding"), compressed, s.maxDecodedBytes)
+	if errors.Is(err, errUnsupportedEncoding) {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	if errors.Is(err, errDecodedTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error decompressing request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Parse the protobuf message, remote write 2.0 is converted to 1.0
+	var writeRequest *prompb.WriteRequest
+	if msg == writeProtoV2 {
+		writeRequest, err = decodeWriteV2(reqBuf)
+	} else {
+		writeRequest = &prompb.WriteRequest{}
+		err = proto.Unmarshal(reqBuf, writeRequest)
+	}
+	if err != nil {
+		http.Error(w, "Error unmarshaling request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.checkWriteLimits(writeRequest); err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if n := len(writeRequest.Timeseries); seq > 0 && n > 1 {
+		http.Error(w, fmt.Sprintf("Sequenced write of %d series, a sequence applies to a single series", n), http.StatusBadRequest)
+		return
+	}
+
+	// Store every sample in the head, a failing sample doesn't fail the
+	// other ones
+	var (
+		samples, histograms, exemplars int
+		histogramsFailed               int
+		exemplarsFailed                int
+		failures                       writeFailures
+	)
+	seriesBefore := s.head.SeriesCreated()
+	for _, ts := range writeRequest.Timeseries {
+		samples += len(ts.Samples)
+		histograms += len(ts.Histograms)
+		exemplars += len(ts.Exemplars)
+
+		lset := labelsFromProto(ts.Labels)
+		var ref uint64
+		if seq > 0 {
+			// A stale sequence is a write replayed by the sender, its samples
+			// are already stored
+			err := s.head.AppendSequenced(lset, seq, ts.Samples...)
+			if err != nil && !errors.Is(err, head.ErrStaleSequence) {
+				failures.add(err, len(ts.Samples))
+			}
+		} else {
+			// The series is resolved by its first sample, the others are
+			// appended by reference
+			for _, sample := range ts.Samples {
+				err := head.ErrUnknownSeries
+				if ref != 0 {
+					err = s.head.AppendWithRef(ref, sample)
+				}
+				if errors.Is(err, head.ErrUnknownSeries) {
+					ref, err = s.head.AppendRef(lset, sample)
+				}
+				if err != nil {
+					failures.add(err, 1)
+				}
+			}
+		}
+
+		for _, hist := range ts.Histograms {
+			if err := s.head.AppendHistogram(lset, hist); err != nil {
+				failures.add(err, 1)
+				histogramsFailed++
+			}
+		}
+
+		if len(ts.Exemplars) > 0 {
+			if ref == 0 {
+				ref, _ = s.head.GetRef(lset)
+			}
+			if ref == 0 {
+				exemplarsFailed += len(ts.Exemplars)
+				continue
+			}
+			for _, e := range ts.Exemplars {
+				if err := s.head.AppendExemplar(ref, e); err != nil {
+					exemplarsFailed++
+				}
+			}
+		}
+	}
+
+	for _, md := range writeRequest.Metadata {
+		if err := s.head.SetMetadata(md); err != nil {
+			s.logger.Warn("Error storing metadata", "metric", md.MetricFamilyName, "err", err)
+		}
+	}
+
+	if flush, _ := strconv.ParseBool(r.Header.Get(flushWALHeader)); flush {
+		if err := s.head.FlushWAL(); err != nil {
+			s.logger.Error("Error flushing WAL", "err", err)
+			http.Error(w, "Error flushing WAL", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	total := samples + histograms
+	atomic.AddUint64(&s.remoteWriteSamples, uint64(total-failures.total))
+	if failures.total > 0 {
+		s.logger.Warn("Failed to append samples", "failed", failures.total, "total", total, "errors", failures.summary("; "))
+	}
+	if exemplarsFailed > 0 {
+		s.logger.Warn("Failed to append exemplars", "failed", exemplarsFailed)
+	}
+	// Counted across the head, so concurrent writes may add to it. A burst
+	// of these hints at a cardinality spike.
+	if created := s.head.SeriesCreated() - seriesBefore; created > 0 {
+		s.logger.Debug("Remote write created series", "series", created, "total", len(writeRequest.Timeseries))
+	}
+
+	if msg == writeProtoV2 {
+		w.Header().Set(samplesWrittenHeader, strconv.Itoa(samples-(failures.total-histogramsFailed)))
+		w.Header().Set(histogramsWrittenHeader, strconv.Itoa(histograms-histogramsFailed))
+		w.Header().Set(exemplarsWrittenHeader, strconv.Itoa(exemplars-exemplarsFailed))
+	}
+
+	switch {
+	case failures.tooManySeries:
+		// Series over the limit are lost until series go away, ask the
+		// sender to back off and retry rather than dropping them
+		w.Header().Set("Retry-After", strconv.Itoa(seriesLimitRetryAfter))
+		http.Error(w, head.ErrTooManySeries.Error(), http.StatusTooManyRequests)
+	case failures.total > 0 && failures.total == total:
+		http.Error(w, failures.summary("\n"), http.StatusBadRequest)
+	case failures.total > 0:
+		// The request succeeded, the body tells why the dropped samples
+		// were rejected, e.g. by validation
+		w.Header().Set(samplesDroppedHeader, strconv.Itoa(failures.total))
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, failures.summary("\n"))
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// acquireWriteSlot reserves one of the concurrent remote write slots,
+// reporting false if all are taken
+func (s *Server) acquireWriteSlot() bool {
+	if s.maxConcurrentWrites <= 0 {
+		return true
+	}
+	if atomic.AddInt64(&s.inflightWrites, 1) > int64(s.maxConcurrentWrites) {
+		atomic.AddInt64(&s.inflightWrites, -1)
+		return false
+	}
+	return true
+}
+
+// releaseWriteSlot frees a slot reserved by acquireWriteSlot
+func (s *Server) releaseWriteSlot() {
+	if s.maxConcurrentWrites > 0 {
+		atomic.AddInt64(&s.inflightWrites, -1)
+	}
+}
+
+// samplesDroppedHeader reports how many samples of a partially accepted
+// remote write request were dropped
+const samplesDroppedHeader = "X-Prometheus-Remote-Write-Samples-Dropped"
+
+// sequenceHeader carries an optional sequence of a remote write request,
+// used to drop writes replayed by exactly-once pipelines. The samples are
+// dropped if the series was already written with the same or a later
+// sequence. Sequenced requests must hold a single series and are rejected
+// otherwise: the series of one request may come from producers with
+// unrelated sequences, which one header cannot tell apart.
+const sequenceHeader = "X-Protsdb-Sequence"
+
+// flushWALHeader set to true on a remote write request makes what it wrote
+// durable before the response is sent, whatever the WAL sync policy. Such
+// requests take an fsync longer and serialize with all other writes while
+// it runs, so it is meant for the few writes that must not be lost.
+const flushWALHeader = "X-Protsdb-Flush-WAL"
+
+// writeFailures counts the samples of a remote write request that failed,
+// by error
+type writeFailures struct {
+	total         int
+	byError       map[string]int
+	tooManySeries bool // some failed on the series limit
+}
+
+func (f *writeFailures) add(err error, n int) {
+	if n == 0 {
+		return
+	}
+	if f.byError == nil {
+		f.byError = make(map[string]int)
+	}
+	f.total += n
+	f.byError[err.Error()] += n
+	f.tooManySeries = f.tooManySeries || errors.Is(err, head.ErrTooManySeries)
+}
+
+// summary lists the failure counts by error, most frequent first
+func (f *writeFailures) summary(sep string) string {
+	msgs := make([]string, 0, len(f.byError))
+	for msg := range f.byError {
+		msgs = append(msgs, msg)
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		if f.byError[msgs[i]] != f.byError[msgs[j]] {
+			return f.byError[msgs[i]] > f.byError[msgs[j]]
+		}
+		return msgs[i] < msgs[j]
+	})
+
+	lines := make([]string, len(msgs))
+	for i, msg := range msgs {
+		lines[i] = fmt.Sprintf("%d samples: %s", f.byError[msg], msg)
+	}
+	return strings.Join(lines, sep)
+}
+
+// checkWriteLimits rejects a remote write request exceeding the per
+// request limits, before any of it is ingested
+func (s *Server) checkWriteLimits(req *prompb.WriteRequest) error {
+	if s.maxSeriesPerWrite > 0 && len(req.Timeseries) > s.maxSeriesPerWrite {
+		return fmt.Errorf("request has %d series, the limit is %d", len(req.Timeseries), s.maxSeriesPerWrite)
+	}
+	if s.maxSamplesPerWrite > 0 {
+		var n int
+		for _, ts := range req.Timeseries {
+			n += len(ts.Samples) + len(ts.Histograms)
+		}
+		if n > s.maxSamplesPerWrite {
+			return fmt.Errorf("request has %d samples, the limit is %d", n, s.maxSamplesPerWrite)
+		}
+	}
+	return nil
+}
+
+// errUnsupportedEncoding is returned for request bodies in an unknown encoding
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// errDecodedTooLarge is returned for request bodies decompressing to more
+// than the limit
+var errDecodedTooLarge = errors.New("decompressed request body too large")
+
+// decodeBody decompresses a request body according to its Content-Encoding,
+// failing with errDecodedTooLarge once it exceeds limit bytes.
+// Prometheus always sends snappy, so it is assumed if the header is missing.
+func decodeBody(encoding string, body []byte, limit int64) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "snappy":
+		return decodeSnappy(body, limit)
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return readLimited(zr, limit)
+	case "identity":
+		if int64(len(body)) > limit {
+			return nil, fmt.Errorf("%w: exceeds %d bytes", errDecodedTooLarge, limit)
+		}
+		return body, nil
+	default:
+		return nil, fmt.Errorf("%w %q", errUnsupportedEncoding, encoding)
+	}
+}
+
+// readLimited reads r to the end, failing with errDecodedTooLarge once it
+// returns more than limit bytes
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > limit {
+		return nil, fmt.Errorf("%w: exceeds %d bytes", errDecodedTooLarge, limit)
+	}
+	return b, nil
+}
+
+// snappyFramedMagic is the stream identifier starting snappy framed data
+const snappyFramedMagic = "\xff\x06\x00\x00sNaPpY"
+
+// decodeSnappy decodes snappy data in either the block format Prometheus
+// uses or the framed format some other clients send. Framed data is
+// recognized by its stream identifier; if it fails to decode as a stream,
+// it is tried as a block in case the identifier was a coincidence.
+func decodeSnappy(body []byte, limit int64) ([]byte, error) {
+	if bytes.HasPrefix(body, []byte(snappyFramedMagic)) {
+		b, err := readLimited(snappy.NewReader(bytes.NewReader(body)), limit)
+		if err == nil || errors.Is(err, errDecodedTooLarge) {
+			return b, err
+		}
+		if b, blockErr := decodeSnappyBlock(body, limit); blockErr == nil {
+			return b, nil
+		}
+		return nil, fmt.Errorf("invalid snappy framed data: %w", err)
+	}
+	return decodeSnappyBlock(body, limit)
+}
+
+// decodeSnappyBlock decodes data in the snappy block format, checking the
+// decoded length its header states against limit before allocating
+func decodeSnappyBlock(body []byte, limit int64) ([]byte, error) {
+	n, err := snappy.DecodedLen(body)
+	if err != nil {
+		return nil, err
+	}
+	if int64(n) > limit {
+		return nil, fmt.Errorf("%w: %d bytes exceed %d", errDecodedTooLarge, n, limit)
+	}
+	return snappy.Decode(nil, body)
+}
+
+// labelsFromProto converts remote write labels into a label set sorted by
+// name. Senders should sort them already, but one that doesn't would
+// otherwise write to a second series with the same labels.
+func labelsFromProto(pls []prompb.Label) labels.Labels {
+	b := labels.NewScratchBuilder(len(pls))
+	for _, l := range pls {
+		b.Add(l.Name, l.Value)
+	}
+	b.Sort()
+	return b.Labels()
+}
+
+// parseSequence returns the value of the sequence header of a remote write
+// request, or 0 if it carries none
+func parseSequence(v string) (uint64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	seq, err := strconv.ParseUint(v, 10, 64)
+	if err != nil || seq == 0 {
+		return 0, fmt.Errorf("invalid sequence %q", v)
+	}
+	return seq, nil
+}
+
+// labelsToProto converts a label set into remote read labels
+func labelsToProto(lset labels.Labels) []prompb.Label {
+	pls := make([]prompb.Label, 0, lset.Len())
+	lset.Range(func(l labels.Label) {
+		pls = append(pls, prompb.Label{Name: l.Name, Value: l.Value})
+	})
+	return pls
+}
+
+// matchersFromProto converts remote read matchers into label matchers
+func matchersFromProto(pms []*prompb.LabelMatcher) ([]*labels.Matcher, error) {
+	ms := make([]*labels.Matcher, 0, len(pms))
+	for _, pm := range pms {
+		var typ labels.MatchType
+		switch pm.Type {
+		case prompb.LabelMatcher_EQ:
+			typ = labels.MatchEqual
+		case prompb.LabelMatcher_NEQ:
+			typ = labels.MatchNotEqual
+		case prompb.LabelMatcher_RE:
+			typ = labels.MatchRegexp
+		case prompb.LabelMatcher_NRE:
+			typ = labels.MatchNotRegexp
+		default:
+			return nil, fmt.Errorf("invalid matcher type %d", pm.Type)
+		}
+
+		m, err := labels.NewMatcher(typ, pm.Name, pm.Value)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+// handleRemoteRead handles Prometheus remote read requests, answering in
+// snappy compressed protobuf unless the Accept header prefers JSON, see
+// wantsJSON, or the request accepts streamed chunks first
+func (s *Server) handleRemoteRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
 	compressed, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Error reading request body", http.StatusInternalServerError)
@@ -69,33 +680,176 @@ func (s *Server) handleRemoteWrite(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	// Prometheus remote write uses snappy compression
 	reqBuf, err := snappy.Decode(nil, compressed)
 	if err != nil {
 		http.Error(w, "Error decompressing request body", http.StatusBadRequest)
 		return
 	}
 
-	// Parse the protobuf message
-	var writeRequest prompb.WriteRequest
-	if err := proto.Unmarshal(reqBuf, &writeRequest); err != nil {
+	var readRequest prompb.ReadRequest
+	if err := proto.Unmarshal(reqBuf, &readRequest); err != nil {
 		http.Error(w, "Error unmarshaling request", http.StatusBadRequest)
 		return
 	}
 
-	// TODO: Store the time series data directly using prompb types
-	// For now, just log the number of time series received
-	log.Printf("Received %d time series", len(writeRequest.Timeseries))
+	ctx, cancel := context.WithTimeout(r.Context(), s.queryTimeout)
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	if wantsJSON(r.Header.Get("Accept")) {
+		s.respondReadJSON(w, r, readRequest.Queries)
+		return
+	}
+	respType, err := negotiateResponseType(readRequest.AcceptedResponseTypes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if respType == prompb.ReadRequest_STREAMED_XOR_CHUNKS {
+		s.streamReadChunks(w, r, readRequest.Queries)
+		return
+	}
+
+	// Run every query against the head, results keep the query order
+	resp := prompb.ReadResponse{
+		Results: make([]*prompb.QueryResult, 0, len(readRequest.Queries)),
+	}
+	for _, q := range readRequest.Queries {
+		matchers, err := matchersFromProto(q.Matchers)
+		if err != nil {
+			http.Error(w, "Error parsing matchers: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// The sample limit is checked as samples are gathered, before the
+		// result grows past it
+		result := &prompb.QueryResult{}
+		samples := 0
+		ss := s.head.Select(r.Context(), q.StartTimestampMs, q.EndTimestampMs, matchers...)
+		for ss.Next() {
+			series := ss.At()
+			ts := &prompb.TimeSeries{Labels: labelsToProto(series.Labels())}
+			it := series.Iterator()
+			for it.Next() {
+				samples++
+				if err := s.checkSampleLimit(samples); err != nil {
+					http.Error(w, err.Error(), readErrorStatus(err))
+					return
+				}
+				t, v := it.At()
+				ts.Samples = append(ts.Samples, prompb.Sample{Timestamp: t, Value: v})
+			}
+			if err := it.Err(); err != nil {
+				http.Error(w, "Error reading series: "+err.Error(), readErrorStatus(err))
+				return
+			}
+			hit := series.HistogramIterator()
+			for hit.Next() {
+				samples++
+				if err := s.checkSampleLimit(samples); err != nil {
+					http.Error(w, err.Error(), readErrorStatus(err))
+					return
+				}
+				_, hist := hit.At()
+				ts.Histograms = append(ts.Histograms, hist)
+			}
+			if err := hit.Err(); err != nil {
+				http.Error(w, "Error reading series: "+err.Error(), readErrorStatus(err))
+				return
+			}
+			result.Timeseries = append(result.Timeseries, ts)
+		}
+		if err := ss.Err(); err != nil {
+			http.Error(w, "Error selecting series: "+err.Error(), readErrorStatus(err))
+			return
+		}
+		resp.Results = append(resp.Results, result)
+	}
+
+	data, err := proto.Marshal(&resp)
+	if err != nil {
+		http.Error(w, "Error marshaling response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	if _, err := w.Write(snappy.Encode(nil, data)); err != nil {
+		s.logger.Warn("Error writing remote read response", "err", err)
+	}
+}
+
+// handleHealthy handles liveness checks, succeeding as long as the server
+// serves requests
+func (s *Server) handleHealthy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
 }
 
-// handleHealth handles health check requests
-func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+// handleReady handles readiness checks, failing with 503 Service
+// Unavailable unless the server was set ready and the head accepts writes
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	if atomic.LoadInt32(&s.ready) == 0 || !s.head.Ready() {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
 }
+
+// handleCardinality reports label cardinality of the head
+func (s *Server) handleCardinality(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit, err := parseLimit(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, errorBadData, err)
+		return
+	}
+
+	respond(w, s.head.Cardinality(limit))
+}
+
+// handleTSDBStatus returns the cardinality statistics of Prometheus's TSDB
+// status page, the top limit entries of each
+func (s *Server) handleTSDBStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit, err := parseLimit(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, errorBadData, err)
+		return
+	}
+
+	respond(w, s.head.TSDBStatus(limit))
+}
+
+// parseLimit parses the optional limit parameter of the status endpoints,
+// 10 if missing
+func parseLimit(r *http.Request) (int, error) {
+	v := r.FormValue("limit")
+	if v == "" {
+		return 10, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid limit %q", v)
+	}
+	return n, nil
+}
@@ -0,0 +1,527 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/yuanhuiqu/protsdb/head"
+)
+
+// newTestServer returns a server over a head writing its WAL into a
+// temporary directory, closed when the test ends
+func newTestServer(t *testing.T, hopts head.Options, opts Options) *Server {
+	t.Helper()
+	if hopts.WALDir == "" {
+		hopts.WALDir = filepath.Join(t.TempDir(), "wal")
+	}
+	h, err := head.NewHead(hopts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	s, err := New(h, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// remoteWrite sends a remote write 1.0 request with the given headers
+func remoteWrite(t *testing.T, s *Server, req *prompb.WriteRequest, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	b, err := req.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(snappy.Encode(nil, b)))
+	for name, vs := range header {
+		r.Header[name] = vs
+	}
+	rec := httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, r)
+	return rec
+}
+
+// writeRequest returns a remote write request of a single series
+func writeRequest(lset labels.Labels, samples ...prompb.Sample) *prompb.WriteRequest {
+	return &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+		Labels:  labelsToProto(lset),
+		Samples: samples,
+	}}}
+}
+
+// selectAll returns the float samples of all series in the head, by series
+// labels
+func selectAll(t *testing.T, h *head.Head) map[string][]prompb.Sample {
+	t.Helper()
+	res := make(map[string][]prompb.Sample)
+	ss := h.Select(context.Background(), math.MinInt64, math.MaxInt64, labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, ".+"))
+	for ss.Next() {
+		var samples []prompb.Sample
+		it := ss.At().Iterator()
+		for it.Next() {
+			ts, v := it.At()
+			samples = append(samples, prompb.Sample{Timestamp: ts, Value: v})
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+		res[ss.At().Labels().String()] = samples
+	}
+	if err := ss.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// TestRemoteWriteEncoding posts the same request under every supported
+// content encoding, and under unsupported or mismatched ones
+func TestRemoteWriteEncoding(t *testing.T) {
+	s := newTestServer(t, head.Options{}, Options{})
+	lset := labels.FromStrings(labels.MetricName, "a")
+	gz := func(b []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(b)
+		zw.Close()
+		return buf.Bytes()
+	}
+	identity := func(b []byte) []byte { return b }
+	block := func(b []byte) []byte { return snappy.Encode(nil, b) }
+
+	for i, tc := range []struct {
+		encoding string
+		encode   func([]byte) []byte
+		code     int
+	}{
+		{"", block, http.StatusOK},
+		{"snappy", block, http.StatusOK},
+		{"gzip", gz, http.StatusOK},
+		{" GZip ", gz, http.StatusOK},
+		{"identity", identity, http.StatusOK},
+		{"br", identity, http.StatusUnsupportedMediaType},
+		{"gzip", block, http.StatusBadRequest},
+		{"snappy", gz, http.StatusBadRequest},
+	} {
+		ts := int64(1000 * (i + 1))
+		b, err := writeRequest(lset, prompb.Sample{Timestamp: ts, Value: 1}).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(tc.encode(b)))
+		if tc.encoding != "" {
+			r.Header.Set("Content-Encoding", tc.encoding)
+		}
+		rec := httptest.NewRecorder()
+		s.mux.ServeHTTP(rec, r)
+		if rec.Code != tc.code {
+			t.Errorf("encoding %q: status %d, want %d: %s", tc.encoding, rec.Code, tc.code, rec.Body)
+			continue
+		}
+
+		samples := selectAll(t, s.head)[lset.String()]
+		stored := len(samples) > 0 && samples[len(samples)-1].Timestamp == ts
+		if stored != (tc.code == http.StatusOK) {
+			t.Errorf("encoding %q: sample stored %v", tc.encoding, stored)
+		}
+	}
+}
+
+// TestRemoteWriteTooManySeries checks that a write creating series beyond
+// the head limit gets a 429 with a retry hint, while writes to existing
+// series go through
+func TestRemoteWriteTooManySeries(t *testing.T) {
+	s := newTestServer(t, head.Options{MaxSeries: 1}, Options{})
+	a := labels.FromStrings(labels.MetricName, "a")
+	b := labels.FromStrings(labels.MetricName, "b")
+
+	if rec := remoteWrite(t, s, writeRequest(a, prompb.Sample{Timestamp: 1, Value: 1}), nil); rec.Code != http.StatusOK {
+		t.Fatalf("first series: status %d: %s", rec.Code, rec.Body)
+	}
+	rec := remoteWrite(t, s, writeRequest(b, prompb.Sample{Timestamp: 1, Value: 1}), nil)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("series over the limit: status %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if got := rec.Header().Get("Retry-After"); got != strconv.Itoa(seriesLimitRetryAfter) {
+		t.Fatalf("Retry-After %q, want %d", got, seriesLimitRetryAfter)
+	}
+	if !strings.Contains(rec.Body.String(), head.ErrTooManySeries.Error()) {
+		t.Fatalf("body %q does not carry %v", rec.Body, head.ErrTooManySeries)
+	}
+	if rec := remoteWrite(t, s, writeRequest(a, prompb.Sample{Timestamp: 2, Value: 2}), nil); rec.Code != http.StatusOK {
+		t.Fatalf("existing series: status %d: %s", rec.Code, rec.Body)
+	}
+
+	res := selectAll(t, s.head)
+	if len(res) != 1 || len(res[a.String()]) != 2 {
+		t.Fatalf("head holds %v, want two samples of %s only", res, a)
+	}
+}
+
+// TestRemoteWriteLimits checks that requests over a per-request limit are
+// rejected as a whole, and ones at the limit are stored
+func TestRemoteWriteLimits(t *testing.T) {
+	series := func(n, samples int) *prompb.WriteRequest {
+		req := &prompb.WriteRequest{}
+		for i := 0; i < n; i++ {
+			lset := labels.FromStrings(labels.MetricName, "m", "i", strconv.Itoa(i))
+			req.Timeseries = append(req.Timeseries, writeRequest(lset).Timeseries[0])
+			for j := 0; j < samples; j++ {
+				req.Timeseries[i].Samples = append(req.Timeseries[i].Samples, prompb.Sample{Timestamp: int64(1000 + j), Value: 1})
+			}
+		}
+		return req
+	}
+	for _, tc := range []struct {
+		name string
+		opts Options
+		req  *prompb.WriteRequest
+		code int
+	}{
+		{"series at limit", Options{MaxSeriesPerWrite: 3}, series(3, 2), http.StatusOK},
+		{"series over limit", Options{MaxSeriesPerWrite: 3}, series(4, 1), http.StatusRequestEntityTooLarge},
+		{"samples at limit", Options{MaxSamplesPerWrite: 6}, series(3, 2), http.StatusOK},
+		{"samples over limit", Options{MaxSamplesPerWrite: 6}, series(2, 4), http.StatusRequestEntityTooLarge},
+		{"unlimited", Options{}, series(10, 10), http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, head.Options{}, tc.opts)
+			rec := remoteWrite(t, s, tc.req, nil)
+			if rec.Code != tc.code {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tc.code, rec.Body)
+			}
+			want := 0
+			if tc.code == http.StatusOK {
+				want = len(tc.req.Timeseries)
+			}
+			if got := len(selectAll(t, s.head)); got != want {
+				t.Errorf("%d series stored, want %d", got, want)
+			}
+		})
+	}
+}
+
+// TestRemoteWriteBodyLimit checks that a body over MaxRequestBytes is
+// rejected before it is decoded
+func TestRemoteWriteBodyLimit(t *testing.T) {
+	s := newTestServer(t, head.Options{}, Options{MaxRequestBytes: 1024})
+	lset := labels.FromStrings(labels.MetricName, "a")
+
+	rec := remoteWrite(t, s, writeRequest(lset, prompb.Sample{Timestamp: 1000, Value: 1}), nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("small request: status %d: %s", rec.Code, rec.Body)
+	}
+
+	// Garbage that would fail to decode if it was read as a whole
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(bytes.Repeat([]byte{0xff}, 1025)))
+	rec = httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, r)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized request: status %d, want %d: %s", rec.Code, http.StatusRequestEntityTooLarge, rec.Body)
+	}
+}
+
+// TestRemoteWriteDecodedLimit checks that a body decompressing to more
+// than MaxDecodedBytes is rejected in every encoding, without decoding a
+// snappy block whose header states a larger length
+func TestRemoteWriteDecodedLimit(t *testing.T) {
+	s := newTestServer(t, head.Options{}, Options{MaxDecodedBytes: 1024})
+	gz := func(b []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(b)
+		zw.Close()
+		return buf.Bytes()
+	}
+	framed := func(b []byte) []byte {
+		var buf bytes.Buffer
+		sw := snappy.NewBufferedWriter(&buf)
+		sw.Write(b)
+		sw.Close()
+		return buf.Bytes()
+	}
+	block := func(b []byte) []byte { return snappy.Encode(nil, b) }
+	identity := func(b []byte) []byte { return b }
+	// A block claiming to hold 1GB
+	forged := func([]byte) []byte { return append(binary.AppendUvarint(nil, 1<<30), 0) }
+
+	small, err := writeRequest(labels.FromStrings(labels.MetricName, "a"), prompb.Sample{Timestamp: 1000, Value: 1}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := make([]byte, 1025)
+
+	for _, tc := range []struct {
+		name, encoding string
+		encode         func([]byte) []byte
+		body           []byte
+		code           int
+	}{
+		{"block", "snappy", block, small, http.StatusOK},
+		{"block", "snappy", block, large, http.StatusRequestEntityTooLarge},
+		{"forged block", "snappy", forged, nil, http.StatusRequestEntityTooLarge},
+		{"framed", "snappy", framed, small, http.StatusOK},
+		{"framed", "snappy", framed, large, http.StatusRequestEntityTooLarge},
+		{"gzip", "gzip", gz, small, http.StatusOK},
+		{"gzip", "gzip", gz, large, http.StatusRequestEntityTooLarge},
+		{"identity", "identity", identity, small, http.StatusOK},
+		{"identity", "identity", identity, large, http.StatusRequestEntityTooLarge},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(tc.encode(tc.body)))
+		r.Header.Set("Content-Encoding", tc.encoding)
+		rec := httptest.NewRecorder()
+		s.mux.ServeHTTP(rec, r)
+		if rec.Code != tc.code {
+			t.Errorf("%s of %d bytes: status %d, want %d: %s", tc.name, len(tc.body), rec.Code, tc.code, rec.Body)
+		}
+	}
+}
+
+// TestRemoteWriteSnappyFormats posts a request in the snappy block format
+// and in the framed format
+func TestRemoteWriteSnappyFormats(t *testing.T) {
+	s := newTestServer(t, head.Options{}, Options{})
+	lset := labels.FromStrings(labels.MetricName, "a")
+	framed := func(b []byte) []byte {
+		var buf bytes.Buffer
+		sw := snappy.NewBufferedWriter(&buf)
+		sw.Write(b)
+		sw.Close()
+		return buf.Bytes()
+	}
+	block := func(b []byte) []byte { return snappy.Encode(nil, b) }
+	garbage := func([]byte) []byte { return []byte(snappyFramedMagic + "garbage") }
+
+	for i, tc := range []struct {
+		name   string
+		encode func([]byte) []byte
+		code   int
+	}{
+		{"block", block, http.StatusOK},
+		{"framed", framed, http.StatusOK},
+		{"neither", garbage, http.StatusBadRequest},
+	} {
+		ts := int64(1000 * (i + 1))
+		b, err := writeRequest(lset, prompb.Sample{Timestamp: ts, Value: 1}).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		s.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(tc.encode(b))))
+		if rec.Code != tc.code {
+			t.Errorf("%s: status %d, want %d: %s", tc.name, rec.Code, tc.code, rec.Body)
+			continue
+		}
+		samples := selectAll(t, s.head)[lset.String()]
+		stored := len(samples) > 0 && samples[len(samples)-1].Timestamp == ts
+		if stored != (tc.code == http.StatusOK) {
+			t.Errorf("%s: sample stored %v", tc.name, stored)
+		}
+	}
+}
+
+// blockingReader returns its data once released
+type blockingReader struct {
+	release <-chan struct{}
+	r       io.Reader
+	reading chan<- struct{}
+}
+
+func (b *blockingReader) Read(p []byte) (int, error) {
+	if b.reading != nil {
+		b.reading <- struct{}{}
+		b.reading = nil
+	}
+	<-b.release
+	return b.r.Read(p)
+}
+
+// TestRemoteWriteOverload saturates the concurrent write limit with
+// requests stuck reading their bodies
+func TestRemoteWriteOverload(t *testing.T) {
+	const limit = 2
+	s := newTestServer(t, head.Options{}, Options{MaxConcurrentWrites: limit})
+	// Concurrent writes go to series of their own, so they can't run out of order
+	body := func(i int) []byte {
+		b, err := writeRequest(labels.FromStrings(labels.MetricName, "a", "i", strconv.Itoa(i)), prompb.Sample{Timestamp: 1000, Value: 1}).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return snappy.Encode(nil, b)
+	}
+
+	release := make(chan struct{})
+	reading := make(chan struct{})
+	codes := make(chan int, limit)
+	for i := 0; i < limit; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/write", &blockingReader{release: release, r: bytes.NewReader(body(i)), reading: reading})
+		go func() {
+			rec := httptest.NewRecorder()
+			s.mux.ServeHTTP(rec, r)
+			codes <- rec.Code
+		}()
+		<-reading
+	}
+
+	rec := remoteWrite(t, s, writeRequest(labels.FromStrings(labels.MetricName, "a"), prompb.Sample{Timestamp: 3000, Value: 1}), nil)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("write beyond the limit: status %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if got := rec.Header().Get("Retry-After"); got != strconv.Itoa(overloadRetryAfter) {
+		t.Errorf("Retry-After %q, want %d", got, overloadRetryAfter)
+	}
+
+	close(release)
+	for i := 0; i < limit; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("write within the limit: status %d", code)
+		}
+	}
+
+	// The slots are free again
+	for i := 0; i < limit+1; i++ {
+		rec := remoteWrite(t, s, writeRequest(labels.FromStrings(labels.MetricName, "a"), prompb.Sample{Timestamp: int64(4000 + i), Value: 1}), nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("write after the others finished: status %d: %s", rec.Code, rec.Body)
+		}
+	}
+}
+
+// TestRemoteWriteInvalid checks that samples failing validation are dropped
+// from a remote write request, which still succeeds if any sample was
+// stored, and that the response tells why
+func TestRemoteWriteInvalid(t *testing.T) {
+	s := newTestServer(t, head.Options{}, Options{})
+	a := labels.FromStrings(labels.MetricName, "a")
+	b := labels.FromStrings(labels.MetricName, "b")
+	invalid := []prompb.Sample{{Timestamp: 2, Value: math.NaN()}, {Timestamp: -1, Value: 1}}
+
+	for _, tc := range []struct {
+		name    string
+		req     *prompb.WriteRequest
+		code    int
+		dropped string
+	}{
+		{"partial", writeRequest(a, append([]prompb.Sample{{Timestamp: 1, Value: 1}}, invalid...)...), http.StatusOK, "2"},
+		{"all invalid", writeRequest(b, invalid...), http.StatusBadRequest, ""},
+	} {
+		rec := remoteWrite(t, s, tc.req, nil)
+		if rec.Code != tc.code {
+			t.Fatalf("%s: status %d, want %d: %s", tc.name, rec.Code, tc.code, rec.Body)
+		}
+		if got := rec.Header().Get(samplesDroppedHeader); got != tc.dropped {
+			t.Fatalf("%s: %q samples dropped, want %q", tc.name, got, tc.dropped)
+		}
+		for _, err := range []error{head.ErrInvalidValue, head.ErrInvalidTimestamp} {
+			if !strings.Contains(rec.Body.String(), "1 samples: "+err.Error()) {
+				t.Fatalf("%s: body %q does not carry %v", tc.name, rec.Body, err)
+			}
+		}
+	}
+
+	if res := selectAll(t, s.head); len(res) != 1 || len(res[a.String()]) != 1 {
+		t.Fatalf("head holds %v, want the valid sample of %s only", res, a)
+	}
+	rec := httptest.NewRecorder()
+	s.mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, reason := range []string{"invalid_value", "invalid_timestamp"} {
+		if want := `protsdb_head_samples_rejected_total{reason="` + reason + `"} 2`; !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics do not report %s", want)
+		}
+	}
+}
+
+// TestRemoteWriteUnsortedLabels checks that series sent with labels in any
+// order are stored as a single series
+func TestRemoteWriteUnsortedLabels(t *testing.T) {
+	s := newTestServer(t, head.Options{}, Options{})
+	lset := labels.FromStrings(labels.MetricName, "a", "job", "x", "zone", "y")
+	unsorted := []prompb.Label{{Name: "zone", Value: "y"}, {Name: labels.MetricName, Value: "a"}, {Name: "job", Value: "x"}}
+
+	req := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{Labels: unsorted, Samples: []prompb.Sample{{Timestamp: 1000, Value: 1}}}}}
+	if rec := remoteWrite(t, s, req, nil); rec.Code != http.StatusOK {
+		t.Fatalf("unsorted labels: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := remoteWrite(t, s, writeRequest(lset, prompb.Sample{Timestamp: 2000, Value: 2}), nil); rec.Code != http.StatusOK {
+		t.Fatalf("sorted labels: status %d: %s", rec.Code, rec.Body)
+	}
+
+	want := map[string][]prompb.Sample{lset.String(): {{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 2}}}
+	if got := selectAll(t, s.head); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// TestRemoteWriteSequence checks that a write replaying the sequence header
+// of an earlier one is acknowledged without storing its samples, and that
+// the sequence never becomes a label
+func TestRemoteWriteSequence(t *testing.T) {
+	s := newTestServer(t, head.Options{}, Options{})
+	lset := labels.FromStrings(labels.MetricName, "a")
+	seq := func(v string) http.Header { return http.Header{sequenceHeader: {v}} }
+
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		sample prompb.Sample
+		code   int
+		stored bool
+	}{
+		{"first", seq("1"), prompb.Sample{Timestamp: 1000, Value: 1}, http.StatusOK, true},
+		{"replayed", seq("1"), prompb.Sample{Timestamp: 2000, Value: 2}, http.StatusOK, false},
+		{"next", seq("2"), prompb.Sample{Timestamp: 3000, Value: 3}, http.StatusOK, true},
+		{"older", seq("1"), prompb.Sample{Timestamp: 4000, Value: 4}, http.StatusOK, false},
+		{"invalid", seq("x"), prompb.Sample{Timestamp: 5000, Value: 5}, http.StatusBadRequest, false},
+		{"zero", seq("0"), prompb.Sample{Timestamp: 6000, Value: 6}, http.StatusBadRequest, false},
+		{"none", nil, prompb.Sample{Timestamp: 7000, Value: 7}, http.StatusOK, true},
+	} {
+		before := len(selectAll(t, s.head)[lset.String()])
+		rec := remoteWrite(t, s, writeRequest(lset, tc.sample), tc.header)
+		if rec.Code != tc.code {
+			t.Fatalf("%s: status %d, want %d: %s", tc.name, rec.Code, tc.code, rec.Body)
+		}
+
+		// The sequence is not a label of the series
+		got := selectAll(t, s.head)
+		if len(got) != 1 {
+			t.Fatalf("%s: %d series, want 1: %v", tc.name, len(got), got)
+		}
+		stored := len(got[lset.String()]) > before
+		if stored != tc.stored {
+			t.Errorf("%s: sample stored %v, want %v", tc.name, stored, tc.stored)
+		}
+	}
+}
+
+// TestRemoteWriteSequenceSeries checks that a sequenced write of more than
+// one series is rejected without storing any of it
+func TestRemoteWriteSequenceSeries(t *testing.T) {
+	s := newTestServer(t, head.Options{}, Options{})
+	req := writeRequest(labels.FromStrings(labels.MetricName, "a"), prompb.Sample{Timestamp: 1000, Value: 1})
+	req.Timeseries = append(req.Timeseries, writeRequest(labels.FromStrings(labels.MetricName, "b"), prompb.Sample{Timestamp: 1000, Value: 1}).Timeseries...)
+
+	rec := remoteWrite(t, s, req, http.Header{sequenceHeader: {"1"}})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("sequenced write of two series: status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if got := selectAll(t, s.head); len(got) != 0 {
+		t.Fatalf("rejected write stored %v", got)
+	}
+	if rec := remoteWrite(t, s, req, nil); rec.Code != http.StatusOK {
+		t.Fatalf("write of two series without sequence: status %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,332 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Remote write messages, as named by the proto parameter of the request
+// Content-Type
+const (
+	writeProtoV1 = "prometheus.WriteRequest"
+	writeProtoV2 = "io.prometheus.write.v2.Request"
+)
+
+// Response headers of remote write 2.0, telling the sender what was stored
+const (
+	samplesWrittenHeader    = "X-Prometheus-Remote-Write-Samples-Written"
+	histogramsWrittenHeader = "X-Prometheus-Remote-Write-Histograms-Written"
+	exemplarsWrittenHeader  = "X-Prometheus-Remote-Write-Exemplars-Written"
+)
+
+// errUnsupportedContentType is returned for remote write requests carrying
+// a message other than the supported ones
+var errUnsupportedContentType = errors.New("unsupported content type")
+
+// remoteWriteProto returns the message a remote write request carries
+// according to its Content-Type. Senders predating remote write 2.0 may
+// leave out the header or its proto parameter.
+func remoteWriteProto(contentType string) (string, error) {
+	if contentType == "" {
+		return writeProtoV1, nil
+	}
+	mt, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mt != "application/x-protobuf" {
+		return "", fmt.Errorf("%w %q", errUnsupportedContentType, contentType)
+	}
+	switch p := params["proto"]; p {
+	case "", writeProtoV1:
+		return writeProtoV1, nil
+	case writeProtoV2:
+		return writeProtoV2, nil
+	default:
+		return "", fmt.Errorf("%w %q", errUnsupportedContentType, contentType)
+	}
+}
+
+// decodeWriteV2 decodes a remote write 2.0 request into the equivalent
+// remote write 1.0 request, resolving the label and metadata references of
+// its series against the symbol table. Series metadata becomes metadata of
+// the metric family named by the series.
+func decodeWriteV2(b []byte) (*prompb.WriteRequest, error) {
+	var (
+		symbols []string
+		series  [][]byte
+	)
+	err := forEachField(b, func(f field) error {
+		switch f.num {
+		case 4:
+			if f.typ != protowire.BytesType {
+				return errWireType(f)
+			}
+			symbols = append(symbols, string(f.b))
+		case 5:
+			if f.typ != protowire.BytesType {
+				return errWireType(f)
+			}
+			series = append(series, f.b)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(symbols) > 0 && symbols[0] != "" {
+		return nil, errors.New("first symbol must be the empty string")
+	}
+
+	req := &prompb.WriteRequest{Timeseries: make([]prompb.TimeSeries, 0, len(series))}
+	for _, b := range series {
+		ts, md, err := decodeSeriesV2(b, symbols)
+		if err != nil {
+			return nil, err
+		}
+		req.Timeseries = append(req.Timeseries, ts)
+		if md != nil {
+			req.Metadata = append(req.Metadata, *md)
+		}
+	}
+	return req, nil
+}
+
+// decodeSeriesV2 decodes a remote write 2.0 series and its metadata, which
+// is nil if the series carries none
+func decodeSeriesV2(b []byte, symbols []string) (prompb.TimeSeries, *prompb.MetricMetadata, error) {
+	var (
+		ts       prompb.TimeSeries
+		refs     []uint32
+		metadata []byte
+	)
+	err := forEachField(b, func(f field) (err error) {
+		switch f.num {
+		case 1:
+			refs, err = appendRefs(refs, f)
+		case 2:
+			var s prompb.Sample
+			if s, err = decodeSampleV2(f); err == nil {
+				ts.Samples = append(ts.Samples, s)
+			}
+		case 3:
+			if f.typ != protowire.BytesType {
+				return errWireType(f)
+			}
+			// Histograms are encoded like in remote write 1.0
+			var h prompb.Histogram
+			if err = proto.Unmarshal(f.b, &h); err == nil {
+				ts.Histograms = append(ts.Histograms, h)
+			}
+		case 4:
+			var e prompb.Exemplar
+			if e, err = decodeExemplarV2(f, symbols); err == nil {
+				ts.Exemplars = append(ts.Exemplars, e)
+			}
+		case 5:
+			if f.typ != protowire.BytesType {
+				return errWireType(f)
+			}
+			metadata = f.b
+		}
+		return err
+	})
+	if err != nil {
+		return ts, nil, err
+	}
+	if ts.Labels, err = resolveLabels(refs, symbols); err != nil {
+		return ts, nil, err
+	}
+
+	if metadata == nil {
+		return ts, nil, nil
+	}
+	md, err := decodeMetadataV2(metadata, symbols)
+	if err != nil || md == nil {
+		return ts, nil, err
+	}
+	md.MetricFamilyName = labelsFromProto(ts.Labels).Get(labels.MetricName)
+	return ts, md, nil
+}
+
+// decodeSampleV2 decodes a sample, which is a value and a timestamp
+func decodeSampleV2(f field) (prompb.Sample, error) {
+	var s prompb.Sample
+	if f.typ != protowire.BytesType {
+		return s, errWireType(f)
+	}
+	err := forEachField(f.b, func(f field) error {
+		switch f.num {
+		case 1:
+			if f.typ != protowire.Fixed64Type {
+				return errWireType(f)
+			}
+			s.Value = math.Float64frombits(f.u)
+		case 2:
+			if f.typ != protowire.VarintType {
+				return errWireType(f)
+			}
+			s.Timestamp = int64(f.u)
+		}
+		return nil
+	})
+	return s, err
+}
+
+// decodeExemplarV2 decodes an exemplar, whose labels are symbol references
+func decodeExemplarV2(f field, symbols []string) (prompb.Exemplar, error) {
+	var (
+		e    prompb.Exemplar
+		refs []uint32
+	)
+	if f.typ != protowire.BytesType {
+		return e, errWireType(f)
+	}
+	err := forEachField(f.b, func(f field) (err error) {
+		switch f.num {
+		case 1:
+			refs, err = appendRefs(refs, f)
+		case 2:
+			if f.typ != protowire.Fixed64Type {
+				return errWireType(f)
+			}
+			e.Value = math.Float64frombits(f.u)
+		case 3:
+			if f.typ != protowire.VarintType {
+				return errWireType(f)
+			}
+			e.Timestamp = int64(f.u)
+		}
+		return err
+	})
+	if err != nil {
+		return e, err
+	}
+	e.Labels, err = resolveLabels(refs, symbols)
+	return e, err
+}
+
+// decodeMetadataV2 decodes series metadata, whose help and unit are symbol
+// references. It returns nil for metadata left empty.
+func decodeMetadataV2(b []byte, symbols []string) (*prompb.MetricMetadata, error) {
+	var md prompb.MetricMetadata
+	err := forEachField(b, func(f field) error {
+		if f.num < 1 || f.num > 4 || f.num == 2 {
+			return nil
+		}
+		if f.typ != protowire.VarintType {
+			return errWireType(f)
+		}
+		if f.num == 1 {
+			md.Type = prompb.MetricMetadata_MetricType(f.u)
+			return nil
+		}
+		if f.u >= uint64(len(symbols)) {
+			return fmt.Errorf("metadata symbol reference %d out of range", f.u)
+		}
+		if f.num == 3 {
+			md.Help = symbols[f.u]
+		} else {
+			md.Unit = symbols[f.u]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if md.Type == prompb.MetricMetadata_UNKNOWN && md.Help == "" && md.Unit == "" {
+		return nil, nil
+	}
+	return &md, nil
+}
+
+// resolveLabels turns pairs of name and value symbol references into labels
+func resolveLabels(refs []uint32, symbols []string) ([]prompb.Label, error) {
+	if len(refs)%2 != 0 {
+		return nil, fmt.Errorf("odd number of label references %d", len(refs))
+	}
+	ls := make([]prompb.Label, 0, len(refs)/2)
+	for i := 0; i < len(refs); i += 2 {
+		name, value := refs[i], refs[i+1]
+		if int(name) >= len(symbols) || int(value) >= len(symbols) {
+			return nil, fmt.Errorf("label symbol reference out of range, %d symbols", len(symbols))
+		}
+		ls = append(ls, prompb.Label{Name: symbols[name], Value: symbols[value]})
+	}
+	return ls, nil
+}
+
+// field is a decoded protobuf field, holding either the integer of a
+// varint or fixed size field or the bytes of a length delimited one
+type field struct {
+	num protowire.Number
+	typ protowire.Type
+	u   uint64
+	b   []byte
+}
+
+// forEachField calls fn for every field of a protobuf message in order
+func forEachField(b []byte, fn func(f field) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		f := field{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.u, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			f.u, n = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			f.u = uint64(v)
+		case protowire.BytesType:
+			f.b, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendRefs appends the symbol references of a repeated uint32 field,
+// packed or not
+func appendRefs(refs []uint32, f field) ([]uint32, error) {
+	switch f.typ {
+	case protowire.VarintType:
+		return append(refs, uint32(f.u)), nil
+	case protowire.BytesType:
+		for b := f.b; len(b) > 0; {
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			refs = append(refs, uint32(v))
+			b = b[n:]
+		}
+		return refs, nil
+	default:
+		return nil, errWireType(f)
+	}
+}
+
+// errWireType reports a field encoded with an unexpected wire type
+func errWireType(f field) error {
+	return fmt.Errorf("field %d has unexpected wire type %d", f.num, f.typ)
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/yuanhuiqu/protsdb/head"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// seriesV2 encodes a remote write 2.0 series of float samples, labels
+// given as pairs of symbol references
+func seriesV2(refs []uint32, samples ...prompb.Sample) []byte {
+	var b, packed []byte
+	for _, ref := range refs {
+		packed = protowire.AppendVarint(packed, uint64(ref))
+	}
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendBytes(b, packed)
+	for _, s := range samples {
+		var sb []byte
+		sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+		sb = protowire.AppendFixed64(sb, math.Float64bits(s.Value))
+		sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+		sb = protowire.AppendVarint(sb, uint64(s.Timestamp))
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, sb)
+	}
+	return b
+}
+
+// requestV2 encodes a remote write 2.0 request
+func requestV2(symbols []string, series ...[]byte) []byte {
+	var b []byte
+	for _, s := range symbols {
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendString(b, s)
+	}
+	for _, s := range series {
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendBytes(b, s)
+	}
+	return b
+}
+
+func TestRemoteWriteV2(t *testing.T) {
+	symbols := []string{"", labels.MetricName, "up", "job", "a", "b"}
+	valid := requestV2(symbols,
+		seriesV2([]uint32{1, 2, 3, 4}, prompb.Sample{Timestamp: 1000, Value: 1}, prompb.Sample{Timestamp: 2000, Value: 2}),
+		seriesV2([]uint32{1, 2, 3, 5}, prompb.Sample{Timestamp: 1000, Value: 3}),
+	)
+	v2 := "application/x-protobuf;proto=" + writeProtoV2
+
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		body        []byte
+		code        int
+	}{
+		{"v2", v2, valid, http.StatusOK},
+		{"unknown proto", "application/x-protobuf;proto=foo", valid, http.StatusUnsupportedMediaType},
+		{"not protobuf", "application/json", valid, http.StatusUnsupportedMediaType},
+		{"reference out of range", v2, requestV2(symbols, seriesV2([]uint32{1, 2, 3, 9})), http.StatusBadRequest},
+		{"first symbol not empty", v2, requestV2([]string{"x"}), http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, head.Options{}, Options{})
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(snappy.Encode(nil, tc.body)))
+			r.Header.Set("Content-Type", tc.contentType)
+			rec := httptest.NewRecorder()
+			s.mux.ServeHTTP(rec, r)
+			if rec.Code != tc.code {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tc.code, rec.Body)
+			}
+			if tc.code != http.StatusOK {
+				return
+			}
+
+			if got := rec.Header().Get(samplesWrittenHeader); got != "3" {
+				t.Errorf("%s %q, want 3", samplesWrittenHeader, got)
+			}
+			want := map[string][]prompb.Sample{
+				`{__name__="up", job="a"}`: {{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 2}},
+				`{__name__="up", job="b"}`: {{Timestamp: 1000, Value: 3}},
+			}
+			if got := selectAll(t, s.head); !reflect.DeepEqual(got, want) {
+				t.Errorf("head holds %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package chunkenc
+
+import "io"
+
+// bstream is a stream of bits, written most significant bit first
+type bstream struct {
+	stream []byte // the data stream
+	count  uint8  // how many bits are free in the last byte
+}
+
+func (b *bstream) bytes() []byte {
+	return b.stream
+}
+
+func (b *bstream) writeBit(bit bool) {
+	if b.count == 0 {
+		b.stream = append(b.stream, 0)
+		b.count = 8
+	}
+
+	if bit {
+		b.stream[len(b.stream)-1] |= 1 << (b.count - 1)
+	}
+	b.count--
+}
+
+func (b *bstream) writeByte(byt byte) {
+	if b.count == 0 {
+		b.stream = append(b.stream, byt)
+		return
+	}
+
+	// Fill up the free bits of the last byte and spill the rest into a new one
+	i := len(b.stream) - 1
+	b.stream[i] |= byt >> (8 - b.count)
+	b.stream = append(b.stream, byt<<b.count)
+}
+
+// writeBits writes the nbits least significant bits of u
+func (b *bstream) writeBits(u uint64, nbits int) {
+	u <<= 64 - uint(nbits)
+	for nbits >= 8 {
+		b.writeByte(byte(u >> 56))
+		u <<= 8
+		nbits -= 8
+	}
+	for nbits > 0 {
+		b.writeBit((u >> 63) == 1)
+		u <<= 1
+		nbits--
+	}
+}
+
+// bstreamReader reads bits from a stream
+type bstreamReader struct {
+	stream []byte
+	pos    int // index of the next bit to read
+}
+
+func newBReader(b []byte) bstreamReader {
+	return bstreamReader{stream: b}
+}
+
+func (r *bstreamReader) readBit() (bool, error) {
+	if r.pos >= len(r.stream)*8 {
+		return false, io.EOF
+	}
+	bit := r.stream[r.pos/8]&(0x80>>(r.pos%8)) != 0
+	r.pos++
+	return bit, nil
+}
+
+// readBits reads nbits bits into the least significant bits of the result
+func (r *bstreamReader) readBits(nbits uint8) (uint64, error) {
+	var u uint64
+	for i := uint8(0); i < nbits; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		u <<= 1
+		if bit {
+			u |= 1
+		}
+	}
+	return u, nil
+}
+
+// ReadByte implements io.ByteReader for varint decoding
+func (r *bstreamReader) ReadByte() (byte, error) {
+	u, err := r.readBits(8)
+	return byte(u), err
+}
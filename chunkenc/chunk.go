@@ -0,0 +1,63 @@
+// Package chunkenc implements compressed encodings for chunks of samples.
+package chunkenc
+
+import "fmt"
+
+// Encoding identifies the encoding of a chunk. Values match Prometheus'
+// chunk encodings so chunks can be handed out over remote read as is,
+// except for EncDelta which Prometheus does not know.
+type Encoding uint8
+
+// Chunk encodings
+const (
+	EncNone  Encoding = 0
+	EncXOR   Encoding = 1
+	EncDelta Encoding = 0x80
+)
+
+func (e Encoding) String() string {
+	switch e {
+	case EncNone:
+		return "none"
+	case EncXOR:
+		return "XOR"
+	case EncDelta:
+		return "delta"
+	}
+	return fmt.Sprintf("<unknown encoding %d>", e)
+}
+
+// Chunk is a compressed sequence of samples in timestamp order
+type Chunk interface {
+	// Bytes returns the encoded chunk, which must not be modified
+	Bytes() []byte
+	Encoding() Encoding
+	NumSamples() int
+	// Appender returns an appender adding samples to the end of the chunk
+	Appender() (Appender, error)
+	Iterator() Iterator
+}
+
+// Appender adds samples to a chunk. Timestamps must be increasing.
+type Appender interface {
+	Append(t int64, v float64)
+}
+
+// Iterator iterates over the samples of a chunk
+type Iterator interface {
+	Next() bool
+	At() (int64, float64)
+	Err() error
+}
+
+// FromData returns a chunk of the given encoding over previously encoded
+// bytes. Such chunks are meant for reading, appending to them is not supported.
+func FromData(e Encoding, b []byte) (Chunk, error) {
+	switch e {
+	case EncXOR:
+		return &XORChunk{b: bstream{stream: b}}, nil
+	case EncDelta:
+		return &DeltaChunk{b: b}, nil
+	}
+	return nil, fmt.Errorf("chunkenc: unsupported encoding %s", e)
+}
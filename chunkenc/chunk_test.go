@@ -0,0 +1,158 @@
+package chunkenc
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/value"
+)
+
+type sample struct {
+	t int64
+	v float64
+}
+
+// gauge returns n samples of a slowly changing gauge scraped every 15s
+// with a few milliseconds of jitter
+func gauge(n int) []sample {
+	rng := rand.New(rand.NewSource(1))
+	samples := make([]sample, n)
+	t, v := int64(1_700_000_000_000), 512.0
+	for i := range samples {
+		t += 15000 + rng.Int63n(5) - 2
+		if rng.Intn(10) == 0 {
+			v += float64(rng.Intn(3) - 1)
+		}
+		samples[i] = sample{t, v}
+	}
+	return samples
+}
+
+// counter returns n samples of a counter scraped every 15s, growing by
+// whole numbers and reset once
+func counter(n int) []sample {
+	rng := rand.New(rand.NewSource(1))
+	samples := make([]sample, n)
+	t, v := int64(1_700_000_000_000), 0.0
+	for i := range samples {
+		t += 15000 + rng.Int63n(5) - 2
+		v += float64(rng.Intn(100))
+		if i == n/2 {
+			v = 3
+		}
+		samples[i] = sample{t, v}
+	}
+	return samples
+}
+
+// encodings are the chunk encodings under test, by their constructors
+var encodings = map[Encoding]func() Chunk{
+	EncXOR:   func() Chunk { return NewXORChunk() },
+	EncDelta: func() Chunk { return NewDeltaChunk() },
+}
+
+// appendAll appends the samples to a new chunk, getting a new appender
+// every step samples to check that appending resumes where it stopped
+func appendAll(t testing.TB, c Chunk, samples []sample, step int) Chunk {
+	t.Helper()
+	var app Appender
+	for i, s := range samples {
+		if i%step == 0 {
+			var err error
+			if app, err = c.Appender(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		app.Append(s.t, s.v)
+	}
+	return c
+}
+
+func TestRoundTrip(t *testing.T) {
+	stale := math.Float64frombits(value.StaleNaN)
+	for _, tc := range []struct {
+		name    string
+		samples []sample
+	}{
+		{"empty", nil},
+		{"one sample", []sample{{1, 1}}},
+		{"negative timestamp", []sample{{-5, 1}, {-3, 2}, {10, 3}}},
+		{"gauge", gauge(120)},
+		{"counter", counter(120)},
+		{"fractional increments", []sample{{1, 0.5}, {2, 0.75}, {3, 1e300}, {4, 1e300 + 1e290}, {5, -1}}},
+		{"constant", []sample{{1000, 7}, {2000, 7}, {3000, 7}, {4000, 7}}},
+		{"NaN and stale markers", []sample{{1, 1}, {2, math.NaN()}, {3, stale}, {4, 4}, {5, stale}, {6, math.Inf(-1)}, {7, math.Inf(1)}}},
+		{"extreme values", []sample{{1, math.MaxFloat64}, {2, -math.MaxFloat64}, {3, math.SmallestNonzeroFloat64}, {4, 0}, {5, math.Copysign(0, -1)}}},
+		{"delta of deltas of every width", []sample{
+			{0, 1}, {10, 2}, {20, 3},
+			{20 + 10 + 1<<13, 4},
+			{20 + 10 + 1<<13 + 10 + 1<<13 + 1<<16, 5},
+			{20 + 10 + 1<<13 + 10 + 1<<13 + 1<<16 + 10 + 1<<13 + 1<<16 + 1<<19, 6},
+			{1 << 40, 7},
+			{1<<40 + 1, 8},
+			{1<<62 - 1, 9},
+		}},
+		{"shrinking deltas", []sample{{0, 1}, {1 << 30, 2}, {1<<30 + 1, 3}, {1<<30 + 2, 4}}},
+	} {
+		for enc, newChunk := range encodings {
+			t.Run(enc.String()+"/"+tc.name, func(t *testing.T) {
+				for _, step := range []int{1, 2, len(tc.samples) + 1} {
+					c := appendAll(t, newChunk(), tc.samples, step)
+					if n := c.NumSamples(); n != len(tc.samples) {
+						t.Fatalf("step %d: %d samples in the chunk, want %d", step, n, len(tc.samples))
+					}
+
+					// Reading back the encoded bytes gives the same samples
+					fc, err := FromData(enc, c.Bytes())
+					if err != nil {
+						t.Fatal(err)
+					}
+					for _, it := range []Iterator{c.Iterator(), fc.Iterator()} {
+						i := 0
+						for ; it.Next(); i++ {
+							ts, v := it.At()
+							if i >= len(tc.samples) {
+								t.Fatalf("step %d: extra sample %v@%d", step, v, ts)
+							}
+							want := tc.samples[i]
+							if ts != want.t || math.Float64bits(v) != math.Float64bits(want.v) {
+								t.Fatalf("step %d: sample %d is %v@%d, want %v@%d", step, i, v, ts, want.v, want.t)
+							}
+						}
+						if err := it.Err(); err != nil {
+							t.Fatalf("step %d: %v", step, err)
+						}
+						if i != len(tc.samples) {
+							t.Fatalf("step %d: %d samples read, want %d", step, i, len(tc.samples))
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkChunk encodes chunks of a slowly changing gauge and of a counter
+// and reports the bytes per sample, against 16 for a raw timestamp and value
+func BenchmarkChunk(b *testing.B) {
+	for _, data := range []struct {
+		name    string
+		samples []sample
+	}{
+		{"gauge", gauge(120)},
+		{"counter", counter(120)},
+	} {
+		for _, enc := range []Encoding{EncXOR, EncDelta} {
+			b.Run(data.name+"/"+enc.String(), func(b *testing.B) {
+				b.ReportAllocs()
+				var size int
+				for i := 0; i < b.N; i++ {
+					c := appendAll(b, encodings[enc](), data.samples, len(data.samples))
+					size = len(c.Bytes())
+				}
+				b.ReportMetric(float64(size)/float64(len(data.samples)), "bytes/sample")
+			})
+		}
+	}
+}
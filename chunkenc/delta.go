@@ -0,0 +1,222 @@
+package chunkenc
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// DeltaChunk holds float samples of monotonic counters, whose values mostly
+// grow by whole numbers. Timestamps are stored as delta-of-deltas and values
+// as the difference to their predecessor, falling back to the raw value when
+// the difference is not a whole number. The layout is byte aligned:
+//
+//	| num samples (2b) | t0 varint | v0 (8b) | t1-t0 varint | v1 | dod varint | v ... |
+//
+// where a value is either the uvarint of its zigzag encoded difference
+// shifted left by one, or the uvarint 1 followed by the raw value (8b).
+type DeltaChunk struct {
+	b []byte
+}
+
+// maxExactDelta bounds the differences stored as integers, beyond it not
+// every whole number is representable as a float
+const maxExactDelta = 1 << 53
+
+// rawValue marks a value stored as is rather than as a difference
+const rawValue = 1
+
+var errDeltaChunkTruncated = errors.New("chunkenc: delta chunk truncated")
+
+// NewDeltaChunk returns an empty delta chunk
+func NewDeltaChunk() *DeltaChunk {
+	return &DeltaChunk{b: make([]byte, 2, 64)}
+}
+
+// Encoding returns EncDelta
+func (c *DeltaChunk) Encoding() Encoding {
+	return EncDelta
+}
+
+// Bytes returns the encoded chunk
+func (c *DeltaChunk) Bytes() []byte {
+	return c.b
+}
+
+// NumSamples returns the number of samples in the chunk
+func (c *DeltaChunk) NumSamples() int {
+	return int(binary.BigEndian.Uint16(c.b))
+}
+
+// Appender returns an appender positioned after the last sample. The
+// state needed to continue encoding is restored by iterating the chunk.
+func (c *DeltaChunk) Appender() (Appender, error) {
+	it := c.iterator()
+	for it.Next() {
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return &deltaAppender{c: c, t: it.t, v: it.val, tDelta: it.tDelta}, nil
+}
+
+// Iterator returns an iterator over the samples of the chunk
+func (c *DeltaChunk) Iterator() Iterator {
+	return c.iterator()
+}
+
+func (c *DeltaChunk) iterator() *deltaIterator {
+	return &deltaIterator{
+		// The first 2 bytes hold the number of samples
+		b:        c.b[2:],
+		numTotal: binary.BigEndian.Uint16(c.b),
+	}
+}
+
+type deltaAppender struct {
+	c *DeltaChunk
+
+	t      int64
+	v      float64
+	tDelta int64
+}
+
+func (a *deltaAppender) Append(t int64, v float64) {
+	num := binary.BigEndian.Uint16(a.c.b)
+
+	var tDelta int64
+	switch num {
+	case 0:
+		a.c.b = binary.AppendVarint(a.c.b, t)
+		a.c.b = binary.BigEndian.AppendUint64(a.c.b, math.Float64bits(v))
+	default:
+		tDelta = t - a.t
+		if num == 1 {
+			a.c.b = binary.AppendVarint(a.c.b, tDelta)
+		} else {
+			a.c.b = binary.AppendVarint(a.c.b, tDelta-a.tDelta)
+		}
+		a.writeValue(v)
+	}
+
+	a.t = t
+	a.v = v
+	a.tDelta = tDelta
+	binary.BigEndian.PutUint16(a.c.b, num+1)
+}
+
+// writeValue stores v as the difference to the previous value if that
+// restores it exactly, and as is otherwise
+func (a *deltaAppender) writeValue(v float64) {
+	d := v - a.v
+	if d == math.Trunc(d) && math.Abs(d) < maxExactDelta &&
+		math.Float64bits(a.v+float64(int64(d))) == math.Float64bits(v) {
+		a.c.b = binary.AppendUvarint(a.c.b, zigzag(int64(d))<<1)
+		return
+	}
+	a.c.b = binary.AppendUvarint(a.c.b, rawValue)
+	a.c.b = binary.BigEndian.AppendUint64(a.c.b, math.Float64bits(v))
+}
+
+type deltaIterator struct {
+	b        []byte
+	numTotal uint16
+	numRead  uint16
+
+	t      int64
+	val    float64
+	tDelta int64
+	err    error
+}
+
+func (it *deltaIterator) At() (int64, float64) {
+	return it.t, it.val
+}
+
+func (it *deltaIterator) Err() error {
+	return it.err
+}
+
+func (it *deltaIterator) Next() bool {
+	if it.err != nil || it.numRead == it.numTotal {
+		return false
+	}
+
+	if it.numRead == 0 {
+		t, ok := it.varint()
+		if !ok {
+			return false
+		}
+		v, ok := it.raw()
+		if !ok {
+			return false
+		}
+		it.t, it.val = t, v
+		it.numRead++
+		return true
+	}
+
+	d, ok := it.varint()
+	if !ok {
+		return false
+	}
+	if it.numRead == 1 {
+		it.tDelta = d
+	} else {
+		it.tDelta += d
+	}
+	it.t += it.tDelta
+
+	u, ok := it.uvarint()
+	if !ok {
+		return false
+	}
+	if u == rawValue {
+		if it.val, ok = it.raw(); !ok {
+			return false
+		}
+	} else {
+		it.val += float64(unzigzag(u >> 1))
+	}
+
+	it.numRead++
+	return true
+}
+
+func (it *deltaIterator) varint() (int64, bool) {
+	v, n := binary.Varint(it.b)
+	if n <= 0 {
+		it.err = errDeltaChunkTruncated
+		return 0, false
+	}
+	it.b = it.b[n:]
+	return v, true
+}
+
+func (it *deltaIterator) uvarint() (uint64, bool) {
+	v, n := binary.Uvarint(it.b)
+	if n <= 0 {
+		it.err = errDeltaChunkTruncated
+		return 0, false
+	}
+	it.b = it.b[n:]
+	return v, true
+}
+
+func (it *deltaIterator) raw() (float64, bool) {
+	if len(it.b) < 8 {
+		it.err = errDeltaChunkTruncated
+		return 0, false
+	}
+	v := math.Float64frombits(binary.BigEndian.Uint64(it.b))
+	it.b = it.b[8:]
+	return v, true
+}
+
+func zigzag(x int64) uint64 {
+	return uint64(x<<1) ^ uint64(x>>63)
+}
+
+func unzigzag(u uint64) int64 {
+	return int64(u>>1) ^ -int64(u&1)
+}
@@ -0,0 +1,271 @@
+// Command wal-dump prints a summary of a WAL directory: every segment with
+// its state, size and record counts by type, and optionally every record.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/yuanhuiqu/protsdb/wal"
+)
+
+// recordNames maps record types to printable names
+var recordNames = map[byte]string{
+	wal.RecordSeries:          "series",
+	wal.RecordSamples:         "samples",
+	wal.RecordCheckpoint:      "checkpoint",
+	wal.RecordSequence:        "sequence",
+	wal.RecordHistograms:      "histograms",
+	wal.RecordExemplars:       "exemplars",
+	wal.RecordMetadata:        "metadata",
+	wal.RecordTombstones:      "tombstones",
+	wal.RecordFloatHistograms: "float histograms",
+}
+
+func recordName(typ byte) string {
+	if name, ok := recordNames[typ]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", typ)
+}
+
+// segmentSummary aggregates the records of one segment
+type segmentSummary struct {
+	id      int
+	size    int64
+	counts  map[byte]int
+	maxTime int64 // newest sample or histogram timestamp
+}
+
+func main() {
+	verbose := flag.Bool("v", false, "Print every record with its decoded contents")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-v] <wal-dir>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	dir := flag.Arg(0)
+
+	ids, err := wal.ListSegments(dir)
+	if err != nil {
+		log.Fatalf("Error listing segments: %v", err)
+	}
+	summaries := make(map[int]*segmentSummary, len(ids))
+	for _, id := range ids {
+		info, err := os.Stat(wal.SegmentPath(dir, id))
+		if err != nil {
+			log.Fatalf("Error reading segment %d: %v", id, err)
+		}
+		summaries[id] = &segmentSummary{id: id, size: info.Size(), counts: make(map[byte]int), maxTime: math.MinInt64}
+	}
+
+	r, err := wal.NewReader(dir)
+	if err != nil {
+		log.Fatalf("Error opening WAL: %v", err)
+	}
+	defer r.Close()
+
+	// A checkpoint covers the samples up to its time, segments holding
+	// only such samples are flushed. Checkpoints of older versions carry no
+	// time and flush all segments before the one they are written to.
+	var (
+		lastCheckpoint = -1
+		checkpointTime = int64(math.MinInt64)
+	)
+	for r.Next() {
+		typ, data := r.Record()
+		if sum, ok := summaries[r.Segment()]; ok {
+			sum.counts[typ]++
+			sum.maxTime = max(sum.maxTime, maxTime(typ, r.Version(), data))
+		}
+		if typ == wal.RecordCheckpoint {
+			if t, err := wal.DecodeCheckpoint(data); err == nil && t > math.MinInt64 {
+				checkpointTime = max(checkpointTime, t)
+			} else {
+				lastCheckpoint = r.Segment()
+			}
+		}
+		if *verbose {
+			fmt.Printf("segment %d %s v%d: %s\n", r.Segment(), recordName(typ), r.Version(), describe(typ, r.Version(), data))
+		}
+	}
+	readErr := r.Err()
+
+	if *verbose {
+		fmt.Println()
+	}
+	for i, id := range ids {
+		sum := summaries[id]
+		state := wal.SegmentSealed
+		switch {
+		case i == len(ids)-1:
+			state = wal.SegmentActive
+		case id < lastCheckpoint, sum.maxTime <= checkpointTime:
+			state = wal.SegmentFlushed
+		}
+
+		fmt.Printf("segment %08d  %-7s  %10d bytes", id, state, sum.size)
+		types := make([]int, 0, len(sum.counts))
+		for typ := range sum.counts {
+			types = append(types, int(typ))
+		}
+		sort.Ints(types)
+		for _, typ := range types {
+			fmt.Printf("  %s=%d", recordName(byte(typ)), sum.counts[byte(typ)])
+		}
+		fmt.Println()
+	}
+
+	if readErr != nil {
+		log.Fatalf("Error reading WAL: %v", readErr)
+	}
+}
+
+// maxTime returns the newest sample or histogram timestamp of a record
+func maxTime(typ, version byte, data []byte) int64 {
+	var samples []prompb.Sample
+	maxt := int64(math.MinInt64)
+	switch {
+	case typ == wal.RecordSamples && version == 0:
+		_, samples, _ = wal.DecodeLegacySamples(data)
+	case typ == wal.RecordSamples:
+		_, samples, _ = wal.DecodeSamples(data)
+	case typ == wal.RecordHistograms, typ == wal.RecordFloatHistograms:
+		_, histograms, _ := wal.DecodeHistograms(data)
+		for _, h := range histograms {
+			maxt = max(maxt, h.Timestamp)
+		}
+	}
+	for _, s := range samples {
+		maxt = max(maxt, s.Timestamp)
+	}
+	return maxt
+}
+
+// describe decodes a record with the same routines the head replays it with
+func describe(typ, version byte, data []byte) string {
+	if version == 0 {
+		return describeLegacy(typ, data)
+	}
+
+	switch typ {
+	case wal.RecordSeries:
+		ref, lset, err := wal.DecodeSeries(data)
+		if err != nil {
+			return err.Error()
+		}
+		return fmt.Sprintf("ref=%d %s", ref, lset)
+
+	case wal.RecordSamples:
+		refs, samples, err := wal.DecodeSamples(data)
+		if err != nil {
+			return err.Error()
+		}
+		s := fmt.Sprintf("%d samples", len(samples))
+		for i, sample := range samples {
+			s += fmt.Sprintf("\n  ref=%d t=%d v=%g", refs[i], sample.Timestamp, sample.Value)
+		}
+		return s
+
+	case wal.RecordHistograms, wal.RecordFloatHistograms:
+		refs, histograms, err := wal.DecodeHistograms(data)
+		if err != nil {
+			return err.Error()
+		}
+		s := fmt.Sprintf("%d %s", len(histograms), recordName(typ))
+		for i, h := range histograms {
+			s += fmt.Sprintf("\n  ref=%d t=%d sum=%g schema=%d", refs[i], h.Timestamp, h.Sum, h.Schema)
+		}
+		return s
+
+	case wal.RecordExemplars:
+		refs, exemplars, err := wal.DecodeExemplars(data)
+		if err != nil {
+			return err.Error()
+		}
+		s := fmt.Sprintf("%d exemplars", len(exemplars))
+		for i, e := range exemplars {
+			s += fmt.Sprintf("\n  ref=%d t=%d v=%g labels=%v", refs[i], e.Timestamp, e.Value, e.Labels)
+		}
+		return s
+
+	case wal.RecordMetadata:
+		md, err := wal.DecodeMetadata(data)
+		if err != nil {
+			return err.Error()
+		}
+		return fmt.Sprintf("%s type=%s unit=%q help=%q", md.MetricFamilyName, md.Type, md.Unit, md.Help)
+
+	case wal.RecordTombstones:
+		stones, err := wal.DecodeTombstones(data)
+		if err != nil {
+			return err.Error()
+		}
+		s := fmt.Sprintf("%d tombstones", len(stones))
+		for _, t := range stones {
+			s += fmt.Sprintf("\n  ref=%d [%d, %d]", t.Ref, t.Mint, t.Maxt)
+		}
+		return s
+
+	case wal.RecordSequence:
+		ref, seq, err := wal.DecodeSequence(data)
+		if err != nil {
+			return err.Error()
+		}
+		return fmt.Sprintf("ref=%d seq=%d", ref, seq)
+
+	case wal.RecordCheckpoint:
+		maxt, err := wal.DecodeCheckpoint(data)
+		if err != nil {
+			return err.Error()
+		}
+		if maxt == math.MinInt64 {
+			return "-"
+		}
+		return fmt.Sprintf("maxt=%d", maxt)
+	}
+	return fmt.Sprintf("%d bytes", len(data))
+}
+
+// describeLegacy decodes a version 0 record
+func describeLegacy(typ byte, data []byte) string {
+	switch typ {
+	case wal.RecordSeries:
+		lset, err := wal.DecodeLegacySeries(data)
+		if err != nil {
+			return err.Error()
+		}
+		return lset.String()
+
+	case wal.RecordSamples:
+		lsets, samples, err := wal.DecodeLegacySamples(data)
+		if err != nil {
+			return err.Error()
+		}
+		s := fmt.Sprintf("%d samples", len(samples))
+		for i, sample := range samples {
+			s += fmt.Sprintf("\n  %s t=%d v=%g", lsets[i], sample.Timestamp, sample.Value)
+		}
+		return s
+
+	case wal.RecordSequence:
+		lset, seq, err := wal.DecodeLegacySequence(data)
+		if err != nil {
+			return err.Error()
+		}
+		return fmt.Sprintf("%s seq=%d", lset, seq)
+
+	case wal.RecordCheckpoint:
+		return "-"
+	}
+	return fmt.Sprintf("%d bytes", len(data))
+}
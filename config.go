@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the configuration of protsdb, read from a YAML file. Fields
+// left out keep their defaults.
+type Config struct {
+	Server  ServerConfig  `yaml:"server"`
+	Storage StorageConfig `yaml:"storage"`
+	Query   QueryConfig   `yaml:"query"`
+	Log     LogConfig     `yaml:"log"`
+}
+
+// ServerConfig configures the HTTP server and remote write limits
+type ServerConfig struct {
+	ListenAddr          string        `yaml:"listen_addr"`
+	TLSCertFile         string        `yaml:"tls_cert_file"`
+	TLSKeyFile          string        `yaml:"tls_key_file"`
+	ReadTimeout         time.Duration `yaml:"read_timeout"`
+	WriteTimeout        time.Duration `yaml:"write_timeout"`
+	MaxRequestBytes     int64         `yaml:"max_request_bytes"`
+	MaxDecodedBytes     int64         `yaml:"max_decoded_bytes"`
+	MaxSamplesPerWrite  int           `yaml:"max_samples_per_write"`
+	MaxSeriesPerWrite   int           `yaml:"max_series_per_write"`
+	MaxConcurrentWrites int           `yaml:"max_concurrent_writes"`
+}
+
+// StorageConfig configures the head, its WAL and blocks
+type StorageConfig struct {
+	WALDir                string        `yaml:"wal_dir"`
+	BlockDir              string        `yaml:"block_dir"`
+	ChunkSize             int           `yaml:"chunk_size"`
+	MaxChunkDuration      time.Duration `yaml:"max_chunk_duration"`
+	MaxSeries             int           `yaml:"max_series"`
+	MaxSamplesPerSeries   int           `yaml:"max_samples_per_series"`
+	OutOfOrderWindow      time.Duration `yaml:"out_of_order_window"`
+	MaxExemplarsPerSeries int           `yaml:"max_exemplars_per_series"`
+	DisableCompression    bool          `yaml:"disable_compression"`
+	MaintenanceInterval   time.Duration `yaml:"maintenance_interval"`
+	StaleSeriesTimeout    time.Duration `yaml:"stale_series_timeout"`
+	StripeCount           int           `yaml:"stripe_count"`
+	WALCompression        bool          `yaml:"wal_compression"`
+	WALPreallocate        bool          `yaml:"wal_preallocate"`
+	RepairWAL             bool          `yaml:"repair_wal"`
+	VerifyWAL             bool          `yaml:"verify_wal"`
+	ReadOnly              bool          `yaml:"read_only"`
+	DisableValidation     bool          `yaml:"disable_validation"`
+	AllowNamelessSeries   bool          `yaml:"allow_nameless_series"`
+	RejectUnsortedLabels  bool          `yaml:"reject_unsorted_labels"`
+	FutureTolerance       time.Duration `yaml:"future_tolerance"`
+}
+
+// QueryConfig configures PromQL evaluation and remote reads
+type QueryConfig struct {
+	Timeout            time.Duration `yaml:"timeout"`
+	MaxSamples         int           `yaml:"max_samples"`
+	MaxPoints          int           `yaml:"max_points"`
+	MaxSamplesPerQuery int           `yaml:"max_samples_per_query"` // per remote read query
+}
+
+// LogConfig configures logging
+type LogConfig struct {
+	Level  string `yaml:"level"`  // debug, info, warn or error
+	Format string `yaml:"format"` // text or json
+}
+
+// defaultConfig returns the configuration used for everything the config
+// file leaves out. Zero values fall back to the defaults of the head and
+// api packages.
+func defaultConfig() Config {
+	return Config{
+		Server: ServerConfig{
+			ListenAddr: ":9090",
+		},
+		Storage: StorageConfig{
+			WALDir: "data/wal",
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+	}
+}
+
+// loadConfig reads a YAML config file on top of the defaults. Unknown keys
+// are an error. An empty path returns the defaults.
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := yaml.UnmarshalStrict(b, &cfg); err != nil {
+		return cfg, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// applyEnv overrides config fields with the PROTSDB_* environment variables
+// that are set, for container deployments without a config file
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	overrides := []struct {
+		key string
+		set func(string) error
+	}{
+		{"PROTSDB_LISTEN_ADDR", setString(&c.Server.ListenAddr)},
+		{"PROTSDB_TLS_CERT_FILE", setString(&c.Server.TLSCertFile)},
+		{"PROTSDB_TLS_KEY_FILE", setString(&c.Server.TLSKeyFile)},
+		{"PROTSDB_MAX_REQUEST_BYTES", setInt64(&c.Server.MaxRequestBytes)},
+		{"PROTSDB_MAX_DECODED_BYTES", setInt64(&c.Server.MaxDecodedBytes)},
+		{"PROTSDB_WAL_DIR", setString(&c.Storage.WALDir)},
+		{"PROTSDB_BLOCK_DIR", setString(&c.Storage.BlockDir)},
+		{"PROTSDB_CHUNK_SIZE", setInt(&c.Storage.ChunkSize)},
+		{"PROTSDB_MAX_SERIES", setInt(&c.Storage.MaxSeries)},
+		{"PROTSDB_OUT_OF_ORDER_WINDOW", setDuration(&c.Storage.OutOfOrderWindow)},
+		{"PROTSDB_QUERY_TIMEOUT", setDuration(&c.Query.Timeout)},
+		{"PROTSDB_QUERY_MAX_POINTS", setInt(&c.Query.MaxPoints)},
+		{"PROTSDB_LOG_LEVEL", setString(&c.Log.Level)},
+		{"PROTSDB_LOG_FORMAT", setString(&c.Log.Format)},
+	}
+	for _, o := range overrides {
+		v, ok := lookup(o.key)
+		if !ok || v == "" {
+			continue
+		}
+		if err := o.set(v); err != nil {
+			return fmt.Errorf("invalid %s %q: %w", o.key, v, err)
+		}
+	}
+	return nil
+}
+
+func setString(p *string) func(string) error {
+	return func(v string) error {
+		*p = v
+		return nil
+	}
+}
+
+func setInt(p *int) func(string) error {
+	return func(v string) (err error) {
+		*p, err = strconv.Atoi(v)
+		return err
+	}
+}
+
+func setInt64(p *int64) func(string) error {
+	return func(v string) (err error) {
+		*p, err = strconv.ParseInt(v, 10, 64)
+		return err
+	}
+}
+
+func setDuration(p *time.Duration) func(string) error {
+	return func(v string) (err error) {
+		*p, err = time.ParseDuration(v)
+		return err
+	}
+}
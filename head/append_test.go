@@ -0,0 +1,162 @@
+package head
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// TestAppendDuplicate checks that a retried sample is ignored and one
+// reusing a timestamp with another value is rejected, for the newest sample
+// as for an out-of-order one
+func TestAppendDuplicate(t *testing.T) {
+	h := newTestHead(t, Options{OutOfOrderWindow: time.Second})
+	l := labels.FromStrings(labels.MetricName, "a")
+	stale := math.Float64frombits(value.StaleNaN)
+	// The stale marker is appended last and goes out of order
+	mustAppend(t, h, l, []prompb.Sample{{Timestamp: 10, Value: 1}, {Timestamp: 30, Value: 3}, {Timestamp: 20, Value: stale}}...)
+
+	for _, tc := range []struct {
+		sample prompb.Sample
+		err    error
+	}{
+		{prompb.Sample{Timestamp: 30, Value: 3}, nil},
+		{prompb.Sample{Timestamp: 30, Value: 4}, ErrDuplicateSample},
+		{prompb.Sample{Timestamp: 20, Value: stale}, nil},
+		{prompb.Sample{Timestamp: 20, Value: 2}, ErrDuplicateSample},
+	} {
+		if err := h.Append(l, tc.sample); err != tc.err {
+			t.Errorf("append %v@%d: %v, want %v", tc.sample.Value, tc.sample.Timestamp, err, tc.err)
+		}
+	}
+
+	got := query(t, h, 0, 100)[l.String()]
+	if len(got) != 3 || got[0].Value != 1 || !value.IsStaleNaN(got[1].Value) || got[2].Value != 3 {
+		t.Errorf("got %v, want the samples as first appended", got)
+	}
+}
+
+// TestAppendConcurrent appends to disjoint series from many goroutines,
+// for the race detector to check the head's time range and the series
+// index, with readers of both running meanwhile
+func TestAppendConcurrent(t *testing.T) {
+	h := newTestHead(t, Options{})
+	const (
+		writers = 16
+		samples = 200
+	)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			l := labels.FromStrings(labels.MetricName, "m", "writer", strconv.Itoa(w))
+			// Each writer covers its own part of the time range, so both
+			// ends move concurrently
+			base := int64(1000 + w*samples)
+			for i := int64(0); i < samples; i++ {
+				if err := h.Append(l, prompb.Sample{Timestamp: base + i, Value: 1}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			h.MinTime()
+			h.MaxTime()
+			h.LabelValues("writer")
+		}
+	}()
+	wg.Wait()
+	<-done
+
+	if mint, maxt := h.MinTime(), h.MaxTime(); mint != 1000 || maxt != 1000+writers*samples-1 {
+		t.Errorf("time range [%d, %d], want [1000, %d]", mint, maxt, 1000+writers*samples-1)
+	}
+	if n := countSamples(t, h, 0, math.MaxInt64); n != writers*samples {
+		t.Errorf("%d samples, want %d", n, writers*samples)
+	}
+}
+
+// TestChunkRotation checks that chunks are cut by sample count and by the
+// time they span, whichever comes first
+func TestChunkRotation(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		span  time.Duration
+		step  int64
+		sizes []int // samples per chunk, the last one being the open chunk
+	}{
+		{"by count", 100 * time.Millisecond, 1, []int{10, 10, 10, 10, 10}},
+		{"by span", 100 * time.Millisecond, 30, []int{4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 2}},
+		{"span disabled", -1, 30, []int{10, 10, 10, 10, 10}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHead(t, Options{ChunkSize: 10, MaxChunkDuration: tc.span})
+			l := labels.FromStrings(labels.MetricName, "a")
+			mustAppend(t, h, l, samplesAt(tc.step, 50*tc.step, tc.step)...)
+
+			ref, _ := h.GetRef(l)
+			s := h.Series(ref)
+			s.RLock()
+			defer s.RUnlock()
+			var sizes []int
+			for _, c := range append(s.chunks, s.chunk) {
+				if c.maxTime-c.minTime > tc.span.Milliseconds() && tc.span > 0 {
+					t.Errorf("chunk [%d, %d] spans more than %v", c.minTime, c.maxTime, tc.span)
+				}
+				sizes = append(sizes, int((c.maxTime-c.minTime)/tc.step)+1)
+			}
+			if !reflect.DeepEqual(sizes, tc.sizes) {
+				t.Errorf("chunks of %v samples, want %v", sizes, tc.sizes)
+			}
+		})
+	}
+}
+
+// TestAppendRef checks that AppendRef returns the reference of the series
+// it appended to, even for a rejected sample, for AppendWithRef to use
+func TestAppendRef(t *testing.T) {
+	h := newTestHead(t, Options{DisableWAL: true})
+	l := labels.FromStrings(labels.MetricName, "a")
+
+	ref, err := h.AppendRef(l, prompb.Sample{Timestamp: 10, Value: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := h.GetRef(l); !ok || got != ref {
+		t.Fatalf("AppendRef returned ref %d, GetRef %d", ref, got)
+	}
+	if err := h.AppendWithRef(ref, prompb.Sample{Timestamp: 11, Value: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A rejected sample still returns the reference of its series
+	got, err := h.AppendRef(l, prompb.Sample{Timestamp: 11, Value: 2})
+	if err != ErrDuplicateSample || got != ref {
+		t.Fatalf("AppendRef of a duplicate: ref %d, %v, want ref %d, %v", got, err, ref, ErrDuplicateSample)
+	}
+
+	// Once the series is removed its reference is unknown, and appending
+	// by labels creates it under a new one
+	if _, _, err := h.Truncate(20); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AppendWithRef(ref, prompb.Sample{Timestamp: 21, Value: 1}); err != ErrUnknownSeries {
+		t.Fatalf("AppendWithRef after removing the series: %v, want %v", err, ErrUnknownSeries)
+	}
+	if got, err := h.AppendRef(l, prompb.Sample{Timestamp: 21, Value: 1}); err != nil || got == ref {
+		t.Fatalf("AppendRef after removing the series: ref %d, %v, want a new ref", got, err)
+	}
+}
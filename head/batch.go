@@ -0,0 +1,203 @@
+package head
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Defaults for batching appends
+const (
+	defaultBatchSize     = 1000
+	defaultFlushInterval = 100 * time.Millisecond
+)
+
+// BatchOptions configures a Batcher
+type BatchOptions struct {
+	// MaxSamples flushes the batch once this many samples are pending (default 1000)
+	MaxSamples int
+	// FlushInterval flushes pending samples at the latest this long after
+	// the first of them was added (default 100ms)
+	FlushInterval time.Duration
+}
+
+// Batcher accumulates samples of a single writer in memory and commits them
+// to the WAL as one record and to the head under one lock acquisition.
+// Samples are only durable once the batch they are part of was flushed.
+type Batcher struct {
+	h    *Head
+	opts BatchOptions
+
+	mtx     sync.Mutex
+	lsets   []labels.Labels
+	samples []prompb.Sample
+	timer   *time.Timer
+	err     error // error of the last background flush
+}
+
+// NewBatcher returns a batcher appending into the head
+func (h *Head) NewBatcher(opts BatchOptions) *Batcher {
+	if opts.MaxSamples <= 0 {
+		opts.MaxSamples = defaultBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultFlushInterval
+	}
+	return &Batcher{h: h, opts: opts}
+}
+
+// Append queues a sample, flushing the batch when it is full. A failure of
+// a preceding background flush is reported here.
+func (b *Batcher) Append(l labels.Labels, sample prompb.Sample) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if err := b.err; err != nil {
+		b.err = nil
+		return err
+	}
+
+	b.lsets = append(b.lsets, l)
+	b.samples = append(b.samples, sample)
+
+	if len(b.samples) >= b.opts.MaxSamples {
+		return b.flushLocked()
+	}
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.opts.FlushInterval, b.flushAsync)
+	}
+	return nil
+}
+
+// Flush commits all pending samples
+func (b *Batcher) Flush() error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.flushLocked()
+}
+
+// flushAsync is the timer-triggered flush
+func (b *Batcher) flushAsync() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if err := b.flushLocked(); err != nil {
+		b.err = err
+	}
+}
+
+func (b *Batcher) flushLocked() error {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.samples) == 0 {
+		return nil
+	}
+
+	err := b.h.appendBatch(b.lsets, b.samples)
+	b.lsets = b.lsets[:0]
+	b.samples = b.samples[:0]
+	return err
+}
+
+// appendBatch logs the samples as a single WAL record and adds them to
+// their series, locking each series once for all of its samples. Samples
+// failing validation are dropped, the first error is returned once the
+// others were appended.
+func (h *Head) appendBatch(lsets []labels.Labels, samples []prompb.Sample) error {
+	var firstErr error
+	n := 0
+	for i := range samples {
+		if err := h.validateSample(samples[i]); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		lsets[n], samples[n] = lsets[i], samples[i]
+		samples[n].Timestamp = h.truncate(samples[n].Timestamp)
+		h.observeSkew(samples[n].Timestamp)
+		n++
+	}
+	lsets, samples = lsets[:n], samples[:n]
+	if n == 0 {
+		return firstErr
+	}
+
+	// Group samples by series, keeping their order within a series
+	var (
+		order   []*memSeries
+		grouped = make(map[*memSeries][]prompb.Sample)
+		refs    = make([]uint64, len(lsets))
+	)
+	for i, l := range lsets {
+		s, _, err := h.getOrCreate(l)
+		if err != nil {
+			return err
+		}
+		if _, ok := grouped[s]; !ok {
+			order = append(order, s)
+		}
+		grouped[s] = append(grouped[s], samples[i])
+		refs[i] = s.ref
+	}
+
+	if err := h.wal.LogSamples(refs, samples); err != nil {
+		return err
+	}
+
+	var appended uint64
+	for _, s := range order {
+		samples := grouped[s]
+		s.Lock()
+		if s.deleted {
+			// Removed by gc since it was resolved, the samples go to the
+			// series now holding its labels and are logged again under its
+			// reference
+			s.Unlock()
+			var err error
+			if s, err = h.relogDeleted(s.lset, samples); err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+		}
+		for _, sample := range samples {
+			dropped := h.keepsFirst(s, sample)
+			if err := h.appendSample(s, sample); err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			if !dropped {
+				appended++
+			}
+		}
+		s.Unlock()
+	}
+	atomic.AddUint64(&h.samplesAppended, appended)
+	return firstErr
+}
+
+// relogDeleted returns the locked series now holding the labels of a series
+// removed by gc, with the samples meant for the old one logged to the WAL
+func (h *Head) relogDeleted(l labels.Labels, samples []prompb.Sample) (*memSeries, error) {
+	s, err := h.lockSeries(l)
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]uint64, len(samples))
+	for i := range refs {
+		refs[i] = s.ref
+	}
+	if err := h.wal.LogSamples(refs, samples); err != nil {
+		s.Unlock()
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,125 @@
+package head
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// TestBatcher checks that no sample is lost whether its batch is flushed
+// when full, by the timer or by hand, and that they all survive a restart
+func TestBatcher(t *testing.T) {
+	opts := Options{}
+	h := newTestHead(t, opts)
+
+	const writers = 4
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			b := h.NewBatcher(BatchOptions{MaxSamples: 7, FlushInterval: time.Millisecond})
+			l := labels.FromStrings(labels.MetricName, "m", "writer", strconv.Itoa(w))
+			for _, s := range samplesAt(1, 500, 1) {
+				if err := b.Append(l, s); err != nil {
+					t.Error(err)
+					return
+				}
+				// Give the timer a chance to flush partial batches
+				if s.Timestamp%50 == 0 {
+					time.Sleep(2 * time.Millisecond)
+				}
+			}
+			if err := b.Flush(); err != nil {
+				t.Error(err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	want := make(map[string][]prompb.Sample)
+	for w := 0; w < writers; w++ {
+		l := labels.FromStrings(labels.MetricName, "m", "writer", strconv.Itoa(w))
+		want[l.String()] = samplesAt(1, 500, 1)
+	}
+	if got := query(t, h, 0, 1000); !reflect.DeepEqual(got, want) {
+		t.Fatalf("%d samples appended, want %d", countSamples(t, h, 0, 1000), writers*500)
+	}
+	h = reopenHead(t, h, opts)
+	if got := query(t, h, 0, 1000); !reflect.DeepEqual(got, want) {
+		t.Fatalf("%d samples after a restart, want %d", countSamples(t, h, 0, 1000), writers*500)
+	}
+}
+
+// TestBatcherInvalid checks that an invalid sample fails the flush without
+// losing the rest of the batch
+func TestBatcherInvalid(t *testing.T) {
+	h := newTestHead(t, Options{})
+	b := h.NewBatcher(BatchOptions{MaxSamples: 100, FlushInterval: time.Hour})
+	l := labels.FromStrings(labels.MetricName, "m")
+	for _, s := range []prompb.Sample{{Timestamp: 1, Value: 1}, {Timestamp: -1, Value: 1}, {Timestamp: 2, Value: 2}} {
+		if err := b.Append(l, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := countSamples(t, h, 0, 10); n != 0 {
+		t.Fatalf("%d samples visible before the flush", n)
+	}
+	if err := b.Flush(); err != ErrInvalidTimestamp {
+		t.Fatalf("flush: %v, want %v", err, ErrInvalidTimestamp)
+	}
+	want := []prompb.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}}
+	if got := query(t, h, 0, 10)[l.String()]; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+// BenchmarkBatcher compares appending samples one by one to batching them,
+// reporting the WAL records, each a WAL lock acquisition, per sample
+func BenchmarkBatcher(b *testing.B) {
+	series := make([]labels.Labels, 100)
+	for i := range series {
+		series[i] = labels.FromStrings(labels.MetricName, "m", "i", fmt.Sprint(i))
+	}
+	run := func(b *testing.B, appendFn func(h *Head) func(labels.Labels, prompb.Sample) error, flush func() error) {
+		h := newTestHead(b, Options{})
+		app := appendFn(h)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			l := series[i%len(series)]
+			if err := app(l, prompb.Sample{Timestamp: int64(i/len(series)) + 1, Value: 1}); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := flush(); err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+
+		records := 0
+		if err := h.wal.Replay(func(byte, byte, []byte) error {
+			records++
+			return nil
+		}); err != nil {
+			b.Fatal(err)
+		}
+		b.ReportMetric(float64(records-len(series))/float64(b.N), "records/sample")
+	}
+
+	b.Run("append", func(b *testing.B) {
+		run(b, func(h *Head) func(labels.Labels, prompb.Sample) error { return h.Append }, func() error { return nil })
+	})
+	b.Run("batch", func(b *testing.B) {
+		var bt *Batcher
+		run(b, func(h *Head) func(labels.Labels, prompb.Sample) error {
+			bt = h.NewBatcher(BatchOptions{})
+			return bt.Append
+		}, func() error { return bt.Flush() })
+	})
+}
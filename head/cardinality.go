@@ -0,0 +1,175 @@
+package head
+
+import (
+	"sort"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// LabelCardinality summarizes how a single label name is used across series
+type LabelCardinality struct {
+	Name   string `json:"name"`
+	Values int    `json:"values"` // distinct values of the label
+	Series int    `json:"series"` // series carrying the label
+}
+
+// LabelPairCardinality is the number of series carrying a name/value pair
+type LabelPairCardinality struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Series int    `json:"series"`
+}
+
+// Cardinality is a point-in-time cardinality report of the head
+type Cardinality struct {
+	NumSeries int                    `json:"numSeries"`
+	Labels    []LabelCardinality     `json:"labels"`
+	TopPairs  []LabelPairCardinality `json:"topPairs"`
+}
+
+// Cardinality reports per label name cardinality and the limit label pairs
+// shared by the most series. The counts come from the postings index as of
+// a single point in time, see readIndexes. A series lives in a single
+// stripe, so the postings of a pair across stripes add up to its series.
+func (h *Head) Cardinality(limit int) Cardinality {
+	var numSeries int
+	pairs := make(map[labelPair]int)
+	h.readStripes(func(st *seriesStripe) {
+		numSeries += len(st.series)
+		for name, vs := range st.index.values {
+			for v := range vs {
+				p := labelPair{name, v}
+				pairs[p] += len(st.index.postings[p])
+			}
+		}
+	})
+
+	names := make(map[string]*LabelCardinality)
+	for p, n := range pairs {
+		lc, ok := names[p.name]
+		if !ok {
+			lc = &LabelCardinality{Name: p.name}
+			names[p.name] = lc
+		}
+		lc.Values++
+		lc.Series += n
+	}
+
+	res := Cardinality{
+		NumSeries: numSeries,
+		Labels:    make([]LabelCardinality, 0, len(names)),
+		TopPairs:  make([]LabelPairCardinality, 0, len(pairs)),
+	}
+	for _, lc := range names {
+		res.Labels = append(res.Labels, *lc)
+	}
+	sort.Slice(res.Labels, func(i, j int) bool {
+		if res.Labels[i].Values != res.Labels[j].Values {
+			return res.Labels[i].Values > res.Labels[j].Values
+		}
+		return res.Labels[i].Name < res.Labels[j].Name
+	})
+
+	for p, n := range pairs {
+		res.TopPairs = append(res.TopPairs, LabelPairCardinality{Name: p.name, Value: p.value, Series: n})
+	}
+	sort.Slice(res.TopPairs, func(i, j int) bool {
+		a, b := res.TopPairs[i], res.TopPairs[j]
+		if a.Series != b.Series {
+			return a.Series > b.Series
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Value < b.Value
+	})
+	if limit > 0 && len(res.TopPairs) > limit {
+		res.TopPairs = res.TopPairs[:limit]
+	}
+
+	return res
+}
+
+// TSDBStatus is the report of Prometheus's /api/v1/status/tsdb endpoint
+type TSDBStatus struct {
+	HeadStats                   HeadStats   `json:"headStats"`
+	SeriesCountByMetricName     []StatEntry `json:"seriesCountByMetricName"`
+	LabelValueCountByLabelName  []StatEntry `json:"labelValueCountByLabelName"`
+	MemoryInBytesByLabelName    []StatEntry `json:"memoryInBytesByLabelName"`
+	SeriesCountByLabelValuePair []StatEntry `json:"seriesCountByLabelValuePair"`
+}
+
+// HeadStats are the head totals of a TSDBStatus
+type HeadStats struct {
+	NumSeries     int   `json:"numSeries"`
+	NumLabelPairs int   `json:"numLabelPairs"`
+	ChunkCount    int   `json:"chunkCount"`
+	MinTime       int64 `json:"minTime"`
+	MaxTime       int64 `json:"maxTime"`
+}
+
+// StatEntry is a name and its count in a TSDBStatus list
+type StatEntry struct {
+	Name  string `json:"name"`
+	Value uint64 `json:"value"`
+}
+
+// TSDBStatus reports the limit metric names with the most series, label
+// names with the most values or using the most memory for their values,
+// and label pairs with the most series. It is derived from the report of
+// Cardinality over all pairs.
+func (h *Head) TSDBStatus(limit int) TSDBStatus {
+	c := h.Cardinality(0)
+
+	var (
+		metrics = make(map[string]uint64)
+		values  = make(map[string]uint64, len(c.Labels))
+		memory  = make(map[string]uint64, len(c.Labels))
+		byPair  = make(map[string]uint64, len(c.TopPairs))
+	)
+	for _, lc := range c.Labels {
+		values[lc.Name] = uint64(lc.Values)
+	}
+	for _, p := range c.TopPairs {
+		n := uint64(p.Series)
+		if p.Name == labels.MetricName {
+			metrics[p.Value] = n
+		}
+		memory[p.Name] += uint64(len(p.Value)) * n
+		byPair[p.Name+"="+p.Value] = n
+	}
+
+	st := h.Stats()
+	return TSDBStatus{
+		HeadStats: HeadStats{
+			NumSeries:     c.NumSeries,
+			NumLabelPairs: len(c.TopPairs),
+			ChunkCount:    st.NumChunks,
+			MinTime:       st.MinTime,
+			MaxTime:       st.MaxTime,
+		},
+		SeriesCountByMetricName:     topEntries(metrics, limit),
+		LabelValueCountByLabelName:  topEntries(values, limit),
+		MemoryInBytesByLabelName:    topEntries(memory, limit),
+		SeriesCountByLabelValuePair: topEntries(byPair, limit),
+	}
+}
+
+// topEntries returns the limit entries with the highest counts, ties
+// ordered by name
+func topEntries(counts map[string]uint64, limit int) []StatEntry {
+	res := make([]StatEntry, 0, len(counts))
+	for name, n := range counts {
+		res = append(res, StatEntry{Name: name, Value: n})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Value != res[j].Value {
+			return res[i].Value > res[j].Value
+		}
+		return res[i].Name < res[j].Name
+	})
+	if limit > 0 && len(res) > limit {
+		res = res[:limit]
+	}
+	return res
+}
@@ -0,0 +1,59 @@
+package head
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+func TestCardinality(t *testing.T) {
+	h := newTestHead(t, Options{DisableWAL: true, StripeCount: 4})
+	for _, l := range []labels.Labels{
+		labels.FromStrings(labels.MetricName, "up", "job", "a", "instance", "1"),
+		labels.FromStrings(labels.MetricName, "up", "job", "a", "instance", "2"),
+		labels.FromStrings(labels.MetricName, "up", "job", "b", "instance", "1"),
+		labels.FromStrings(labels.MetricName, "requests", "job", "a"),
+	} {
+		mustAppend(t, h, l, samplesAt(1000, 1000, 1)...)
+	}
+	// Truncated series are removed from the index as well
+	mustAppend(t, h, labels.FromStrings(labels.MetricName, "old", "job", "c"), samplesAt(1, 1, 1)...)
+	if _, _, err := h.Truncate(2); err != nil {
+		t.Fatal(err)
+	}
+
+	want := Cardinality{
+		NumSeries: 4,
+		Labels: []LabelCardinality{
+			{Name: "__name__", Values: 2, Series: 4},
+			{Name: "instance", Values: 2, Series: 3},
+			{Name: "job", Values: 2, Series: 4},
+		},
+		TopPairs: []LabelPairCardinality{
+			{Name: "__name__", Value: "up", Series: 3},
+			{Name: "job", Value: "a", Series: 3},
+		},
+	}
+	if got := h.Cardinality(2); !reflect.DeepEqual(got, want) {
+		t.Errorf("Cardinality(2) = %+v, want %+v", got, want)
+	}
+
+	st := h.TSDBStatus(2)
+	if st.HeadStats.NumSeries != 4 || st.HeadStats.NumLabelPairs != 6 {
+		t.Errorf("%d series and %d label pairs, want 4 and 6", st.HeadStats.NumSeries, st.HeadStats.NumLabelPairs)
+	}
+	for _, tc := range []struct {
+		name      string
+		got, want []StatEntry
+	}{
+		{"series by metric", st.SeriesCountByMetricName, []StatEntry{{"up", 3}, {"requests", 1}}},
+		{"values by label", st.LabelValueCountByLabelName, []StatEntry{{"__name__", 2}, {"instance", 2}}},
+		{"memory by label", st.MemoryInBytesByLabelName, []StatEntry{{"__name__", 2*3 + 8}, {"job", 4}}},
+		{"series by pair", st.SeriesCountByLabelValuePair, []StatEntry{{"__name__=up", 3}, {"job=a", 3}}},
+	} {
+		if !reflect.DeepEqual(tc.got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, tc.got, tc.want)
+		}
+	}
+}
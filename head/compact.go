@@ -0,0 +1,604 @@
+package head
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/yuanhuiqu/protsdb/chunkenc"
+)
+
+// Files of a block directory
+const (
+	blockChunksFile = "chunks"
+	blockIndexFile  = "index"
+	blockMetaFile   = "meta.json"
+	blockPrefix     = "block-"
+	blockTmpSuffix  = ".tmp"
+)
+
+// Index file format, all integers are varints unless noted:
+//
+//	| #series | series ... | CRC32 of everything before (4b) |
+//
+// series:
+//
+//	| #labels | len(name) name len(value) value ... | #chunks | chunk ... |
+//
+// chunk:
+//
+//	| minTime | maxTime | encoding (1b) | offset | length |
+//
+// offset and length address the chunk bytes within the chunks file.
+
+// BlockMeta describes the contents of a block
+type BlockMeta struct {
+	MinTime    int64 `json:"minTime"`
+	MaxTime    int64 `json:"maxTime"`
+	NumSeries  int   `json:"numSeries"`
+	NumChunks  int   `json:"numChunks"`
+	NumSamples int   `json:"numSamples"`
+}
+
+// BlockSeries is a series and its samples, sorted by timestamp, to be
+// written into a block
+type BlockSeries struct {
+	Labels  labels.Labels
+	Samples []prompb.Sample
+}
+
+// Compactor persists samples as immutable blocks on disk
+type Compactor struct {
+	dir       string
+	chunkSize int
+}
+
+// NewCompactor returns a compactor writing blocks into dir, cutting chunks
+// of at most chunkSize samples
+func NewCompactor(dir string, chunkSize int) *Compactor {
+	if chunkSize <= 0 || chunkSize > math.MaxUint16 {
+		chunkSize = math.MaxUint16
+	}
+	return &Compactor{dir: dir, chunkSize: chunkSize}
+}
+
+// Write persists the series as a new block covering [mint, maxt] and opens
+// it. The block is assembled in a temporary directory and renamed into
+// place, so a crash never leaves a partial block behind.
+func (c *Compactor) Write(mint, maxt int64, series []BlockSeries) (*Block, error) {
+	if err := os.MkdirAll(c.dir, 0777); err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("%s%d-%d", blockPrefix, mint, maxt)
+	final := filepath.Join(c.dir, name)
+	if _, err := os.Stat(final); err == nil {
+		return nil, fmt.Errorf("head: block %s already exists", name)
+	}
+	tmp := final + blockTmpSuffix
+	if err := os.RemoveAll(tmp); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(tmp, 0777); err != nil {
+		return nil, err
+	}
+
+	meta, err := c.writeFiles(tmp, series)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+	meta.MinTime, meta.MaxTime = mint, maxt
+
+	b, err := json.Marshal(meta)
+	if err == nil {
+		err = writeFileSync(filepath.Join(tmp, blockMetaFile), b)
+	}
+	if err == nil {
+		err = os.Rename(tmp, final)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+
+	return OpenBlock(final)
+}
+
+// writeFiles writes the chunks and index files of a block
+func (c *Compactor) writeFiles(dir string, series []BlockSeries) (BlockMeta, error) {
+	var meta BlockMeta
+
+	// Empty series are not worth an index entry
+	nonEmpty := series[:0:0]
+	for _, s := range series {
+		if len(s.Samples) > 0 {
+			nonEmpty = append(nonEmpty, s)
+		}
+	}
+	series = nonEmpty
+	sort.Slice(series, func(i, j int) bool {
+		return labels.Compare(series[i].Labels, series[j].Labels) < 0
+	})
+
+	f, err := os.Create(filepath.Join(dir, blockChunksFile))
+	if err != nil {
+		return meta, err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	var offset uint64
+	index := binary.AppendUvarint(nil, uint64(len(series)))
+	for _, s := range series {
+		meta.NumSeries++
+		meta.NumSamples += len(s.Samples)
+
+		index = appendBlockLabels(index, s.Labels)
+		nchunks := (len(s.Samples) + c.chunkSize - 1) / c.chunkSize
+		index = binary.AppendUvarint(index, uint64(nchunks))
+
+		for samples := s.Samples; len(samples) > 0; {
+			n := min(len(samples), c.chunkSize)
+			chk := encodeChunk(chunkenc.EncXOR, samples[:n])
+
+			if _, err := w.Write(chk.Bytes()); err != nil {
+				return meta, err
+			}
+			index = binary.AppendVarint(index, samples[0].Timestamp)
+			index = binary.AppendVarint(index, samples[n-1].Timestamp)
+			index = append(index, byte(chk.Encoding()))
+			index = binary.AppendUvarint(index, offset)
+			index = binary.AppendUvarint(index, uint64(len(chk.Bytes())))
+
+			offset += uint64(len(chk.Bytes()))
+			meta.NumChunks++
+			samples = samples[n:]
+		}
+	}
+	index = binary.BigEndian.AppendUint32(index, crc32.ChecksumIEEE(index))
+
+	if err := w.Flush(); err != nil {
+		return meta, err
+	}
+	if err := f.Sync(); err != nil {
+		return meta, err
+	}
+	return meta, writeFileSync(filepath.Join(dir, blockIndexFile), index)
+}
+
+// encodeChunk compresses sorted samples into a single chunk, delta encoded
+// for EncDelta and XOR encoded otherwise
+func encodeChunk(enc chunkenc.Encoding, samples []prompb.Sample) chunkenc.Chunk {
+	var c chunkenc.Chunk = chunkenc.NewXORChunk()
+	if enc == chunkenc.EncDelta {
+		c = chunkenc.NewDeltaChunk()
+	}
+	app, _ := c.Appender() // cannot fail for an empty chunk
+	for _, s := range samples {
+		app.Append(s.Timestamp, s.Value)
+	}
+	return c
+}
+
+func appendBlockLabels(b []byte, lset labels.Labels) []byte {
+	b = binary.AppendUvarint(b, uint64(len(lset)))
+	for _, l := range lset {
+		b = binary.AppendUvarint(b, uint64(len(l.Name)))
+		b = append(b, l.Name...)
+		b = binary.AppendUvarint(b, uint64(len(l.Value)))
+		b = append(b, l.Value...)
+	}
+	return b
+}
+
+// writeFileSync writes a file and syncs it to disk
+func writeFileSync(name string, data []byte) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// blockChunk locates a chunk in the chunks file of a block
+type blockChunk struct {
+	minTime, maxTime int64
+	encoding         chunkenc.Encoding
+	offset, length   uint64
+}
+
+// blockEntry is a series in the index of a block
+type blockEntry struct {
+	lset   labels.Labels
+	chunks []blockChunk
+}
+
+// Block is an immutable set of series persisted on disk. The index is held
+// in memory, chunks are read from disk on demand.
+type Block struct {
+	dir    string
+	meta   BlockMeta
+	series []blockEntry // sorted by labels
+	chunks *os.File
+
+	// Deleted intervals by position in series
+	mtx        sync.RWMutex
+	tombstones map[int][]Interval
+}
+
+// errBlockIndex is returned for corrupted index files
+var errBlockIndex = errors.New("head: invalid block index")
+
+// OpenBlock opens a block written by a Compactor
+func OpenBlock(dir string) (*Block, error) {
+	b, err := os.ReadFile(filepath.Join(dir, blockMetaFile))
+	if err != nil {
+		return nil, err
+	}
+	var meta BlockMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, err
+	}
+
+	index, err := os.ReadFile(filepath.Join(dir, blockIndexFile))
+	if err != nil {
+		return nil, err
+	}
+	series, err := decodeBlockIndex(index)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", dir, err)
+	}
+
+	tombstones, err := readBlockTombstones(dir, len(series))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", dir, err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, blockChunksFile))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Block{dir: dir, meta: meta, series: series, chunks: f, tombstones: tombstones}, nil
+}
+
+func decodeBlockIndex(b []byte) ([]blockEntry, error) {
+	if len(b) < 4 {
+		return nil, errBlockIndex
+	}
+	b, sum := b[:len(b)-4], binary.BigEndian.Uint32(b[len(b)-4:])
+	if crc32.ChecksumIEEE(b) != sum {
+		return nil, fmt.Errorf("%w: checksum mismatch", errBlockIndex)
+	}
+
+	d := decbuf{b: b}
+	series := make([]blockEntry, d.uvarint())
+	for i := range series {
+		nl := int(d.uvarint())
+		sb := labels.NewScratchBuilder(nl)
+		for j := 0; j < nl; j++ {
+			sb.Add(d.str(), d.str())
+		}
+		series[i].lset = sb.Labels()
+
+		series[i].chunks = make([]blockChunk, d.uvarint())
+		for j := range series[i].chunks {
+			series[i].chunks[j] = blockChunk{
+				minTime:  d.varint(),
+				maxTime:  d.varint(),
+				encoding: chunkenc.Encoding(d.byte()),
+				offset:   d.uvarint(),
+				length:   d.uvarint(),
+			}
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return series, nil
+}
+
+// decbuf decodes index entries, remembering the first error
+type decbuf struct {
+	b   []byte
+	err error
+}
+
+func (d *decbuf) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = errBlockIndex
+		return 0
+	}
+	d.b = d.b[n:]
+	return x
+}
+
+func (d *decbuf) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errBlockIndex
+		return 0
+	}
+	d.b = d.b[n:]
+	return x
+}
+
+func (d *decbuf) byte() byte {
+	if d.err != nil || len(d.b) == 0 {
+		d.err = errBlockIndex
+		return 0
+	}
+	c := d.b[0]
+	d.b = d.b[1:]
+	return c
+}
+
+func (d *decbuf) str() string {
+	n := d.uvarint()
+	if d.err != nil || uint64(len(d.b)) < n {
+		d.err = errBlockIndex
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
+
+// Meta returns the metadata of the block
+func (b *Block) Meta() BlockMeta { return b.meta }
+
+// Dir returns the directory of the block
+func (b *Block) Dir() string { return b.dir }
+
+// Close releases the chunks file of the block
+func (b *Block) Close() error { return b.chunks.Close() }
+
+// Select returns the series of the block matching all matchers with
+// samples in [mint, maxt]
+func (b *Block) Select(mint, maxt int64, ms ...*labels.Matcher) SeriesSet {
+	series, err := b.query(mint, maxt, ms)
+	return &listSeriesSet{series: series, idx: -1, err: err}
+}
+
+// query loads the chunks of all matching series overlapping [mint, maxt]
+func (b *Block) query(mint, maxt int64, ms []*labels.Matcher) ([]Series, error) {
+	if b.meta.MaxTime < mint || b.meta.MinTime > maxt {
+		return nil, nil
+	}
+
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	var res []Series
+	for i, e := range b.series {
+		if !matchesAll(e.lset, ms) {
+			continue
+		}
+
+		var chunks []chunkView
+		for _, c := range e.chunks {
+			if c.maxTime < mint || c.minTime > maxt {
+				continue
+			}
+			data := make([]byte, c.length)
+			if _, err := b.chunks.ReadAt(data, int64(c.offset)); err != nil {
+				return nil, fmt.Errorf("head: reading chunk of block %s: %w", b.dir, err)
+			}
+			chk, err := chunkenc.FromData(c.encoding, data)
+			if err != nil {
+				return nil, err
+			}
+			chunks = append(chunks, chunkView{data: chk, mint: c.minTime, maxt: c.maxTime})
+		}
+		if len(chunks) > 0 {
+			res = append(res, &querySeries{
+				lset:       e.lset,
+				mint:       mint,
+				maxt:       maxt,
+				chunks:     chunks,
+				tombstones: b.tombstones[i],
+			})
+		}
+	}
+	return res, nil
+}
+
+// openBlocks opens all complete blocks in dir, ordered by time. Leftovers
+// of interrupted compactions are removed unless readOnly is set.
+func openBlocks(dir string, readOnly bool) ([]*Block, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks []*Block
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() || !strings.HasPrefix(name, blockPrefix) {
+			continue
+		}
+		if strings.HasSuffix(name, blockTmpSuffix) {
+			if !readOnly {
+				os.RemoveAll(filepath.Join(dir, name))
+			}
+			continue
+		}
+
+		b, err := OpenBlock(filepath.Join(dir, name))
+		if err != nil {
+			closeBlocks(blocks)
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].meta.MinTime < blocks[j].meta.MinTime
+	})
+	return blocks, nil
+}
+
+// closeBlocks closes all blocks, returning the first error
+func closeBlocks(blocks []*Block) error {
+	var firstErr error
+	for _, b := range blocks {
+		if err := b.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Compact writes all samples in [mint, maxt] into a new block on disk and
+// drops them from memory. Afterwards the head no longer accepts samples at
+// or before maxt, like Prometheus after persisting a block, so the block
+// stays the single source of truth for that range. It returns nil without
+// writing anything if the head holds no samples in the range.
+func (h *Head) Compact(mint, maxt int64) (*Block, error) {
+	if h.readOnly {
+		return nil, ErrReadOnly
+	}
+	if mint > maxt {
+		return nil, fmt.Errorf("head: invalid compaction range [%d, %d]", mint, maxt)
+	}
+
+	// Freeze the range first so no sample sneaks in after it was gathered
+	prevValid := atomic.LoadInt64(&h.minValidTime)
+	if maxt+1 > prevValid {
+		atomic.StoreInt64(&h.minValidTime, maxt+1)
+	}
+
+	all := h.allSeries()
+
+	var (
+		toWrite []BlockSeries
+		owners  []*memSeries
+	)
+	for _, s := range all {
+		qs := s.query(mint, maxt)
+		if qs == nil {
+			continue
+		}
+		var samples []prompb.Sample
+		it := qs.Iterator()
+		for it.Next() {
+			t, v := it.At()
+			samples = append(samples, prompb.Sample{Timestamp: t, Value: v})
+		}
+		if err := it.Err(); err != nil {
+			atomic.StoreInt64(&h.minValidTime, prevValid)
+			return nil, err
+		}
+		toWrite = append(toWrite, BlockSeries{Labels: s.lset, Samples: samples})
+		owners = append(owners, s)
+	}
+	if len(toWrite) == 0 {
+		return nil, nil
+	}
+
+	b, err := h.compactor.Write(mint, maxt, toWrite)
+	if err != nil {
+		atomic.StoreInt64(&h.minValidTime, prevValid)
+		return nil, err
+	}
+
+	h.mtx.Lock()
+	h.blocks = append(h.blocks, b)
+	sort.Slice(h.blocks, func(i, j int) bool {
+		return h.blocks[i].meta.MinTime < h.blocks[j].meta.MinTime
+	})
+	h.mtx.Unlock()
+
+	for _, s := range owners {
+		s.Lock()
+		s.dropRange(mint, maxt, h.compress)
+		s.Unlock()
+	}
+
+	// The block holds everything up to maxt now, so the replay may skip it
+	// and the segments holding nothing newer are removed
+	if err := h.wal.Checkpoint(maxt); err != nil {
+		return b, err
+	}
+	return b, h.checkpointWAL()
+}
+
+// dropRange removes all samples in [mint, maxt] from the series, which
+// must be locked. Chunks are rebuilt rather than modified in place since
+// queries may still reference them.
+func (s *memSeries) dropRange(mint, maxt int64, compress bool) {
+	chunks := s.chunks[:0:0]
+	for _, c := range s.chunks {
+		if c.maxTime < mint || c.minTime > maxt {
+			chunks = append(chunks, c)
+			continue
+		}
+		if kept := c.without(mint, maxt); len(kept.samples) > 0 {
+			if compress {
+				kept.compress(s.encoding)
+			}
+			chunks = append(chunks, kept)
+		}
+	}
+	s.chunks = chunks
+	s.chunk = s.chunk.without(mint, maxt)
+	s.ooo = s.ooo.without(mint, maxt)
+	s.numSamples, _ = s.size()
+}
+
+// without returns a raw chunk holding the samples outside [mint, maxt]
+func (c *memChunk) without(mint, maxt int64) *memChunk {
+	res := &memChunk{}
+	it := c.iterator()
+	for it.Next() {
+		t, v := it.At()
+		if t >= mint && t <= maxt {
+			continue
+		}
+		if len(res.samples) == 0 {
+			res.minTime = t
+		}
+		res.samples = append(res.samples, prompb.Sample{Timestamp: t, Value: v})
+		res.maxTime = t
+	}
+	return res
+}
+
+// iterator returns an iterator over all samples of the chunk
+func (c *memChunk) iterator() SampleIterator {
+	if c.data != nil {
+		return c.data.Iterator()
+	}
+	return &sliceIterator{samples: c.samples, idx: -1}
+}
@@ -0,0 +1,55 @@
+package head
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/yuanhuiqu/protsdb/chunkenc"
+)
+
+// TestChooseEncoding checks that completed chunks are encoded by the type
+// of their metric family if known, and by whether the first chunk grows
+// otherwise, and that queries read them back
+func TestChooseEncoding(t *testing.T) {
+	h := newTestHead(t, Options{ChunkSize: 10})
+	if err := h.SetMetadata(prompb.MetricMetadata{MetricFamilyName: "typed_gauge", Type: prompb.MetricMetadata_GAUGE}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetMetadata(prompb.MetricMetadata{MetricFamilyName: "typed_counter", Type: prompb.MetricMetadata_COUNTER}); err != nil {
+		t.Fatal(err)
+	}
+
+	growing := samplesAt(1, 30, 1)
+	shrinking := samplesAt(1, 30, 1)
+	for i := range shrinking {
+		shrinking[i].Value = -shrinking[i].Value
+	}
+	for _, tc := range []struct {
+		name    string
+		samples []prompb.Sample
+		want    chunkenc.Encoding
+	}{
+		{"counter", growing, chunkenc.EncDelta},
+		{"gauge", shrinking, chunkenc.EncXOR},
+		{"typed_gauge", growing, chunkenc.EncXOR},
+		{"typed_counter", shrinking, chunkenc.EncDelta},
+		{"open_chunk", samplesAt(1, 5, 1), chunkenc.EncNone},
+	} {
+		l := labels.FromStrings(labels.MetricName, tc.name)
+		mustAppend(t, h, l, tc.samples...)
+		ref, _ := h.GetRef(l)
+		if enc := h.Series(ref).encoding; enc != tc.want {
+			t.Errorf("%s: chunks encoded as %s, want %s", tc.name, enc, tc.want)
+		}
+		if got := query(t, h, 0, 100)[l.String()]; !reflect.DeepEqual(got, tc.samples) {
+			t.Errorf("%s: read back %v, want %v", tc.name, got, tc.samples)
+		}
+	}
+
+	want := map[chunkenc.Encoding]int{chunkenc.EncXOR: 2, chunkenc.EncDelta: 2}
+	if got := h.Stats().Encodings; !reflect.DeepEqual(got, want) {
+		t.Errorf("stats report encodings %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,100 @@
+package head
+
+import (
+	"errors"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// ErrOutOfOrderExemplar is returned for exemplars older than the newest
+// exemplar stored for their series.
+var ErrOutOfOrderExemplar = errors.New("head: out of order exemplar")
+
+// ErrUnknownSeries is returned when a series reference does not belong to
+// any series of the head.
+var ErrUnknownSeries = errors.New("head: unknown series reference")
+
+// defaultMaxExemplars is the default size of the per series exemplar buffer
+const defaultMaxExemplars = 10
+
+// AppendExemplar stores an exemplar for an existing series. Only the most
+// recent exemplars of each series are kept, see Options.MaxExemplarsPerSeries.
+func (h *Head) AppendExemplar(ref uint64, e prompb.Exemplar) error {
+	s := h.Series(ref)
+	if s == nil {
+		return ErrUnknownSeries
+	}
+	if h.maxExemplars <= 0 {
+		return nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.deleted {
+		return ErrUnknownSeries
+	}
+
+	// Validate before logging so rejected exemplars are not replayed
+	if last, ok := s.exemplars.last(); ok && e.Timestamp < last.Timestamp {
+		return ErrOutOfOrderExemplar
+	}
+	if err := h.wal.LogExemplars([]uint64{ref}, []prompb.Exemplar{e}); err != nil {
+		return err
+	}
+	return h.appendExemplar(s, e)
+}
+
+// appendExemplar adds an exemplar to the buffer of a locked series
+func (h *Head) appendExemplar(s *memSeries, e prompb.Exemplar) error {
+	if last, ok := s.exemplars.last(); ok {
+		if e.Timestamp < last.Timestamp {
+			return ErrOutOfOrderExemplar
+		}
+		// Retried writes repeat the newest exemplar
+		if e.Timestamp == last.Timestamp && e.Value == last.Value {
+			return nil
+		}
+	}
+	s.exemplars.add(e, h.maxExemplars)
+	return nil
+}
+
+// exemplarRing keeps the most recent exemplars of a series
+type exemplarRing struct {
+	buf  []prompb.Exemplar
+	next int // slot overwritten next once buf is full
+}
+
+// add stores an exemplar, evicting the oldest one if max are stored
+func (r *exemplarRing) add(e prompb.Exemplar, max int) {
+	if len(r.buf) < max {
+		r.buf = append(r.buf, e)
+		return
+	}
+	r.buf[r.next] = e
+	r.next = (r.next + 1) % len(r.buf)
+}
+
+// last returns the newest exemplar
+func (r *exemplarRing) last() (prompb.Exemplar, bool) {
+	if len(r.buf) == 0 {
+		return prompb.Exemplar{}, false
+	}
+	i := r.next - 1
+	if i < 0 {
+		i = len(r.buf) - 1
+	}
+	return r.buf[i], true
+}
+
+// between returns a copy of the exemplars in [mint, maxt], oldest first
+func (r *exemplarRing) between(mint, maxt int64) []prompb.Exemplar {
+	var res []prompb.Exemplar
+	for i := range r.buf {
+		e := r.buf[(r.next+i)%len(r.buf)]
+		if e.Timestamp >= mint && e.Timestamp <= maxt {
+			res = append(res, e)
+		}
+	}
+	return res
+}
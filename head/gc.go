@@ -0,0 +1,84 @@
+package head
+
+import "sync/atomic"
+
+// gc removes the series left without samples by truncation, compaction or
+// deletion from the head and its index, and returns how many it removed.
+// Appenders that looked up a removed series before gc locked it see it
+// marked deleted and create it anew.
+func (h *Head) gc() int {
+	removed := 0
+	for _, st := range h.stripes {
+		st.Lock()
+		for _, s := range st.series {
+			s.Lock()
+			if s.empty() {
+				s.deleted = true
+				h.deleteSeries(st, s)
+				removed++
+			}
+			s.Unlock()
+		}
+		st.Unlock()
+	}
+	atomic.AddUint64(&h.seriesRemoved, uint64(removed))
+	return removed
+}
+
+// evictStale removes the series that got no appends for longer than the
+// stale series timeout, even if they hold samples, and returns how many it
+// removed. Like gc it logs nothing to the WAL.
+func (h *Head) evictStale() int {
+	if h.staleTimeout <= 0 {
+		return 0
+	}
+	cutoff := h.now().Add(-h.staleTimeout).UnixMilli()
+
+	removed := 0
+	for _, st := range h.stripes {
+		st.Lock()
+		for _, s := range st.series {
+			s.Lock()
+			if s.lastAppend < cutoff {
+				s.deleted = true
+				h.deleteSeries(st, s)
+				removed++
+			}
+			s.Unlock()
+		}
+		st.Unlock()
+	}
+	atomic.AddUint64(&h.seriesRemoved, uint64(removed))
+	return removed
+}
+
+// empty reports whether a locked series holds no samples that are not
+// covered by its tombstones
+func (s *memSeries) empty() bool {
+	for _, c := range s.chunks {
+		if !covered(c.minTime, c.maxTime, s.tombstones) {
+			return false
+		}
+	}
+	for _, c := range []*memChunk{s.chunk, s.ooo} {
+		if len(c.samples) > 0 && !covered(c.minTime, c.maxTime, s.tombstones) {
+			return false
+		}
+	}
+	for _, c := range s.histograms {
+		if !covered(c.minTime, c.maxTime, s.tombstones) {
+			return false
+		}
+	}
+	return true
+}
+
+// covered reports whether [mint, maxt] lies within one of the intervals
+func covered(mint, maxt int64, ivs []Interval) bool {
+	for _, iv := range ivs {
+		if iv.contains(mint) && iv.contains(maxt) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package head
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// TestGCDeleted checks that gc removes a series whose samples are all
+// deleted, and that appending to it afterwards creates it anew
+func TestGCDeleted(t *testing.T) {
+	h := newTestHead(t, Options{})
+	a := labels.FromStrings(labels.MetricName, "a")
+	b := labels.FromStrings(labels.MetricName, "b")
+	mustAppend(t, h, a, samplesAt(1, 100, 1)...)
+	mustAppend(t, h, b, samplesAt(1, 100, 1)...)
+
+	if err := h.Delete(0, 50, labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Delete(0, 100, labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "b")); err != nil {
+		t.Fatal(err)
+	}
+	ref, _ := h.GetRef(b)
+	old := h.Series(ref)
+	if n := h.gc(); n != 1 {
+		t.Fatalf("gc removed %d series, want 1", n)
+	}
+	_, okA := h.GetRef(a)
+	if _, okB := h.GetRef(b); okB || !okA {
+		t.Fatal("gc did not remove exactly the fully deleted series")
+	}
+	if !old.deleted {
+		t.Fatal("removed series is not marked deleted")
+	}
+	if st := h.Stats(); st.NumSeries != 1 || st.SeriesRemoved != 1 {
+		t.Fatalf("stats report %d series and %d removed, want 1 and 1", st.NumSeries, st.SeriesRemoved)
+	}
+
+	mustAppend(t, h, b, prompb.Sample{Timestamp: 200, Value: 1})
+	if ref, ok := h.GetRef(b); !ok || h.Series(ref) == old {
+		t.Fatal("append after gc did not create the series anew")
+	}
+	if n := h.gc(); n != 0 {
+		t.Fatalf("second gc removed %d series, want 0", n)
+	}
+}
@@ -1,34 +1,154 @@
 package head
 
 import (
+	"errors"
+	"log/slog"
 	"math"
+	"path/filepath"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
 	"github.com/prometheus/prometheus/prompb"
+	"github.com/yuanhuiqu/protsdb/chunkenc"
 	"github.com/yuanhuiqu/protsdb/wal"
 )
 
+// ErrOutOfBounds is returned when a sample is older than the out-of-order
+// window of its series allows.
+var ErrOutOfBounds = errors.New("head: sample out of bounds")
+
+// ErrDuplicateSample is returned when a sample has the same timestamp as a
+// stored sample of the series but a different value.
+var ErrDuplicateSample = errors.New("head: duplicate sample for timestamp")
+
+// ErrTooManySeries is returned when creating a series would exceed the
+// series limit of the head.
+var ErrTooManySeries = errors.New("head: too many series")
+
+// ErrSeriesFull is returned when a series already holds as many samples as
+// the per-series sample limit of the head allows.
+var ErrSeriesFull = errors.New("head: series sample limit reached")
+
+// ErrReadOnly is returned for writes to a head opened with Options.ReadOnly,
+// it is the WAL's error of the same name
+var ErrReadOnly = wal.ErrReadOnly
+
+// ErrEmptyLabels is returned for appends to a series without labels, it is
+// the WAL's error of the same name
+var ErrEmptyLabels = wal.ErrEmptyLabels
+
+// ErrMissingMetricName is returned for appends to a series without a
+// __name__ label, unless Options.AllowNamelessSeries is set.
+var ErrMissingMetricName = errors.New("head: series without metric name")
+
+// ErrUnsortedLabels is returned for appends whose labels are not sorted by
+// name if Options.RejectUnsortedLabels is set.
+var ErrUnsortedLabels = errors.New("head: labels not sorted by name")
+
 // Head represents the in-memory state of the storage engine.
 // It holds the most recent data in memory and not yet compacted to disk.
 type Head struct {
-	// Protects concurrent access
+	// Protects the blocks and the closed state, series are guarded by the
+	// lock of their stripe
 	mtx sync.RWMutex
 
-	// All series in memory by their ref
-	series map[uint64]*memSeries
+	// Series sharded by label hash, and by reference for lookups by ref
+	stripes    []*seriesStripe
+	refStripes []*refStripe
+
+	// Number of series, plus those being created under the series limit,
+	// accessed atomically
+	numSeries int64
+
+	// Assigns references to new series
+	refs RefAllocator
 
-	// Reference counter for generating unique series references
-	lastRef uint64
+	// Label names and values shared by the series, replaced with the stripes
+	intern *interner
 
 	// WAL for durability
-	wal *wal.WAL
+	wal      *wal.WAL
+	walDir   string
+	walSync  wal.SyncPolicy
+	walComp  bool
+	walSeg   int64 // WAL segment size, 0 for the WAL's default
+	prealloc bool  // create WAL segments at their full size
+	walHooks wal.Hooks
+	noWAL    bool // Options.DisableWAL, h.wal stays nil
+	repair   bool // repair a corrupt WAL instead of failing to open
+	verify   bool // read back all WAL records before replaying them
+
+	readOnly bool // opened for queries only, see Options.ReadOnly
+	closed   bool // set by Close, cleared by Reopen
+
+	// Persisted blocks, ordered by time, and the compactor writing them
+	blocks    []*Block
+	blockDir  string
+	compactor *Compactor
+
+	// Samples before this time were compacted into blocks and are rejected,
+	// accessed atomically
+	minValidTime int64
 
-	// Time bounds and limits
-	minTime   int64 // Minimum time of any sample in the head
-	maxTime   int64 // Maximum time of any sample in the head
+	// Time bounds, accessed atomically as appends to different series only
+	// hold their own series lock
+	minTime int64 // Minimum time of any sample in the head
+	maxTime int64 // Maximum time of any sample in the head
+
+	// Samples accepted by appends since the head was created, accessed atomically
+	samplesAppended uint64
+
+	// Series created by appends and removed by gc or eviction since the
+	// head was created, accessed atomically
+	seriesCreated uint64
+	seriesRemoved uint64
+
+	// Append-time validation, and the samples it or the per-series sample
+	// limit rejected by reason, accessed atomically
+	validate        bool
+	futureTolerance int64 // How far in milliseconds samples may be ahead of the clock
+	requireName     bool  // Series must have a __name__ label
+	rejectUnsorted  bool  // Unsorted labels fail appends rather than being sorted
+	rejected        [numRejectReasons]uint64
+
+	// Limits
 	chunkSize int   // Target size in samples of each chunk
+	chunkSpan int64 // Time in milliseconds a chunk may span, 0 is unlimited
+	oooWindow int64 // How far in milliseconds samples may lag behind their series
+	compress  bool  // Whether completed chunks are XOR compressed
+
+	// Exemplars kept per series, 0 or less disables them
+	maxExemplars int
+
+	// Series the head may hold before appends of new series fail, 0 is unlimited
+	maxSeries int
+
+	// Samples a series may hold before appends to it fail, 0 is unlimited
+	maxSeriesSamples int
+
+	// Ingest-time timestamp handling
+	tsResolution int64           // Truncation step in milliseconds, 0 disables it
+	dupPolicy    DuplicatePolicy // Which sample wins when timestamps collide
+
+	// Metadata by metric family name, last write wins
+	metaMtx  sync.RWMutex
+	metadata map[string]prompb.MetricMetadata
+
+	// Background WAL maintenance, see StartMaintenance
+	maintInterval time.Duration
+	staleTimeout  time.Duration // evict series without appends for this long, 0 never does
+	maintMtx      sync.Mutex
+	maintStop     chan struct{} // closed to stop the loop, nil if not running
+	maintDone     chan struct{} // closed once the loop exited
+
+	// Clock and distribution of the ingest time to sample time difference
+	now        func() time.Time
+	lateSkew   *histogram
+	futureSkew *histogram
 }
 
 // memSeries represents a single time series in memory
@@ -36,24 +156,166 @@ type memSeries struct {
 	sync.RWMutex
 
 	// Immutable fields
-	ref   uint64        // unique series reference
-	lset  labels.Labels // series labels
-	chunk *memChunk     // current chunk being written to
+	ref  uint64        // unique series reference
+	lset labels.Labels // series labels
+
+	// Sample data, guarded by the series lock
+	chunks []*memChunk // completed chunks, oldest first
+	chunk  *memChunk   // current chunk being written to
+	ooo    *memChunk   // out-of-order samples, sorted by timestamp
+
+	// Native histogram chunks, oldest first, the last one is written to
+	histograms []*histChunk
+
+	// Most recent exemplars
+	exemplars exemplarRing
+
+	// Deleted time ranges, replaced rather than modified in place
+	tombstones []Interval
+
+	// Last client supplied sequence, only set for sequenced appends
+	lastSeq uint64
+
+	// Whether the newest in-order sample is a Prometheus staleness marker
+	stale bool
+
+	// Ingest time in milliseconds of the last sample appended or replayed,
+	// or of the creation of the series
+	lastAppend int64
+
+	// Samples and histograms held, recounted when chunks are dropped
+	numSamples int
+
+	// Encoding of completed chunks, chosen when the first one completes
+	encoding chunkenc.Encoding
+
+	// Set by gc once the series is removed from the head, appenders that
+	// looked it up before must look it up again
+	deleted bool
 }
 
 // memChunk holds sample data for a time series in memory
 type memChunk struct {
 	minTime int64           // First sample timestamp
 	maxTime int64           // Last sample timestamp
-	samples []prompb.Sample // Actual samples
+	samples []prompb.Sample // Actual samples, nil once compressed
+	data    chunkenc.Chunk  // Compressed samples of a completed chunk
 }
 
+// DuplicatePolicy decides what happens to a sample whose timestamp collapses
+// onto the timestamp of the previous sample in the same series.
+type DuplicatePolicy int
+
+const (
+	// DuplicateKeepLast overwrites the stored sample with the newer one
+	DuplicateKeepLast DuplicatePolicy = iota
+	// DuplicateKeepFirst keeps the stored sample and drops the newer one
+	DuplicateKeepFirst
+)
+
 // Options for configuring the head block
 type Options struct {
 	// ChunkSize is the number of samples per chunk
 	ChunkSize int
+	// MaxChunkDuration also starts a new chunk once a sample would make the
+	// current one span more than this, so chunks of slow series don't
+	// cover hours while those of fast ones rotate within seconds
+	// (default 2h, negative disables it)
+	MaxChunkDuration time.Duration
 	// WALDir is the directory to store WAL files
 	WALDir string
+	// WALSyncPolicy decides when WAL records are fsynced, trading
+	// durability for ingestion throughput (default wal.SyncAlways)
+	WALSyncPolicy wal.SyncPolicy
+	// WALCompression snappy compresses WAL records
+	WALCompression bool
+	// WALSegmentSize is the size WAL segments are rotated at (default 128MB)
+	WALSegmentSize int64
+	// WALPreallocate creates WAL segments at their full size up front
+	// rather than growing them with every record
+	WALPreallocate bool
+	// WALHooks are called on WAL segment creation and checkpoints
+	WALHooks wal.Hooks
+	// DisableWAL keeps the head in memory only, e.g. for tests and
+	// throwaway ingestion benchmarks. No WAL is created, appends write
+	// nothing to disk and everything is lost on Close. The other WAL
+	// options are ignored.
+	DisableWAL bool
+	// RepairWAL repairs the WAL with WAL.Repair if its replay hits a
+	// corrupt record, dropping that record and everything logged after it,
+	// instead of failing to open the head
+	RepairWAL bool
+	// VerifyWAL reads back every WAL record before the replay, failing to
+	// open on the first corrupt one. With RepairWAL the replay finds and
+	// repairs the corruption instead.
+	VerifyWAL bool
+	// ReadOnly opens the WAL and blocks of an existing data directory for
+	// queries only, e.g. for tools inspecting a copy of it. Nothing on disk
+	// is modified, writes fail with ErrReadOnly and there is no maintenance.
+	ReadOnly bool
+	// BlockDir is the directory compacted blocks are written to (default
+	// "blocks" next to WALDir)
+	BlockDir string
+	// TimestampResolution truncates sample timestamps to a multiple of the
+	// given duration at ingest. Zero (or anything below 1ms) keeps the raw timestamps.
+	TimestampResolution time.Duration
+	// DuplicatePolicy coalesces samples that truncate to the same timestamp
+	DuplicatePolicy DuplicatePolicy
+	// OutOfOrderWindow is how far a sample may be older than the newest
+	// sample of its series. Such samples are kept in a separate out-of-order
+	// chunk, older ones fail with ErrOutOfBounds. Zero rejects all of them.
+	OutOfOrderWindow time.Duration
+	// SkewBuckets are the histogram buckets in seconds for ingest skew
+	// (default DefaultSkewBuckets)
+	SkewBuckets []float64
+	// Now is the clock used at ingest (default time.Now)
+	Now func() time.Time
+	// RefAllocator assigns series references (default IncrementingRefs)
+	RefAllocator RefAllocator
+	// MaxExemplarsPerSeries is how many of the most recent exemplars are
+	// kept per series (default 10, negative disables exemplar storage)
+	MaxExemplarsPerSeries int
+	// MaxSeries is the number of series the head may hold. Appends that
+	// would create another series fail with ErrTooManySeries, existing series
+	// keep accepting samples. Zero is unlimited.
+	MaxSeries int
+	// MaxSamplesPerSeries is the number of samples and histograms a series
+	// may hold in memory. Appends beyond it fail with ErrSeriesFull until
+	// compaction or truncation drained the series, which keeps a single
+	// flooded series from growing without bound when compaction is
+	// disabled. Zero is unlimited.
+	MaxSamplesPerSeries int
+	// StripeCount is the number of stripes the series and their index are
+	// sharded into by label hash, appends creating or looking up series of
+	// different stripes don't contend (default 16)
+	StripeCount int
+	// MaintenanceInterval is how often the loop started by StartMaintenance
+	// checkpoints and cleans the WAL (default 1m)
+	MaintenanceInterval time.Duration
+	// StaleSeriesTimeout makes the maintenance loop evict series that got
+	// no appends for this long, with their samples, so series of departed
+	// targets don't pile up in memory. Nothing is logged to the WAL for
+	// them, a restart replays those the WAL still holds and they age out
+	// again. Zero disables it.
+	StaleSeriesTimeout time.Duration
+	// DisableCompression keeps completed chunks as raw samples instead of
+	// XOR compressing them, trading memory for cheaper reads
+	DisableCompression bool
+	// DisableValidation stores samples appends would otherwise reject with
+	// ErrInvalidValue, ErrInvalidTimestamp or ErrTooFarInFuture, e.g. for
+	// users storing NaN on purpose
+	DisableValidation bool
+	// AllowNamelessSeries accepts series without a __name__ label, for
+	// users storing such series on purpose. Series without any label are
+	// always rejected with ErrEmptyLabels.
+	AllowNamelessSeries bool
+	// RejectUnsortedLabels fails appends whose labels are not sorted by
+	// name with ErrUnsortedLabels. By default they are sorted, as series are
+	// looked up by their sorted labels.
+	RejectUnsortedLabels bool
+	// FutureTolerance is how far ahead of the clock sample timestamps may
+	// be (default 10m)
+	FutureTolerance time.Duration
 }
 
 // NewHead creates a new head block
@@ -61,81 +323,385 @@ func NewHead(opts Options) (*Head, error) {
 	if opts.ChunkSize == 0 {
 		opts.ChunkSize = 120
 	}
+	if opts.MaxChunkDuration == 0 {
+		opts.MaxChunkDuration = defaultMaxChunkDuration
+	}
+	if opts.SkewBuckets == nil {
+		opts.SkewBuckets = DefaultSkewBuckets
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	if opts.RefAllocator == nil {
+		opts.RefAllocator = &IncrementingRefs{}
+	}
+	if opts.MaxExemplarsPerSeries == 0 {
+		opts.MaxExemplarsPerSeries = defaultMaxExemplars
+	}
+	if opts.StripeCount <= 0 {
+		opts.StripeCount = defaultStripeCount
+	}
+	if opts.MaintenanceInterval == 0 {
+		opts.MaintenanceInterval = defaultMaintenanceInterval
+	}
+	if opts.FutureTolerance == 0 {
+		opts.FutureTolerance = defaultFutureTolerance
+	}
+	if opts.BlockDir == "" {
+		opts.BlockDir = filepath.Join(filepath.Dir(opts.WALDir), "blocks")
+	}
 
-	// Initialize WAL
-	w, err := wal.New(wal.Options{
-		Dir:         opts.WALDir,
-		SegmentSize: 128 * 1024 * 1024, // 128MB segments
-	})
-	if err != nil {
+	h := &Head{
+		walDir:       opts.WALDir,
+		walSync:      opts.WALSyncPolicy,
+		walComp:      opts.WALCompression,
+		walSeg:       opts.WALSegmentSize,
+		prealloc:     opts.WALPreallocate,
+		walHooks:     opts.WALHooks,
+		noWAL:        opts.DisableWAL,
+		repair:       opts.RepairWAL,
+		verify:       opts.VerifyWAL,
+		readOnly:     opts.ReadOnly,
+		blockDir:     opts.BlockDir,
+		compactor:    NewCompactor(opts.BlockDir, opts.ChunkSize),
+		chunkSize:    opts.ChunkSize,
+		chunkSpan:    max(opts.MaxChunkDuration.Milliseconds(), 0),
+		oooWindow:    opts.OutOfOrderWindow.Milliseconds(),
+		compress:     !opts.DisableCompression && opts.ChunkSize <= math.MaxUint16,
+		tsResolution: opts.TimestampResolution.Milliseconds(),
+		dupPolicy:    opts.DuplicatePolicy,
+		maxExemplars: opts.MaxExemplarsPerSeries,
+		maxSeries:    opts.MaxSeries,
+		now:          opts.Now,
+		refs:         opts.RefAllocator,
+		lateSkew:     newHistogram(opts.SkewBuckets),
+		futureSkew:   newHistogram(opts.SkewBuckets),
+		stripes:      make([]*seriesStripe, opts.StripeCount),
+		refStripes:   make([]*refStripe, opts.StripeCount),
+
+		maintInterval:    opts.MaintenanceInterval,
+		staleTimeout:     max(opts.StaleSeriesTimeout, 0),
+		maxSeriesSamples: max(opts.MaxSamplesPerSeries, 0),
+		validate:         !opts.DisableValidation,
+		requireName:      !opts.AllowNamelessSeries,
+		rejectUnsorted:   opts.RejectUnsortedLabels,
+		futureTolerance:  opts.FutureTolerance.Milliseconds(),
+	}
+	if err := h.open(); err != nil {
 		return nil, err
 	}
+	return h, nil
+}
+
+// open loads the persisted blocks, opens the WAL and rebuilds the
+// in-memory state from it
+func (h *Head) open() error {
+	blocks, err := openBlocks(h.blockDir, h.readOnly)
+	if err != nil {
+		return err
+	}
+	minValid := int64(math.MinInt64)
+	for _, b := range blocks {
+		if b.meta.MaxTime >= minValid {
+			minValid = b.meta.MaxTime + 1
+		}
+	}
+
+	// Without a WAL h.wal stays nil, which discards all writes
+	var w *wal.WAL
+	if !h.noWAL {
+		w, err = wal.New(wal.Options{
+			Dir:         h.walDir,
+			SegmentSize: h.walSeg,
+			SyncPolicy:  h.walSync,
+			Compress:    h.walComp,
+			Preallocate: h.prealloc,
+			Hooks:       h.walHooks,
+			Verify:      h.verify && !h.repair,
+			ReadOnly:    h.readOnly,
+		})
+		if err != nil {
+			closeBlocks(blocks)
+			return err
+		}
+	}
+
+	// The checkpoint file outlives the segments holding checkpoint records
+	if maxt := w.CheckpointTime(); maxt != math.MinInt64 && maxt >= minValid {
+		minValid = maxt + 1
+	}
+
+	h.wal = w
+	h.blocks = blocks
+	atomic.StoreInt64(&h.minValidTime, minValid)
+	h.resetState()
+
+	// Samples already in blocks are skipped by the replay
+	err = h.replay()
+	var corrupt *wal.CorruptionError
+	if err != nil && h.repair && !h.readOnly && errors.As(err, &corrupt) {
+		slog.Warn("WAL replay failed on a corrupt record, repairing the WAL", "err", err)
+		if err = w.Repair(); err == nil {
+			h.resetState()
+			err = h.replay()
+		}
+	}
+	if err != nil {
+		w.Close()
+		closeBlocks(blocks)
+		return err
+	}
+	h.closed = false
+	return nil
+}
 
-	return &Head{
-		series:    make(map[uint64]*memSeries),
-		wal:       w,
-		chunkSize: opts.ChunkSize,
-		minTime:   math.MaxInt64,
-		maxTime:   math.MinInt64,
-	}, nil
+// truncate rounds a millisecond timestamp down to the configured resolution
+func (h *Head) truncate(t int64) int64 {
+	if h.tsResolution <= 1 {
+		return t
+	}
+	r := t % h.tsResolution
+	if r < 0 {
+		r += h.tsResolution
+	}
+	return t - r
 }
 
-// getOrCreate returns a series for the given labels, creating a new one if necessary
-func (h *Head) getOrCreate(l labels.Labels) (*memSeries, error) {
-	h.mtx.Lock()
-	defer h.mtx.Unlock()
+// resetState drops all series, metadata and time bounds before a replay
+func (h *Head) resetState() {
+	h.resetStripes()
+	h.metadata = make(map[string]prompb.MetricMetadata)
+	atomic.StoreInt64(&h.minTime, math.MaxInt64)
+	atomic.StoreInt64(&h.maxTime, math.MinInt64)
+}
 
-	// First try to find an existing series
-	for _, s := range h.series {
-		if labels.Equal(s.lset, l) {
-			return s, nil
+// getOrCreate returns a series for the given labels, creating a new one if
+// necessary. created reports whether it did.
+func (h *Head) getOrCreate(l labels.Labels) (s *memSeries, created bool, err error) {
+	if l, err = h.sortLabels(l); err != nil {
+		return nil, false, err
+	}
+	if err := h.checkLabels(l); err != nil {
+		return nil, false, err
+	}
+	st := h.stripe(l.Hash())
+	st.Lock()
+	defer st.Unlock()
+
+	if s := st.lookup(l); s != nil {
+		return s, false, nil
+	}
+	if h.readOnly {
+		return nil, false, ErrReadOnly
+	}
+
+	// Reserve a slot for the new series first, so creations in other
+	// stripes can't exceed the limit together
+	if h.maxSeries > 0 {
+		if atomic.AddInt64(&h.numSeries, 1) > int64(h.maxSeries) {
+			atomic.AddInt64(&h.numSeries, -1)
+			return nil, false, ErrTooManySeries
 		}
+		defer atomic.AddInt64(&h.numSeries, -1)
 	}
 
-	// Create new series with atomic reference generation
-	ref := atomic.AddUint64(&h.lastRef, 1)
-	s := &memSeries{
-		ref:   ref,
-		lset:  l,
-		chunk: &memChunk{},
+	s, err = h.createSeries(st, l)
+	if err != nil {
+		return nil, false, err
 	}
-	h.series[ref] = s
 
-	// Log series creation to WAL
-	if err := h.wal.LogSeries(l); err != nil {
-		return nil, err
+	// Log series creation to WAL, a series that could not be logged must
+	// not take samples whose replay would not find it
+	if err := h.wal.LogSeries(s.ref, l); err != nil {
+		h.deleteSeries(st, s)
+		return nil, false, err
 	}
 
-	return s, nil
+	atomic.AddUint64(&h.seriesCreated, 1)
+	return s, true, nil
 }
 
-// Append adds a new sample to a series
-func (h *Head) Append(l labels.Labels, sample prompb.Sample) error {
-	// First log the sample to WAL
-	if err := h.wal.LogSample(l, sample); err != nil {
-		return err
+// SeriesCreated returns the number of series appends created since the
+// head was opened. It is cheap to call, unlike Stats.
+func (h *Head) SeriesCreated() uint64 {
+	return atomic.LoadUint64(&h.seriesCreated)
+}
+
+// lockSeries returns the series for the given labels, created if necessary,
+// with its lock held. A series removed by gc between the lookup and the lock
+// is looked up again, so no sample lands in a series gone from the head.
+func (h *Head) lockSeries(l labels.Labels) (*memSeries, error) {
+	for {
+		s, _, err := h.getOrCreate(l)
+		if err != nil {
+			return nil, err
+		}
+		s.Lock()
+		if !s.deleted {
+			return s, nil
+		}
+		s.Unlock()
 	}
+}
+
+// createSeries registers a new series under a reference from the allocator
+// without writing to the WAL. The caller must hold the stripe lock of the
+// labels.
+func (h *Head) createSeries(st *seriesStripe, l labels.Labels) (*memSeries, error) {
+	return h.newSeries(st, h.refs.NextRef(l), l)
+}
 
-	// Then append to memory
-	s, err := h.getOrCreate(l)
+// Append adds a new sample to a series. The WAL only receives what the head
+// accepts: a series is logged once it was created within the series limit,
+// and a sample once it passed validation and its series exists and accepts
+// it, before it becomes visible to queries.
+func (h *Head) Append(l labels.Labels, sample prompb.Sample) error {
+	_, err := h.AppendRef(l, sample)
+	return err
+}
+
+// AppendRef is Append returning the reference of the series, for appending
+// its next samples with AppendWithRef. The reference is returned along with
+// the error if the series exists but rejected the sample.
+func (h *Head) AppendRef(l labels.Labels, sample prompb.Sample) (uint64, error) {
+	if err := h.validateSample(sample); err != nil {
+		return 0, err
+	}
+	// The series record must precede the samples referencing it
+	s, err := h.lockSeries(l)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer s.Unlock()
+	return s.ref, h.appendLocked(s, sample)
+}
 
+// AppendWithRef adds a new sample to the series with the given reference,
+// as returned by AppendRef or GetRef, sparing the label lookup of Append for callers
+// appending many samples to the same series. It fails with
+// ErrUnknownSeries if there is no such series, e.g. because it was removed
+// for holding no samples, in which case the caller falls back to Append.
+func (h *Head) AppendWithRef(ref uint64, sample prompb.Sample) error {
+	if err := h.validateSample(sample); err != nil {
+		return err
+	}
+	s := h.Series(ref)
+	if s == nil {
+		return ErrUnknownSeries
+	}
 	s.Lock()
 	defer s.Unlock()
+	if s.deleted {
+		return ErrUnknownSeries
+	}
+	return h.appendLocked(s, sample)
+}
+
+// appendLocked logs a sample and adds it to a locked series. Samples the
+// series rejects are not logged, so the replay never sees them.
+func (h *Head) appendLocked(s *memSeries, sample prompb.Sample) error {
+	sample.Timestamp = h.truncate(sample.Timestamp)
+	if err := h.checkSample(s, sample); err != nil {
+		return err
+	}
+	// Nothing to log or count for a sample the series drops
+	if h.keepsFirst(s, sample) {
+		return nil
+	}
+
+	// Log the sample to WAL before it becomes visible
+	if err := h.wal.LogSample(s.ref, sample); err != nil {
+		return err
+	}
+
+	h.observeSkew(sample.Timestamp)
+
+	if err := h.appendSample(s, sample); err != nil {
+		return err
+	}
+	atomic.AddUint64(&h.samplesAppended, 1)
+	return nil
+}
+
+// checkSample returns the error appendSample rejects a sample with, without
+// modifying the locked series
+func (h *Head) checkSample(s *memSeries, sample prompb.Sample) error {
+	// Compacted ranges are immutable
+	if sample.Timestamp < atomic.LoadInt64(&h.minValidTime) {
+		return ErrOutOfBounds
+	}
+	if err := h.checkSeriesFull(s, 1); err != nil {
+		return err
+	}
+
+	n := len(s.chunk.samples)
+	switch {
+	case n == 0 || sample.Timestamp > s.chunk.maxTime:
+		return nil
+	case sample.Timestamp == s.chunk.maxTime:
+		// Samples that truncated onto the previous timestamp are coalesced
+		if h.tsResolution > 1 {
+			return nil
+		}
+		// A repeated timestamp is fine as long as the value is the same,
+		// which happens when remote write retries a request
+		return checkDuplicate(s.chunk.samples[n-1], sample)
+	}
+
+	// Late samples go into the out-of-order chunk if they are within the window
+	if sample.Timestamp < s.chunk.maxTime-h.oooWindow {
+		return ErrOutOfBounds
+	}
+	if prev, ok := s.ooo.at(sample.Timestamp); ok {
+		return checkDuplicate(prev, sample)
+	}
+	return nil
+}
+
+// keepsFirst reports whether appendSample drops a sample because it was
+// coalesced onto the newest sample of a locked series, which
+// DuplicateKeepFirst keeps
+func (h *Head) keepsFirst(s *memSeries, sample prompb.Sample) bool {
+	return h.tsResolution > 1 && h.dupPolicy == DuplicateKeepFirst &&
+		len(s.chunk.samples) > 0 && sample.Timestamp == s.chunk.maxTime
+}
 
-	// Update time bounds
-	if sample.Timestamp < h.minTime {
-		h.minTime = sample.Timestamp
+// appendSample adds a sample to the in-memory chunks of a locked series
+func (h *Head) appendSample(s *memSeries, sample prompb.Sample) error {
+	if err := h.checkSample(s, sample); err != nil {
+		return err
 	}
-	if sample.Timestamp > h.maxTime {
-		h.maxTime = sample.Timestamp
+
+	// What checkSample let through at or before the newest sample is a
+	// late sample, a coalesced sample or a retried duplicate
+	if n := len(s.chunk.samples); n > 0 && sample.Timestamp <= s.chunk.maxTime {
+		switch {
+		case sample.Timestamp < s.chunk.maxTime:
+			if _, ok := s.ooo.at(sample.Timestamp); !ok {
+				s.ooo.insert(sample)
+				s.numSamples++
+				h.updateMinTime(sample.Timestamp)
+			}
+		case h.tsResolution > 1 && h.dupPolicy == DuplicateKeepLast:
+			s.chunk.replaceLast(sample)
+		}
+		return nil
 	}
 
+	h.updateMinTime(sample.Timestamp)
+	h.updateMaxTime(sample.Timestamp)
+	s.lastAppend = h.now().UnixMilli()
+
 	// Check if we need to create a new chunk
-	if len(s.chunk.samples) >= h.chunkSize {
-		// Create new chunk
+	if h.chunkFull(len(s.chunk.samples), s.chunk.minTime, sample.Timestamp) {
+		// Keep the full chunk around and start a new one
+		if h.compress {
+			if s.encoding == chunkenc.EncNone {
+				s.encoding = h.chooseEncoding(s)
+			}
+			s.chunk.compress(s.encoding)
+		}
+		s.chunks = append(s.chunks, s.chunk)
 		s.chunk = &memChunk{
 			minTime: sample.Timestamp,
 			maxTime: sample.Timestamp,
@@ -143,20 +709,230 @@ func (h *Head) Append(l labels.Labels, sample prompb.Sample) error {
 	}
 
 	// Append sample
+	if len(s.chunk.samples) == 0 {
+		s.chunk.minTime = sample.Timestamp
+	}
 	s.chunk.samples = append(s.chunk.samples, sample)
 	s.chunk.maxTime = sample.Timestamp
+	s.numSamples++
+
+	// A staleness marker ends the series until the next real sample
+	s.stale = value.IsStaleNaN(sample.Value)
 
 	return nil
 }
 
+// defaultMaxChunkDuration is the default time a chunk may span
+const defaultMaxChunkDuration = 2 * time.Hour
+
+// chunkFull reports whether a chunk of n samples starting at mint is
+// completed before a sample at t is appended, because it reached the chunk
+// size or t lies too far after its first sample
+func (h *Head) chunkFull(n int, mint, t int64) bool {
+	if n >= h.chunkSize {
+		return true
+	}
+	return n > 0 && h.chunkSpan > 0 && t-mint > h.chunkSpan
+}
+
+// updateMinTime lowers the head's minTime to t if t is older
+func (h *Head) updateMinTime(t int64) {
+	for {
+		cur := atomic.LoadInt64(&h.minTime)
+		if t >= cur || atomic.CompareAndSwapInt64(&h.minTime, cur, t) {
+			return
+		}
+	}
+}
+
+// updateMaxTime raises the head's maxTime to t if t is newer
+func (h *Head) updateMaxTime(t int64) {
+	for {
+		cur := atomic.LoadInt64(&h.maxTime)
+		if t <= cur || atomic.CompareAndSwapInt64(&h.maxTime, cur, t) {
+			return
+		}
+	}
+}
+
+// MinTime returns the oldest sample timestamp in the head, math.MaxInt64
+// if it is empty
+func (h *Head) MinTime() int64 { return atomic.LoadInt64(&h.minTime) }
+
+// MaxTime returns the newest sample timestamp in the head, math.MinInt64
+// if it is empty
+func (h *Head) MaxTime() int64 { return atomic.LoadInt64(&h.maxTime) }
+
+// compress encodes the samples of a completed chunk and releases them
+func (c *memChunk) compress(enc chunkenc.Encoding) {
+	c.data = encodeChunk(enc, c.samples)
+	c.samples = nil
+}
+
+// chooseEncoding picks the encoding of a series' completed chunks from the
+// type of its metric family, falling back to delta encoding if the samples
+// of its first chunk never decrease and XOR otherwise. The series must be
+// locked.
+func (h *Head) chooseEncoding(s *memSeries) chunkenc.Encoding {
+	h.metaMtx.RLock()
+	md, ok := h.metadata[s.lset.Get(labels.MetricName)]
+	h.metaMtx.RUnlock()
+	if ok {
+		switch md.Type {
+		case prompb.MetricMetadata_COUNTER:
+			return chunkenc.EncDelta
+		case prompb.MetricMetadata_GAUGE:
+			return chunkenc.EncXOR
+		}
+	}
+
+	if isMonotonic(s.chunk.samples) {
+		return chunkenc.EncDelta
+	}
+	return chunkenc.EncXOR
+}
+
+// isMonotonic reports whether sample values never decrease, not counting
+// staleness markers
+func isMonotonic(samples []prompb.Sample) bool {
+	prev := math.Inf(-1)
+	for _, s := range samples {
+		if value.IsStaleNaN(s.Value) {
+			continue
+		}
+		if !(s.Value >= prev) {
+			return false
+		}
+		prev = s.Value
+	}
+	return true
+}
+
+// checkDuplicate compares a sample with a stored one of the same timestamp.
+// Values are compared bitwise so retried NaNs are recognized as well.
+func checkDuplicate(stored, sample prompb.Sample) error {
+	if math.Float64bits(stored.Value) != math.Float64bits(sample.Value) {
+		return ErrDuplicateSample
+	}
+	return nil
+}
+
+// at returns the sample with the given timestamp, if the chunk holds one
+func (c *memChunk) at(t int64) (prompb.Sample, bool) {
+	i := sort.Search(len(c.samples), func(i int) bool {
+		return c.samples[i].Timestamp >= t
+	})
+	if i < len(c.samples) && c.samples[i].Timestamp == t {
+		return c.samples[i], true
+	}
+	return prompb.Sample{}, false
+}
+
+// insert adds a sample at its position in timestamp order. The samples are
+// copied rather than shifted in place, as queries may still read the old slice.
+func (c *memChunk) insert(sample prompb.Sample) {
+	i := sort.Search(len(c.samples), func(i int) bool {
+		return c.samples[i].Timestamp > sample.Timestamp
+	})
+	samples := make([]prompb.Sample, 0, len(c.samples)+1)
+	samples = append(samples, c.samples[:i]...)
+	samples = append(samples, sample)
+	c.samples = append(samples, c.samples[i:]...)
+
+	c.minTime = c.samples[0].Timestamp
+	c.maxTime = c.samples[len(c.samples)-1].Timestamp
+}
+
+// replaceLast replaces the newest sample. Like insert, it copies the samples
+// rather than overwriting them in place, as queries may still read the old slice.
+func (c *memChunk) replaceLast(sample prompb.Sample) {
+	samples := make([]prompb.Sample, len(c.samples))
+	copy(samples, c.samples)
+	samples[len(samples)-1] = sample
+	c.samples = samples
+}
+
 // Series returns a series by its reference
 func (h *Head) Series(ref uint64) *memSeries {
+	rs := h.refStripe(ref)
+	rs.RLock()
+	defer rs.RUnlock()
+	return rs.series[ref]
+}
+
+// GetRef returns the reference of the series with the given labels
+func (h *Head) GetRef(l labels.Labels) (uint64, bool) {
+	l, err := h.sortLabels(l)
+	if err != nil {
+		return 0, false
+	}
+	st := h.stripe(l.Hash())
+	st.RLock()
+	defer st.RUnlock()
+	if s := st.lookup(l); s != nil {
+		return s.ref, true
+	}
+	return 0, false
+}
+
+// Close closes the head block, its WAL and the persisted blocks. The WAL
+// is checkpointed first and synced as it is closed, so everything appended
+// before survives a restart regardless of the sync policy.
+func (h *Head) Close() error {
+	h.stopMaintenance()
+
+	h.mtx.Lock()
+	if h.closed {
+		h.mtx.Unlock()
+		return nil
+	}
+	h.closed = true
+	blocks := h.blocks
+	h.blocks = nil
+	h.mtx.Unlock()
+
+	var err error
+	if !h.readOnly {
+		err = h.checkpointWAL()
+	}
+	if werr := h.wal.Close(); err == nil {
+		err = werr
+	}
+	if berr := closeBlocks(blocks); err == nil {
+		err = berr
+	}
+	return err
+}
+
+// FlushWAL makes everything appended so far durable, regardless of the WAL
+// sync policy, at the cost of an fsync. See wal.WAL.Flush.
+func (h *Head) FlushWAL() error {
+	return h.wal.Flush()
+}
+
+// Ready reports whether the head finished replaying its WAL and accepts
+// writes, which is not the case once it is closed until Reopen completes
+func (h *Head) Ready() bool {
 	h.mtx.RLock()
 	defer h.mtx.RUnlock()
-	return h.series[ref]
+	return !h.closed
 }
 
-// Close closes the head block and its WAL
-func (h *Head) Close() error {
-	return h.wal.Close()
+// Blocks returns the persisted blocks, ordered by time
+func (h *Head) Blocks() []*Block {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+	return append([]*Block(nil), h.blocks...)
+}
+
+// Reopen opens a closed head again, reloading the WAL and rebuilding the
+// in-memory state from it. It must not run concurrently with other calls.
+func (h *Head) Reopen() error {
+	h.mtx.RLock()
+	closed := h.closed
+	h.mtx.RUnlock()
+	if !closed {
+		return errors.New("head: reopen of a head that is not closed")
+	}
+	return h.open()
 }
@@ -0,0 +1,139 @@
+package head
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// newTestHead opens a head with a WAL in a temporary directory, unless
+// opts name one, and closes it when the test ends
+func newTestHead(t testing.TB, opts Options) *Head {
+	t.Helper()
+	if opts.WALDir == "" {
+		opts.WALDir = filepath.Join(t.TempDir(), "wal")
+	}
+	h, err := NewHead(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// reopenHead closes a head and opens a new one on the same WAL
+func reopenHead(t testing.TB, h *Head, opts Options) *Head {
+	t.Helper()
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	opts.WALDir = h.walDir
+	return newTestHead(t, opts)
+}
+
+// mustAppend appends float samples to a series, failing the test on error
+func mustAppend(t testing.TB, h *Head, l labels.Labels, samples ...prompb.Sample) {
+	t.Helper()
+	for _, s := range samples {
+		if err := h.Append(l, s); err != nil {
+			t.Fatalf("append %s@%d: %v", l, s.Timestamp, err)
+		}
+	}
+}
+
+// samplesAt returns a sample at every timestamp from mint to maxt, stepping
+// by step, with the timestamp as value
+func samplesAt(mint, maxt, step int64) []prompb.Sample {
+	var samples []prompb.Sample
+	for t := mint; t <= maxt; t += step {
+		samples = append(samples, prompb.Sample{Timestamp: t, Value: float64(t)})
+	}
+	return samples
+}
+
+// query returns the float samples of the series matching all matchers
+// between mint and maxt, by series labels
+func query(t testing.TB, h *Head, mint, maxt int64, ms ...*labels.Matcher) map[string][]prompb.Sample {
+	t.Helper()
+	res := make(map[string][]prompb.Sample)
+	ss := h.Select(context.Background(), mint, maxt, ms...)
+	for ss.Next() {
+		s := ss.At()
+		var samples []prompb.Sample
+		it := s.Iterator()
+		for it.Next() {
+			ts, v := it.At()
+			samples = append(samples, prompb.Sample{Timestamp: ts, Value: v})
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+		res[s.Labels().String()] = samples
+	}
+	if err := ss.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// countSamples returns the number of float samples the head holds between
+// mint and maxt, across all series
+func countSamples(t testing.TB, h *Head, mint, maxt int64) int {
+	t.Helper()
+	n := 0
+	for _, samples := range query(t, h, mint, maxt) {
+		n += len(samples)
+	}
+	return n
+}
+
+// BenchmarkChunkMemory reports the heap bytes per sample of series holding
+// a slowly changing gauge, with and without compressing completed chunks
+func BenchmarkChunkMemory(b *testing.B) {
+	for _, disable := range []bool{false, true} {
+		b.Run(fmt.Sprintf("disable_compression=%v", disable), func(b *testing.B) {
+			const series, samples = 100, 1200
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				b.StartTimer()
+
+				h := newTestHead(b, Options{DisableCompression: disable})
+				rng := rand.New(rand.NewSource(1))
+				for j := 0; j < series; j++ {
+					s, _, err := h.getOrCreate(labels.FromStrings(labels.MetricName, "m", "i", strconv.Itoa(j)))
+					if err != nil {
+						b.Fatal(err)
+					}
+					v := 512.0
+					s.Lock()
+					for k := int64(1); k <= samples; k++ {
+						if rng.Intn(10) == 0 {
+							v += float64(rng.Intn(3) - 1)
+						}
+						if err := h.appendSample(s, prompb.Sample{Timestamp: k * 15000, Value: v}); err != nil {
+							b.Fatal(err)
+						}
+					}
+					s.Unlock()
+				}
+
+				b.StopTimer()
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/(series*samples), "bytes/sample")
+				runtime.KeepAlive(h)
+				b.StartTimer()
+			}
+		})
+	}
+}
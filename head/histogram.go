@@ -0,0 +1,204 @@
+package head
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"sync/atomic"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// HistogramIterator iterates over native histogram samples in timestamp order
+type HistogramIterator interface {
+	Next() bool
+	At() (int64, prompb.Histogram)
+	Err() error
+}
+
+// ErrInvalidHistogram is returned for histograms mixing the fields of
+// integer and float histograms.
+var ErrInvalidHistogram = errors.New("head: histogram mixes integer and float fields")
+
+// histChunk holds native histogram samples of a series, sorted by
+// timestamp, either all integer or all float histograms
+type histChunk struct {
+	minTime    int64
+	maxTime    int64
+	float      bool
+	histograms []prompb.Histogram
+}
+
+// AppendHistogram adds a native histogram sample to a series. Histograms
+// are stored in their own chunks next to the float chunks of the series and
+// must arrive in order, there is no out-of-order window for them. Integer
+// and float histograms may follow each other in a series, each is read
+// back as the kind it was written as.
+func (h *Head) AppendHistogram(l labels.Labels, hist prompb.Histogram) error {
+	if err := checkHistogram(hist); err != nil {
+		return err
+	}
+	hist.Timestamp = h.truncate(hist.Timestamp)
+
+	s, err := h.lockSeries(l)
+	if err != nil {
+		return err
+	}
+	defer s.Unlock()
+	if err := h.checkSeriesFull(s, 1); err != nil {
+		return err
+	}
+
+	logHistograms := h.wal.LogHistograms
+	if isFloatHistogram(hist) {
+		logHistograms = h.wal.LogFloatHistograms
+	}
+	if err := logHistograms([]uint64{s.ref}, []prompb.Histogram{hist}); err != nil {
+		return err
+	}
+
+	h.observeSkew(hist.Timestamp)
+
+	if err := h.appendHistogram(s, hist); err != nil {
+		return err
+	}
+	atomic.AddUint64(&h.samplesAppended, 1)
+	return nil
+}
+
+// appendHistogram adds a histogram to the chunks of a locked series
+func (h *Head) appendHistogram(s *memSeries, hist prompb.Histogram) error {
+	if hist.Timestamp < atomic.LoadInt64(&h.minValidTime) {
+		return ErrOutOfBounds
+	}
+
+	var c *histChunk
+	if n := len(s.histograms); n > 0 {
+		c = s.histograms[n-1]
+		last := &c.histograms[len(c.histograms)-1]
+		switch {
+		case hist.Timestamp == last.Timestamp:
+			if !equalHistograms(last, &hist) {
+				return ErrDuplicateSample
+			}
+			return nil
+		case hist.Timestamp < last.Timestamp:
+			return ErrOutOfBounds
+		}
+	}
+
+	h.updateMinTime(hist.Timestamp)
+	h.updateMaxTime(hist.Timestamp)
+	s.lastAppend = h.now().UnixMilli()
+
+	float := isFloatHistogram(hist)
+	if c == nil || c.float != float || h.chunkFull(len(c.histograms), c.minTime, hist.Timestamp) {
+		c = &histChunk{minTime: hist.Timestamp, float: float}
+		s.histograms = append(s.histograms, c)
+	}
+	c.histograms = append(c.histograms, hist)
+	c.maxTime = hist.Timestamp
+	s.numSamples++
+
+	return nil
+}
+
+// checkHistogram rejects histograms that would be read back as the wrong
+// kind. Integer histograms carry integer counts and bucket deltas, float
+// histograms float counts and absolute bucket counts.
+func checkHistogram(hist prompb.Histogram) error {
+	float := isFloatHistogram(hist)
+	switch hist.GetZeroCount().(type) {
+	case *prompb.Histogram_ZeroCountInt:
+		if float {
+			return ErrInvalidHistogram
+		}
+	case *prompb.Histogram_ZeroCountFloat:
+		if !float {
+			return ErrInvalidHistogram
+		}
+	}
+	if float && (len(hist.PositiveDeltas) > 0 || len(hist.NegativeDeltas) > 0) ||
+		!float && (len(hist.PositiveCounts) > 0 || len(hist.NegativeCounts) > 0) {
+		return ErrInvalidHistogram
+	}
+	return nil
+}
+
+// equalHistograms reports whether two histograms are identical, which is
+// the case for retried writes
+func equalHistograms(a, b *prompb.Histogram) bool {
+	ab, err := a.Marshal()
+	if err != nil {
+		return false
+	}
+	bb, err := b.Marshal()
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ab, bb)
+}
+
+// clipHistograms returns the histograms of a chunk in [mint, maxt]
+func clipHistograms(c *histChunk, mint, maxt int64) []prompb.Histogram {
+	if c.maxTime < mint || c.minTime > maxt {
+		return nil
+	}
+	lo := sort.Search(len(c.histograms), func(i int) bool { return c.histograms[i].Timestamp >= mint })
+	hi := sort.Search(len(c.histograms), func(i int) bool { return c.histograms[i].Timestamp > maxt })
+	return c.histograms[lo:hi]
+}
+
+// histSliceIterator iterates over consecutive slices of histograms
+type histSliceIterator struct {
+	slices [][]prompb.Histogram
+	idx    int
+}
+
+func newHistSliceIterator(slices [][]prompb.Histogram) *histSliceIterator {
+	return &histSliceIterator{slices: slices, idx: -1}
+}
+
+func (it *histSliceIterator) Next() bool {
+	for len(it.slices) > 0 {
+		if it.idx+1 < len(it.slices[0]) {
+			it.idx++
+			return true
+		}
+		it.slices = it.slices[1:]
+		it.idx = -1
+	}
+	return false
+}
+
+func (it *histSliceIterator) At() (int64, prompb.Histogram) {
+	hist := it.slices[0][it.idx]
+	return hist.Timestamp, hist
+}
+
+func (it *histSliceIterator) Err() error { return nil }
+
+// histChainIterator iterates over consecutive histogram iterators
+type histChainIterator struct {
+	its []HistogramIterator
+	err error
+}
+
+func (it *histChainIterator) Next() bool {
+	for len(it.its) > 0 {
+		if it.its[0].Next() {
+			return true
+		}
+		if err := it.its[0].Err(); err != nil {
+			it.err = err
+			return false
+		}
+		it.its = it.its[1:]
+	}
+	return false
+}
+
+func (it *histChainIterator) At() (int64, prompb.Histogram) { return it.its[0].At() }
+
+func (it *histChainIterator) Err() error { return it.err }
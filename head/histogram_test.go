@@ -0,0 +1,149 @@
+package head
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+// intHistogram returns an integer histogram with two buckets
+func intHistogram(ts int64) prompb.Histogram {
+	return prompb.Histogram{
+		Timestamp:      ts,
+		Count:          &prompb.Histogram_CountInt{CountInt: 5},
+		ZeroCount:      &prompb.Histogram_ZeroCountInt{ZeroCountInt: 1},
+		Sum:            float64(ts),
+		PositiveSpans:  []prompb.BucketSpan{{Offset: 0, Length: 2}},
+		PositiveDeltas: []int64{1, 2},
+	}
+}
+
+// floatHistogram returns a float histogram with two buckets
+func floatHistogram(ts int64) prompb.Histogram {
+	return prompb.Histogram{
+		Timestamp:      ts,
+		Count:          &prompb.Histogram_CountFloat{CountFloat: 5.5},
+		ZeroCount:      &prompb.Histogram_ZeroCountFloat{ZeroCountFloat: 0.5},
+		Sum:            float64(ts),
+		PositiveSpans:  []prompb.BucketSpan{{Offset: 0, Length: 2}},
+		PositiveCounts: []float64{1.5, 3.5},
+	}
+}
+
+// queryHistograms returns the histograms of the series with the labels
+func queryHistograms(t *testing.T, h *Head, l labels.Labels) []prompb.Histogram {
+	t.Helper()
+	var res []prompb.Histogram
+	ss := h.Select(context.Background(), 0, 1000, labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, l.Get(labels.MetricName)))
+	for ss.Next() {
+		it := ss.At().HistogramIterator()
+		for it.Next() {
+			_, hist := it.At()
+			res = append(res, hist)
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ss.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// TestHistogramKinds checks that a series switching between integer and
+// float histograms reads each back as the kind it was written as, before
+// and after a WAL replay
+func TestHistogramKinds(t *testing.T) {
+	opts := Options{}
+	h := newTestHead(t, opts)
+	l := labels.FromStrings(labels.MetricName, "h")
+	want := []prompb.Histogram{
+		intHistogram(1), intHistogram(2),
+		floatHistogram(3), floatHistogram(4),
+		intHistogram(5),
+		floatHistogram(6),
+	}
+	for _, hist := range want {
+		if err := h.AppendHistogram(l, hist); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantTypes := []chunkenc.ValueType{
+		chunkenc.ValHistogram, chunkenc.ValHistogram,
+		chunkenc.ValFloatHistogram, chunkenc.ValFloatHistogram,
+		chunkenc.ValHistogram,
+		chunkenc.ValFloatHistogram,
+	}
+
+	check := func(when string) {
+		t.Helper()
+		if got := queryHistograms(t, h, l); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got %v, want %v", when, got, want)
+		}
+
+		q, err := NewQueryable(h).Querier(context.Background(), 0, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer q.Close()
+		ss := q.Select(true, nil, labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "h"))
+		var types []chunkenc.ValueType
+		for ss.Next() {
+			it := ss.At().Iterator(nil)
+			for vt := it.Next(); vt != chunkenc.ValNone; vt = it.Next() {
+				types = append(types, vt)
+				switch vt {
+				case chunkenc.ValHistogram:
+					if _, fh := it.AtHistogram(); fh.Count != 5 || fh.PositiveBuckets[1] != 2 {
+						t.Errorf("%s: integer histogram %v at %d", when, fh, it.AtT())
+					}
+				case chunkenc.ValFloatHistogram:
+					if _, fh := it.AtFloatHistogram(); fh.Count != 5.5 || fh.PositiveBuckets[1] != 3.5 {
+						t.Errorf("%s: float histogram %v at %d", when, fh, it.AtT())
+					}
+				}
+			}
+			if err := it.Err(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !reflect.DeepEqual(types, wantTypes) {
+			t.Errorf("%s: value types %v, want %v", when, types, wantTypes)
+		}
+	}
+	check("appended")
+	h = reopenHead(t, h, opts)
+	check("replayed")
+}
+
+// TestHistogramInvalid checks that histograms mixing integer and float
+// fields are rejected
+func TestHistogramInvalid(t *testing.T) {
+	h := newTestHead(t, Options{})
+	l := labels.FromStrings(labels.MetricName, "h")
+
+	intCounts := floatHistogram(1)
+	intCounts.PositiveDeltas = []int64{1}
+	intZero := floatHistogram(1)
+	intZero.ZeroCount = &prompb.Histogram_ZeroCountInt{ZeroCountInt: 1}
+	floatCounts := intHistogram(1)
+	floatCounts.PositiveCounts = []float64{1}
+	floatZero := intHistogram(1)
+	floatZero.ZeroCount = &prompb.Histogram_ZeroCountFloat{ZeroCountFloat: 1}
+
+	for name, hist := range map[string]prompb.Histogram{
+		"float with deltas":       intCounts,
+		"float with int zero":     intZero,
+		"integer with counts":     floatCounts,
+		"integer with float zero": floatZero,
+	} {
+		if err := h.AppendHistogram(l, hist); err != ErrInvalidHistogram {
+			t.Errorf("%s: %v, want %v", name, err, ErrInvalidHistogram)
+		}
+	}
+}
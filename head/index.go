@@ -0,0 +1,326 @@
+package head
+
+import (
+	"regexp/syntax"
+	"sort"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// labelPair is a single name/value pair of a label set
+type labelPair struct {
+	name, value string
+}
+
+// postingsIndex maps every label pair to the refs of the series carrying
+// it. Postings lists are kept sorted by ref so they intersect in linear
+// time. Each series stripe has its own, guarded by the stripe lock.
+type postingsIndex struct {
+	postings map[labelPair][]uint64
+
+	// Values of each label name with postings, so names and values are
+	// enumerated without going through all pairs or series
+	values map[string]map[string]struct{}
+}
+
+func newPostingsIndex() *postingsIndex {
+	return &postingsIndex{
+		postings: make(map[labelPair][]uint64),
+		values:   make(map[string]map[string]struct{}),
+	}
+}
+
+// add indexes a series under all of its label pairs
+func (ix *postingsIndex) add(ref uint64, lset labels.Labels) {
+	for _, l := range lset {
+		p := labelPair{l.Name, l.Value}
+		list := ix.postings[p]
+		if len(list) == 0 {
+			vs := ix.values[l.Name]
+			if vs == nil {
+				vs = make(map[string]struct{})
+				ix.values[l.Name] = vs
+			}
+			vs[l.Value] = struct{}{}
+		}
+
+		// Refs are usually handed out in increasing order, so appending keeps
+		// the list sorted; anything else is inserted in place
+		if n := len(list); n == 0 || list[n-1] < ref {
+			ix.postings[p] = append(list, ref)
+			continue
+		}
+		i := sort.Search(len(list), func(i int) bool { return list[i] >= ref })
+		if list[i] == ref {
+			continue
+		}
+		list = append(list, 0)
+		copy(list[i+1:], list[i:])
+		list[i] = ref
+		ix.postings[p] = list
+	}
+}
+
+// delete removes a series from the postings of all of its label pairs
+func (ix *postingsIndex) delete(ref uint64, lset labels.Labels) {
+	for _, l := range lset {
+		p := labelPair{l.Name, l.Value}
+		list := ix.postings[p]
+
+		i := sort.Search(len(list), func(i int) bool { return list[i] >= ref })
+		if i == len(list) || list[i] != ref {
+			continue
+		}
+		if len(list) == 1 {
+			delete(ix.postings, p)
+			if vs := ix.values[l.Name]; len(vs) == 1 {
+				delete(ix.values, l.Name)
+			} else {
+				delete(vs, l.Value)
+			}
+			continue
+		}
+		ix.postings[p] = append(list[:i], list[i+1:]...)
+	}
+}
+
+// get returns the postings list of a label pair, which must not be modified
+func (ix *postingsIndex) get(name, value string) []uint64 {
+	return ix.postings[labelPair{name, value}]
+}
+
+// intersect returns the refs present in both sorted lists
+func intersect(a, b []uint64) []uint64 {
+	res := make([]uint64, 0, min(len(a), len(b)))
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			res = append(res, a[i])
+			i++
+			j++
+		}
+	}
+	return res
+}
+
+// dedupe removes repeated refs from a sorted list in place
+func dedupe(refs []uint64) []uint64 {
+	if len(refs) == 0 {
+		return refs
+	}
+	n := 1
+	for _, ref := range refs[1:] {
+		if ref != refs[n-1] {
+			refs[n] = ref
+			n++
+		}
+	}
+	return refs[:n]
+}
+
+// readIndexes calls fn with the index of every stripe while holding the
+// read locks of all stripes, so fn sees the series of a single point in
+// time. Creating and looking up series waits until fn returns, appends
+// through series references don't.
+func (h *Head) readIndexes(fn func(ix *postingsIndex)) {
+	h.readStripes(func(st *seriesStripe) {
+		fn(st.index)
+	})
+}
+
+// readStripes calls fn with every stripe like readIndexes, for readers
+// that need the series maps of the same point in time as well
+func (h *Head) readStripes(fn func(st *seriesStripe)) {
+	for _, st := range h.stripes {
+		st.RLock()
+	}
+	defer func() {
+		for _, st := range h.stripes {
+			st.RUnlock()
+		}
+	}()
+	for _, st := range h.stripes {
+		fn(st)
+	}
+}
+
+// selectSeries returns the series matching all matchers, querying one
+// stripe at a time
+func (h *Head) selectSeries(ms []*labels.Matcher) []*memSeries {
+	var (
+		res    []*memSeries
+		values = matcherValues(ms)
+	)
+	for _, st := range h.stripes {
+		st.RLock()
+		res = st.selectSeries(res, ms, values)
+		st.RUnlock()
+	}
+	return res
+}
+
+// selectSeries appends the series of the stripe matching all matchers to
+// res. Matchers with a fixed set of values are resolved through the postings
+// index; all other matchers filter the candidates, or all series if there is
+// no such matcher. The caller must hold the stripe read lock.
+func (st *seriesStripe) selectSeries(res []*memSeries, ms []*labels.Matcher, values [][]string) []*memSeries {
+	var (
+		refs    []uint64
+		indexed bool
+	)
+	for i, m := range ms {
+		if values[i] == nil {
+			continue
+		}
+		list := st.index.forValues(m.Name, values[i])
+		if !indexed {
+			refs, indexed = list, true
+		} else {
+			refs = intersect(refs, list)
+		}
+		if len(refs) == 0 {
+			return res
+		}
+	}
+
+	if !indexed {
+		for _, s := range st.series {
+			if matchesAll(s.lset, ms) {
+				res = append(res, s)
+			}
+		}
+		return res
+	}
+
+	for _, ref := range refs {
+		if s := st.series[ref]; s != nil && matchesAll(s.lset, ms) {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// forValues returns the sorted refs of the series carrying the label name
+// with one of the values. The list must not be modified.
+func (ix *postingsIndex) forValues(name string, values []string) []uint64 {
+	if len(values) == 1 {
+		return ix.get(name, values[0])
+	}
+	var refs []uint64
+	for _, v := range values {
+		refs = append(refs, ix.get(name, v)...)
+	}
+	// A series has one value per label, so the lists only overlap if a
+	// value is listed twice
+	sort.Slice(refs, func(i, j int) bool { return refs[i] < refs[j] })
+	return dedupe(refs)
+}
+
+// matcherValues returns for each matcher the fixed set of non-empty values
+// it selects, equality and regexes like "a|b" or "foo", or nil if it cannot
+// be resolved through the index, because it matches the empty value, which
+// series without the label have, or an open set of values
+func matcherValues(ms []*labels.Matcher) [][]string {
+	values := make([][]string, len(ms))
+	for i, m := range ms {
+		switch m.Type {
+		case labels.MatchEqual:
+			if m.Value != "" {
+				values[i] = []string{m.Value}
+			}
+		case labels.MatchRegexp:
+			if !m.Matches("") {
+				values[i] = literalValues(m.GetRegexString())
+			}
+		}
+	}
+	return values
+}
+
+// maxLiteralValues bounds the number of values a regex is expanded to
+const maxLiteralValues = 256
+
+// literalValues returns the strings a regex matches in full if it only
+// matches a small, fixed set of them, like "foo", "a|b" or "api-(v1|v2)",
+// and nil otherwise
+func literalValues(re string) []string {
+	parsed, err := syntax.Parse(re, syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	values, ok := expandLiteral(parsed.Simplify())
+	if !ok || len(values) == 0 {
+		return nil
+	}
+	// Concatenations like "(a|ab)(c|bc)" yield the same string twice
+	set := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		set[v] = struct{}{}
+	}
+	return sortedKeys(set)
+}
+
+// expandLiteral returns the distinct strings matched by a parsed regex, or
+// false if they are not a fixed set of at most maxLiteralValues
+func expandLiteral(re *syntax.Regexp) ([]string, bool) {
+	switch re.Op {
+	case syntax.OpEmptyMatch:
+		return []string{""}, true
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return nil, false
+		}
+		return []string{string(re.Rune)}, true
+	case syntax.OpCharClass:
+		var values []string
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			lo, hi := re.Rune[i], re.Rune[i+1]
+			if int(hi-lo)+len(values) >= maxLiteralValues {
+				return nil, false
+			}
+			for r := lo; r <= hi; r++ {
+				values = append(values, string(r))
+			}
+		}
+		return values, true
+	case syntax.OpCapture:
+		return expandLiteral(re.Sub[0])
+	case syntax.OpAlternate:
+		set := make(map[string]struct{})
+		for _, sub := range re.Sub {
+			values, ok := expandLiteral(sub)
+			if !ok {
+				return nil, false
+			}
+			for _, v := range values {
+				set[v] = struct{}{}
+			}
+			if len(set) > maxLiteralValues {
+				return nil, false
+			}
+		}
+		return sortedKeys(set), true
+	case syntax.OpConcat:
+		values := []string{""}
+		for _, sub := range re.Sub {
+			suffixes, ok := expandLiteral(sub)
+			if !ok || len(values)*len(suffixes) > maxLiteralValues {
+				return nil, false
+			}
+			next := make([]string, 0, len(values)*len(suffixes))
+			for _, v := range values {
+				for _, suffix := range suffixes {
+					next = append(next, v+suffix)
+				}
+			}
+			values = next
+		}
+		return values, true
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,243 @@
+package head
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestPostingsIndex(t *testing.T) {
+	ix := newPostingsIndex()
+	x := labels.FromStrings("job", "x")
+	for _, ref := range []uint64{5, 1, 9, 3, 9, 7} {
+		ix.add(ref, x)
+	}
+	if got := ix.get("job", "x"); !reflect.DeepEqual(got, []uint64{1, 3, 5, 7, 9}) {
+		t.Fatalf("postings %v, want sorted refs without duplicates", got)
+	}
+
+	ix.add(4, labels.FromStrings("job", "y"))
+	if got := intersect(ix.get("job", "x"), []uint64{2, 3, 4, 9, 10}); !reflect.DeepEqual(got, []uint64{3, 9}) {
+		t.Fatalf("intersection %v, want [3 9]", got)
+	}
+	if got := ix.get("job", "y"); !reflect.DeepEqual(got, []uint64{4}) {
+		t.Fatalf("postings of another value %v, want [4]", got)
+	}
+}
+
+// TestLiteralValues checks which regexes expand to their full set of
+// matching values, and that the others are left to a scan
+func TestLiteralValues(t *testing.T) {
+	for _, c := range []struct {
+		re   string
+		want []string
+	}{
+		{"foo", []string{"foo"}},
+		{"a|b", []string{"a", "b"}},
+		{"b|a|b", []string{"a", "b"}},
+		{"foo|foobar", []string{"foo", "foobar"}},
+		{"api-(v1|v2)", []string{"api-v1", "api-v2"}},
+		{"(a|ab)(c|bc)", []string{"abc", "abbc", "ac"}},
+		{"[0-3]", []string{"0", "1", "2", "3"}},
+		{"(?:x|y)z", []string{"xz", "yz"}},
+		{"", []string{""}},
+		{"foo.*", nil},
+		{"a+", nil},
+		{"[^a]", nil},
+		{"(?i)foo", nil},
+		{"[0-9][0-9][0-9]", nil},
+		{"(", nil},
+	} {
+		got := literalValues(c.re)
+		sort.Strings(c.want)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("literalValues(%q) = %q, want %q", c.re, got, c.want)
+		}
+	}
+}
+
+// TestSelectPostingsMatchScan checks that resolving matchers through the
+// postings index selects exactly the series a scan of all series does
+func TestSelectPostingsMatchScan(t *testing.T) {
+	h := newTestHead(t, Options{})
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		b := labels.NewScratchBuilder(4)
+		b.Add(labels.MetricName, fmt.Sprintf("m%d", rng.Intn(3)))
+		b.Add("i", fmt.Sprint(i))
+		if v := rng.Intn(4); v > 0 {
+			b.Add("env", []string{"", "dev", "prod", "test"}[v])
+		}
+		if rng.Intn(2) == 0 {
+			b.Add("zone", fmt.Sprintf("z%d", rng.Intn(10)))
+		}
+		b.Sort()
+		mustAppend(t, h, b.Labels(), prompb.Sample{Timestamp: 1, Value: 1})
+	}
+
+	m := labels.MustNewMatcher
+	for _, ms := range [][]*labels.Matcher{
+		{m(labels.MatchEqual, labels.MetricName, "m1")},
+		{m(labels.MatchEqual, "env", "prod")},
+		{m(labels.MatchEqual, "env", "")},
+		{m(labels.MatchEqual, "env", "missing")},
+		{m(labels.MatchNotEqual, "env", "prod")},
+		{m(labels.MatchNotEqual, "env", "")},
+		{m(labels.MatchRegexp, "env", "dev|prod")},
+		{m(labels.MatchRegexp, "env", "dev|")},
+		{m(labels.MatchRegexp, "env", "d.*")},
+		{m(labels.MatchRegexp, "i", "1[0-9]")},
+		{m(labels.MatchRegexp, "i", "(1|2)(3|4)")},
+		{m(labels.MatchRegexp, "zone", "z(1|2|3)")},
+		{m(labels.MatchRegexp, "zone", ".*")},
+		{m(labels.MatchRegexp, "zone", ".+")},
+		{m(labels.MatchNotRegexp, "zone", "z1|z2")},
+		{m(labels.MatchNotRegexp, "zone", "")},
+		{m(labels.MatchEqual, labels.MetricName, "m0"), m(labels.MatchRegexp, "env", "dev|test")},
+		{m(labels.MatchEqual, labels.MetricName, "m2"), m(labels.MatchNotEqual, "zone", "z3")},
+		{m(labels.MatchEqual, labels.MetricName, "m1"), m(labels.MatchEqual, "zone", "z3")},
+		{m(labels.MatchRegexp, "env", "prod|test"), m(labels.MatchRegexp, "zone", "z[0-4]"), m(labels.MatchNotRegexp, "i", "1.*")},
+		{m(labels.MatchEqual, "env", "dev"), m(labels.MatchEqual, "env", "prod")},
+	} {
+		var got []string
+		for _, s := range h.selectSeries(ms) {
+			got = append(got, s.lset.String())
+		}
+		var want []string
+		for _, s := range h.allSeries() {
+			if matchesAll(s.lset, ms) {
+				want = append(want, s.lset.String())
+			}
+		}
+		sort.Strings(got)
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: selected %d series, scan matched %d", ms, len(got), len(want))
+		}
+	}
+}
+
+// TestSelectPostingsOnly checks that equality matchers only look at the
+// series listed in the postings of their pairs. The labels of every other
+// series are changed to match behind the index's back, so a scan would
+// select them.
+func TestSelectPostingsOnly(t *testing.T) {
+	h := newTestHead(t, Options{})
+	want := labels.FromStrings(labels.MetricName, "m", "instance", "y", "job", "x")
+	mustAppend(t, h, want, prompb.Sample{Timestamp: 1, Value: 1})
+	for _, l := range []labels.Labels{
+		labels.FromStrings(labels.MetricName, "m", "instance", "y", "job", "z"),
+		labels.FromStrings(labels.MetricName, "m", "instance", "z", "job", "x"),
+		labels.FromStrings(labels.MetricName, "m", "instance", "z", "job", "z"),
+		labels.FromStrings(labels.MetricName, "n"),
+	} {
+		mustAppend(t, h, l, prompb.Sample{Timestamp: 1, Value: 1})
+	}
+
+	ref, _ := h.GetRef(want)
+	for _, s := range h.allSeries() {
+		s.lset = want
+	}
+
+	ms := []*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, "job", "x"),
+		labels.MustNewMatcher(labels.MatchEqual, "instance", "y"),
+	}
+	got := h.selectSeries(ms)
+	if len(got) != 1 || got[0].ref != ref {
+		t.Fatalf("selected %d series for %v, want only ref %d", len(got), ms, ref)
+	}
+}
+
+// TestLabelNamesRemoved checks that label names and values read from the
+// index follow series being created and removed
+func TestLabelNamesRemoved(t *testing.T) {
+	h := newTestHead(t, Options{DisableWAL: true, StripeCount: 4})
+	mustAppend(t, h, labels.FromStrings(labels.MetricName, "a", "job", "x"), prompb.Sample{Timestamp: 1, Value: 1})
+	mustAppend(t, h, labels.FromStrings(labels.MetricName, "a", "job", "y", "zone", "z"), prompb.Sample{Timestamp: 1, Value: 1})
+	mustAppend(t, h, labels.FromStrings(labels.MetricName, "b", "job", "x"), prompb.Sample{Timestamp: 10, Value: 1})
+
+	if got, want := h.LabelNames(), []string{labels.MetricName, "job", "zone"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("names %v, want %v", got, want)
+	}
+	if got, want := h.LabelValues("job"), []string{"x", "y"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("job values %v, want %v", got, want)
+	}
+
+	// Truncation removes both series of a
+	if _, _, err := h.Truncate(5); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := h.LabelNames(), []string{labels.MetricName, "job"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("names after removing series %v, want %v", got, want)
+	}
+	if got, want := h.LabelValues("job"), []string{"x"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("job values after removing series %v, want %v", got, want)
+	}
+	if got := h.LabelValues("zone"); len(got) != 0 {
+		t.Errorf("zone values %v of removed series", got)
+	}
+}
+
+// TestLabelValuesSnapshot checks that label values are read as of a single
+// point in time while series are created. Series are created one after the
+// other, so values seen must be those of the first series created, even
+// though the series are spread over stripes.
+func TestLabelValuesSnapshot(t *testing.T) {
+	h := newTestHead(t, Options{DisableWAL: true, StripeCount: 16})
+	const n = 2000
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			l := labels.FromStrings(labels.MetricName, "m", "i", fmt.Sprintf("%05d", i))
+			if err := h.Append(l, prompb.Sample{Timestamp: 1, Value: 1}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		values := h.LabelValues("i")
+		for i, v := range values {
+			if want := fmt.Sprintf("%05d", i); v != want {
+				t.Fatalf("value %s seen without %s created before it", v, want)
+			}
+		}
+		if !running && len(values) != n {
+			t.Fatalf("%d values, want %d", len(values), n)
+		}
+	}
+}
+
+// BenchmarkLabelNames enumerates the label names and values of a head of
+// 500k series
+func BenchmarkLabelNames(b *testing.B) {
+	h := newTestHead(b, Options{DisableWAL: true})
+	for i := 0; i < 500000; i++ {
+		l := labels.FromStrings(labels.MetricName, "m", "instance", fmt.Sprint(i), "job", fmt.Sprint(i%100))
+		mustAppend(b, h, l, prompb.Sample{Timestamp: 1, Value: 1})
+	}
+
+	b.Run("names", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			h.LabelNames()
+		}
+	})
+	b.Run("values", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			h.LabelValues("job")
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package head
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// interner shares the backing storage of label names and values across
+// series, as most series repeat the same names and many the same values,
+// e.g. job or namespace. Strings are reference counted and dropped once the
+// last series using them is removed. Label sets whose strings are all
+// pooled already, as for most new series, only take the read lock.
+type interner struct {
+	mtx  sync.RWMutex
+	pool map[string]*internEntry
+}
+
+// internEntry is a pooled string. References are only added concurrently,
+// under the read lock, and dropped under the write lock, so an entry is
+// removed from the pool in the same critical section its count reaches 0.
+type internEntry struct {
+	s    string
+	refs atomic.Int64
+}
+
+func newInterner() *interner {
+	return &interner{pool: make(map[string]*internEntry)}
+}
+
+// labels returns a copy of lset whose names and values are interned
+func (in *interner) labels(lset labels.Labels) labels.Labels {
+	b := labels.NewScratchBuilder(lset.Len())
+
+	in.mtx.RLock()
+	if in.pooled(lset) {
+		lset.Range(func(l labels.Label) {
+			b.Add(in.acquire(l.Name), in.acquire(l.Value))
+		})
+		in.mtx.RUnlock()
+		return b.Labels()
+	}
+	in.mtx.RUnlock()
+
+	in.mtx.Lock()
+	defer in.mtx.Unlock()
+	lset.Range(func(l labels.Label) {
+		b.Add(in.intern(l.Name), in.intern(l.Value))
+	})
+	return b.Labels()
+}
+
+// pooled reports whether all names and values of lset are pooled, in.mtx
+// must be held for reading at least
+func (in *interner) pooled(lset labels.Labels) bool {
+	ok := true
+	lset.Range(func(l labels.Label) {
+		if ok {
+			_, okName := in.pool[l.Name]
+			_, okValue := in.pool[l.Value]
+			ok = okName && okValue
+		}
+	})
+	return ok
+}
+
+// acquire returns the pooled copy of s, which must be pooled, adding a
+// reference. in.mtx must be held for reading at least.
+func (in *interner) acquire(s string) string {
+	e := in.pool[s]
+	e.refs.Add(1)
+	return e.s
+}
+
+// release drops the references of a label set returned by labels
+func (in *interner) release(lset labels.Labels) {
+	in.mtx.Lock()
+	defer in.mtx.Unlock()
+
+	lset.Range(func(l labels.Label) {
+		in.releaseString(l.Name)
+		in.releaseString(l.Value)
+	})
+}
+
+// intern returns the pooled copy of s, in.mtx must be held
+func (in *interner) intern(s string) string {
+	if _, ok := in.pool[s]; ok {
+		return in.acquire(s)
+	}
+	// Don't keep the caller's buffer, e.g. a decoded request, alive
+	s = strings.Clone(s)
+	e := &internEntry{s: s}
+	e.refs.Store(1)
+	in.pool[s] = e
+	return s
+}
+
+// releaseString drops a reference to s, in.mtx must be held
+func (in *interner) releaseString(s string) {
+	e, ok := in.pool[s]
+	if !ok {
+		return
+	}
+	if e.refs.Add(-1) == 0 {
+		delete(in.pool, s)
+	}
+}
+
+// size returns the number of interned strings
+func (in *interner) size() int {
+	in.mtx.RLock()
+	defer in.mtx.RUnlock()
+	return len(in.pool)
+}
@@ -0,0 +1,119 @@
+package head
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// TestInterner checks that interned label sets share their strings, which
+// are dropped once the last set holding them is released
+func TestInterner(t *testing.T) {
+	in := newInterner()
+	// Strings not sharing the storage of the literals
+	job := func() string { return string([]byte("node")) }
+	a := in.labels(labels.FromStrings("job", job(), "instance", "a"))
+	b := in.labels(labels.FromStrings("job", job(), "instance", "b"))
+	if unsafe.StringData(a.Get("job")) != unsafe.StringData(b.Get("job")) {
+		t.Error("label values are not shared")
+	}
+	if n := in.size(); n != 5 {
+		t.Fatalf("%d interned strings, want 5", n)
+	}
+
+	in.release(a)
+	if n := in.size(); n != 4 {
+		t.Fatalf("%d interned strings after releasing a, want 4", n)
+	}
+	in.release(b)
+	if n := in.size(); n != 0 {
+		t.Fatalf("%d interned strings after releasing all, want 0", n)
+	}
+}
+
+// TestInternerConcurrent interns and releases overlapping label sets from
+// several goroutines and checks that no string is leaked
+func TestInternerConcurrent(t *testing.T) {
+	in := newInterner()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				l := in.labels(labels.FromStrings("job", "node", "instance", fmt.Sprint(i%10), "g", fmt.Sprint(g)))
+				if i%2 == 0 {
+					in.release(l)
+					continue
+				}
+				// Interning a set that is held takes the read-locked path,
+				// while other goroutines release the shared strings
+				next := in.labels(l)
+				in.release(l)
+				in.release(next)
+			}
+		}(g)
+	}
+	wg.Wait()
+	if n := in.size(); n != 0 {
+		t.Errorf("%d interned strings after releasing all, want 0", n)
+	}
+}
+
+// BenchmarkInternMemory reports the heap bytes per series held by the
+// labels of 100k series, as decoded from requests with every string in its
+// own allocation, and once interned
+func BenchmarkInternMemory(b *testing.B) {
+	const series = 100_000
+	// Every call allocates its strings anew, as decoding a request does
+	lsets := func() []labels.Labels {
+		res := make([]labels.Labels, series)
+		for i := range res {
+			b := labels.NewScratchBuilder(5)
+			for _, l := range [][2]string{
+				{labels.MetricName, "http_requests_total_" + strconv.Itoa(i%50)},
+				{"instance", "10.0." + strconv.Itoa(i/50%1000) + ":9100"},
+				{"job", "job-" + strconv.Itoa(i%5)},
+				{"namespace", "monitoring-" + strconv.Itoa(i%3)},
+				{"status", strconv.Itoa(200 + i%4)},
+			} {
+				b.Add(strings.Clone(l[0]), strings.Clone(l[1]))
+			}
+			res[i] = b.Labels()
+		}
+		return res
+	}
+	heap := func() uint64 {
+		var ms runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&ms)
+		return ms.HeapAlloc
+	}
+
+	b.Run("decoded", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			before := heap()
+			res := lsets()
+			b.ReportMetric(float64(heap()-before)/series, "bytes/series")
+			runtime.KeepAlive(res)
+		}
+	})
+	b.Run("interned", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			before := heap()
+			in := newInterner()
+			res := lsets()
+			for j, lset := range res {
+				res[j] = in.labels(lset)
+			}
+			b.ReportMetric(float64(heap()-before)/series, "bytes/series")
+			runtime.KeepAlive(res)
+		}
+	})
+}
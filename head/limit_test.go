@@ -0,0 +1,86 @@
+package head
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/yuanhuiqu/protsdb/wal"
+)
+
+// TestMaxSeries fills the series limit and checks that new series are
+// rejected while the existing ones keep accepting samples
+func TestMaxSeries(t *testing.T) {
+	h := newTestHead(t, Options{MaxSeries: 3})
+	series := func(i int) labels.Labels {
+		return labels.FromStrings(labels.MetricName, "m", "i", strconv.Itoa(i))
+	}
+	for i := 0; i < 3; i++ {
+		mustAppend(t, h, series(i), prompb.Sample{Timestamp: 1, Value: 1})
+	}
+
+	if err := h.Append(series(3), prompb.Sample{Timestamp: 1, Value: 1}); !errors.Is(err, ErrTooManySeries) {
+		t.Fatalf("append to a new series: %v, want %v", err, ErrTooManySeries)
+	}
+	if err := h.AppendHistogram(series(3), prompb.Histogram{Timestamp: 1}); !errors.Is(err, ErrTooManySeries) {
+		t.Fatalf("append histogram to a new series: %v, want %v", err, ErrTooManySeries)
+	}
+	for i := 0; i < 3; i++ {
+		mustAppend(t, h, series(i), prompb.Sample{Timestamp: 2, Value: 2})
+	}
+
+	st := h.Stats()
+	if st.NumSeries != 3 || st.MaxSeries != 3 {
+		t.Fatalf("stats report %d of %d series, want 3 of 3", st.NumSeries, st.MaxSeries)
+	}
+	if n := countSamples(t, h, 0, 10); n != 6 {
+		t.Fatalf("head holds %d samples, want 6", n)
+	}
+}
+
+// TestRejectedNotLogged checks that series beyond the limit and samples the
+// head rejects never reach the WAL, so a restart without the limit does not
+// bring them back
+func TestRejectedNotLogged(t *testing.T) {
+	h := newTestHead(t, Options{MaxSeries: 2})
+	a := labels.FromStrings(labels.MetricName, "m", "i", "a")
+	b := labels.FromStrings(labels.MetricName, "m", "i", "b")
+	mustAppend(t, h, a, prompb.Sample{Timestamp: 10, Value: 1})
+	mustAppend(t, h, b, prompb.Sample{Timestamp: 10, Value: 1})
+
+	for _, tc := range []struct {
+		l      labels.Labels
+		sample prompb.Sample
+		err    error
+	}{
+		{labels.FromStrings(labels.MetricName, "m", "i", "c"), prompb.Sample{Timestamp: 10, Value: 1}, ErrTooManySeries},
+		{a, prompb.Sample{Timestamp: 5, Value: 1}, ErrOutOfBounds},
+		{a, prompb.Sample{Timestamp: 10, Value: 2}, ErrDuplicateSample},
+	} {
+		if err := h.Append(tc.l, tc.sample); !errors.Is(err, tc.err) {
+			t.Fatalf("append %s@%d: %v, want %v", tc.l, tc.sample.Timestamp, err, tc.err)
+		}
+	}
+
+	records := map[byte]int{}
+	if err := h.wal.Replay(func(typ, _ byte, _ []byte) error {
+		records[typ]++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if records[wal.RecordSeries] != 2 || records[wal.RecordSamples] != 2 {
+		t.Fatalf("WAL holds %d series and %d sample records, want 2 and 2",
+			records[wal.RecordSeries], records[wal.RecordSamples])
+	}
+
+	h = reopenHead(t, h, Options{})
+	if n := h.Stats().NumSeries; n != 2 {
+		t.Fatalf("%d series after restart, want 2", n)
+	}
+	if n := countSamples(t, h, 0, 100); n != 2 {
+		t.Fatalf("%d samples after restart, want 2", n)
+	}
+}
@@ -0,0 +1,150 @@
+package head
+
+import (
+	"log/slog"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/yuanhuiqu/protsdb/wal"
+)
+
+// defaultMaintenanceInterval is how often the maintenance loop runs unless
+// configured otherwise
+const defaultMaintenanceInterval = time.Minute
+
+// StartMaintenance starts a background loop that removes empty series and
+// checkpoints and cleans the WAL every interval, or every Options.MaintenanceInterval if interval
+// is zero. Only segments whose samples are all older than the compacted or
+// truncated range are flushed, the series and state they define are written
+// into a checkpoint replayed in their place, so a restart restores the same
+// head. Close stops the loop,
+// it is not restarted by Reopen. Calling it while the loop runs, or on a
+// read-only head, does nothing.
+func (h *Head) StartMaintenance(interval time.Duration) {
+	if h.readOnly {
+		return
+	}
+	if interval <= 0 {
+		interval = h.maintInterval
+	}
+
+	h.maintMtx.Lock()
+	defer h.maintMtx.Unlock()
+	if h.maintStop != nil {
+		return
+	}
+	h.maintStop = make(chan struct{})
+	h.maintDone = make(chan struct{})
+	go h.maintenanceLoop(interval, h.maintStop, h.maintDone)
+}
+
+// stopMaintenance stops the maintenance loop and waits for it to exit
+func (h *Head) stopMaintenance() {
+	h.maintMtx.Lock()
+	defer h.maintMtx.Unlock()
+	if h.maintStop == nil {
+		return
+	}
+	close(h.maintStop)
+	<-h.maintDone
+	h.maintStop, h.maintDone = nil, nil
+}
+
+func (h *Head) maintenanceLoop(interval time.Duration, stop, done chan struct{}) {
+	defer close(done)
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if err := h.maintain(); err != nil {
+				slog.Warn("WAL maintenance failed", "err", err)
+			}
+		}
+	}
+}
+
+// maintain removes empty and stale series, then flushes the WAL segments
+// holding only samples that are no longer part of the head and removes them
+func (h *Head) maintain() error {
+	if n := h.gc(); n > 0 {
+		slog.Debug("Removed empty series from the head", "series", n)
+	}
+	if n := h.evictStale(); n > 0 {
+		slog.Info("Evicted stale series from the head", "series", n, "timeout", h.staleTimeout)
+	}
+	return h.checkpointWAL()
+}
+
+// checkpointWAL flushes the WAL segments holding only samples that are no
+// longer part of the head and removes them
+func (h *Head) checkpointWAL() error {
+	upto, ok := h.wal.FlushableBefore(atomic.LoadInt64(&h.minValidTime))
+	if !ok {
+		return h.wal.Clean()
+	}
+	if err := h.wal.CheckpointBefore(upto, h.checkpointState); err != nil {
+		return err
+	}
+	return h.wal.Clean()
+}
+
+// checkpointState logs the series, tombstones, sequences, exemplars and
+// metadata of the head into a WAL checkpoint, which replaces the segments
+// defining them
+func (h *Head) checkpointState(cw *wal.CheckpointWriter) error {
+	all := h.allSeries()
+
+	var (
+		stones    []wal.Tombstone
+		exRefs    []uint64
+		exemplars []prompb.Exemplar
+	)
+	for _, s := range all {
+		if err := cw.LogSeries(s.ref, s.lset); err != nil {
+			return err
+		}
+
+		s.RLock()
+		seq := s.lastSeq
+		for _, iv := range s.tombstones {
+			stones = append(stones, wal.Tombstone{Ref: s.ref, Mint: iv.Mint, Maxt: iv.Maxt})
+		}
+		for _, e := range s.exemplars.between(math.MinInt64, math.MaxInt64) {
+			exRefs = append(exRefs, s.ref)
+			exemplars = append(exemplars, e)
+		}
+		s.RUnlock()
+
+		if seq > 0 {
+			if err := cw.LogSequence(s.ref, seq); err != nil {
+				return err
+			}
+		}
+	}
+	if len(stones) > 0 {
+		if err := cw.LogTombstones(stones); err != nil {
+			return err
+		}
+	}
+	// Replaying the segments the checkpoint keeps after it repeats their
+	// exemplars, which appendExemplar drops as older than the newest one or
+	// a retry of it
+	if len(exemplars) > 0 {
+		if err := cw.LogExemplars(exRefs, exemplars); err != nil {
+			return err
+		}
+	}
+
+	for _, md := range h.Metadata() {
+		if err := cw.LogMetadata(md); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package head
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// appendAfterTruncation leaves a head whose WAL has sealed segments that
+// only hold samples from before a truncation, so the next checkpoint
+// flushes them: the segment still being written to when the truncation ran,
+// and two more only holding the records of series whose first append was
+// rejected as too old. The series of the first one gets samples later, so
+// its record is in a segment Clean removes after the checkpoint. It
+// returns that series.
+func appendAfterTruncation(t *testing.T, h *Head) labels.Labels {
+	t.Helper()
+	a := labels.FromStrings(labels.MetricName, "a")
+	mustAppend(t, h, a, samplesAt(1, 2000, 1)...)
+	if _, _, err := h.Truncate(2001); err != nil {
+		t.Fatal(err)
+	}
+
+	// Records larger than a segment are written alone into one
+	pad := strings.Repeat("x", 4096)
+	b := labels.FromStrings(labels.MetricName, "b", "pad", pad)
+	c := labels.FromStrings(labels.MetricName, "c", "pad", pad)
+	for _, l := range []labels.Labels{b, c} {
+		if err := h.Append(l, prompb.Sample{Timestamp: 1}); err != ErrOutOfBounds {
+			t.Fatalf("append before the truncation time: %v, want %v", err, ErrOutOfBounds)
+		}
+	}
+	mustAppend(t, h, b, samplesAt(3001, 4000, 1)...)
+	if !flushable(h) {
+		t.Fatal("no WAL segment to flush after the truncation")
+	}
+	return b
+}
+
+// flushable reports whether the next checkpoint flushes WAL segments
+func flushable(h *Head) bool {
+	_, ok := h.wal.FlushableBefore(atomic.LoadInt64(&h.minValidTime))
+	return ok
+}
+
+func TestMaintainRestart(t *testing.T) {
+	opts := Options{WALSegmentSize: 4096}
+	h := newTestHead(t, opts)
+	b := appendAfterTruncation(t, h)
+
+	if err := h.maintain(); err != nil {
+		t.Fatal(err)
+	}
+	if flushable(h) {
+		t.Fatal("maintenance left WAL segments to flush")
+	}
+	want := query(t, h, 0, 5000)
+	if n := len(want[b.String()]); n != 1000 || len(want) != 1 {
+		t.Fatalf("%d series and %d samples of b before the restart, want 1 and 1000", len(want), n)
+	}
+
+	h = reopenHead(t, h, opts)
+	if got := query(t, h, 0, 5000); !reflect.DeepEqual(got, want) {
+		t.Errorf("restart after maintenance restored %d samples, want 1000", countSamples(t, h, 0, 5000))
+	}
+}
+
+func TestMaintenanceLoop(t *testing.T) {
+	now := time.Now()
+	opts := Options{
+		WALSegmentSize:     4096,
+		StaleSeriesTimeout: time.Hour,
+		Now:                func() time.Time { return now },
+	}
+	h := newTestHead(t, opts)
+	b := appendAfterTruncation(t, h)
+	stale := labels.FromStrings(labels.MetricName, "stale")
+	mustAppend(t, h, stale, samplesAt(3001, 3001, 1)...)
+
+	// Two hours later by the head's clock only b gets appends
+	now = now.Add(2 * time.Hour)
+	mustAppend(t, h, b, samplesAt(4001, 4001, 1)...)
+
+	h.StartMaintenance(time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := h.GetRef(stale); !ok && !flushable(h) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("maintenance did not evict the stale series and flush the WAL")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	h.stopMaintenance()
+
+	want := query(t, h, 0, 5000)
+	if _, ok := want[stale.String()]; ok {
+		t.Fatal("evicted series is still queried")
+	}
+	h = reopenHead(t, h, opts)
+	if got := query(t, h, 0, 5000)[b.String()]; !reflect.DeepEqual(got, want[b.String()]) {
+		t.Errorf("restart after the maintenance loop restored %d samples of b, want %d", len(got), len(want[b.String()]))
+	}
+}
+
+// TestCheckpointExemplars checks that exemplars logged into WAL segments a
+// checkpoint flushes survive a restart
+func TestCheckpointExemplars(t *testing.T) {
+	opts := Options{WALSegmentSize: 4096, MaxExemplarsPerSeries: 100}
+	h := newTestHead(t, opts)
+	a := labels.FromStrings(labels.MetricName, "a")
+	var want []prompb.Exemplar
+	for ts := int64(100); ts <= 2000; ts += 100 {
+		mustAppend(t, h, a, samplesAt(ts-99, ts, 1)...)
+		ref, ok := h.GetRef(a)
+		if !ok {
+			t.Fatal("series not found")
+		}
+		e := prompb.Exemplar{
+			Labels:    []prompb.Label{{Name: "trace_id", Value: strconv.FormatInt(ts, 10)}},
+			Timestamp: ts,
+			Value:     float64(ts),
+		}
+		if err := h.AppendExemplar(ref, e); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, e)
+	}
+	if _, _, err := h.Truncate(1900); err != nil {
+		t.Fatal(err)
+	}
+	if st := h.wal.Stats(); st.FlushedSegments == 0 {
+		t.Fatalf("no segments flushed by the truncation: %+v", st)
+	}
+
+	h = reopenHead(t, h, opts)
+	ss := h.Select(context.Background(), 0, 3000)
+	if !ss.Next() {
+		t.Fatalf("no series after the restart: %v", ss.Err())
+	}
+	if got := ss.At().Exemplars(); !reflect.DeepEqual(got, want) {
+		t.Errorf("restart restored exemplars %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,54 @@
+package head
+
+import (
+	"errors"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// ErrEmptyMetricName is returned for metadata without a metric family name.
+var ErrEmptyMetricName = errors.New("head: metadata without metric name")
+
+// SetMetadata stores the type, unit and help of a metric family, replacing
+// what was stored for the same name before. Unchanged metadata, which
+// remote write resends periodically, is not logged again.
+func (h *Head) SetMetadata(md prompb.MetricMetadata) error {
+	if md.MetricFamilyName == "" {
+		return ErrEmptyMetricName
+	}
+
+	h.metaMtx.Lock()
+	defer h.metaMtx.Unlock()
+
+	if prev, ok := h.metadata[md.MetricFamilyName]; ok && equalMetadata(prev, md) {
+		return nil
+	}
+	if err := h.wal.LogMetadata(md); err != nil {
+		return err
+	}
+	h.metadata[md.MetricFamilyName] = md
+	return nil
+}
+
+// setMetadata stores replayed metadata
+func (h *Head) setMetadata(md prompb.MetricMetadata) {
+	h.metaMtx.Lock()
+	h.metadata[md.MetricFamilyName] = md
+	h.metaMtx.Unlock()
+}
+
+// Metadata returns a copy of the stored metadata by metric family name
+func (h *Head) Metadata() map[string]prompb.MetricMetadata {
+	h.metaMtx.RLock()
+	defer h.metaMtx.RUnlock()
+
+	res := make(map[string]prompb.MetricMetadata, len(h.metadata))
+	for name, md := range h.metadata {
+		res[name] = md
+	}
+	return res
+}
+
+func equalMetadata(a, b prompb.MetricMetadata) bool {
+	return a.Type == b.Type && a.MetricFamilyName == b.MetricFamilyName && a.Help == b.Help && a.Unit == b.Unit
+}
@@ -0,0 +1,585 @@
+package head
+
+import (
+	"context"
+	"sort"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/yuanhuiqu/protsdb/chunkenc"
+)
+
+// SeriesSet iterates over the series returned by Select, in label order.
+// It mirrors Prometheus's storage.SeriesSet.
+type SeriesSet interface {
+	Next() bool
+	At() Series
+	Err() error
+}
+
+// Series is a single series of a query result
+type Series interface {
+	Labels() labels.Labels
+	// Iterator returns a fresh iterator over the samples of the series
+	// within the queried time range
+	Iterator() SampleIterator
+	// HistogramIterator returns a fresh iterator over the native histogram
+	// samples of the series within the queried time range
+	HistogramIterator() HistogramIterator
+	// Exemplars returns the stored exemplars of the series within the
+	// queried time range, oldest first
+	Exemplars() []prompb.Exemplar
+	// StaleAt reports whether the series is stale at t, i.e. its latest
+	// sample at or before t within the queried range is a staleness marker
+	StaleAt(t int64) bool
+}
+
+// SampleIterator iterates over samples in timestamp order
+type SampleIterator interface {
+	Next() bool
+	At() (int64, float64)
+	Err() error
+}
+
+// ctxCheckInterval is the number of series or samples a query processes
+// between checks of its context
+const ctxCheckInterval = 128
+
+// Select returns the series that match all matchers and have at least one
+// sample in [mint, maxt], from memory and the persisted blocks. Their
+// iterators are clipped to that range. Selecting and iterating stop early
+// with the context's error once it is done.
+func (h *Head) Select(ctx context.Context, mint, maxt int64, ms ...*labels.Matcher) SeriesSet {
+	matched := h.selectSeries(ms)
+	blocks := h.Blocks()
+
+	res := make([]Series, 0, len(matched))
+	for i, s := range matched {
+		if i%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return &listSeriesSet{idx: -1, err: err}
+			}
+		}
+		if qs := s.query(mint, maxt); qs != nil {
+			res = append(res, qs)
+		}
+	}
+	for _, b := range blocks {
+		if err := ctx.Err(); err != nil {
+			return &listSeriesSet{idx: -1, err: err}
+		}
+		series, err := b.query(mint, maxt, ms)
+		if err != nil {
+			return &listSeriesSet{idx: -1, err: err}
+		}
+		res = append(res, series...)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return labels.Compare(res[i].Labels(), res[j].Labels()) < 0
+	})
+
+	return &listSeriesSet{ctx: ctx, series: mergeSeries(res), idx: -1}
+}
+
+// mergeSeries combines adjacent series with equal labels, as a series can
+// have samples in several blocks and in memory
+func mergeSeries(sorted []Series) []Series {
+	res := sorted[:0]
+	for i := 0; i < len(sorted); {
+		j := i + 1
+		for j < len(sorted) && labels.Equal(sorted[i].Labels(), sorted[j].Labels()) {
+			j++
+		}
+		if j-i == 1 {
+			res = append(res, sorted[i])
+		} else {
+			res = append(res, &mergedSeries{parts: append([]Series(nil), sorted[i:j]...)})
+		}
+		i = j
+	}
+	return res
+}
+
+// mergedSeries is a series whose samples are spread over several sources
+type mergedSeries struct {
+	parts []Series
+}
+
+func (s *mergedSeries) Labels() labels.Labels { return s.parts[0].Labels() }
+
+func (s *mergedSeries) Iterator() SampleIterator {
+	it := s.parts[0].Iterator()
+	for _, p := range s.parts[1:] {
+		it = newMergeIterator(it, p.Iterator())
+	}
+	return it
+}
+
+func (s *mergedSeries) StaleAt(t int64) bool { return staleAt(s.Iterator(), t) }
+
+// Exemplars concatenates the exemplars of all parts. Only the head holds
+// exemplars, so at most one part has any.
+func (s *mergedSeries) Exemplars() []prompb.Exemplar {
+	var res []prompb.Exemplar
+	for _, p := range s.parts {
+		res = append(res, p.Exemplars()...)
+	}
+	return res
+}
+
+// HistogramIterator chains the histograms of all parts. Only the head
+// holds histograms, so at most one part has any.
+func (s *mergedSeries) HistogramIterator() HistogramIterator {
+	its := make([]HistogramIterator, 0, len(s.parts))
+	for _, p := range s.parts {
+		its = append(its, p.HistogramIterator())
+	}
+	return &histChainIterator{its: its}
+}
+
+// LabelNames returns the sorted label names of the series in the head
+// that match all matchers, or of all series if there are none. Without
+// matchers they are read from the index as of a single point in time,
+// holding up the creation of series only as long as copying the names takes.
+func (h *Head) LabelNames(ms ...*labels.Matcher) []string {
+	set := make(map[string]struct{})
+	if len(ms) == 0 {
+		h.readIndexes(func(ix *postingsIndex) {
+			for name := range ix.values {
+				set[name] = struct{}{}
+			}
+		})
+		return sortedKeys(set)
+	}
+	for _, s := range h.selectSeries(ms) {
+		for _, l := range s.lset {
+			set[l.Name] = struct{}{}
+		}
+	}
+	return sortedKeys(set)
+}
+
+// LabelValues returns the sorted values the given label name has across
+// the series in the head that match all matchers. Without matchers they are
+// read from the index like the names of LabelNames.
+func (h *Head) LabelValues(name string, ms ...*labels.Matcher) []string {
+	set := make(map[string]struct{})
+	if len(ms) == 0 {
+		h.readIndexes(func(ix *postingsIndex) {
+			for v := range ix.values[name] {
+				set[v] = struct{}{}
+			}
+		})
+		return sortedKeys(set)
+	}
+	for _, s := range h.selectSeries(ms) {
+		if v := s.lset.Get(name); v != "" {
+			set[v] = struct{}{}
+		}
+	}
+	return sortedKeys(set)
+}
+
+// sortedKeys returns the keys of a string set in ascending order
+func sortedKeys(set map[string]struct{}) []string {
+	res := make([]string, 0, len(set))
+	for k := range set {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// matchesAll reports whether the label set satisfies all matchers
+func matchesAll(lset labels.Labels, ms []*labels.Matcher) bool {
+	for _, m := range ms {
+		if !m.Matches(lset.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// query captures the chunks of the series overlapping [mint, maxt]. Only
+// slice headers are copied, samples appended afterwards are not visible.
+// It returns nil if the series has no sample in the range.
+func (s *memSeries) query(mint, maxt int64) *querySeries {
+	s.RLock()
+	defer s.RUnlock()
+
+	var chunks []chunkView
+	for _, c := range append(s.chunks[:len(s.chunks):len(s.chunks)], s.chunk) {
+		if c.maxTime < mint || c.minTime > maxt {
+			continue
+		}
+		if c.data != nil {
+			chunks = append(chunks, chunkView{data: c.data, mint: c.minTime, maxt: c.maxTime})
+		} else if samples := clip(c, mint, maxt); len(samples) > 0 {
+			chunks = append(chunks, chunkView{samples: samples, mint: samples[0].Timestamp, maxt: samples[len(samples)-1].Timestamp})
+		}
+	}
+	ooo := clip(s.ooo, mint, maxt)
+
+	var hists [][]prompb.Histogram
+	for _, c := range s.histograms {
+		hs := clipHistograms(c, mint, maxt)
+		if len(s.tombstones) > 0 {
+			hs = filterHistograms(hs, s.tombstones)
+		}
+		if len(hs) > 0 {
+			hists = append(hists, hs)
+		}
+	}
+
+	exemplars := filterExemplars(s.exemplars.between(mint, maxt), s.tombstones)
+
+	if len(chunks) == 0 && len(ooo) == 0 && len(hists) == 0 && len(exemplars) == 0 {
+		return nil
+	}
+	return &querySeries{
+		lset:       s.lset,
+		mint:       mint,
+		maxt:       maxt,
+		chunks:     chunks,
+		ooo:        ooo,
+		histograms: hists,
+		exemplars:  exemplars,
+		tombstones: s.tombstones,
+	}
+}
+
+// Iterator returns an iterator over the float samples of the series in
+// [mint, maxt] in timestamp order, out-of-order samples included and
+// deleted ranges excluded. Chunks outside the range are not decoded.
+func (s *memSeries) Iterator(mint, maxt int64) SampleIterator {
+	qs := s.query(mint, maxt)
+	if qs == nil {
+		return &sliceIterator{idx: -1}
+	}
+	return qs.Iterator()
+}
+
+// clip returns the raw samples of a chunk in [mint, maxt]
+func clip(c *memChunk, mint, maxt int64) []prompb.Sample {
+	if len(c.samples) == 0 || c.maxTime < mint || c.minTime > maxt {
+		return nil
+	}
+	// Samples are sorted by timestamp
+	lo := sort.Search(len(c.samples), func(i int) bool { return c.samples[i].Timestamp >= mint })
+	hi := sort.Search(len(c.samples), func(i int) bool { return c.samples[i].Timestamp > maxt })
+	return c.samples[lo:hi]
+}
+
+// chunkView is a chunk as seen by a query, either raw samples already
+// clipped to the range or a compressed chunk, with the time range it spans
+type chunkView struct {
+	samples    []prompb.Sample
+	data       chunkenc.Chunk
+	mint, maxt int64
+}
+
+// querySeries is a series of a Select result
+type querySeries struct {
+	lset       labels.Labels
+	mint, maxt int64
+	chunks     []chunkView
+	ooo        []prompb.Sample
+	histograms [][]prompb.Histogram
+	exemplars  []prompb.Exemplar
+	tombstones []Interval // deleted ranges, applied to chunks and ooo
+}
+
+func (s *querySeries) Labels() labels.Labels { return s.lset }
+
+// Iterator returns the samples of all chunks in strictly increasing
+// timestamp order. Chunks following each other are chained, chunks
+// overlapping them, e.g. read from overlapping blocks, and the out-of-order
+// samples are merged in. Of samples with the same timestamp the one of the
+// earlier chunk wins.
+func (s *querySeries) Iterator() SampleIterator {
+	// Runs of chunks that don't overlap, each chunk goes into the first
+	// run it follows
+	var (
+		runs [][]SampleIterator
+		ends []int64
+	)
+	for _, c := range s.chunks {
+		var it SampleIterator
+		if c.data != nil {
+			it = &clipIterator{it: c.data.Iterator(), mint: s.mint, maxt: s.maxt}
+		} else {
+			it = &sliceIterator{samples: c.samples, idx: -1}
+		}
+		i := 0
+		for i < len(runs) && ends[i] >= c.mint {
+			i++
+		}
+		if i == len(runs) {
+			runs, ends = append(runs, nil), append(ends, 0)
+		}
+		runs[i], ends[i] = append(runs[i], it), c.maxt
+	}
+
+	var it SampleIterator = &chainIterator{}
+	for i, run := range runs {
+		if i == 0 {
+			it = &chainIterator{its: run}
+		} else {
+			it = newMergeIterator(it, &chainIterator{its: run})
+		}
+	}
+	if len(s.ooo) > 0 {
+		it = newMergeIterator(it, &sliceIterator{samples: s.ooo, idx: -1})
+	}
+	if len(s.tombstones) > 0 {
+		it = &deletedIterator{it: it, intervals: s.tombstones}
+	}
+	return it
+}
+
+func (s *querySeries) HistogramIterator() HistogramIterator {
+	return newHistSliceIterator(s.histograms)
+}
+
+func (s *querySeries) Exemplars() []prompb.Exemplar { return s.exemplars }
+
+func (s *querySeries) StaleAt(t int64) bool { return staleAt(s.Iterator(), t) }
+
+// staleAt reports whether the latest sample of it at or before t is a
+// staleness marker
+func staleAt(it SampleIterator, t int64) bool {
+	stale := false
+	for it.Next() {
+		ts, v := it.At()
+		if ts > t {
+			break
+		}
+		stale = value.IsStaleNaN(v)
+	}
+	return stale
+}
+
+// sliceIterator iterates over raw samples
+type sliceIterator struct {
+	samples []prompb.Sample
+	idx     int
+}
+
+func (it *sliceIterator) Next() bool {
+	it.idx++
+	return it.idx < len(it.samples)
+}
+
+func (it *sliceIterator) At() (int64, float64) {
+	s := it.samples[it.idx]
+	return s.Timestamp, s.Value
+}
+
+func (it *sliceIterator) Err() error { return nil }
+
+// clipIterator skips samples of a compressed chunk outside [mint, maxt]
+type clipIterator struct {
+	it         chunkenc.Iterator
+	mint, maxt int64
+}
+
+func (it *clipIterator) Next() bool {
+	for it.it.Next() {
+		t, _ := it.it.At()
+		if t < it.mint {
+			continue
+		}
+		return t <= it.maxt
+	}
+	return false
+}
+
+func (it *clipIterator) At() (int64, float64) { return it.it.At() }
+
+func (it *clipIterator) Err() error { return it.it.Err() }
+
+// chainIterator iterates over consecutive, non-overlapping iterators
+type chainIterator struct {
+	its []SampleIterator
+	err error
+}
+
+func (it *chainIterator) Next() bool {
+	for len(it.its) > 0 {
+		if it.its[0].Next() {
+			return true
+		}
+		if err := it.its[0].Err(); err != nil {
+			it.err = err
+			return false
+		}
+		it.its = it.its[1:]
+	}
+	return false
+}
+
+func (it *chainIterator) At() (int64, float64) { return it.its[0].At() }
+
+func (it *chainIterator) Err() error { return it.err }
+
+// mergeIterator merges two sorted iterators into one. Of two samples with
+// the same timestamp only the one of a is returned.
+type mergeIterator struct {
+	a, b     SampleIterator
+	aok, bok bool
+	cur      SampleIterator
+	dup      bool // b is at the timestamp of the current sample of a
+	started  bool
+}
+
+func newMergeIterator(a, b SampleIterator) *mergeIterator {
+	return &mergeIterator{a: a, b: b}
+}
+
+func (it *mergeIterator) Next() bool {
+	if !it.started {
+		it.aok, it.bok = it.a.Next(), it.b.Next()
+		it.started = true
+	} else if it.cur == it.a {
+		it.aok = it.a.Next()
+		if it.dup {
+			it.bok, it.dup = it.b.Next(), false
+		}
+	} else if it.cur == it.b {
+		it.bok = it.b.Next()
+	}
+
+	switch {
+	case it.aok && it.bok:
+		ta, _ := it.a.At()
+		tb, _ := it.b.At()
+		if tb < ta {
+			it.cur = it.b
+		} else {
+			it.cur, it.dup = it.a, tb == ta
+		}
+	case it.aok:
+		it.cur = it.a
+	case it.bok:
+		it.cur = it.b
+	default:
+		it.cur = nil
+		return false
+	}
+	return true
+}
+
+func (it *mergeIterator) At() (int64, float64) { return it.cur.At() }
+
+func (it *mergeIterator) Err() error {
+	if err := it.a.Err(); err != nil {
+		return err
+	}
+	return it.b.Err()
+}
+
+// listSeriesSet is a SeriesSet over a materialized list of series. With a
+// context, it stops once the context is done and so do the iterators of
+// its series.
+type listSeriesSet struct {
+	ctx    context.Context
+	series []Series
+	idx    int
+	err    error
+}
+
+func (ss *listSeriesSet) Next() bool {
+	if ss.err != nil {
+		return false
+	}
+	if ss.ctx != nil {
+		if ss.err = ss.ctx.Err(); ss.err != nil {
+			return false
+		}
+	}
+	ss.idx++
+	return ss.idx < len(ss.series)
+}
+
+func (ss *listSeriesSet) At() Series {
+	if ss.ctx == nil {
+		return ss.series[ss.idx]
+	}
+	return &ctxSeries{Series: ss.series[ss.idx], ctx: ss.ctx}
+}
+
+func (ss *listSeriesSet) Err() error { return ss.err }
+
+// ctxSeries is a series whose iterators stop once a context is done
+type ctxSeries struct {
+	Series
+	ctx context.Context
+}
+
+func (s *ctxSeries) Iterator() SampleIterator {
+	return &ctxIterator{it: s.Series.Iterator(), ctx: s.ctx}
+}
+
+func (s *ctxSeries) HistogramIterator() HistogramIterator {
+	return &ctxHistogramIterator{it: s.Series.HistogramIterator(), ctx: s.ctx}
+}
+
+// ctxIterator checks its context every ctxCheckInterval samples and stops
+// with the context's error once it is done
+type ctxIterator struct {
+	it  SampleIterator
+	ctx context.Context
+	n   int
+	err error
+}
+
+func (it *ctxIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.n++; it.n%ctxCheckInterval == 0 {
+		if it.err = it.ctx.Err(); it.err != nil {
+			return false
+		}
+	}
+	return it.it.Next()
+}
+
+func (it *ctxIterator) At() (int64, float64) { return it.it.At() }
+
+func (it *ctxIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.it.Err()
+}
+
+// ctxHistogramIterator is the ctxIterator of histogram samples
+type ctxHistogramIterator struct {
+	it  HistogramIterator
+	ctx context.Context
+	n   int
+	err error
+}
+
+func (it *ctxHistogramIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if it.n++; it.n%ctxCheckInterval == 0 {
+		if it.err = it.ctx.Err(); it.err != nil {
+			return false
+		}
+	}
+	return it.it.Next()
+}
+
+func (it *ctxHistogramIterator) At() (int64, prompb.Histogram) { return it.it.At() }
+
+func (it *ctxHistogramIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.it.Err()
+}
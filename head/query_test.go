@@ -0,0 +1,196 @@
+package head
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// TestSeriesIterator checks that an iterator over a range within a series
+// of many chunks yields exactly the samples of the range, from the chunks
+// overlapping it only
+func TestSeriesIterator(t *testing.T) {
+	h := newTestHead(t, Options{ChunkSize: 10})
+	l := labels.FromStrings(labels.MetricName, "a")
+	mustAppend(t, h, l, samplesAt(1, 100, 1)...)
+	ref, _ := h.GetRef(l)
+	s := h.Series(ref)
+
+	for _, tc := range []struct {
+		mint, maxt int64
+		chunks     int
+	}{
+		{35, 62, 4},
+		{41, 50, 1},
+		{40, 41, 2},
+		{1, 100, 10},
+		{95, 200, 1},
+	} {
+		var got []prompb.Sample
+		it := s.Iterator(tc.mint, tc.maxt)
+		for it.Next() {
+			ts, v := it.At()
+			got = append(got, prompb.Sample{Timestamp: ts, Value: v})
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal(err)
+		}
+		want := samplesAt(tc.mint, min(tc.maxt, 100), 1)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("[%d, %d]: got %d samples, want %d", tc.mint, tc.maxt, len(got), len(want))
+		}
+		if n := len(s.query(tc.mint, tc.maxt).chunks); n != tc.chunks {
+			t.Errorf("[%d, %d]: read %d chunks, want %d", tc.mint, tc.maxt, n, tc.chunks)
+		}
+	}
+
+	it := s.Iterator(200, 300)
+	if it.Next() || it.Err() != nil {
+		t.Errorf("iterator past the series has samples or fails: %v", it.Err())
+	}
+}
+
+// TestSelectCanceled cancels queries before they start, between series
+// and in the middle of the samples of a series
+func TestSelectCanceled(t *testing.T) {
+	h := newTestHead(t, Options{})
+	for i := 0; i < 10; i++ {
+		mustAppend(t, h, labels.FromStrings(labels.MetricName, "m", "i", strconv.Itoa(i)), samplesAt(1, 1000, 1)...)
+	}
+	all := labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "m")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ss := h.Select(ctx, 0, 1000, all)
+	if ss.Next() || !errors.Is(ss.Err(), context.Canceled) {
+		t.Fatalf("select with a canceled context: %v, want %v", ss.Err(), context.Canceled)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	ss = h.Select(ctx, 0, 1000, all)
+	for i := 0; i < 3; i++ {
+		if !ss.Next() {
+			t.Fatalf("series %d missing: %v", i, ss.Err())
+		}
+	}
+	cancel()
+	if ss.Next() || !errors.Is(ss.Err(), context.Canceled) {
+		t.Fatalf("series after canceling: %v, want %v", ss.Err(), context.Canceled)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	ss = h.Select(ctx, 0, 1000, all)
+	if !ss.Next() {
+		t.Fatal(ss.Err())
+	}
+	it := ss.At().Iterator()
+	for i := 0; i < 10; i++ {
+		it.Next()
+	}
+	cancel()
+	n := 10
+	for it.Next() {
+		n++
+	}
+	if !errors.Is(it.Err(), context.Canceled) || n > 10+ctxCheckInterval {
+		t.Fatalf("iterated %d of 1000 samples after canceling at 10: %v, want to stop within %d with %v", n, it.Err(), ctxCheckInterval, context.Canceled)
+	}
+}
+
+// collect returns the samples of an iterator
+func collect(t *testing.T, it SampleIterator) []prompb.Sample {
+	t.Helper()
+	var res []prompb.Sample
+	for it.Next() {
+		ts, v := it.At()
+		res = append(res, prompb.Sample{Timestamp: ts, Value: v})
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// rawChunk returns a chunk view of samples at the timestamps, all with
+// value v
+func rawChunk(v float64, ts ...int64) chunkView {
+	c := chunkView{mint: ts[0], maxt: ts[len(ts)-1]}
+	for _, t := range ts {
+		c.samples = append(c.samples, prompb.Sample{Timestamp: t, Value: v})
+	}
+	return c
+}
+
+// TestIteratorOverlappingChunks checks that the chunks of a series and its
+// out-of-order samples are merged into strictly increasing timestamps, the
+// sample of the earlier chunk winning on duplicates
+func TestIteratorOverlappingChunks(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		chunks []chunkView
+		ooo    []prompb.Sample
+		want   []prompb.Sample
+	}{
+		{
+			name:   "disjoint",
+			chunks: []chunkView{rawChunk(1, 1, 2), rawChunk(1, 3, 4)},
+			want:   rawChunk(1, 1, 2, 3, 4).samples,
+		},
+		{
+			name:   "interleaved",
+			chunks: []chunkView{rawChunk(1, 1, 3, 5, 7), rawChunk(1, 2, 4, 6), rawChunk(1, 8, 9)},
+			want:   rawChunk(1, 1, 2, 3, 4, 5, 6, 7, 8, 9).samples,
+		},
+		{
+			name:   "nested",
+			chunks: []chunkView{rawChunk(1, 1, 10), rawChunk(1, 2, 3), rawChunk(1, 4, 5)},
+			want:   rawChunk(1, 1, 2, 3, 4, 5, 10).samples,
+		},
+		{
+			name:   "duplicates",
+			chunks: []chunkView{rawChunk(1, 1, 3, 5), rawChunk(2, 3, 4, 5), rawChunk(3, 5, 6)},
+			want:   []prompb.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 3, Value: 1}, {Timestamp: 4, Value: 2}, {Timestamp: 5, Value: 1}, {Timestamp: 6, Value: 3}},
+		},
+		{
+			name:   "out of order",
+			chunks: []chunkView{rawChunk(1, 1, 5), rawChunk(1, 4, 8)},
+			ooo:    []prompb.Sample{{Timestamp: 2, Value: 2}, {Timestamp: 5, Value: 2}, {Timestamp: 6, Value: 2}},
+			want:   []prompb.Sample{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}, {Timestamp: 4, Value: 1}, {Timestamp: 5, Value: 1}, {Timestamp: 6, Value: 2}, {Timestamp: 8, Value: 1}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &querySeries{mint: 0, maxt: 100, chunks: tc.chunks, ooo: tc.ooo}
+			if got := collect(t, s.Iterator()); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestSelectOutOfOrder checks that a series with out-of-order samples
+// spread over several compressed chunks and the open one is selected in
+// strictly increasing timestamps
+func TestSelectOutOfOrder(t *testing.T) {
+	h := newTestHead(t, Options{ChunkSize: 10, OutOfOrderWindow: time.Second})
+	l := labels.FromStrings(labels.MetricName, "a")
+	mustAppend(t, h, l, samplesAt(2, 100, 2)...)
+	mustAppend(t, h, l, samplesAt(1, 99, 2)...)
+	// Retried samples are dropped
+	mustAppend(t, h, l, samplesAt(1, 100, 10)...)
+
+	want := map[string][]prompb.Sample{l.String(): samplesAt(1, 100, 1)}
+	if got := query(t, h, 0, 200); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	want = map[string][]prompb.Sample{l.String(): samplesAt(35, 62, 1)}
+	if got := query(t, h, 35, 62); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
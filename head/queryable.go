@@ -0,0 +1,237 @@
+package head
+
+import (
+	"context"
+
+	promhist "github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+// Queryable exposes a head as a Prometheus storage.Queryable, so the PromQL
+// engine can evaluate queries against it
+type Queryable struct {
+	head *Head
+}
+
+// NewQueryable returns a Queryable backed by the given head
+func NewQueryable(h *Head) *Queryable {
+	return &Queryable{head: h}
+}
+
+// Querier returns a querier over [mint, maxt] whose selects stop once the
+// context is done
+func (q *Queryable) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	return &querier{ctx: ctx, head: q.head, mint: mint, maxt: maxt}, nil
+}
+
+// querier implements storage.Querier over a fixed time range
+type querier struct {
+	ctx        context.Context
+	head       *Head
+	mint, maxt int64
+}
+
+// Select returns the matching series through the postings index. Series
+// are always sorted by labels, so sortSeries is ignored. Samples are only
+// decoded while iterating.
+func (q *querier) Select(_ bool, _ *storage.SelectHints, ms ...*labels.Matcher) storage.SeriesSet {
+	return &storageSeriesSet{ss: q.head.Select(q.ctx, q.mint, q.maxt, ms...)}
+}
+
+func (q *querier) LabelValues(name string, ms ...*labels.Matcher) ([]string, storage.Warnings, error) {
+	return q.head.LabelValues(name, ms...), nil, nil
+}
+
+func (q *querier) LabelNames(ms ...*labels.Matcher) ([]string, storage.Warnings, error) {
+	return q.head.LabelNames(ms...), nil, nil
+}
+
+func (q *querier) Close() error { return nil }
+
+// storageSeriesSet adapts a SeriesSet to storage.SeriesSet
+type storageSeriesSet struct {
+	ss SeriesSet
+}
+
+func (s *storageSeriesSet) Next() bool                 { return s.ss.Next() }
+func (s *storageSeriesSet) At() storage.Series         { return storageSeries{s.ss.At()} }
+func (s *storageSeriesSet) Err() error                 { return s.ss.Err() }
+func (s *storageSeriesSet) Warnings() storage.Warnings { return nil }
+
+// storageSeries adapts a Series to storage.Series
+type storageSeries struct {
+	Series
+}
+
+// Iterator returns an iterator over the float and histogram samples of the
+// series, reusing it if it was returned by an earlier call
+func (s storageSeries) Iterator(it chunkenc.Iterator) chunkenc.Iterator {
+	if si, ok := it.(*storageIterator); ok {
+		si.reset(s.Series.Iterator(), s.Series.HistogramIterator())
+		return si
+	}
+	si := &storageIterator{}
+	si.reset(s.Series.Iterator(), s.Series.HistogramIterator())
+	return si
+}
+
+// storageIterator merges the float and histogram samples of a series into
+// a single chunkenc.Iterator. Histograms are converted only when read.
+type storageIterator struct {
+	floats SampleIterator
+	hists  HistogramIterator
+
+	started  bool
+	fok, hok bool // the iterator holds a pending sample
+	ft       int64
+	fv       float64
+	ht       int64
+	h        prompb.Histogram
+
+	cur chunkenc.ValueType
+	err error
+}
+
+func (it *storageIterator) reset(floats SampleIterator, hists HistogramIterator) {
+	*it = storageIterator{floats: floats, hists: hists}
+}
+
+func (it *storageIterator) Next() chunkenc.ValueType {
+	if it.err != nil {
+		return chunkenc.ValNone
+	}
+	switch {
+	case !it.started:
+		it.started = true
+		it.nextFloat()
+		it.nextHistogram()
+	case it.cur == chunkenc.ValFloat:
+		it.nextFloat()
+	case it.cur != chunkenc.ValNone:
+		it.nextHistogram()
+	}
+	if it.err != nil {
+		it.cur = chunkenc.ValNone
+		return it.cur
+	}
+
+	switch {
+	case it.fok && (!it.hok || it.ft <= it.ht):
+		it.cur = chunkenc.ValFloat
+	case it.hok:
+		it.cur = chunkenc.ValHistogram
+		if isFloatHistogram(it.h) {
+			it.cur = chunkenc.ValFloatHistogram
+		}
+	default:
+		it.cur = chunkenc.ValNone
+	}
+	return it.cur
+}
+
+func (it *storageIterator) nextFloat() {
+	if it.fok = it.floats.Next(); it.fok {
+		it.ft, it.fv = it.floats.At()
+	} else if err := it.floats.Err(); err != nil {
+		it.err = err
+	}
+}
+
+func (it *storageIterator) nextHistogram() {
+	if it.hok = it.hists.Next(); it.hok {
+		it.ht, it.h = it.hists.At()
+	} else if err := it.hists.Err(); err != nil {
+		it.err = err
+	}
+}
+
+// seekTime is a timestamp as Seek takes it. Naming int64 apart keeps go vet
+// from taking Seek for the io.Seeker method.
+type seekTime = int64
+
+// Seek advances to the first sample at or after t. It never moves back.
+func (it *storageIterator) Seek(t seekTime) chunkenc.ValueType {
+	if it.started && it.cur != chunkenc.ValNone && it.AtT() >= t {
+		return it.cur
+	}
+	for it.Next() != chunkenc.ValNone {
+		if it.AtT() >= t {
+			return it.cur
+		}
+	}
+	return chunkenc.ValNone
+}
+
+func (it *storageIterator) At() (int64, float64) { return it.ft, it.fv }
+
+func (it *storageIterator) AtHistogram() (int64, *promhist.Histogram) {
+	return it.ht, histogramFromProto(it.h)
+}
+
+func (it *storageIterator) AtFloatHistogram() (int64, *promhist.FloatHistogram) {
+	if isFloatHistogram(it.h) {
+		return it.ht, floatHistogramFromProto(it.h)
+	}
+	return it.ht, histogramFromProto(it.h).ToFloat()
+}
+
+func (it *storageIterator) AtT() int64 {
+	if it.cur == chunkenc.ValFloat {
+		return it.ft
+	}
+	return it.ht
+}
+
+func (it *storageIterator) Err() error { return it.err }
+
+// isFloatHistogram reports whether a histogram carries float counts
+func isFloatHistogram(h prompb.Histogram) bool {
+	_, ok := h.GetCount().(*prompb.Histogram_CountFloat)
+	return ok
+}
+
+// histogramFromProto converts a remote write histogram with integer counts
+func histogramFromProto(h prompb.Histogram) *promhist.Histogram {
+	return &promhist.Histogram{
+		CounterResetHint: promhist.CounterResetHint(h.ResetHint),
+		Schema:           h.Schema,
+		ZeroThreshold:    h.ZeroThreshold,
+		ZeroCount:        h.GetZeroCountInt(),
+		Count:            h.GetCountInt(),
+		Sum:              h.Sum,
+		PositiveSpans:    spansFromProto(h.PositiveSpans),
+		PositiveBuckets:  h.PositiveDeltas,
+		NegativeSpans:    spansFromProto(h.NegativeSpans),
+		NegativeBuckets:  h.NegativeDeltas,
+	}
+}
+
+// floatHistogramFromProto converts a remote write histogram with float counts
+func floatHistogramFromProto(h prompb.Histogram) *promhist.FloatHistogram {
+	return &promhist.FloatHistogram{
+		CounterResetHint: promhist.CounterResetHint(h.ResetHint),
+		Schema:           h.Schema,
+		ZeroThreshold:    h.ZeroThreshold,
+		ZeroCount:        h.GetZeroCountFloat(),
+		Count:            h.GetCountFloat(),
+		Sum:              h.Sum,
+		PositiveSpans:    spansFromProto(h.PositiveSpans),
+		PositiveBuckets:  h.PositiveCounts,
+		NegativeSpans:    spansFromProto(h.NegativeSpans),
+		NegativeBuckets:  h.NegativeCounts,
+	}
+}
+
+func spansFromProto(ps []prompb.BucketSpan) []promhist.Span {
+	if len(ps) == 0 {
+		return nil
+	}
+	spans := make([]promhist.Span, len(ps))
+	for i, s := range ps {
+		spans[i] = promhist.Span{Offset: s.Offset, Length: s.Length}
+	}
+	return spans
+}
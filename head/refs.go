@@ -0,0 +1,57 @@
+package head
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// ErrRefInUse is returned when a RefAllocator hands out the reserved zero
+// reference or one that already belongs to another series.
+var ErrRefInUse = errors.New("head: series reference already in use")
+
+// RefAllocator assigns references to newly created series. References must
+// be non-zero and unique among the series of a head. NextRef is called with
+// the stripe lock of the labels held, so it may run concurrently for labels
+// of different stripes. Series restored from the WAL keep their references,
+// so an allocator must not rely on having handed out all references in use.
+type RefAllocator interface {
+	NextRef(lset labels.Labels) uint64
+}
+
+// refObserver is implemented by allocators that need to learn about
+// references restored from the WAL
+type refObserver interface {
+	observe(ref uint64)
+}
+
+// IncrementingRefs hands out consecutive references starting at 1. It is
+// the default allocator.
+type IncrementingRefs struct {
+	last uint64
+}
+
+// NextRef returns the next unused reference
+func (a *IncrementingRefs) NextRef(labels.Labels) uint64 {
+	return atomic.AddUint64(&a.last, 1)
+}
+
+// observe makes sure ref is never handed out again
+func (a *IncrementingRefs) observe(ref uint64) {
+	for {
+		last := atomic.LoadUint64(&a.last)
+		if ref <= last || atomic.CompareAndSwapUint64(&a.last, last, ref) {
+			return
+		}
+	}
+}
+
+// HashRefs derives references from the label set hash, so the same series
+// gets the same reference across restarts and instances.
+type HashRefs struct{}
+
+// NextRef returns the hash of the labels
+func (HashRefs) NextRef(lset labels.Labels) uint64 {
+	return lset.Hash()
+}
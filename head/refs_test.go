@@ -0,0 +1,99 @@
+package head
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// shardRefs hands out references carrying a shard id in the upper 32 bits
+type shardRefs struct {
+	shard uint64
+
+	mtx  sync.Mutex
+	next uint64
+}
+
+func (a *shardRefs) NextRef(labels.Labels) uint64 {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.next++
+	return a.shard<<32 | a.next
+}
+
+// fixedRef hands out the same reference for every series
+type fixedRef uint64
+
+func (r fixedRef) NextRef(labels.Labels) uint64 { return uint64(r) }
+
+func TestRefAllocator(t *testing.T) {
+	h := newTestHead(t, Options{RefAllocator: &shardRefs{shard: 7}})
+	seen := make(map[uint64]bool)
+	for i := 0; i < 100; i++ {
+		s, _, err := h.getOrCreate(labels.FromStrings(labels.MetricName, "m", "i", fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.ref>>32 != 7 || s.ref&(1<<32-1) != uint64(i+1) {
+			t.Fatalf("series %d got ref %#x, want shard 7 and counter %d", i, s.ref, i+1)
+		}
+		if seen[s.ref] {
+			t.Fatalf("ref %#x handed out twice", s.ref)
+		}
+		seen[s.ref] = true
+	}
+
+	h = newTestHead(t, Options{RefAllocator: HashRefs{}})
+	l := labels.FromStrings(labels.MetricName, "m")
+	if s, _, err := h.getOrCreate(l); err != nil || s.ref != l.Hash() {
+		t.Fatalf("HashRefs: %v, want the label hash %#x as ref", err, l.Hash())
+	}
+}
+
+// TestRefAllocatorInUse checks that series are not created under a zero
+// reference or one another series holds
+func TestRefAllocatorInUse(t *testing.T) {
+	h := newTestHead(t, Options{RefAllocator: fixedRef(5)})
+	a := labels.FromStrings(labels.MetricName, "a")
+	mustAppend(t, h, a, prompb.Sample{Timestamp: 1, Value: 1})
+	if err := h.Append(labels.FromStrings(labels.MetricName, "b"), prompb.Sample{Timestamp: 1, Value: 1}); err != ErrRefInUse {
+		t.Fatalf("append with a reference in use: %v, want %v", err, ErrRefInUse)
+	}
+	if s := h.Series(5); s == nil || !labels.Equal(s.lset, a) {
+		t.Fatal("series holding the reference replaced")
+	}
+
+	h = newTestHead(t, Options{RefAllocator: fixedRef(0)})
+	if err := h.Append(a, prompb.Sample{Timestamp: 1, Value: 1}); err != ErrRefInUse {
+		t.Fatalf("append with the zero reference: %v, want %v", err, ErrRefInUse)
+	}
+}
+
+// TestIncrementingRefsRestart checks that references restored from the WAL
+// are not handed out again
+func TestIncrementingRefsRestart(t *testing.T) {
+	opts := Options{}
+	h := newTestHead(t, opts)
+	var refs []uint64
+	for i := 0; i < 10; i++ {
+		s, _, err := h.getOrCreate(labels.FromStrings(labels.MetricName, "m", "i", fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, s.ref)
+	}
+
+	h = reopenHead(t, h, opts)
+	s, _, err := h.getOrCreate(labels.FromStrings(labels.MetricName, "n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, old := range refs {
+		if s.ref == old {
+			t.Fatalf("ref %d of a restored series handed out again", s.ref)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package head
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/yuanhuiqu/protsdb/wal"
+)
+
+func TestReopen(t *testing.T) {
+	opts := Options{}
+	h := newTestHead(t, opts)
+	a := labels.FromStrings(labels.MetricName, "a")
+	b := labels.FromStrings(labels.MetricName, "b")
+	mustAppend(t, h, a, samplesAt(1, 100, 1)...)
+
+	if err := h.Reopen(); err == nil {
+		t.Fatal("reopen of an open head succeeded")
+	}
+	opts.WALDir = h.walDir
+	if _, err := NewHead(opts); !errors.Is(err, wal.ErrLocked) {
+		t.Fatalf("second head on an open WAL: %v, want %v", err, wal.ErrLocked)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := h.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Reopen(); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := h.GetRef(a); !ok {
+			t.Fatal("series not reopened")
+		}
+		mustAppend(t, h, b, samplesAt(int64(101+100*i), int64(200+100*i), 1)...)
+	}
+
+	want := map[string][]prompb.Sample{
+		a.String(): samplesAt(1, 100, 1),
+		b.String(): samplesAt(101, 300, 1),
+	}
+	if got := query(t, h, 0, 1000); !reflect.DeepEqual(got, want) {
+		t.Errorf("%d samples after reopening, want %d", countSamples(t, h, 0, 1000), 300)
+	}
+	if _, err := NewHead(opts); !errors.Is(err, wal.ErrLocked) {
+		t.Fatalf("second head on a reopened WAL: %v, want %v", err, wal.ErrLocked)
+	}
+
+	// Closing released the lock, which another head may take meanwhile
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	other := newTestHead(t, opts)
+	if got := query(t, other, 0, 1000); !reflect.DeepEqual(got, want) {
+		t.Errorf("%d samples in a head opened after closing, want %d", countSamples(t, other, 0, 1000), 300)
+	}
+	if err := h.Reopen(); !errors.Is(err, wal.ErrLocked) {
+		t.Fatalf("reopen of a WAL locked by another head: %v, want %v", err, wal.ErrLocked)
+	}
+}
+
+// TestCloseReplay checks that everything appended before Close is replayed
+// after a restart, although the sync policy never synced it on its own and
+// maintenance was running meanwhile
+func TestCloseReplay(t *testing.T) {
+	opts := Options{WALSyncPolicy: wal.SyncInterval(time.Hour)}
+	h := newTestHead(t, opts)
+	h.StartMaintenance(time.Millisecond)
+	series := []labels.Labels{
+		labels.FromStrings(labels.MetricName, "a"),
+		labels.FromStrings(labels.MetricName, "b"),
+	}
+	for _, l := range series {
+		mustAppend(t, h, l, samplesAt(1, 1000, 1)...)
+	}
+	want := query(t, h, 0, 1000)
+
+	h = reopenHead(t, h, opts)
+	if got := query(t, h, 0, 1000); !reflect.DeepEqual(got, want) {
+		t.Fatalf("%d samples replayed after closing, want %d", countSamples(t, h, 0, 1000), 2000)
+	}
+}
+
+// TestDisableWAL checks that a head without a WAL serves what was appended
+// without writing it anywhere, and starts empty after a restart
+func TestDisableWAL(t *testing.T) {
+	opts := Options{DisableWAL: true}
+	h := newTestHead(t, opts)
+	l := labels.FromStrings(labels.MetricName, "a")
+	mustAppend(t, h, l, samplesAt(1, 100, 1)...)
+	b := h.NewBatcher(BatchOptions{})
+	if err := b.Append(l, prompb.Sample{Timestamp: 101, Value: 101}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countSamples(t, h, 0, 1000); n != 101 {
+		t.Fatalf("%d samples appended, want 101", n)
+	}
+	if _, err := os.Stat(h.walDir); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("WAL directory created: %v", err)
+	}
+
+	h = reopenHead(t, h, opts)
+	if n := h.Stats().NumSeries; n != 0 {
+		t.Fatalf("%d series after a restart, want none", n)
+	}
+}
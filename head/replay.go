@@ -0,0 +1,228 @@
+package head
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/yuanhuiqu/protsdb/wal"
+)
+
+// replay rebuilds the in-memory series from the WAL. Samples the live path
+// would reject, e.g. duplicates, are skipped the same way, as are samples
+// of series whose record was already cleaned from the WAL and of series
+// without labels, which older versions logged. A checkpoint
+// record raises the minimum valid time past the samples it covers, which
+// are skipped from then on and dropped if they were replayed before it.
+func (h *Head) replay() error {
+	// Series by the reference they were logged with
+	refs := make(map[uint64]*memSeries)
+
+	floor := atomic.LoadInt64(&h.minValidTime)
+
+	// Replayed samples were accepted once, and those a later checkpoint
+	// record drops still count until the end, so the sample limit only
+	// applies to new appends
+	limit := h.maxSeriesSamples
+	h.maxSeriesSamples = 0
+	defer func() { h.maxSeriesSamples = limit }()
+	err := h.wal.Replay(func(typ, version byte, data []byte) error {
+		if version == 0 {
+			return h.replayLegacy(typ, data)
+		}
+
+		switch typ {
+		case wal.RecordSeries:
+			ref, lset, err := wal.DecodeSeries(data)
+			if err != nil {
+				return err
+			}
+			if lset.IsEmpty() {
+				return nil
+			}
+			s, err := h.replaySeries(ref, lset)
+			if err != nil {
+				return err
+			}
+			refs[ref] = s
+
+		case wal.RecordSamples:
+			sampleRefs, samples, err := wal.DecodeSamples(data)
+			if err != nil {
+				return err
+			}
+			for i, sample := range samples {
+				if s, ok := refs[sampleRefs[i]]; ok {
+					h.replaySample(s, sample)
+				}
+			}
+
+		case wal.RecordHistograms, wal.RecordFloatHistograms:
+			histRefs, histograms, err := wal.DecodeHistograms(data)
+			if err != nil {
+				return err
+			}
+			for i, hist := range histograms {
+				if s, ok := refs[histRefs[i]]; ok {
+					s.Lock()
+					h.appendHistogram(s, hist)
+					s.Unlock()
+				}
+			}
+
+		case wal.RecordExemplars:
+			exRefs, exemplars, err := wal.DecodeExemplars(data)
+			if err != nil {
+				return err
+			}
+			for i, e := range exemplars {
+				if s, ok := refs[exRefs[i]]; ok {
+					s.Lock()
+					h.appendExemplar(s, e)
+					s.Unlock()
+				}
+			}
+
+		case wal.RecordMetadata:
+			md, err := wal.DecodeMetadata(data)
+			if err != nil {
+				return err
+			}
+			h.setMetadata(md)
+
+		case wal.RecordTombstones:
+			stones, err := wal.DecodeTombstones(data)
+			if err != nil {
+				return err
+			}
+			for _, t := range stones {
+				if s, ok := refs[t.Ref]; ok {
+					s.Lock()
+					s.addTombstone(Interval{Mint: t.Mint, Maxt: t.Maxt})
+					s.Unlock()
+				}
+			}
+
+		case wal.RecordSequence:
+			ref, seq, err := wal.DecodeSequence(data)
+			if err != nil {
+				return err
+			}
+			if s, ok := refs[ref]; ok {
+				s.replaySequence(seq)
+			}
+
+		case wal.RecordCheckpoint:
+			maxt, err := wal.DecodeCheckpoint(data)
+			if err != nil {
+				return err
+			}
+			if maxt >= atomic.LoadInt64(&h.minValidTime) {
+				atomic.StoreInt64(&h.minValidTime, maxt+1)
+			}
+
+		default:
+			return fmt.Errorf("head: unknown WAL record type %d", typ)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if minValid := atomic.LoadInt64(&h.minValidTime); minValid > floor {
+		for _, s := range h.allSeries() {
+			s.Lock()
+			s.dropRange(math.MinInt64, minValid-1, h.compress)
+			s.Unlock()
+		}
+	}
+	return nil
+}
+
+// replayLegacy restores a version 0 record, which identifies series by
+// their full label set
+func (h *Head) replayLegacy(typ byte, data []byte) error {
+	switch typ {
+	case wal.RecordSeries:
+		lset, err := wal.DecodeLegacySeries(data)
+		if err != nil || lset.IsEmpty() {
+			return err
+		}
+		_, err = h.replaySeries(0, lset)
+		return err
+
+	case wal.RecordSamples:
+		lsets, samples, err := wal.DecodeLegacySamples(data)
+		if err != nil {
+			return err
+		}
+		for i, sample := range samples {
+			if lsets[i].IsEmpty() {
+				continue
+			}
+			s, err := h.replaySeries(0, lsets[i])
+			if err != nil {
+				return err
+			}
+			h.replaySample(s, sample)
+		}
+
+	case wal.RecordSequence:
+		lset, seq, err := wal.DecodeLegacySequence(data)
+		if err != nil || lset.IsEmpty() {
+			return err
+		}
+		s, err := h.replaySeries(0, lset)
+		if err != nil {
+			return err
+		}
+		s.replaySequence(seq)
+
+	case wal.RecordCheckpoint:
+		// Nothing to restore
+
+	default:
+		return fmt.Errorf("head: unknown WAL record type %d", typ)
+	}
+	return nil
+}
+
+// replaySeries returns the series for a replayed series record. New series
+// keep their logged reference if it is still free, so references are stable
+// across restarts. A zero ref always allocates a new one.
+func (h *Head) replaySeries(ref uint64, lset labels.Labels) (*memSeries, error) {
+	st := h.stripe(lset.Hash())
+	st.Lock()
+	defer st.Unlock()
+
+	if s := st.lookup(lset); s != nil {
+		return s, nil
+	}
+	if ref == 0 || h.Series(ref) != nil {
+		return h.createSeries(st, lset)
+	}
+	if o, ok := h.refs.(refObserver); ok {
+		o.observe(ref)
+	}
+	return h.newSeries(st, ref, lset)
+}
+
+// replaySample adds a replayed sample, ignoring the errors the live path
+// reported when it was first appended
+func (h *Head) replaySample(s *memSeries, sample prompb.Sample) {
+	s.Lock()
+	h.appendSample(s, sample)
+	s.Unlock()
+}
+
+// replaySequence restores the last accepted sequence of a series
+func (s *memSeries) replaySequence(seq uint64) {
+	s.Lock()
+	if seq > s.lastSeq {
+		s.lastSeq = seq
+	}
+	s.Unlock()
+}
@@ -0,0 +1,146 @@
+package head
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestDuplicatePolicy(t *testing.T) {
+	in := []prompb.Sample{
+		{Timestamp: 1000, Value: 1},
+		{Timestamp: 1500, Value: 2},
+		{Timestamp: 1999, Value: 3},
+		{Timestamp: 2000, Value: 4},
+		{Timestamp: 2001, Value: 5},
+	}
+	for _, tc := range []struct {
+		name   string
+		policy DuplicatePolicy
+		want   []prompb.Sample
+	}{
+		{
+			name:   "keep last",
+			policy: DuplicateKeepLast,
+			want:   []prompb.Sample{{Timestamp: 1000, Value: 3}, {Timestamp: 2000, Value: 5}},
+		},
+		{
+			name:   "keep first",
+			policy: DuplicateKeepFirst,
+			want:   []prompb.Sample{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 4}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHead(t, Options{
+				DisableWAL:          true,
+				TimestampResolution: time.Second,
+				DuplicatePolicy:     tc.policy,
+			})
+			l := labels.FromStrings(labels.MetricName, "a")
+			mustAppend(t, h, l, in...)
+			if got := query(t, h, 0, 3000)[l.String()]; !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestDuplicateKeepFirstAppended checks that samples DuplicateKeepFirst
+// drops are not counted as appended, whichever way they are appended
+func TestDuplicateKeepFirstAppended(t *testing.T) {
+	in := []prompb.Sample{
+		{Timestamp: 1000, Value: 1},
+		{Timestamp: 1500, Value: 2},
+		{Timestamp: 2000, Value: 3},
+		{Timestamp: 2999, Value: 4},
+	}
+	for _, tc := range []struct {
+		name   string
+		append func(h *Head, l labels.Labels) error
+	}{
+		{"append", func(h *Head, l labels.Labels) error {
+			for _, s := range in {
+				if err := h.Append(l, s); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		{"batch", func(h *Head, l labels.Labels) error {
+			b := h.NewBatcher(BatchOptions{})
+			for _, s := range in {
+				if err := b.Append(l, s); err != nil {
+					return err
+				}
+			}
+			return b.Flush()
+		}},
+		{"sequenced", func(h *Head, l labels.Labels) error {
+			return h.AppendSequenced(l, 1, in...)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := Options{TimestampResolution: time.Second, DuplicatePolicy: DuplicateKeepFirst}
+			h := newTestHead(t, opts)
+			l := labels.FromStrings(labels.MetricName, "a")
+			if err := tc.append(h, l); err != nil {
+				t.Fatal(err)
+			}
+			want := []prompb.Sample{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 3}}
+			if got := query(t, h, 0, 3000)[l.String()]; !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+			if n := h.Stats().SamplesAppended; n != 2 {
+				t.Errorf("%d samples appended, want 2", n)
+			}
+
+			h = reopenHead(t, h, opts)
+			if got := query(t, h, 0, 3000)[l.String()]; !reflect.DeepEqual(got, want) {
+				t.Errorf("restart restored %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// TestDuplicateKeepLastConcurrentQuery replaces the newest sample while
+// queries iterate over it, for the race detector to check
+func TestDuplicateKeepLastConcurrentQuery(t *testing.T) {
+	h := newTestHead(t, Options{
+		DisableWAL:          true,
+		TimestampResolution: time.Second,
+	})
+	l := labels.FromStrings(labels.MetricName, "a")
+	mustAppend(t, h, l, prompb.Sample{Timestamp: 1000, Value: 0})
+	ref, _ := h.GetRef(l)
+	s := h.Series(ref)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i < 1000; i++ {
+			if err := h.Append(l, prompb.Sample{Timestamp: 1000 + int64(i), Value: float64(i)}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		it := s.Iterator(0, 2000)
+		n := 0
+		for it.Next() {
+			if ts, _ := it.At(); ts != 1000 {
+				t.Fatalf("sample at %d, want 1000", ts)
+			}
+			n++
+		}
+		if n != 1 {
+			t.Fatalf("%d samples, want 1", n)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,68 @@
+package head
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// ErrStaleSequence is returned for sequenced appends whose sequence is not
+// greater than the last one accepted for the series, i.e. replays.
+var ErrStaleSequence = errors.New("head: stale sequence")
+
+// AppendSequenced appends samples for a series tagged with a client supplied,
+// per series monotonic sequence. All samples share the sequence and are
+// dropped together with ErrStaleSequence if it was already seen, which lets
+// exactly-once pipelines replay writes safely. Sequences start at 1. The
+// samples are also rejected together if one of them fails validation or
+// they don't fit into the sample limit of the series.
+func (h *Head) AppendSequenced(l labels.Labels, seq uint64, samples ...prompb.Sample) error {
+	for _, sample := range samples {
+		if err := h.validateSample(sample); err != nil {
+			return err
+		}
+	}
+
+	s, err := h.lockSeries(l)
+	if err != nil {
+		return err
+	}
+	defer s.Unlock()
+
+	if seq <= s.lastSeq {
+		return ErrStaleSequence
+	}
+	if err := h.checkSeriesFull(s, len(samples)); err != nil {
+		return err
+	}
+
+	refs := make([]uint64, len(samples))
+	for i := range samples {
+		refs[i] = s.ref
+		samples[i].Timestamp = h.truncate(samples[i].Timestamp)
+		h.observeSkew(samples[i].Timestamp)
+	}
+
+	// Persist the sequence along with the samples so replays are still
+	// recognized after a restart
+	if err := h.wal.LogSequence(s.ref, seq); err != nil {
+		return err
+	}
+	if err := h.wal.LogSamples(refs, samples); err != nil {
+		return err
+	}
+	s.lastSeq = seq
+
+	for _, sample := range samples {
+		dropped := h.keepsFirst(s, sample)
+		if err := h.appendSample(s, sample); err != nil {
+			return err
+		}
+		if !dropped {
+			atomic.AddUint64(&h.samplesAppended, 1)
+		}
+	}
+	return nil
+}
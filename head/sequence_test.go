@@ -0,0 +1,107 @@
+package head
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// TestAppendSequenced checks that replayed and older sequences are dropped,
+// also after a restart
+func TestAppendSequenced(t *testing.T) {
+	opts := Options{}
+	h := newTestHead(t, opts)
+	a := labels.FromStrings(labels.MetricName, "a")
+
+	if err := h.AppendSequenced(a, 1, samplesAt(1, 10, 1)...); err != nil {
+		t.Fatal(err)
+	}
+	// Replayed and older sequences are dropped with all their samples
+	for _, seq := range []uint64{1, 0} {
+		if err := h.AppendSequenced(a, seq, samplesAt(11, 20, 1)...); err != ErrStaleSequence {
+			t.Fatalf("sequence %d: %v, want %v", seq, err, ErrStaleSequence)
+		}
+	}
+	if err := h.AppendSequenced(a, 3, samplesAt(21, 30, 1)...); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AppendSequenced(a, 2, samplesAt(31, 40, 1)...); err != ErrStaleSequence {
+		t.Fatalf("older sequence: %v, want %v", err, ErrStaleSequence)
+	}
+	if n := countSamples(t, h, 0, 100); n != 20 {
+		t.Errorf("%d samples, want 20", n)
+	}
+
+	// Sequences survive restarts
+	h = reopenHead(t, h, opts)
+	if err := h.AppendSequenced(a, 3, samplesAt(41, 50, 1)...); err != ErrStaleSequence {
+		t.Fatalf("replayed sequence after a restart: %v, want %v", err, ErrStaleSequence)
+	}
+	if err := h.AppendSequenced(a, 4, samplesAt(41, 50, 1)...); err != nil {
+		t.Fatal(err)
+	}
+	if n := countSamples(t, h, 0, 100); n != 30 {
+		t.Errorf("%d samples after a restart, want 30", n)
+	}
+}
+
+// TestAppendSequencedCheckpoint checks that sequences survive restarts once
+// the segments logging them were replaced by a checkpoint
+func TestAppendSequencedCheckpoint(t *testing.T) {
+	opts := Options{WALSegmentSize: 4096}
+	h := newTestHead(t, opts)
+	a := labels.FromStrings(labels.MetricName, "a")
+
+	// The first write is large enough to fill a WAL segment of its own,
+	// which the truncation below checkpoints along with the segment
+	// logging the series and its sequence
+	if err := h.AppendSequenced(a, 1, samplesAt(1, 1000, 1)...); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AppendSequenced(a, 1, samplesAt(1001, 1001, 1)...); err != ErrStaleSequence {
+		t.Fatalf("replayed sequence: %v, want %v", err, ErrStaleSequence)
+	}
+	mustAppend(t, h, a, samplesAt(3000, 3000, 1)...)
+	if _, _, err := h.Truncate(2000); err != nil {
+		t.Fatal(err)
+	}
+	if st := h.wal.Stats(); st.LastCheckpoint.IsZero() {
+		t.Fatal("truncation did not checkpoint the WAL")
+	}
+
+	// Sequences survive restarts, also once the segments logging them were
+	// replaced by a checkpoint
+	for i := 0; i < 2; i++ {
+		h = reopenHead(t, h, opts)
+		if err := h.AppendSequenced(a, 1, samplesAt(3001, 3001, 1)...); err != ErrStaleSequence {
+			t.Fatalf("restart %d: replayed sequence: %v, want %v", i+1, err, ErrStaleSequence)
+		}
+	}
+	if err := h.AppendSequenced(a, 2, samplesAt(3001, 3002, 1)...); err != nil {
+		t.Fatal(err)
+	}
+	if got := query(t, h, 0, 4000)[a.String()]; len(got) != 3 {
+		t.Errorf("%d samples, want 3: %v", len(got), got)
+	}
+}
+
+// TestAppendSequencedAtomic checks that a write is rejected as a whole if
+// one of its samples is invalid
+func TestAppendSequencedAtomic(t *testing.T) {
+	h := newTestHead(t, Options{DisableWAL: true})
+	a := labels.FromStrings(labels.MetricName, "a")
+
+	// A sample failing validation rejects the whole write and leaves its
+	// sequence unused
+	bad := []prompb.Sample{{Timestamp: 1000, Value: 1}, {Timestamp: 0, Value: 2}}
+	if err := h.AppendSequenced(a, 1, bad...); err != ErrInvalidTimestamp {
+		t.Fatalf("invalid sample: %v, want %v", err, ErrInvalidTimestamp)
+	}
+	if err := h.AppendSequenced(a, 1, samplesAt(1000, 1001, 1)...); err != nil {
+		t.Fatal(err)
+	}
+	if n := countSamples(t, h, 0, 2000); n != 2 {
+		t.Errorf("%d samples, want 2", n)
+	}
+}
@@ -0,0 +1,85 @@
+package head
+
+import (
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultSkewBuckets are the upper bounds in seconds of the ingest skew histograms
+var DefaultSkewBuckets = []float64{0.1, 0.5, 1, 5, 15, 60, 300, 900, 3600, 21600, 86400}
+
+// histogram is a cumulative-on-read histogram safe for concurrent use
+type histogram struct {
+	bounds []float64 // sorted upper bounds, +Inf is implicit
+	counts []uint64  // per bucket counts, last one is +Inf
+	count  uint64
+	sum    uint64 // float64 bits
+}
+
+func newHistogram(bounds []float64) *histogram {
+	b := append([]float64(nil), bounds...)
+	sort.Float64s(b)
+	return &histogram{bounds: b, counts: make([]uint64, len(b)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		if atomic.CompareAndSwapUint64(&h.sum, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// HistogramSnapshot is a point-in-time copy of a histogram
+type HistogramSnapshot struct {
+	Bounds []float64 // upper bounds, excluding +Inf
+	Counts []uint64  // cumulative counts per bound, the last entry is +Inf
+	Count  uint64
+	Sum    float64
+}
+
+func (h *histogram) snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Bounds: h.bounds,
+		Counts: make([]uint64, len(h.counts)),
+		Count:  atomic.LoadUint64(&h.count),
+		Sum:    math.Float64frombits(atomic.LoadUint64(&h.sum)),
+	}
+	var cum uint64
+	for i := range h.counts {
+		cum += atomic.LoadUint64(&h.counts[i])
+		s.Counts[i] = cum
+	}
+	return s
+}
+
+// SkewStats is the distribution of the difference between the ingest time
+// and sample timestamps, in seconds
+type SkewStats struct {
+	Late   HistogramSnapshot // samples older than now
+	Future HistogramSnapshot // samples ahead of now
+}
+
+// TimestampSkew returns the ingest skew distribution observed so far
+func (h *Head) TimestampSkew() SkewStats {
+	return SkewStats{
+		Late:   h.lateSkew.snapshot(),
+		Future: h.futureSkew.snapshot(),
+	}
+}
+
+// observeSkew records how far a sample timestamp lies from now
+func (h *Head) observeSkew(t int64) {
+	d := h.now().Sub(time.UnixMilli(t)).Seconds()
+	if d >= 0 {
+		h.lateSkew.observe(d)
+	} else {
+		h.futureSkew.observe(-d)
+	}
+}
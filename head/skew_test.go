@@ -0,0 +1,56 @@
+package head
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestTimestampSkew(t *testing.T) {
+	now := time.UnixMilli(1_000_000)
+	h := newTestHead(t, Options{
+		SkewBuckets: []float64{60, 1, 5},
+		Now:         func() time.Time { return now },
+	})
+	for _, skew := range []time.Duration{
+		0,
+		300 * time.Millisecond,
+		3 * time.Second,
+		10 * time.Minute,
+		-2 * time.Second,
+		-30 * time.Second,
+	} {
+		s := prompb.Sample{Timestamp: now.Add(-skew).UnixMilli(), Value: 1}
+		if err := h.Append(labels.FromStrings(labels.MetricName, "a", "skew", skew.String()), s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Rejected samples are not counted
+	l := labels.FromStrings(labels.MetricName, "a")
+	if err := h.Append(l, prompb.Sample{Timestamp: -1, Value: 1}); err != ErrInvalidTimestamp {
+		t.Fatalf("append: %v, want %v", err, ErrInvalidTimestamp)
+	}
+
+	st := h.TimestampSkew()
+	late := HistogramSnapshot{
+		Bounds: []float64{1, 5, 60},
+		Counts: []uint64{2, 3, 3, 4},
+		Count:  4,
+		Sum:    0 + 0.3 + 3 + 600,
+	}
+	future := HistogramSnapshot{
+		Bounds: []float64{1, 5, 60},
+		Counts: []uint64{0, 1, 2, 2},
+		Count:  2,
+		Sum:    2 + 30,
+	}
+	if !reflect.DeepEqual(st.Late, late) {
+		t.Errorf("late skew %+v, want %+v", st.Late, late)
+	}
+	if !reflect.DeepEqual(st.Future, future) {
+		t.Errorf("future skew %+v, want %+v", st.Future, future)
+	}
+}
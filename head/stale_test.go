@@ -0,0 +1,75 @@
+package head
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// TestStaleMarker checks that a series ends at a sample carrying the exact
+// staleness marker bit pattern, and lives again at the next real sample
+func TestStaleMarker(t *testing.T) {
+	// Validation would reject the plain NaN below
+	h := newTestHead(t, Options{DisableValidation: true})
+	l := labels.FromStrings(labels.MetricName, "up", "job", "a")
+	stale := math.Float64frombits(value.StaleNaN)
+	mustAppend(t, h, l,
+		prompb.Sample{Timestamp: 10, Value: 1},
+		prompb.Sample{Timestamp: 20, Value: 1},
+		prompb.Sample{Timestamp: 30, Value: stale},
+	)
+	// Any other NaN is an ordinary value
+	other := labels.FromStrings(labels.MetricName, "up", "job", "b")
+	mustAppend(t, h, other, prompb.Sample{Timestamp: 30, Value: math.NaN()})
+
+	if n := h.Stats().NumStaleSeries; n != 1 {
+		t.Fatalf("%d stale series, want 1", n)
+	}
+
+	ss := h.Select(context.Background(), 0, 100, labels.MustNewMatcher(labels.MatchEqual, "job", "a"))
+	if !ss.Next() {
+		t.Fatalf("no series selected: %v", ss.Err())
+	}
+	s := ss.At()
+	for _, tc := range []struct {
+		t     int64
+		stale bool
+	}{
+		{5, false},
+		{10, false},
+		{29, false},
+		{30, true},
+		{100, true},
+	} {
+		if got := s.StaleAt(tc.t); got != tc.stale {
+			t.Errorf("StaleAt(%d) = %v, want %v", tc.t, got, tc.stale)
+		}
+	}
+	// The marker comes back bit for bit
+	samples := query(t, h, 0, 100, labels.MustNewMatcher(labels.MatchEqual, "job", "a"))[l.String()]
+	if len(samples) != 3 || math.Float64bits(samples[2].Value) != value.StaleNaN {
+		t.Fatalf("samples %v do not end with the staleness marker", samples)
+	}
+
+	ss = h.Select(context.Background(), 0, 100, labels.MustNewMatcher(labels.MatchEqual, "job", "b"))
+	if !ss.Next() || ss.At().StaleAt(30) {
+		t.Fatal("series ending in a plain NaN is stale")
+	}
+
+	// A new sample ends the staleness
+	mustAppend(t, h, l, prompb.Sample{Timestamp: 40, Value: 1})
+	if n := h.Stats().NumStaleSeries; n != 0 {
+		t.Fatalf("%d stale series after a new sample, want 0", n)
+	}
+	ss = h.Select(context.Background(), 0, 100, labels.MustNewMatcher(labels.MatchEqual, "job", "a"))
+	if !ss.Next() {
+		t.Fatalf("no series selected: %v", ss.Err())
+	}
+	if s := ss.At(); !s.StaleAt(35) || s.StaleAt(40) {
+		t.Fatal("series is not stale only between the marker and the next sample")
+	}
+}
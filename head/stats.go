@@ -0,0 +1,121 @@
+package head
+
+import (
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/yuanhuiqu/protsdb/chunkenc"
+	"github.com/yuanhuiqu/protsdb/wal"
+)
+
+// Stats is a point-in-time summary of the head
+type Stats struct {
+	NumSeries       int
+	SeriesCreated   uint64 // series created by appends, excluding WAL replay
+	SeriesRemoved   uint64 // series removed for holding no samples or going stale
+	MaxSeries       int    // series limit, 0 if unlimited
+	NumChunks       int    // float, out-of-order and histogram chunks holding samples
+	NumSamples      int    // float and histogram samples held by the head
+	HeadSizeBytes   int64  // approximate memory held by series and their samples
+	InternedStrings int    // distinct label names and values shared by the series
+	NumStaleSeries  int    // series whose newest sample is a staleness marker
+	SamplesAppended uint64 // samples accepted by appends, excluding WAL replay
+	MinTime         int64  // math.MaxInt64 if the head is empty
+	MaxTime         int64  // math.MinInt64 if the head is empty
+
+	// Samples rejected by append-time validation or the per-series sample
+	// limit by reason, reasons without any are left out
+	SamplesRejected map[string]uint64
+
+	// Series by the encoding of their completed chunks, series without
+	// one are not counted
+	Encodings map[chunkenc.Encoding]int
+}
+
+// Stats returns the current head statistics. Series are read locked one
+// at a time, so appends are only held up by the series they write to.
+func (h *Head) Stats() Stats {
+	all := h.allSeries()
+	st := Stats{
+		NumSeries:       len(all),
+		MaxSeries:       h.maxSeries,
+		SeriesCreated:   atomic.LoadUint64(&h.seriesCreated),
+		SeriesRemoved:   atomic.LoadUint64(&h.seriesRemoved),
+		SamplesAppended: atomic.LoadUint64(&h.samplesAppended),
+		MinTime:         h.MinTime(),
+		MaxTime:         h.MaxTime(),
+		Encodings:       make(map[chunkenc.Encoding]int),
+		SamplesRejected: h.samplesRejected(),
+		InternedStrings: h.intern.size(),
+	}
+	for _, s := range all {
+		s.RLock()
+		st.NumChunks += len(s.chunks) + len(s.histograms)
+		if len(s.chunk.samples) > 0 {
+			st.NumChunks++
+		}
+		if len(s.ooo.samples) > 0 {
+			st.NumChunks++
+		}
+		if s.stale {
+			st.NumStaleSeries++
+		}
+		if s.encoding != chunkenc.EncNone {
+			st.Encodings[s.encoding]++
+		}
+		samples, size := s.size()
+		st.NumSamples += samples
+		st.HeadSizeBytes += size
+		s.RUnlock()
+	}
+	return st
+}
+
+// Sizes used to approximate the memory held by the head
+const (
+	memSeriesSize = int64(unsafe.Sizeof(memSeries{}))
+	memChunkSize  = int64(unsafe.Sizeof(memChunk{}))
+	sampleSize    = int64(unsafe.Sizeof(prompb.Sample{}))
+)
+
+// size returns the number of samples of a series and the approximate
+// memory held by it. The series must be locked.
+func (s *memSeries) size() (samples int, bytes int64) {
+	bytes = memSeriesSize
+	for _, l := range s.lset {
+		bytes += int64(len(l.Name) + len(l.Value))
+	}
+	for _, c := range s.chunks {
+		n, b := c.size()
+		samples, bytes = samples+n, bytes+b
+	}
+	for _, c := range []*memChunk{s.chunk, s.ooo} {
+		n, b := c.size()
+		samples, bytes = samples+n, bytes+b
+	}
+	for _, c := range s.histograms {
+		samples += len(c.histograms)
+		for i := range c.histograms {
+			bytes += int64(c.histograms[i].Size())
+		}
+	}
+	return samples, bytes
+}
+
+// size returns the number of samples of a chunk and the approximate memory
+// held by it
+func (c *memChunk) size() (samples int, bytes int64) {
+	bytes = memChunkSize + int64(cap(c.samples))*sampleSize
+	samples = len(c.samples)
+	if c.data != nil {
+		bytes += int64(len(c.data.Bytes()))
+		samples += c.data.NumSamples()
+	}
+	return samples, bytes
+}
+
+// WALStats returns the statistics of the head's WAL
+func (h *Head) WALStats() wal.Stats {
+	return h.wal.Stats()
+}
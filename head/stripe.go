@@ -0,0 +1,143 @@
+package head
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// defaultStripeCount is the number of series stripes unless configured
+// otherwise
+const defaultStripeCount = 16
+
+// seriesStripe holds the series whose label hash falls into it, so creating
+// and looking up series only contends with series of the same stripe
+type seriesStripe struct {
+	sync.RWMutex
+
+	// Series of the stripe by their ref
+	series map[uint64]*memSeries
+
+	// Series bucketed by the hash of their labels, collisions share a bucket
+	hashes map[uint64][]*memSeries
+
+	// Inverted index from label pairs to the refs of the stripe's series
+	index *postingsIndex
+}
+
+// refStripe maps the references falling into it to their series. Its lock
+// may be taken while holding a series stripe lock, never the other way round.
+type refStripe struct {
+	sync.RWMutex
+	series map[uint64]*memSeries
+}
+
+// resetStripes drops all series, keeping the number of stripes
+func (h *Head) resetStripes() {
+	for i := range h.stripes {
+		h.stripes[i] = &seriesStripe{
+			series: make(map[uint64]*memSeries),
+			hashes: make(map[uint64][]*memSeries),
+			index:  newPostingsIndex(),
+		}
+		h.refStripes[i] = &refStripe{series: make(map[uint64]*memSeries)}
+	}
+	h.intern = newInterner()
+	atomic.StoreInt64(&h.numSeries, 0)
+}
+
+// stripe returns the series stripe of a label hash
+func (h *Head) stripe(hash uint64) *seriesStripe {
+	return h.stripes[hash%uint64(len(h.stripes))]
+}
+
+// refStripe returns the reference stripe of a ref
+func (h *Head) refStripe(ref uint64) *refStripe {
+	return h.refStripes[ref%uint64(len(h.refStripes))]
+}
+
+// lookup returns the series with the given labels, or nil. The caller must
+// hold the stripe lock.
+func (st *seriesStripe) lookup(l labels.Labels) *memSeries {
+	for _, s := range st.hashes[l.Hash()] {
+		if labels.Equal(s.lset, l) {
+			return s
+		}
+	}
+	return nil
+}
+
+// newSeries registers a new series under a reference, failing with
+// ErrRefInUse if another series holds it. The series keeps an interned copy
+// of the labels. The caller must hold the stripe lock of the labels.
+func (h *Head) newSeries(st *seriesStripe, ref uint64, l labels.Labels) (*memSeries, error) {
+	if ref == 0 {
+		return nil, ErrRefInUse
+	}
+	rs := h.refStripe(ref)
+	rs.Lock()
+	defer rs.Unlock()
+	if _, ok := rs.series[ref]; ok {
+		return nil, ErrRefInUse
+	}
+
+	l = h.intern.labels(l)
+	s := &memSeries{
+		ref:        ref,
+		lset:       l,
+		chunk:      &memChunk{},
+		ooo:        &memChunk{},
+		lastAppend: h.now().UnixMilli(),
+	}
+	hash := l.Hash()
+	rs.series[ref] = s
+	st.series[ref] = s
+	st.hashes[hash] = append(st.hashes[hash], s)
+	st.index.add(ref, l)
+	atomic.AddInt64(&h.numSeries, 1)
+
+	return s, nil
+}
+
+// deleteSeries removes a series from all lookup structures. The caller
+// must hold the stripe lock of its labels.
+func (h *Head) deleteSeries(st *seriesStripe, s *memSeries) {
+	rs := h.refStripe(s.ref)
+	rs.Lock()
+	delete(rs.series, s.ref)
+	rs.Unlock()
+
+	delete(st.series, s.ref)
+	st.index.delete(s.ref, s.lset)
+
+	hash := s.lset.Hash()
+	bucket := st.hashes[hash]
+	for i, other := range bucket {
+		if other == s {
+			bucket = append(bucket[:i:i], bucket[i+1:]...)
+			break
+		}
+	}
+	if len(bucket) == 0 {
+		delete(st.hashes, hash)
+	} else {
+		st.hashes[hash] = bucket
+	}
+	h.intern.release(s.lset)
+	atomic.AddInt64(&h.numSeries, -1)
+}
+
+// allSeries returns a snapshot of all series of the head, locking one
+// stripe at a time
+func (h *Head) allSeries() []*memSeries {
+	all := make([]*memSeries, 0, atomic.LoadInt64(&h.numSeries))
+	for _, st := range h.stripes {
+		st.RLock()
+		for _, s := range st.series {
+			all = append(all, s)
+		}
+		st.RUnlock()
+	}
+	return all
+}
@@ -0,0 +1,103 @@
+package head
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/yuanhuiqu/protsdb/wal"
+)
+
+// TestLookupCollision checks that series whose labels hash alike are told
+// apart by their labels, and that removing one keeps the other
+func TestLookupCollision(t *testing.T) {
+	h := newTestHead(t, Options{StripeCount: 1})
+	a := labels.FromStrings(labels.MetricName, "a")
+	mustAppend(t, h, a, samplesAt(1, 10, 1)...)
+
+	st := h.stripe(a.Hash())
+	s := st.lookup(a)
+	if s == nil {
+		t.Fatal("series not found by its labels")
+	}
+
+	// A series with other labels in the bucket of a, as if they collided
+	other := &memSeries{ref: s.ref + 1, lset: labels.FromStrings(labels.MetricName, "b")}
+	st.hashes[a.Hash()] = []*memSeries{other, s}
+
+	if got := st.lookup(a); got != s {
+		t.Fatalf("lookup of colliding labels returned the series of %s", got.lset)
+	}
+	if got := st.lookup(labels.FromStrings(labels.MetricName, "c")); got != nil {
+		t.Fatalf("lookup of unknown labels returned the series of %s", got.lset)
+	}
+
+	st.Lock()
+	h.deleteSeries(st, s)
+	st.Unlock()
+	if got := st.lookup(a); got != nil {
+		t.Fatal("removed series still found")
+	}
+	if bucket := st.hashes[a.Hash()]; len(bucket) != 1 || bucket[0] != other {
+		t.Fatalf("bucket holds %d series after removing one of 2", len(bucket))
+	}
+}
+
+// BenchmarkAppendNewSeries appends the first sample of new series to heads
+// already holding many, which takes about as long whatever their number
+func BenchmarkAppendNewSeries(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			h := newTestHead(b, Options{})
+			sample := prompb.Sample{Timestamp: 1, Value: 1}
+			for i := 0; i < n; i++ {
+				mustAppend(b, h, labels.FromStrings(labels.MetricName, "m", "i", strconv.Itoa(i)), sample)
+			}
+			series := make([]labels.Labels, b.N)
+			for i := range series {
+				series[i] = labels.FromStrings(labels.MetricName, "m", "i", fmt.Sprintf("new-%d", i))
+			}
+
+			b.ResetTimer()
+			for _, l := range series {
+				if err := h.Append(l, sample); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkAppendParallel appends samples to series of their own from
+// GOMAXPROCS goroutines, creating a new series every 10 samples, with all
+// series in a single stripe and spread over the default stripes. Samples
+// skip the WAL, which serializes all appends, but new series are logged.
+func BenchmarkAppendParallel(b *testing.B) {
+	for _, stripes := range []int{1, defaultStripeCount} {
+		b.Run("stripes="+strconv.Itoa(stripes), func(b *testing.B) {
+			h := newTestHead(b, Options{StripeCount: stripes, WALSyncPolicy: wal.SyncNever})
+			var worker int64
+			b.RunParallel(func(pb *testing.PB) {
+				w := strconv.FormatInt(atomic.AddInt64(&worker, 1), 10)
+				var l labels.Labels
+				for i := 0; pb.Next(); i++ {
+					if i%10 == 0 {
+						l = labels.FromStrings(labels.MetricName, "m", "worker", w, "i", strconv.Itoa(i))
+					}
+					s, err := h.lockSeries(l)
+					if err != nil {
+						b.Fatal(err)
+					}
+					err = h.appendSample(s, prompb.Sample{Timestamp: int64(i + 1), Value: 1})
+					s.Unlock()
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
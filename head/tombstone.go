@@ -0,0 +1,194 @@
+package head
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/yuanhuiqu/protsdb/wal"
+)
+
+// blockTombstonesFile holds the deletions of a block
+const blockTombstonesFile = "tombstones"
+
+// Interval is a closed time range [Mint, Maxt] in milliseconds
+type Interval struct {
+	Mint int64 `json:"mint"`
+	Maxt int64 `json:"maxt"`
+}
+
+// contains reports whether t lies within the interval
+func (iv Interval) contains(t int64) bool {
+	return t >= iv.Mint && t <= iv.Maxt
+}
+
+// deleted reports whether t lies within any of the intervals
+func deleted(t int64, ivs []Interval) bool {
+	for _, iv := range ivs {
+		if iv.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Delete removes the samples in [mint, maxt] of all series matching the
+// matchers, in memory and in the persisted blocks. Data is not removed
+// right away: the range is recorded as a tombstone which queries respect,
+// and compaction drops the samples for good. Tombstones of the head are
+// logged to the WAL, those of blocks are stored with the block.
+func (h *Head) Delete(mint, maxt int64, ms ...*labels.Matcher) error {
+	if mint > maxt {
+		return fmt.Errorf("head: invalid delete range [%d, %d]", mint, maxt)
+	}
+	iv := Interval{Mint: mint, Maxt: maxt}
+
+	matched := h.selectSeries(ms)
+	blocks := h.Blocks()
+
+	if len(matched) > 0 {
+		stones := make([]wal.Tombstone, len(matched))
+		for i, s := range matched {
+			stones[i] = wal.Tombstone{Ref: s.ref, Mint: mint, Maxt: maxt}
+		}
+		if err := h.wal.LogTombstones(stones); err != nil {
+			return err
+		}
+		for _, s := range matched {
+			s.Lock()
+			s.addTombstone(iv)
+			s.Unlock()
+		}
+	}
+
+	for _, b := range blocks {
+		if err := b.Delete(mint, maxt, ms...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addTombstone records a deleted interval of a locked series. The list is
+// copied as queries may hold the previous one.
+func (s *memSeries) addTombstone(iv Interval) {
+	s.tombstones = append(s.tombstones[:len(s.tombstones):len(s.tombstones)], iv)
+}
+
+// Delete records a tombstone over [mint, maxt] for the matching series of
+// the block and persists all tombstones of the block
+func (b *Block) Delete(mint, maxt int64, ms ...*labels.Matcher) error {
+	if b.meta.MaxTime < mint || b.meta.MinTime > maxt {
+		return nil
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	changed := false
+	for i, e := range b.series {
+		if !matchesAll(e.lset, ms) {
+			continue
+		}
+		ivs := b.tombstones[i]
+		b.tombstones[i] = append(ivs[:len(ivs):len(ivs)], Interval{Mint: mint, Maxt: maxt})
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return b.writeTombstones()
+}
+
+// blockTombstones is the on-disk form of the tombstones of a block
+type blockTombstones struct {
+	Series    int        `json:"series"` // position in the block index
+	Intervals []Interval `json:"intervals"`
+}
+
+// writeTombstones replaces the tombstones file of the block, b.mtx must be held
+func (b *Block) writeTombstones() error {
+	list := make([]blockTombstones, 0, len(b.tombstones))
+	for i, ivs := range b.tombstones {
+		list = append(list, blockTombstones{Series: i, Intervals: ivs})
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Join(b.dir, blockTombstonesFile)
+	if err := writeFileSync(name+blockTmpSuffix, data); err != nil {
+		return err
+	}
+	return os.Rename(name+blockTmpSuffix, name)
+}
+
+// readBlockTombstones loads the tombstones of a block, if it has any
+func readBlockTombstones(dir string, numSeries int) (map[int][]Interval, error) {
+	res := make(map[int][]Interval)
+
+	data, err := os.ReadFile(filepath.Join(dir, blockTombstonesFile))
+	if os.IsNotExist(err) {
+		return res, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []blockTombstones
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("%s: %w", blockTombstonesFile, err)
+	}
+	for _, t := range list {
+		if t.Series < 0 || t.Series >= numSeries {
+			return nil, fmt.Errorf("%s: unknown series %d", blockTombstonesFile, t.Series)
+		}
+		res[t.Series] = t.Intervals
+	}
+	return res, nil
+}
+
+// deletedIterator skips samples within any of the deleted intervals
+type deletedIterator struct {
+	it        SampleIterator
+	intervals []Interval
+}
+
+func (it *deletedIterator) Next() bool {
+	for it.it.Next() {
+		if t, _ := it.it.At(); !deleted(t, it.intervals) {
+			return true
+		}
+	}
+	return false
+}
+
+func (it *deletedIterator) At() (int64, float64) { return it.it.At() }
+
+func (it *deletedIterator) Err() error { return it.it.Err() }
+
+// filterHistograms returns the histograms outside the deleted intervals
+func filterHistograms(hs []prompb.Histogram, ivs []Interval) []prompb.Histogram {
+	var res []prompb.Histogram
+	for _, h := range hs {
+		if !deleted(h.Timestamp, ivs) {
+			res = append(res, h)
+		}
+	}
+	return res
+}
+
+// filterExemplars returns the exemplars outside the deleted intervals
+func filterExemplars(es []prompb.Exemplar, ivs []Interval) []prompb.Exemplar {
+	var res []prompb.Exemplar
+	for _, e := range es {
+		if !deleted(e.Timestamp, ivs) {
+			res = append(res, e)
+		}
+	}
+	return res
+}
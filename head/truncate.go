@@ -0,0 +1,97 @@
+package head
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// Truncate drops all chunks whose newest sample is older than mint and
+// removes series left without samples, bounding memory without a full
+// compaction. Samples older than mint are rejected afterwards, also after
+// a restart. The WAL is checkpointed and cleaned so segments of the dropped
+// data are reclaimed.
+// It returns the number of removed series and chunks.
+func (h *Head) Truncate(mint int64) (seriesRemoved, chunksRemoved int, err error) {
+	if h.readOnly {
+		return 0, 0, ErrReadOnly
+	}
+	if mint > atomic.LoadInt64(&h.minValidTime) {
+		atomic.StoreInt64(&h.minValidTime, mint)
+	}
+
+	// Chunks kept by the truncation may start before mint, so minTime is
+	// recomputed from what is left. Appends racing the loop lower it again
+	// on their own, as do those to series visited before they were made.
+	atomic.StoreInt64(&h.minTime, math.MaxInt64)
+	for _, s := range h.allSeries() {
+		s.Lock()
+		chunksRemoved += s.truncateBefore(mint)
+		h.updateMinTime(s.minTime())
+		s.Unlock()
+	}
+	seriesRemoved = h.gc()
+
+	if mint > math.MinInt64 {
+		if err := h.wal.Checkpoint(mint - 1); err != nil {
+			return seriesRemoved, chunksRemoved, err
+		}
+	}
+	return seriesRemoved, chunksRemoved, h.checkpointWAL()
+}
+
+// truncateBefore drops the chunks of a locked series whose maxTime is
+// before mint and returns how many were dropped
+func (s *memSeries) truncateBefore(mint int64) int {
+	removed := 0
+	chunks := s.chunks[:0:0]
+	for _, c := range s.chunks {
+		if c.maxTime < mint {
+			removed++
+			continue
+		}
+		chunks = append(chunks, c)
+	}
+	s.chunks = chunks
+
+	if len(s.chunk.samples) > 0 && s.chunk.maxTime < mint {
+		s.chunk = &memChunk{}
+		removed++
+	}
+	if len(s.ooo.samples) > 0 && s.ooo.maxTime < mint {
+		s.ooo = &memChunk{}
+		removed++
+	}
+
+	hists := s.histograms[:0:0]
+	for _, c := range s.histograms {
+		if c.maxTime < mint {
+			removed++
+			continue
+		}
+		hists = append(hists, c)
+	}
+	s.histograms = hists
+
+	if removed > 0 {
+		s.numSamples, _ = s.size()
+	}
+	return removed
+}
+
+// minTime returns the oldest sample timestamp of a locked series,
+// math.MaxInt64 if it holds none
+func (s *memSeries) minTime() int64 {
+	mint := int64(math.MaxInt64)
+	for _, c := range s.chunks {
+		mint = min(mint, c.minTime)
+	}
+	for _, c := range []*memChunk{s.chunk, s.ooo} {
+		if len(c.samples) > 0 {
+			mint = min(mint, c.minTime)
+		}
+	}
+	for _, c := range s.histograms {
+		mint = min(mint, c.minTime)
+	}
+	return mint
+}
@@ -0,0 +1,137 @@
+package head
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// TestTruncateMinTime checks that the head's minTime is the oldest sample a
+// truncation kept, which may lie before the truncation time
+func TestTruncateMinTime(t *testing.T) {
+	h := newTestHead(t, Options{ChunkSize: 100})
+	a := labels.FromStrings(labels.MetricName, "a")
+	mustAppend(t, h, a, samplesAt(1, 2000, 1)...)
+
+	if _, _, err := h.Truncate(1050); err != nil {
+		t.Fatal(err)
+	}
+	samples := query(t, h, 0, 2000)[a.String()]
+	if len(samples) == 0 || samples[0].Timestamp >= 1050 {
+		t.Fatalf("truncation kept no chunk straddling it: %v", samples[:min(len(samples), 1)])
+	}
+	if got, want := h.MinTime(), samples[0].Timestamp; got != want {
+		t.Errorf("minTime %d after truncation, want oldest retained sample %d", got, want)
+	}
+
+	// Nothing is left after truncating past the newest sample
+	if _, _, err := h.Truncate(3000); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.MinTime(); got != math.MaxInt64 {
+		t.Errorf("minTime %d of an empty head, want math.MaxInt64", got)
+	}
+	mustAppend(t, h, a, samplesAt(3000, 3010, 1)...)
+	if got := h.MinTime(); got != 3000 {
+		t.Errorf("minTime %d after appending to an emptied head, want 3000", got)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	h := newTestHead(t, Options{})
+	a := labels.FromStrings(labels.MetricName, "a")
+	b := labels.FromStrings(labels.MetricName, "b")
+	mustAppend(t, h, a, samplesAt(1, 2000, 1)...)
+	mustAppend(t, h, b, samplesAt(1, 500, 1)...)
+
+	seriesRemoved, chunksRemoved, err := h.Truncate(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seriesRemoved != 1 {
+		t.Errorf("removed %d series, want 1", seriesRemoved)
+	}
+	if chunksRemoved == 0 {
+		t.Error("no chunks removed")
+	}
+	if _, ok := h.GetRef(b); ok {
+		t.Error("series without samples left is still in the head")
+	}
+	if err := h.Append(a, samplesAt(999, 999, 1)[0]); err != ErrOutOfBounds {
+		t.Errorf("append before the truncation time: %v, want %v", err, ErrOutOfBounds)
+	}
+	for _, s := range query(t, h, 0, 2000)[a.String()] {
+		if s.Timestamp < 1000-int64(h.chunkSize) {
+			t.Fatalf("sample at %d survived the truncation of its chunk", s.Timestamp)
+		}
+	}
+	if got := query(t, h, 1000, 2000)[a.String()]; !reflect.DeepEqual(got, samplesAt(1000, 2000, 1)) {
+		t.Errorf("got %d samples at or after the truncation time, want 1001", len(got))
+	}
+}
+
+// TestTruncateRestart checks that samples kept by a truncation survive a
+// restart after the WAL segments below it were checkpointed and removed
+func TestTruncateRestart(t *testing.T) {
+	opts := Options{WALSegmentSize: 4096}
+	h := newTestHead(t, opts)
+	series := []labels.Labels{
+		labels.FromStrings(labels.MetricName, "a"),
+		labels.FromStrings(labels.MetricName, "b", "job", "x"),
+	}
+	for _, l := range series {
+		mustAppend(t, h, l, samplesAt(1, 2000, 1)...)
+	}
+	if _, _, err := h.Truncate(1000); err != nil {
+		t.Fatal(err)
+	}
+	if st := h.wal.Stats(); st.FlushedSegments == 0 {
+		t.Fatalf("no segments flushed by the truncation: %+v", st)
+	}
+	// Samples before the truncation time in chunks it kept are dropped by
+	// the replay
+	want := query(t, h, 1000, 2000)
+	if n := countSamples(t, h, 1000, 2000); n != 2*1001 {
+		t.Fatalf("%d samples after the truncation, want %d", n, 2*1001)
+	}
+
+	h = reopenHead(t, h, opts)
+	if got := query(t, h, 0, 2000); !reflect.DeepEqual(got, want) {
+		t.Errorf("restart restored %d samples, want %d", countSamples(t, h, 0, 2000), 2*1001)
+	}
+	if err := h.Append(series[0], samplesAt(999, 999, 1)[0]); err != ErrOutOfBounds {
+		t.Errorf("append before the truncation time after a restart: %v, want %v", err, ErrOutOfBounds)
+	}
+
+	// Appends after the restart refer to the series of the checkpoint
+	mustAppend(t, h, series[1], samplesAt(2001, 2100, 1)...)
+	if _, _, err := h.Truncate(1500); err != nil {
+		t.Fatal(err)
+	}
+	want = query(t, h, 1500, 3000)
+	h = reopenHead(t, h, opts)
+	if got := query(t, h, 0, 3000); !reflect.DeepEqual(got, want) {
+		t.Error("second restart lost samples")
+	}
+}
+
+// TestCloseRestart checks that the checkpoint Close leaves after a
+// truncation is replayed by every later restart
+func TestCloseRestart(t *testing.T) {
+	opts := Options{WALSegmentSize: 4096}
+	h := newTestHead(t, opts)
+	b := appendAfterTruncation(t, h)
+	want := query(t, h, 0, 5000)
+
+	for i := 0; i < 2; i++ {
+		h = reopenHead(t, h, opts)
+		if flushable(h) {
+			t.Fatalf("restart %d: close left WAL segments to flush", i+1)
+		}
+		if got := query(t, h, 0, 5000); !reflect.DeepEqual(got, want) {
+			t.Fatalf("restart %d restored %d samples, want %d", i+1, countSamples(t, h, 0, 5000), len(want[b.String()]))
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package head
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// ErrInvalidValue is returned for NaN sample values other than the
+// staleness marker.
+var ErrInvalidValue = errors.New("head: invalid sample value")
+
+// ErrInvalidTimestamp is returned for samples with a timestamp at or before
+// the Unix epoch.
+var ErrInvalidTimestamp = errors.New("head: invalid sample timestamp")
+
+// ErrTooFarInFuture is returned for samples further ahead of the clock than
+// the future tolerance of the head.
+var ErrTooFarInFuture = errors.New("head: sample timestamp too far in the future")
+
+// defaultFutureTolerance is how far ahead of the clock samples may be
+const defaultFutureTolerance = 10 * time.Minute
+
+// Reasons samples are rejected for by validation, indexing Head.rejected
+const (
+	rejectValue = iota
+	rejectTimestamp
+	rejectFuture
+	rejectSeriesFull
+	numRejectReasons
+)
+
+// rejectReasons name the reasons in Stats.SamplesRejected
+var rejectReasons = [numRejectReasons]string{
+	rejectValue:      "invalid_value",
+	rejectTimestamp:  "invalid_timestamp",
+	rejectFuture:     "too_far_in_future",
+	rejectSeriesFull: "series_full",
+}
+
+// validateSample rejects samples no scraper or sender produces on purpose,
+// counting them by reason. It does nothing if validation is disabled.
+func (h *Head) validateSample(sample prompb.Sample) error {
+	if !h.validate {
+		return nil
+	}
+	reason, err := h.checkValid(sample)
+	if err != nil {
+		atomic.AddUint64(&h.rejected[reason], 1)
+	}
+	return err
+}
+
+func (h *Head) checkValid(sample prompb.Sample) (int, error) {
+	if math.IsNaN(sample.Value) && !value.IsStaleNaN(sample.Value) {
+		return rejectValue, ErrInvalidValue
+	}
+	if sample.Timestamp <= 0 {
+		return rejectTimestamp, ErrInvalidTimestamp
+	}
+	if sample.Timestamp > h.now().UnixMilli()+h.futureTolerance {
+		return rejectFuture, ErrTooFarInFuture
+	}
+	return 0, nil
+}
+
+// checkSeriesFull fails with ErrSeriesFull if n more samples would take a
+// locked series past the per-series limit, counting the rejected samples
+func (h *Head) checkSeriesFull(s *memSeries, n int) error {
+	if h.maxSeriesSamples == 0 || s.numSamples+n <= h.maxSeriesSamples {
+		return nil
+	}
+	atomic.AddUint64(&h.rejected[rejectSeriesFull], uint64(n))
+	slog.Debug("Series reached its sample limit", "series", s.lset, "limit", h.maxSeriesSamples)
+	return ErrSeriesFull
+}
+
+// checkLabels rejects label sets no series may have, whether validation is
+// disabled or not
+func (h *Head) checkLabels(l labels.Labels) error {
+	if l.IsEmpty() {
+		return ErrEmptyLabels
+	}
+	if h.requireName && !l.Has(labels.MetricName) {
+		return ErrMissingMetricName
+	}
+	return nil
+}
+
+// sortLabels returns the labels sorted by name, which series lookups rely
+// on. Unsorted labels are sorted in a copy, or rejected with
+// ErrUnsortedLabels if the head is configured to.
+func (h *Head) sortLabels(l labels.Labels) (labels.Labels, error) {
+	sorted, prev := true, ""
+	l.Range(func(lb labels.Label) {
+		sorted = sorted && lb.Name >= prev
+		prev = lb.Name
+	})
+	if sorted {
+		return l, nil
+	}
+	if h.rejectUnsorted {
+		return l, ErrUnsortedLabels
+	}
+	b := labels.NewScratchBuilder(l.Len())
+	b.Assign(l)
+	b.Sort()
+	return b.Labels(), nil
+}
+
+// samplesRejected returns the number of samples rejected by validation
+// by reason, leaving out reasons without any
+func (h *Head) samplesRejected() map[string]uint64 {
+	res := make(map[string]uint64)
+	for reason, name := range rejectReasons {
+		if n := atomic.LoadUint64(&h.rejected[reason]); n > 0 {
+			res[name] = n
+		}
+	}
+	return res
+}
@@ -0,0 +1,220 @@
+package head
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// TestValidateSample checks every reason validation rejects a sample for,
+// through each way of appending one, and that rejected samples are counted
+// and never stored
+func TestValidateSample(t *testing.T) {
+	now := time.UnixMilli(1_000_000)
+	for _, tc := range []struct {
+		name   string
+		sample prompb.Sample
+		err    error
+		reason string
+	}{
+		{"valid", prompb.Sample{Timestamp: 2, Value: 1}, nil, ""},
+		{"stale marker", prompb.Sample{Timestamp: 2, Value: math.Float64frombits(value.StaleNaN)}, nil, ""},
+		{"NaN", prompb.Sample{Timestamp: 2, Value: math.NaN()}, ErrInvalidValue, "invalid_value"},
+		{"zero timestamp", prompb.Sample{Timestamp: 0, Value: 1}, ErrInvalidTimestamp, "invalid_timestamp"},
+		{"negative timestamp", prompb.Sample{Timestamp: -1, Value: 1}, ErrInvalidTimestamp, "invalid_timestamp"},
+		{"within tolerance", prompb.Sample{Timestamp: now.Add(time.Minute).UnixMilli(), Value: 1}, nil, ""},
+		{"future", prompb.Sample{Timestamp: now.Add(time.Minute).UnixMilli() + 1, Value: 1}, ErrTooFarInFuture, "too_far_in_future"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := Options{FutureTolerance: time.Minute, Now: func() time.Time { return now }}
+			h := newTestHead(t, opts)
+			a := labels.FromStrings(labels.MetricName, "a")
+			b := labels.FromStrings(labels.MetricName, "b")
+			c := labels.FromStrings(labels.MetricName, "c")
+			mustAppend(t, h, b, prompb.Sample{Timestamp: 1, Value: 1})
+			ref, _ := h.GetRef(b)
+
+			for _, app := range []struct {
+				name string
+				fn   func() error
+			}{
+				{"Append", func() error { return h.Append(a, tc.sample) }},
+				{"AppendWithRef", func() error { return h.AppendWithRef(ref, tc.sample) }},
+				{"AppendSequenced", func() error { return h.AppendSequenced(c, 1, tc.sample) }},
+			} {
+				if err := app.fn(); !errors.Is(err, tc.err) {
+					t.Fatalf("%s: %v, want %v", app.name, err, tc.err)
+				}
+			}
+
+			rejected := h.Stats().SamplesRejected
+			stored := countSamples(t, h, math.MinInt64, math.MaxInt64) - 1
+			if tc.err == nil {
+				if len(rejected) != 0 || stored == 0 {
+					t.Fatalf("valid sample rejected %v, %d stored", rejected, stored)
+				}
+				return
+			}
+			if len(rejected) != 1 || rejected[tc.reason] != 3 {
+				t.Fatalf("rejected %v, want 3 %s", rejected, tc.reason)
+			}
+			if stored != 0 {
+				t.Fatalf("%d rejected samples stored", stored)
+			}
+
+			// Without validation the sample is stored as is
+			h = newTestHead(t, Options{DisableValidation: true, Now: opts.Now})
+			if err := h.Append(a, tc.sample); err != nil {
+				t.Fatalf("append without validation: %v", err)
+			}
+			if n := len(h.Stats().SamplesRejected); n != 0 {
+				t.Fatalf("%d reasons counted without validation", n)
+			}
+		})
+	}
+}
+
+// TestMaxSamplesPerSeries checks that appends past the sample limit of a
+// series fail and are counted until truncation drains it, and that other
+// series keep accepting samples
+func TestMaxSamplesPerSeries(t *testing.T) {
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	opts := Options{MaxSamplesPerSeries: 10, ChunkSize: 5}
+	h := newTestHead(t, opts)
+	a := labels.FromStrings(labels.MetricName, "a")
+	b := labels.FromStrings(labels.MetricName, "b")
+	mustAppend(t, h, a, samplesAt(1, 10, 1)...)
+
+	if err := h.Append(a, prompb.Sample{Timestamp: 11, Value: 11}); err != ErrSeriesFull {
+		t.Fatalf("append past the limit: %v, want %v", err, ErrSeriesFull)
+	}
+	if err := h.AppendHistogram(a, intHistogram(11)); err != ErrSeriesFull {
+		t.Fatalf("histogram append past the limit: %v, want %v", err, ErrSeriesFull)
+	}
+	if !strings.Contains(logs.String(), "series="+strconv.Quote(a.String())) {
+		t.Errorf("series missing from the log:\n%s", logs.String())
+	}
+
+	// Sequenced samples are rejected together
+	mustAppend(t, h, b, samplesAt(1, 8, 1)...)
+	if err := h.AppendSequenced(b, 1, samplesAt(9, 11, 1)...); err != ErrSeriesFull {
+		t.Fatalf("sequenced append past the limit: %v, want %v", err, ErrSeriesFull)
+	}
+	if err := h.AppendSequenced(b, 2, samplesAt(9, 10, 1)...); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.Stats().SamplesRejected[rejectReasons[rejectSeriesFull]]; got != 1+1+3 {
+		t.Errorf("%d samples rejected, want %d", got, 1+1+3)
+	}
+
+	// A restart replays all samples, the limit still applies after it
+	h = reopenHead(t, h, opts)
+	if n := countSamples(t, h, 0, 100); n != 20 {
+		t.Fatalf("%d samples replayed, want 20", n)
+	}
+	if err := h.Append(a, prompb.Sample{Timestamp: 11, Value: 11}); err != ErrSeriesFull {
+		t.Fatalf("append past the limit after a restart: %v, want %v", err, ErrSeriesFull)
+	}
+
+	// Dropping the oldest chunk makes room again
+	if _, _, err := h.Truncate(6); err != nil {
+		t.Fatal(err)
+	}
+	mustAppend(t, h, a, samplesAt(11, 15, 1)...)
+	if err := h.Append(a, prompb.Sample{Timestamp: 16, Value: 16}); err != ErrSeriesFull {
+		t.Fatalf("append past the limit after truncation: %v, want %v", err, ErrSeriesFull)
+	}
+}
+
+// TestCheckLabels checks that series without labels are always rejected,
+// and series without metric name unless allowed, without logging them
+func TestCheckLabels(t *testing.T) {
+	empty := labels.EmptyLabels()
+	nameless := labels.FromStrings("job", "a")
+	for _, tc := range []struct {
+		allow       bool
+		empty, name error
+	}{
+		{false, ErrEmptyLabels, ErrMissingMetricName},
+		{true, ErrEmptyLabels, nil},
+	} {
+		opts := Options{AllowNamelessSeries: tc.allow}
+		h := newTestHead(t, opts)
+		if err := h.Append(empty, prompb.Sample{Timestamp: 1, Value: 1}); !errors.Is(err, tc.empty) {
+			t.Fatalf("allow=%v: append without labels: %v, want %v", tc.allow, err, tc.empty)
+		}
+		if err := h.Append(nameless, prompb.Sample{Timestamp: 1, Value: 1}); !errors.Is(err, tc.name) {
+			t.Fatalf("allow=%v: append without metric name: %v, want %v", tc.allow, err, tc.name)
+		}
+
+		want := 0
+		if tc.allow {
+			want = 1
+		}
+		h = reopenHead(t, h, opts)
+		if n := h.Stats().NumSeries; n != want {
+			t.Fatalf("allow=%v: %d series after a restart, want %d", tc.allow, n, want)
+		}
+	}
+}
+
+// TestAppendUnsortedLabels checks that appends with labels not sorted by
+// name go to the series of the sorted labels, or fail if configured to
+func TestAppendUnsortedLabels(t *testing.T) {
+	opts := Options{}
+	h := newTestHead(t, opts)
+	sorted := labels.FromStrings(labels.MetricName, "m", "a", "1", "b", "2")
+	unsorted := labels.Labels{{Name: "b", Value: "2"}, {Name: labels.MetricName, Value: "m"}, {Name: "a", Value: "1"}}
+
+	mustAppend(t, h, unsorted, prompb.Sample{Timestamp: 1, Value: 1})
+	mustAppend(t, h, sorted, prompb.Sample{Timestamp: 2, Value: 2})
+	if err := h.AppendSequenced(unsorted, 1, prompb.Sample{Timestamp: 3, Value: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.AppendHistogram(unsorted, intHistogram(4)); err != nil {
+		t.Fatal(err)
+	}
+	if unsorted[0].Name != "b" {
+		t.Errorf("labels of the caller sorted to %s", unsorted)
+	}
+	want, _ := h.GetRef(sorted)
+	if ref, ok := h.GetRef(unsorted); !ok || ref != want {
+		t.Errorf("unsorted labels look up ref %d, want %d", ref, want)
+	}
+
+	check := func(when string) {
+		t.Helper()
+		if n := h.Stats().NumSeries; n != 1 {
+			t.Errorf("%s: %d series, want 1", when, n)
+		}
+		want := map[string][]prompb.Sample{sorted.String(): samplesAt(1, 3, 1)}
+		if got := query(t, h, 0, 10, labels.MustNewMatcher(labels.MatchEqual, "b", "2")); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", when, got, want)
+		}
+	}
+	check("appended")
+	h = reopenHead(t, h, opts)
+	check("replayed")
+
+	h = newTestHead(t, Options{RejectUnsortedLabels: true})
+	if err := h.Append(unsorted, prompb.Sample{Timestamp: 1, Value: 1}); err != ErrUnsortedLabels {
+		t.Errorf("append: %v, want %v", err, ErrUnsortedLabels)
+	}
+	if err := h.AppendHistogram(unsorted, intHistogram(1)); err != ErrUnsortedLabels {
+		t.Errorf("histogram append: %v, want %v", err, ErrUnsortedLabels)
+	}
+	mustAppend(t, h, sorted, prompb.Sample{Timestamp: 1, Value: 1})
+}
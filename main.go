@@ -2,18 +2,121 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
-	"protsdb/api"
+	"github.com/yuanhuiqu/protsdb/api"
+	"github.com/yuanhuiqu/protsdb/head"
 )
 
 func main() {
+	configFile := flag.String("config", envOr("PROTSDB_CONFIG", ""), "YAML configuration file (env PROTSDB_CONFIG)")
+	listenAddr := flag.String("listen-addr", ":9090", "Address to listen on (env PROTSDB_LISTEN_ADDR)")
+	tlsCertFile := flag.String("tls-cert-file", "", "TLS certificate file, enables HTTPS together with -tls-key-file")
+	tlsKeyFile := flag.String("tls-key-file", "", "TLS private key file")
+	maxSeries := flag.Int("max-series", 0, "Maximum number of series held in memory, 0 is unlimited")
+	queryMaxPoints := flag.Int("query-max-points", 11000, "Maximum number of points per series a range query may return")
+	logLevel := flag.String("log-level", "info", "Log level: debug, info, warn or error (env PROTSDB_LOG_LEVEL)")
+	logFormat := flag.String("log-format", "text", "Log format: text or json (env PROTSDB_LOG_FORMAT)")
+	flag.Parse()
+
+	// Flags given on the command line win over the environment, which wins
+	// over the config file
+	cfg, err := loadConfig(*configFile)
+	if err == nil {
+		err = cfg.applyEnv(os.LookupEnv)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading config:", err)
+		os.Exit(2)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen-addr":
+			cfg.Server.ListenAddr = *listenAddr
+		case "tls-cert-file":
+			cfg.Server.TLSCertFile = *tlsCertFile
+		case "tls-key-file":
+			cfg.Server.TLSKeyFile = *tlsKeyFile
+		case "max-series":
+			cfg.Storage.MaxSeries = *maxSeries
+		case "query-max-points":
+			cfg.Query.MaxPoints = *queryMaxPoints
+		case "log-level":
+			cfg.Log.Level = *logLevel
+		case "log-format":
+			cfg.Log.Format = *logFormat
+		}
+	})
+
+	logger, err := newLogger(cfg.Log.Level, cfg.Log.Format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	// Open the head block and its WAL
+	h, err := head.NewHead(head.Options{
+		WALDir:                cfg.Storage.WALDir,
+		BlockDir:              cfg.Storage.BlockDir,
+		ChunkSize:             cfg.Storage.ChunkSize,
+		MaxChunkDuration:      cfg.Storage.MaxChunkDuration,
+		MaxSeries:             cfg.Storage.MaxSeries,
+		MaxSamplesPerSeries:   cfg.Storage.MaxSamplesPerSeries,
+		OutOfOrderWindow:      cfg.Storage.OutOfOrderWindow,
+		MaxExemplarsPerSeries: cfg.Storage.MaxExemplarsPerSeries,
+		DisableCompression:    cfg.Storage.DisableCompression,
+		MaintenanceInterval:   cfg.Storage.MaintenanceInterval,
+		StaleSeriesTimeout:    cfg.Storage.StaleSeriesTimeout,
+		StripeCount:           cfg.Storage.StripeCount,
+		WALCompression:        cfg.Storage.WALCompression,
+		WALPreallocate:        cfg.Storage.WALPreallocate,
+		RepairWAL:             cfg.Storage.RepairWAL,
+		VerifyWAL:             cfg.Storage.VerifyWAL,
+		ReadOnly:              cfg.Storage.ReadOnly,
+		DisableValidation:     cfg.Storage.DisableValidation,
+		AllowNamelessSeries:   cfg.Storage.AllowNamelessSeries,
+		RejectUnsortedLabels:  cfg.Storage.RejectUnsortedLabels,
+		FutureTolerance:       cfg.Storage.FutureTolerance,
+	})
+	if err != nil {
+		logger.Error("Error opening head", "err", err)
+		os.Exit(1)
+	}
+	h.StartMaintenance(0)
+
 	// Create server
-	server := api.New()
+	server, err := api.New(h, api.Options{
+		ListenAddr:          cfg.Server.ListenAddr,
+		ReadTimeout:         cfg.Server.ReadTimeout,
+		WriteTimeout:        cfg.Server.WriteTimeout,
+		TLSCertFile:         cfg.Server.TLSCertFile,
+		TLSKeyFile:          cfg.Server.TLSKeyFile,
+		MaxRequestBytes:     cfg.Server.MaxRequestBytes,
+		MaxDecodedBytes:     cfg.Server.MaxDecodedBytes,
+		MaxSamplesPerWrite:  cfg.Server.MaxSamplesPerWrite,
+		MaxSeriesPerWrite:   cfg.Server.MaxSeriesPerWrite,
+		MaxConcurrentWrites: cfg.Server.MaxConcurrentWrites,
+		QueryTimeout:        cfg.Query.Timeout,
+		QueryMaxSamples:     cfg.Query.MaxSamples,
+		QueryMaxPoints:      cfg.Query.MaxPoints,
+		MaxSamplesPerQuery:  cfg.Query.MaxSamplesPerQuery,
+		Logger:              logger,
+	})
+	if err != nil {
+		logger.Error("Error creating server", "err", err)
+		os.Exit(1)
+	}
+	// The WAL was replayed when the head was opened
+	server.SetReady(true)
 
 	// Setup graceful shutdown
 	stop := make(chan os.Signal, 1)
@@ -21,14 +124,15 @@ func main() {
 
 	// Start server in a goroutine
 	go func() {
-		if err := server.Start(); err != nil {
-			log.Fatalf("Error starting server: %v", err)
+		if err := server.Start(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Error starting server", "err", err)
+			os.Exit(1)
 		}
 	}()
 
 	// Wait for interrupt signal
 	<-stop
-	log.Println("Shutting down server...")
+	logger.Info("Shutting down server")
 
 	// Create shutdown context with timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -36,8 +140,48 @@ func main() {
 
 	// Shutdown server
 	if err := server.Shutdown(ctx); err != nil {
-		log.Printf("Error during server shutdown: %v", err)
+		logger.Error("Error during server shutdown", "err", err)
 	}
 
-	log.Println("Server stopped")
+	// With no requests left, checkpoint and sync the WAL within what is
+	// left of the timeout
+	closed := make(chan error, 1)
+	go func() { closed <- h.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			logger.Error("Error closing head", "err", err)
+		}
+	case <-ctx.Done():
+		logger.Error("Timed out closing head", "err", ctx.Err())
+	}
+
+	logger.Info("Server stopped")
+}
+
+// envOr returns the value of an environment variable, or def if it is unset
+func envOr(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// newLogger returns a logger writing to stderr at the given level, as text
+// or as JSON lines
+func newLogger(level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
 }
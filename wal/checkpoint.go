@@ -0,0 +1,320 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// checkpointFileName is the file in every WAL directory recording the
+// segments flushed by the last checkpoint. It is replaced atomically
+// through a temporary file, so a crash leaves either the old or the new one.
+const (
+	checkpointFileName  = "CHECKPOINT"
+	checkpointTmpSuffix = ".tmp"
+)
+
+// checkpointPrefix starts the names of checkpoint records files, which hold
+// the state a checkpoint logged again in place of the segments it flushed.
+// They have the layout of a segment.
+const checkpointPrefix = "checkpoint-"
+
+// checkpointName returns the file name of the checkpoint records replacing
+// the segments below upto
+func checkpointName(upto int) string {
+	return fmt.Sprintf("%s%08d", checkpointPrefix, upto)
+}
+
+// checkpointMeta is the content of the checkpoint file
+type checkpointMeta struct {
+	// Segments with a lower id are flushed, whether Clean removed them yet
+	// or not
+	FlushedBefore int `json:"flushedBefore"`
+	// Samples up to this time were persisted outside the WAL, math.MinInt64
+	// if no checkpoint record was ever written
+	MaxTime int64 `json:"maxTime"`
+	// When the checkpoint was taken
+	Time time.Time `json:"time"`
+}
+
+// CheckpointTime returns the time up to which the newest checkpoint record
+// written or replayed, or the checkpoint file, states samples were persisted
+// outside the WAL. It is math.MinInt64 if there was no checkpoint.
+func (w *WAL) CheckpointTime() int64 {
+	if w == nil {
+		return math.MinInt64
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.checkpointMaxt
+}
+
+// writeCheckpointFileLocked replaces the checkpoint file with one flushing
+// the segments below upto. The new file is synced before it is renamed
+// into place, and the directory after. w.mtx must be held.
+func (w *WAL) writeCheckpointFileLocked(upto int, now time.Time) error {
+	b, err := json.Marshal(checkpointMeta{FlushedBefore: upto, MaxTime: w.checkpointMaxt, Time: now})
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Join(w.dir, checkpointFileName)
+	tmp := name + checkpointTmpSuffix
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, w.fileMode)
+	if err != nil {
+		return err
+	}
+	if err := w.retry(func() error { return writeAll(f, b) }); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := w.syncFile(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(w.dir)
+}
+
+// CheckpointWriter writes the records of a checkpoint, see CheckpointBefore
+type CheckpointWriter struct {
+	bw       *bufio.Writer
+	compress bool
+}
+
+func (cw *CheckpointWriter) write(typ byte, data []byte) error {
+	header, data := encodeRecord(typ, data, cw.compress)
+	if _, err := cw.bw.Write(header); err != nil {
+		return err
+	}
+	_, err := cw.bw.Write(data)
+	return err
+}
+
+// LogSeries writes a series record to the checkpoint
+func (cw *CheckpointWriter) LogSeries(ref uint64, lset labels.Labels) error {
+	if lset.IsEmpty() {
+		return ErrEmptyLabels
+	}
+	return cw.write(RecordSeries, encodeSeries(ref, lset))
+}
+
+// LogTombstones writes deletions as a single record to the checkpoint
+func (cw *CheckpointWriter) LogTombstones(stones []Tombstone) error {
+	return cw.write(RecordTombstones, encodeTombstones(stones))
+}
+
+// LogSequence writes the last accepted client sequence of a series to the
+// checkpoint
+func (cw *CheckpointWriter) LogSequence(ref uint64, seq uint64) error {
+	return cw.write(RecordSequence, encodeSequence(ref, seq))
+}
+
+// LogExemplars writes exemplars as a single record to the checkpoint.
+// refs[i] is the series of exemplars[i].
+func (cw *CheckpointWriter) LogExemplars(refs []uint64, exemplars []prompb.Exemplar) error {
+	if len(refs) != len(exemplars) {
+		return fmt.Errorf("wal: %d refs for %d exemplars", len(refs), len(exemplars))
+	}
+	return cw.write(RecordExemplars, encodeExemplars(refs, exemplars))
+}
+
+// LogMetadata writes the metadata of a metric family to the checkpoint
+func (cw *CheckpointWriter) LogMetadata(md prompb.MetricMetadata) error {
+	return cw.write(RecordMetadata, encodeMetadata(md))
+}
+
+// CheckpointBefore flushes the sealed segments with an id below upto, so
+// the next Clean removes them. fn logs what of their content is still
+// needed, e.g. the series that samples of later segments refer to, into a
+// checkpoint, which replays read in place of the flushed segments. The
+// checkpoint is synced and renamed into place before the checkpoint file
+// is replaced, so a crash leaves either the old or the new checkpoint.
+// Appends continue while fn runs. It does nothing for a read-only WAL.
+func (w *WAL) CheckpointBefore(upto int, fn func(cw *CheckpointWriter) error) error {
+	if w == nil || w.readOnly {
+		return nil
+	}
+	w.checkpointMtx.Lock()
+	defer w.checkpointMtx.Unlock()
+
+	// Never flush the segment being written to
+	w.mtx.Lock()
+	upto = min(upto, w.current.id)
+	w.mtx.Unlock()
+
+	if err := w.writeCheckpointRecords(upto, fn); err != nil {
+		return err
+	}
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	now := time.Now()
+	if err := w.writeCheckpointFileLocked(upto, now); err != nil {
+		return err
+	}
+	w.flushedBefore = upto
+	w.checkpointed = upto
+	for _, seg := range w.segments {
+		if seg.id < upto {
+			seg.state = SegmentFlushed
+		}
+	}
+	w.lastCheckpoint = now
+	return w.removeCheckpoints(upto)
+}
+
+// writeCheckpointRecords writes the checkpoint records replacing the
+// segments below upto through a temporary file, which is synced and then
+// renamed into place
+func (w *WAL) writeCheckpointRecords(upto int, fn func(cw *CheckpointWriter) error) error {
+	name := filepath.Join(w.dir, checkpointName(upto))
+	tmp := name + checkpointTmpSuffix
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, w.fileMode)
+	if err != nil {
+		return err
+	}
+	cw := &CheckpointWriter{bw: bufio.NewWriter(f), compress: w.compress}
+	_, err = cw.bw.Write(segmentHeader())
+	if err == nil {
+		err = fn(cw)
+	}
+	if err == nil {
+		err = cw.bw.Flush()
+	}
+	if err == nil {
+		err = w.retry(f.Sync)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(w.dir)
+}
+
+// removeCheckpoints removes the checkpoint records files other than the one
+// replacing the segments below upto, including temporary ones left behind
+// by a crash
+func (w *WAL) removeCheckpoints(upto int) error {
+	files, err := os.ReadDir(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, checkpointPrefix) || name == checkpointName(upto) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(w.dir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayCheckpoint calls fn for every record of the checkpoint replacing
+// the segments below w.checkpointed
+func (w *WAL) replayCheckpoint(fn func(typ, version byte, data []byte) error) error {
+	name := filepath.Join(w.dir, checkpointName(w.checkpointed))
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	_, start, err := readSegmentHeader(f, w.checkpointed, info.Size())
+	if err != nil {
+		return fmt.Errorf("wal: reading %s: %w", name, err)
+	}
+
+	rr := newRecordReader(f, w.checkpointed, start, info.Size())
+	for {
+		typ, version, data, err := rr.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("wal: reading %s: %w", name, err)
+		}
+		if err := fn(typ, version, data); err != nil {
+			return err
+		}
+	}
+}
+
+// writeAll writes b to the start of f
+func writeAll(f *os.File, b []byte) error {
+	_, err := f.WriteAt(b, 0)
+	return err
+}
+
+// loadCheckpointFile marks the segments the checkpoint file lists as
+// flushed, except the current one, and restores the time of the last
+// checkpoint and whether its records replace the flushed segments. A
+// temporary file left behind by a crash is removed, the previous checkpoint
+// file is still in place then.
+func (w *WAL) loadCheckpointFile() error {
+	name := filepath.Join(w.dir, checkpointFileName)
+	if !w.readOnly {
+		if err := os.Remove(name + checkpointTmpSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	b, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	meta := checkpointMeta{MaxTime: math.MinInt64}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return fmt.Errorf("wal: reading %s: %w", name, err)
+	}
+
+	w.flushedBefore = meta.FlushedBefore
+	w.checkpointMaxt = max(w.checkpointMaxt, meta.MaxTime)
+	w.lastCheckpoint = meta.Time
+	if _, err := os.Stat(filepath.Join(w.dir, checkpointName(meta.FlushedBefore))); err == nil {
+		w.checkpointed = meta.FlushedBefore
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for id, seg := range w.segments {
+		if id < meta.FlushedBefore && seg != w.current {
+			seg.state = SegmentFlushed
+		}
+	}
+	return nil
+}
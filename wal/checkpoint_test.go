@@ -0,0 +1,227 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// checkpointState returns a checkpoint function logging n series and
+// their exemplars, see checkpointExemplars
+func checkpointState(n int) func(cw *CheckpointWriter) error {
+	return func(cw *CheckpointWriter) error {
+		var refs []uint64
+		for i := 0; i < n; i++ {
+			if err := cw.LogSeries(uint64(i+1), labels.FromStrings(labels.MetricName, "m")); err != nil {
+				return err
+			}
+			refs = append(refs, uint64(i+1))
+		}
+		return cw.LogExemplars(refs, checkpointExemplars(n))
+	}
+}
+
+// checkpointExemplars returns the exemplars checkpointState(n) logs
+func checkpointExemplars(n int) []prompb.Exemplar {
+	var es []prompb.Exemplar
+	for i := 0; i < n; i++ {
+		es = append(es, prompb.Exemplar{
+			Labels:    []prompb.Label{{Name: "trace_id", Value: strconv.Itoa(i)}},
+			Timestamp: int64(i),
+			Value:     float64(i),
+		})
+	}
+	return es
+}
+
+// replayExemplars returns the exemplars of all records a WAL replays
+func replayExemplars(w *WAL) ([]prompb.Exemplar, error) {
+	var es []prompb.Exemplar
+	err := w.Replay(func(typ, version byte, data []byte) error {
+		if typ != RecordExemplars {
+			return nil
+		}
+		_, exemplars, err := DecodeExemplars(data)
+		es = append(es, exemplars...)
+		return err
+	})
+	return es, err
+}
+
+// checkpointFiles returns the names of the checkpoint files in dir
+func checkpointFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		if name := e.Name(); strings.HasPrefix(name, checkpointPrefix) || strings.HasPrefix(name, checkpointFileName) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// TestCheckpointCrash checks that a crash at any step of a checkpoint
+// leaves a WAL replaying either as before or as after it. The WAL is
+// checkpointed twice, and the steps of the second checkpoint are undone to
+// get what a crash before each of them leaves on disk.
+func TestCheckpointCrash(t *testing.T) {
+	var (
+		oldFile    = checkpointFileName
+		tmpFile    = checkpointFileName + checkpointTmpSuffix
+		oldRecords = checkpointName(4)
+		newRecords = checkpointName(8)
+	)
+	for _, tc := range []struct {
+		name  string
+		undo  func(t *testing.T, dir string, old map[string][]byte)
+		after bool
+	}{
+		{
+			name: "records not renamed",
+			undo: func(t *testing.T, dir string, old map[string][]byte) {
+				rename(t, dir, newRecords, newRecords+checkpointTmpSuffix)
+				restore(t, dir, old, oldFile, oldRecords)
+			},
+		},
+		{
+			name: "file not written",
+			undo: func(t *testing.T, dir string, old map[string][]byte) {
+				restore(t, dir, old, oldFile, oldRecords)
+			},
+		},
+		{
+			name: "file not renamed",
+			undo: func(t *testing.T, dir string, old map[string][]byte) {
+				rename(t, dir, oldFile, tmpFile)
+				restore(t, dir, old, oldFile, oldRecords)
+			},
+		},
+		{
+			name: "old records not removed",
+			undo: func(t *testing.T, dir string, old map[string][]byte) {
+				restore(t, dir, old, oldRecords)
+			},
+			after: true,
+		},
+		{
+			name:  "not cleaned",
+			undo:  func(*testing.T, string, map[string][]byte) {},
+			after: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := Options{Dir: dir, SegmentSize: 256}
+			w, err := New(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Two records per segment
+			for i := 0; i < 20; i++ {
+				w.mtx.Lock()
+				err := w.writeLocked(RecordMetadata, bytes.Repeat([]byte{byte(i)}, 100))
+				w.mtx.Unlock()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := w.CheckpointBefore(4, checkpointState(1)); err != nil {
+				t.Fatal(err)
+			}
+			before, err := countRecords(w)
+			if err != nil {
+				t.Fatal(err)
+			}
+			flushedBefore := w.Stats().FlushedSegments
+			old := make(map[string][]byte)
+			for _, name := range []string{oldFile, oldRecords} {
+				if old[name], err = os.ReadFile(filepath.Join(dir, name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := w.CheckpointBefore(8, checkpointState(2)); err != nil {
+				t.Fatal(err)
+			}
+			after, err := countRecords(w)
+			if err != nil {
+				t.Fatal(err)
+			}
+			flushedAfter := w.Stats().FlushedSegments
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if before != 2+12 || after != 3+4 {
+				t.Fatalf("%d records replayed after the first checkpoint and %d after the second, want 14 and 7", before, after)
+			}
+
+			tc.undo(t, dir, old)
+			w = openWAL(t, opts)
+			wantRecords, wantFlushed, wantExemplars := before, flushedBefore, checkpointExemplars(1)
+			if tc.after {
+				wantRecords, wantFlushed, wantExemplars = after, flushedAfter, checkpointExemplars(2)
+			}
+			if n, err := countRecords(w); err != nil || n != wantRecords {
+				t.Errorf("%d records replayed, want %d: %v", n, wantRecords, err)
+			}
+			if n := w.Stats().FlushedSegments; n != wantFlushed {
+				t.Errorf("%d flushed segments, want %d", n, wantFlushed)
+			}
+			if es, err := replayExemplars(w); err != nil || !reflect.DeepEqual(es, wantExemplars) {
+				t.Errorf("exemplars %v replayed, want %v: %v", es, wantExemplars, err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, tmpFile)); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("temporary checkpoint file left after opening: %v", err)
+			}
+
+			// Checkpointing again gets rid of whatever the crash left behind
+			if err := w.CheckpointBefore(8, checkpointState(2)); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Clean(); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := countRecords(w); err != nil || n != after {
+				t.Errorf("%d records replayed after checkpointing again, want %d: %v", n, after, err)
+			}
+			if es, err := replayExemplars(w); err != nil || !reflect.DeepEqual(es, checkpointExemplars(2)) {
+				t.Errorf("exemplars %v replayed after checkpointing again, want %v: %v", es, checkpointExemplars(2), err)
+			}
+			if names := checkpointFiles(t, dir); !reflect.DeepEqual(names, []string{checkpointFileName, newRecords}) {
+				t.Errorf("checkpoint files %v", names)
+			}
+		})
+	}
+}
+
+// rename renames a file of dir
+func rename(t *testing.T, dir, from, to string) {
+	t.Helper()
+	if err := os.Rename(filepath.Join(dir, from), filepath.Join(dir, to)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// restore writes files of dir back with their old content
+func restore(t *testing.T, dir string, old map[string][]byte, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), old[name], 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
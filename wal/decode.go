@@ -0,0 +1,279 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// errInvalidRecord is wrapped by all decoding errors
+var errInvalidRecord = errors.New("wal: invalid record")
+
+// DecodeSeries decodes the payload of a RecordSeries.
+func DecodeSeries(data []byte) (uint64, labels.Labels, error) {
+	if len(data) < 8 {
+		return 0, nil, fmt.Errorf("%w: short series record", errInvalidRecord)
+	}
+	ref := binary.BigEndian.Uint64(data[:8])
+
+	lset, rest, err := decodeLabels(data[8:])
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(rest) != 0 {
+		return 0, nil, fmt.Errorf("%w: %d trailing bytes in series record", errInvalidRecord, len(rest))
+	}
+	return ref, lset, nil
+}
+
+// DecodeSamples decodes the payload of a RecordSamples. refs[i] is the
+// series of samples[i].
+func DecodeSamples(data []byte) ([]uint64, []prompb.Sample, error) {
+	if len(data)%sampleSize != 0 {
+		return nil, nil, fmt.Errorf("%w: short sample", errInvalidRecord)
+	}
+
+	n := len(data) / sampleSize
+	refs := make([]uint64, 0, n)
+	samples := make([]prompb.Sample, 0, n)
+	for ; len(data) > 0; data = data[sampleSize:] {
+		refs = append(refs, binary.BigEndian.Uint64(data[:8]))
+		samples = append(samples, prompb.Sample{
+			Timestamp: int64(binary.BigEndian.Uint64(data[8:16])),
+			Value:     math.Float64frombits(binary.BigEndian.Uint64(data[16:24])),
+		})
+	}
+	return refs, samples, nil
+}
+
+// DecodeHistograms decodes the payload of a RecordHistograms or a
+// RecordFloatHistograms. refs[i] is the series of histograms[i].
+func DecodeHistograms(data []byte) ([]uint64, []prompb.Histogram, error) {
+	var (
+		refs       []uint64
+		histograms []prompb.Histogram
+	)
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, nil, fmt.Errorf("%w: short histogram", errInvalidRecord)
+		}
+		ref := binary.BigEndian.Uint64(data[:8])
+		n, k := binary.Uvarint(data[8:])
+		if k <= 0 || uint64(len(data)-8-k) < n {
+			return nil, nil, fmt.Errorf("%w: bad histogram length", errInvalidRecord)
+		}
+		data = data[8+k:]
+
+		var h prompb.Histogram
+		if err := h.Unmarshal(data[:n]); err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", errInvalidRecord, err)
+		}
+		refs = append(refs, ref)
+		histograms = append(histograms, h)
+		data = data[n:]
+	}
+	return refs, histograms, nil
+}
+
+// DecodeExemplars decodes the payload of a RecordExemplars. refs[i] is
+// the series of exemplars[i].
+func DecodeExemplars(data []byte) ([]uint64, []prompb.Exemplar, error) {
+	var (
+		refs      []uint64
+		exemplars []prompb.Exemplar
+	)
+	for len(data) > 0 {
+		if len(data) < 24 {
+			return nil, nil, fmt.Errorf("%w: short exemplar", errInvalidRecord)
+		}
+		e := prompb.Exemplar{
+			Timestamp: int64(binary.BigEndian.Uint64(data[8:16])),
+			Value:     math.Float64frombits(binary.BigEndian.Uint64(data[16:24])),
+		}
+		ref := binary.BigEndian.Uint64(data[:8])
+		data = data[24:]
+
+		n, k := binary.Varint(data)
+		if k <= 0 || n < 0 {
+			return nil, nil, fmt.Errorf("%w: bad label count", errInvalidRecord)
+		}
+		data = data[k:]
+		e.Labels = make([]prompb.Label, n)
+		for i := range e.Labels {
+			var err error
+			if e.Labels[i].Name, data, err = decodeString(data); err != nil {
+				return nil, nil, err
+			}
+			if e.Labels[i].Value, data, err = decodeString(data); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		refs = append(refs, ref)
+		exemplars = append(exemplars, e)
+	}
+	return refs, exemplars, nil
+}
+
+// DecodeMetadata decodes the payload of a RecordMetadata.
+func DecodeMetadata(data []byte) (prompb.MetricMetadata, error) {
+	var md prompb.MetricMetadata
+
+	typ, n := binary.Uvarint(data)
+	if n <= 0 {
+		return md, fmt.Errorf("%w: bad metric type", errInvalidRecord)
+	}
+	md.Type = prompb.MetricMetadata_MetricType(typ)
+	data = data[n:]
+
+	var err error
+	for _, s := range []*string{&md.MetricFamilyName, &md.Help, &md.Unit} {
+		if *s, data, err = decodeString(data); err != nil {
+			return md, err
+		}
+	}
+	if len(data) != 0 {
+		return md, fmt.Errorf("%w: %d trailing bytes in metadata record", errInvalidRecord, len(data))
+	}
+	return md, nil
+}
+
+// DecodeTombstones decodes the payload of a RecordTombstones.
+func DecodeTombstones(data []byte) ([]Tombstone, error) {
+	var stones []Tombstone
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("%w: short tombstone", errInvalidRecord)
+		}
+		t := Tombstone{Ref: binary.BigEndian.Uint64(data[:8])}
+		data = data[8:]
+
+		var n int
+		if t.Mint, n = binary.Varint(data); n <= 0 {
+			return nil, fmt.Errorf("%w: bad tombstone", errInvalidRecord)
+		}
+		data = data[n:]
+		if t.Maxt, n = binary.Varint(data); n <= 0 {
+			return nil, fmt.Errorf("%w: bad tombstone", errInvalidRecord)
+		}
+		data = data[n:]
+
+		stones = append(stones, t)
+	}
+	return stones, nil
+}
+
+// DecodeSequence decodes the payload of a RecordSequence.
+func DecodeSequence(data []byte) (uint64, uint64, error) {
+	if len(data) < 8 {
+		return 0, 0, fmt.Errorf("%w: short sequence record", errInvalidRecord)
+	}
+	seq, n := binary.Uvarint(data[8:])
+	if n <= 0 {
+		return 0, 0, fmt.Errorf("%w: bad sequence", errInvalidRecord)
+	}
+	return binary.BigEndian.Uint64(data[:8]), seq, nil
+}
+
+// DecodeCheckpoint decodes the payload of a RecordCheckpoint, the time up
+// to which samples were persisted outside the WAL. Checkpoints written
+// before they carried a time have an empty payload and cover nothing, for
+// which it returns math.MinInt64.
+func DecodeCheckpoint(data []byte) (int64, error) {
+	if len(data) == 0 {
+		return math.MinInt64, nil
+	}
+	if len(data) != 8 {
+		return 0, fmt.Errorf("%w: bad checkpoint record length %d", errInvalidRecord, len(data))
+	}
+	return int64(binary.BigEndian.Uint64(data)), nil
+}
+
+// DecodeLegacySeries decodes the payload of a version 0 RecordSeries, which
+// has no reference.
+func DecodeLegacySeries(data []byte) (labels.Labels, error) {
+	lset, rest, err := decodeLabels(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes in series record", errInvalidRecord, len(rest))
+	}
+	return lset, nil
+}
+
+// DecodeLegacySamples decodes the payload of a version 0 RecordSamples.
+// lsets[i] are the labels of samples[i].
+func DecodeLegacySamples(data []byte) ([]labels.Labels, []prompb.Sample, error) {
+	var (
+		lsets   []labels.Labels
+		samples []prompb.Sample
+	)
+	for len(data) > 0 {
+		lset, rest, err := decodeLabels(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rest) < 16 {
+			return nil, nil, fmt.Errorf("%w: short sample", errInvalidRecord)
+		}
+		lsets = append(lsets, lset)
+		samples = append(samples, prompb.Sample{
+			Timestamp: int64(binary.BigEndian.Uint64(rest[:8])),
+			Value:     math.Float64frombits(binary.BigEndian.Uint64(rest[8:16])),
+		})
+		data = rest[16:]
+	}
+	return lsets, samples, nil
+}
+
+// DecodeLegacySequence decodes the payload of a version 0 RecordSequence.
+func DecodeLegacySequence(data []byte) (labels.Labels, uint64, error) {
+	lset, rest, err := decodeLabels(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	seq, n := binary.Uvarint(rest)
+	if n <= 0 {
+		return nil, 0, fmt.Errorf("%w: bad sequence", errInvalidRecord)
+	}
+	return lset, seq, nil
+}
+
+// decodeLabels reads a label set written by appendLabels and returns the
+// remaining bytes
+func decodeLabels(b []byte) (labels.Labels, []byte, error) {
+	n, k := binary.Varint(b)
+	if k <= 0 || n < 0 {
+		return nil, nil, fmt.Errorf("%w: bad label count", errInvalidRecord)
+	}
+	b = b[k:]
+
+	builder := labels.NewScratchBuilder(int(n))
+	for i := int64(0); i < n; i++ {
+		var name, value string
+		var err error
+		if name, b, err = decodeString(b); err != nil {
+			return nil, nil, err
+		}
+		if value, b, err = decodeString(b); err != nil {
+			return nil, nil, err
+		}
+		builder.Add(name, value)
+	}
+	return builder.Labels(), b, nil
+}
+
+// decodeString reads a varint length-prefixed string
+func decodeString(b []byte) (string, []byte, error) {
+	n, k := binary.Varint(b)
+	if k <= 0 || n < 0 || int64(len(b)-k) < n {
+		return "", nil, fmt.Errorf("%w: bad string", errInvalidRecord)
+	}
+	b = b[k:]
+	return string(b[:n]), b[n:], nil
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package wal
+
+import "os"
+
+// syncDir fsyncs a directory, making renames and removals within it durable
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,72 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Segment header format, written as the first bytes of every segment:
+// | magic (4b) | version (1b) | reserved (3b) |
+//
+// Segments written before the header was introduced start right with a
+// record, whose first byte never matches the magic, and are version 0.
+const segmentHeaderSize = 8
+
+// segmentMagic identifies a segment with a header
+var segmentMagic = []byte("PWAL")
+
+// SegmentVersion is the version of the segment format written by this
+// package. Readers fail with ErrUnsupportedVersion on newer ones rather
+// than misparsing them.
+const SegmentVersion byte = 1
+
+// ErrUnsupportedVersion is returned for segments of an unknown format
+// version, e.g. written by a newer release
+var ErrUnsupportedVersion = errors.New("wal: unsupported segment version")
+
+// errShortHeader is returned for a segment cut off within its header, which
+// happens if a crash hits right after the segment was created. Such a
+// segment holds no records.
+var errShortHeader = errors.New("wal: short segment header")
+
+// segmentHeader returns the header of a new segment
+func segmentHeader() []byte {
+	b := make([]byte, segmentHeaderSize)
+	copy(b, segmentMagic)
+	b[len(segmentMagic)] = SegmentVersion
+	return b
+}
+
+// writeSegmentHeader writes the header at the start of a segment file,
+// leaving the file offset after it
+func writeSegmentHeader(f *os.File) error {
+	if _, err := f.WriteAt(segmentHeader(), 0); err != nil {
+		return err
+	}
+	_, err := f.Seek(segmentHeaderSize, io.SeekStart)
+	return err
+}
+
+// readSegmentHeader returns the format version of a segment of the given
+// size and the offset of its first record
+func readSegmentHeader(f io.ReaderAt, id int, size int64) (version byte, start int64, err error) {
+	b := make([]byte, min(size, segmentHeaderSize))
+	if _, err := f.ReadAt(b, 0); err != nil {
+		return 0, 0, err
+	}
+	if !bytes.HasPrefix(segmentMagic, b[:min(len(b), len(segmentMagic))]) {
+		return 0, 0, nil
+	}
+	if len(b) < segmentHeaderSize {
+		return 0, 0, errShortHeader
+	}
+
+	version = b[len(segmentMagic)]
+	if version == 0 || version > SegmentVersion {
+		return 0, 0, fmt.Errorf("%w %d of segment %d", ErrUnsupportedVersion, version, id)
+	}
+	return version, segmentHeaderSize, nil
+}
@@ -0,0 +1,42 @@
+package wal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// ErrLocked is returned by New if another WAL holds the lock of the directory.
+var ErrLocked = errors.New("wal: directory is locked by another process")
+
+// lockFileName is the lock file created in every WAL directory
+const lockFileName = "LOCK"
+
+// lockDir acquires an exclusive lock on the WAL directory, which is held
+// until the returned file is released with unlockDir. The lock file is
+// created with the given mode if it does not exist.
+func lockDir(dir string, mode os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_CREATE|os.O_RDWR, mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// unlockDir releases a lock acquired by lockDir. The lock file itself is
+// left in place, removing it would race with a process acquiring it.
+// Read-only WALs hold no lock, which is a nil f.
+func unlockDir(f *os.File) error {
+	if f == nil {
+		return nil
+	}
+	if err := unlockFile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,35 @@
+package wal
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLockDir(t *testing.T) {
+	dir := t.TempDir()
+	w, err := New(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(Options{Dir: dir}); !errors.Is(err, ErrLocked) {
+		t.Fatalf("second WAL on a locked directory: %v, want %v", err, ErrLocked)
+	}
+
+	// Readers take no lock
+	ro, err := New(Options{Dir: dir, ReadOnly: true})
+	if err != nil {
+		t.Fatalf("read-only WAL on a locked directory: %v", err)
+	}
+	if err := ro.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed open leaves the lock alone, closing releases it
+	if _, err := New(Options{Dir: dir}); !errors.Is(err, ErrLocked) {
+		t.Fatalf("third WAL on a locked directory: %v, want %v", err, ErrLocked)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	openWAL(t, Options{Dir: dir})
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package wal
+
+import "os"
+
+// lockFile is a no-op on Windows, the directory is not protected there
+func lockFile(*os.File) error { return nil }
+
+func unlockFile(*os.File) error { return nil }
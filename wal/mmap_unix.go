@@ -0,0 +1,17 @@
+//go:build !windows
+
+package wal
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the first size bytes of a file read-only
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(b []byte) error {
+	return syscall.Munmap(b)
+}
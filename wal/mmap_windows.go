@@ -0,0 +1,16 @@
+//go:build windows
+
+package wal
+
+import (
+	"errors"
+	"os"
+)
+
+// mmapFile is not supported on Windows, segments are read through buffered
+// reads there
+func mmapFile(*os.File, int64) ([]byte, error) {
+	return nil, errors.New("wal: mmap not supported")
+}
+
+func munmap([]byte) error { return nil }
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package wal
+
+import "os"
+
+// preallocate reserves size bytes for a file by extending it, the blocks
+// are allocated as they are written
+func preallocate(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
@@ -0,0 +1,163 @@
+package wal
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Reader iterates over the records of a WAL directory, oldest segment
+// first, without opening the WAL for writing. It is meant for tooling; a
+// WAL being written concurrently may end in a partial record.
+type Reader struct {
+	dir string
+	ids []int // segment ids still to read, ascending
+
+	seg    int  // id of the current segment
+	segVer byte // format version of the current segment
+	file   *os.File
+	mapped []byte // mapping of the current segment, if any
+	rr     *recordReader
+
+	typ, version byte
+	data         []byte
+	err          error
+}
+
+// NewReader returns a reader over all segments in dir
+func NewReader(dir string) (*Reader, error) {
+	ids, err := ListSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{dir: dir, ids: ids, seg: -1}, nil
+}
+
+// ListSegments returns the ids of the segments in dir, ascending
+func ListSegments(dir string) ([]int, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for _, f := range files {
+		if id, ok := parseSegmentName(f.Name()); ok && !f.IsDir() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// SegmentPath returns the path of a segment file in dir
+func SegmentPath(dir string, id int) string {
+	return filepath.Join(dir, segmentName(id))
+}
+
+// Next advances to the next record, moving on to the next segment once the
+// current one is exhausted. It returns false at the end of the WAL or on error.
+func (r *Reader) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	for {
+		if r.rr != nil {
+			typ, version, data, err := r.rr.next()
+			if err == nil {
+				r.typ, r.version, r.data = typ, version, data
+				return true
+			}
+			r.closeSegment()
+			// A torn tail of the last segment is where writing stopped
+			if errors.Is(err, errTornRecord) && len(r.ids) == 0 {
+				return false
+			}
+			if err != io.EOF {
+				r.err = err
+				return false
+			}
+		}
+
+		if len(r.ids) == 0 {
+			return false
+		}
+		if err := r.openSegment(r.ids[0]); err != nil {
+			r.err = err
+			return false
+		}
+		r.ids = r.ids[1:]
+	}
+}
+
+func (r *Reader) openSegment(id int) error {
+	f, err := os.Open(SegmentPath(r.dir, id))
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	version, start, err := readSegmentHeader(f, id, info.Size())
+	if errors.Is(err, errShortHeader) {
+		// Created right before a crash, there are no records
+		version, start, err = SegmentVersion, info.Size(), nil
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.seg, r.segVer, r.file = id, version, f
+
+	// Segments before the last one are sealed and read in place, the last
+	// one may still be written to
+	if len(r.ids) > 1 && info.Size() > start {
+		if b, err := mmapFile(f, info.Size()); err == nil {
+			r.mapped = b
+			r.rr = newMappedRecordReader(b, id, start)
+			return nil
+		}
+	}
+	r.rr = newRecordReader(f, id, start, info.Size())
+	return nil
+}
+
+func (r *Reader) closeSegment() {
+	if r.mapped != nil {
+		munmap(r.mapped)
+	}
+	if r.file != nil {
+		r.file.Close()
+	}
+	r.file, r.mapped, r.rr = nil, nil, nil
+}
+
+// Record returns the type and payload of the current record. The payload
+// is only valid until the next call to Next or Close.
+func (r *Reader) Record() (typ byte, data []byte) {
+	return r.typ, r.data
+}
+
+// Version returns the format version of the current record
+func (r *Reader) Version() byte { return r.version }
+
+// Segment returns the id of the segment the current record was read from
+func (r *Reader) Segment() int { return r.seg }
+
+// SegmentVersion returns the format version of the segment the current
+// record was read from, 0 for segments written before segments had a header
+func (r *Reader) SegmentVersion() byte { return r.segVer }
+
+// Err returns the error that stopped the iteration, if any
+func (r *Reader) Err() error { return r.err }
+
+// Close releases the open segment file and its mapping
+func (r *Reader) Close() error {
+	r.closeSegment()
+	r.ids = nil
+	return nil
+}
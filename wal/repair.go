@@ -0,0 +1,124 @@
+package wal
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Repair makes a WAL holding a corrupt record consistent again, e.g. after
+// a crash on a failing disk. The segment with the first corrupt record is
+// cut off at that record and all later segments are removed, so everything
+// logged after it is lost. What is dropped is logged. Segments replaced by
+// a checkpoint are not replayed and left alone. Repair does nothing if all
+// records can be read. It fails with ErrReadOnly for a read-only WAL.
+func (w *WAL) Repair() error {
+	if w == nil {
+		return nil
+	}
+	if w.readOnly {
+		return ErrReadOnly
+	}
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	ids := make([]int, 0, len(w.segments))
+	for id := range w.segments {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for i, id := range ids {
+		if id < w.checkpointed {
+			continue
+		}
+		seg := w.segments[id]
+		err := scanSegment(seg)
+		if err == nil {
+			continue
+		}
+		var corrupt *CorruptionError
+		if !errors.As(err, &corrupt) {
+			return err
+		}
+
+		slog.Warn("Repairing corrupt WAL segment", "segment", id, "offset", corrupt.Offset,
+			"dropped_bytes", seg.offset-corrupt.Offset, "err", corrupt.Err)
+		if err := seg.truncate(corrupt.Offset); err != nil {
+			return err
+		}
+		for _, later := range ids[i+1:] {
+			if err := w.removeSegment(later); err != nil {
+				return err
+			}
+		}
+
+		// New records continue right after the last intact one
+		w.current = seg
+		seg.state = SegmentActive
+		if id < w.flushedBefore {
+			if err := w.writeCheckpointFileLocked(id, w.lastCheckpoint); err != nil {
+				return err
+			}
+			w.flushedBefore = id
+		}
+		return nil
+	}
+	return nil
+}
+
+// verify reads all records of the segments a replay reads in order,
+// returning the first corruption. A torn record at the end of the current
+// segment is where writing stopped, the replay truncates it.
+func (w *WAL) verify() error {
+	ids := make([]int, 0, len(w.segments))
+	for id := range w.segments {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		if id < w.checkpointed {
+			continue
+		}
+		seg := w.segments[id]
+		err := scanSegment(seg)
+		if err == nil || (seg == w.current && errors.Is(err, errTornRecord)) {
+			continue
+		}
+		return err
+	}
+	return nil
+}
+
+// scanSegment reads all records of a segment, returning the error of the
+// first one that cannot be read
+func scanSegment(seg *segment) error {
+	rr := newRecordReader(seg.file, seg.id, seg.start, seg.offset)
+	for {
+		if _, _, _, err := rr.next(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// removeSegment closes and deletes a segment dropped by Repair, w.mtx must
+// be held
+func (w *WAL) removeSegment(id int) error {
+	seg := w.segments[id]
+	slog.Warn("Removing WAL segment after a corrupt record", "segment", id, "dropped_bytes", seg.offset)
+
+	seg.file.Close()
+	if err := os.Remove(filepath.Join(w.dir, segmentName(id))); err != nil {
+		return err
+	}
+	delete(w.segments, id)
+	return nil
+}
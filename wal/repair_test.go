@@ -0,0 +1,72 @@
+package wal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// TestRepair corrupts a record in the middle of the WAL and checks that
+// Repair keeps the records before it and drops everything after it
+func TestRepair(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, Options{Dir: dir, SegmentSize: 4096})
+	if err := w.LogSample(1, prompb.Sample{Timestamp: 0}); err != nil {
+		t.Fatal(err)
+	}
+	record := w.current.offset - segmentHeaderSize
+	for i := 1; w.current.id < 2; i++ {
+		if err := w.LogSample(1, prompb.Sample{Timestamp: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := int((w.segments[0].offset - segmentHeaderSize) / record)
+
+	// Flip a payload byte of the third record of segment 1
+	cp := crashCopy(t, dir)
+	path := filepath.Join(cp, segmentName(1))
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corruptAt := segmentHeaderSize + 2*record
+	b[corruptAt+headerSize] ^= 0xff
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	w = openWAL(t, Options{Dir: cp, SegmentSize: 4096})
+	_, err = countRecords(w)
+	var corrupt *CorruptionError
+	if !errors.As(err, &corrupt) || corrupt.Segment != 1 || corrupt.Offset != corruptAt {
+		t.Fatalf("replay: %v, want a corruption in segment 1 at offset %d", err, corruptAt)
+	}
+
+	if err := w.Repair(); err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := ListSegments(cp); err != nil || !reflect.DeepEqual(ids, []int{0, 1}) {
+		t.Fatalf("segments %v after repair: %v, want [0 1]", ids, err)
+	}
+	if n, err := countRecords(w); err != nil || n != first+2 {
+		t.Fatalf("replayed %d records after repair: %v, want %d", n, err, first+2)
+	}
+
+	// New records follow the last intact one
+	if err := w.LogSample(1, prompb.Sample{Timestamp: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := countRecords(w); err != nil || n != first+3 {
+		t.Fatalf("replayed %d records after appending: %v, want %d", n, err, first+3)
+	}
+	if err := w.Repair(); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := countRecords(w); n != first+3 {
+		t.Fatalf("repairing an intact WAL left %d records, want %d", n, first+3)
+	}
+}
@@ -0,0 +1,381 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// headerSize is the size of a record header: version/type(1) + length(8) + crc32(4).
+// Headers of compressed records are one byte longer.
+const headerSize = 13
+
+// errTornRecord is returned for a record cut off by the end of its segment,
+// as left behind by a crash in the middle of a write
+var errTornRecord = errors.New("torn record")
+
+// Replay calls fn for every record in the WAL, with its type and format
+// version. The records of the last checkpoint come first, followed by those
+// of the segments it did not replace, oldest segment first. data is only
+// valid until fn returns, as sealed segments are read from a memory mapping
+// where available. It stops at the first error returned by fn or
+// encountered while reading. A torn record at the end of the last segment
+// was never acknowledged, so it is cut off instead of failing the replay,
+// and new records are written in its place. A read-only WAL keeps it and
+// only skips it.
+func (w *WAL) Replay(fn func(typ, version byte, data []byte) error) error {
+	if w == nil {
+		return nil
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	ids := make([]int, 0, len(w.segments))
+	for id := range w.segments {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	if w.checkpointed > 0 {
+		if err := w.replayCheckpoint(fn); err != nil {
+			return err
+		}
+	}
+	for i, id := range ids {
+		if id < w.checkpointed {
+			continue
+		}
+		if err := w.replaySegment(w.segments[id], i == len(ids)-1, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaySegment reads the records of a single segment, truncating a torn
+// tail if it is the last one
+func (w *WAL) replaySegment(seg *segment, last bool, fn func(typ, version byte, data []byte) error) error {
+	var rr *recordReader
+	if seg != w.current && seg.offset > 0 {
+		// Sealed segments don't change anymore and are read in place
+		if b, err := mmapFile(seg.file, seg.offset); err == nil {
+			defer munmap(b)
+			rr = newMappedRecordReader(b, seg.id, seg.start)
+		}
+	}
+	if rr == nil {
+		rr = newRecordReader(seg.file, seg.id, seg.start, seg.offset)
+	}
+	seg.maxTime = math.MinInt64
+	for {
+		typ, version, data, err := rr.next()
+		if err == io.EOF {
+			return nil
+		}
+		if errors.Is(err, errTornRecord) && last {
+			if w.readOnly {
+				slog.Warn("Ignoring torn record at the end of a read-only WAL", "err", err)
+				return nil
+			}
+			slog.Warn("Truncating WAL after the last complete record", "err", err)
+			return seg.truncate(rr.offset)
+		}
+		if err != nil {
+			return err
+		}
+		seg.maxTime = max(seg.maxTime, recordMaxTime(typ, version, data))
+		if typ == RecordCheckpoint {
+			if maxt, err := DecodeCheckpoint(data); err == nil {
+				w.checkpointMaxt = max(w.checkpointMaxt, maxt)
+			}
+		}
+		if err := fn(typ, version, data); err != nil {
+			return err
+		}
+	}
+}
+
+// recordMaxTime returns the newest sample timestamp of a record, or
+// math.MaxInt64 if it cannot be decoded so the segment is never considered
+// old enough to be flushed
+func recordMaxTime(typ, version byte, data []byte) int64 {
+	var (
+		samples []prompb.Sample
+		err     error
+	)
+	switch {
+	case typ == RecordSamples && version == 0:
+		_, samples, err = DecodeLegacySamples(data)
+	case typ == RecordSamples:
+		_, samples, err = DecodeSamples(data)
+	case typ == RecordHistograms, typ == RecordFloatHistograms:
+		var hs []prompb.Histogram
+		_, hs, err = DecodeHistograms(data)
+		for _, h := range hs {
+			samples = append(samples, prompb.Sample{Timestamp: h.Timestamp})
+		}
+	default:
+		return math.MinInt64
+	}
+	if err != nil {
+		return math.MaxInt64
+	}
+
+	maxt := int64(math.MinInt64)
+	for _, s := range samples {
+		maxt = max(maxt, s.Timestamp)
+	}
+	return maxt
+}
+
+// recordReader decodes the records of a single segment, either through
+// buffered reads or by slicing a memory mapped segment
+type recordReader struct {
+	r      *bufio.Reader
+	mapped []byte // the whole segment if it is memory mapped
+	seg    int    // segment id, for errors
+	size   int64  // size of the segment
+	offset int64  // offset of the next record
+	padded bool   // the rest of the segment after offset is padding
+	header []byte
+	buf    []byte // decompressed payload of the current record
+}
+
+// newRecordReader returns a reader over the records of a segment file of
+// the given size, the first of which is at start
+func newRecordReader(f io.ReaderAt, seg int, start, size int64) *recordReader {
+	return &recordReader{
+		r:      bufio.NewReader(io.NewSectionReader(f, start, size-start)),
+		seg:    seg,
+		size:   size,
+		offset: start,
+		header: make([]byte, headerSize+1),
+	}
+}
+
+// newMappedRecordReader returns a reader over a memory mapped segment,
+// whose records alias the mapping
+func newMappedRecordReader(b []byte, seg int, start int64) *recordReader {
+	return &recordReader{mapped: b, seg: seg, size: int64(len(b)), offset: start}
+}
+
+// next returns the next record, or io.EOF at the end of the segment or of
+// its records if it was preallocated. Compressed payloads are returned
+// decompressed.
+func (rr *recordReader) next() (typ, version byte, data []byte, err error) {
+	if rr.offset >= rr.size || rr.padded {
+		return 0, 0, nil, io.EOF
+	}
+	padding, err := rr.atPadding()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if padding {
+		return 0, 0, nil, io.EOF
+	}
+	header, err := rr.readHeader()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	n := int64(len(header))
+	length := binary.BigEndian.Uint64(header[n-12 : n-4])
+	if length > uint64(rr.size-rr.offset-n) {
+		return 0, 0, nil, rr.errorf("%w: record length %d exceeds segment", errTornRecord, length)
+	}
+
+	if rr.mapped != nil {
+		start := rr.offset + n
+		data = rr.mapped[start : start+int64(length) : start+int64(length)]
+	} else {
+		data = make([]byte, length)
+		if _, err := io.ReadFull(rr.r, data); err != nil {
+			return 0, 0, nil, rr.errorf("reading record: %w", err)
+		}
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[n-4:]) {
+		return 0, 0, nil, rr.errorf("checksum mismatch")
+	}
+
+	version = (header[0] &^ compressedFlag) >> 4
+	if version > FormatVersion {
+		return 0, 0, nil, rr.errorf("unsupported record version %d", version)
+	}
+	if header[0]&compressedFlag != 0 {
+		switch header[1] {
+		case compressionNone:
+		case compressionSnappy:
+			if rr.buf, err = snappy.Decode(rr.buf[:cap(rr.buf)], data); err != nil {
+				return 0, 0, nil, rr.errorf("decompressing record: %w", err)
+			}
+			data = rr.buf
+		default:
+			return 0, 0, nil, rr.errorf("unsupported record compression %d", header[1])
+		}
+	}
+	rr.offset += n + int64(length)
+	return header[0] & 0x0f, version, data, nil
+}
+
+// atPadding reports whether the next byte is zero, which no record header
+// starts with, so it is the padding of a preallocated segment. Padding runs
+// up to the end of the segment, a non-zero byte after it is a corruption.
+func (rr *recordReader) atPadding() (bool, error) {
+	if rr.mapped != nil {
+		rest := rr.mapped[rr.offset:]
+		if rest[0] != 0 {
+			return false, nil
+		}
+		if i := nonZero(rest); i >= 0 {
+			return false, rr.errorf("non-zero byte at offset %d after padding", rr.offset+int64(i))
+		}
+		rr.padded = true
+		return true, nil
+	}
+
+	b, err := rr.r.Peek(1)
+	if err != nil || b[0] != 0 {
+		return false, nil
+	}
+	for off := rr.offset; ; {
+		b, err := rr.r.Peek(rr.r.Size())
+		if i := nonZero(b); i >= 0 {
+			return false, rr.errorf("non-zero byte at offset %d after padding", off+int64(i))
+		}
+		off += int64(len(b))
+		if _, derr := rr.r.Discard(len(b)); derr != nil {
+			err = derr
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, rr.errorf("reading padding: %w", err)
+		}
+	}
+	rr.padded = true
+	return true, nil
+}
+
+// nonZero returns the index of the first non-zero byte of b, or -1
+func nonZero(b []byte) int {
+	for i, c := range b {
+		if c != 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// dataEnd returns the offset after the last record of a segment file whose
+// records start at start, which is before its size if it was preallocated.
+// A file not ending in a zero byte ends with a record and is not read. If a
+// record cannot be read its size is returned, leaving the error to the
+// replay.
+func dataEnd(f *os.File, id int, start, size int64) (int64, error) {
+	if size <= start {
+		return size, nil
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, size-1); err != nil {
+		return 0, err
+	}
+	if last[0] != 0 {
+		return size, nil
+	}
+
+	rr := newRecordReader(f, id, start, size)
+	for {
+		_, _, _, err := rr.next()
+		if err == io.EOF {
+			return rr.offset, nil
+		}
+		if err != nil {
+			return size, nil
+		}
+	}
+}
+
+// trim cuts the padding of a preallocated segment after its last record
+func (seg *segment) trim() error {
+	info, err := seg.file.Stat()
+	if err != nil || info.Size() <= seg.offset {
+		return err
+	}
+	return seg.file.Truncate(seg.offset)
+}
+
+// readHeader returns the header of the next record, which is one byte
+// longer for compressed records
+func (rr *recordReader) readHeader() ([]byte, error) {
+	remaining := rr.size - rr.offset
+	if rr.mapped != nil {
+		n := int64(headerSize)
+		if rr.mapped[rr.offset]&compressedFlag != 0 {
+			n++
+		}
+		if remaining < n {
+			return nil, rr.errorf("%w: partial header", errTornRecord)
+		}
+		return rr.mapped[rr.offset : rr.offset+n], nil
+	}
+
+	if remaining < headerSize {
+		return nil, rr.errorf("%w: partial header", errTornRecord)
+	}
+	header := rr.header[:headerSize]
+	if _, err := io.ReadFull(rr.r, header); err != nil {
+		return nil, rr.errorf("reading header: %w", err)
+	}
+	if header[0]&compressedFlag != 0 {
+		if remaining < headerSize+1 {
+			return nil, rr.errorf("%w: partial header", errTornRecord)
+		}
+		header = rr.header[:headerSize+1]
+		if _, err := io.ReadFull(rr.r, header[headerSize:]); err != nil {
+			return nil, rr.errorf("reading header: %w", err)
+		}
+	}
+	return header, nil
+}
+
+// CorruptionError is returned for a record that cannot be read, e.g. for a
+// checksum mismatch or a record cut off before the end of the WAL
+type CorruptionError struct {
+	Segment int   // id of the segment holding the record
+	Offset  int64 // offset of the record in the segment
+	Err     error
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("wal: segment %d offset %d: %v", e.Segment, e.Offset, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() error { return e.Err }
+
+// errorf returns an error pointing at the current record
+func (rr *recordReader) errorf(format string, args ...any) error {
+	return &CorruptionError{Segment: rr.seg, Offset: rr.offset, Err: fmt.Errorf(format, args...)}
+}
+
+// truncate cuts a segment off at the given offset, so the next record is
+// written there
+func (seg *segment) truncate(offset int64) error {
+	if err := seg.file.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := seg.file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	seg.offset = offset
+	return nil
+}
@@ -0,0 +1,250 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// countRecords replays a WAL and returns the number of records
+func countRecords(w *WAL) (int, error) {
+	n := 0
+	err := w.Replay(func(typ, version byte, data []byte) error {
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// crashCopy copies the segment files of a WAL that is still open into a new
+// directory, as they would be found after a crash
+func crashCopy(t *testing.T, dir string) string {
+	t.Helper()
+	ids, err := ListSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := t.TempDir()
+	for _, id := range ids {
+		b, err := os.ReadFile(filepath.Join(dir, segmentName(id)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(cp, segmentName(id)), b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cp
+}
+
+// appendFile appends b to a file
+func appendFile(t *testing.T, path string, b []byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recordHeader returns the header of a samples record of the given length,
+// as the WAL writes it
+func recordHeader(length int) []byte {
+	header := make([]byte, headerSize)
+	header[0] = FormatVersion<<4 | RecordSamples
+	binary.BigEndian.PutUint64(header[1:9], uint64(length))
+	return header
+}
+
+func TestReplayTorn(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, Options{Dir: dir, SegmentSize: 4096})
+	if err := w.LogSample(1, prompb.Sample{Timestamp: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	header := recordHeader(100)
+	for _, tc := range []struct {
+		name string
+		tail []byte
+	}{
+		{"partial header", header[:5]},
+		{"truncated payload", append(header, make([]byte, 10)...)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cp := crashCopy(t, dir)
+			appendFile(t, filepath.Join(cp, segmentName(0)), tc.tail)
+
+			w := openWAL(t, Options{Dir: cp, SegmentSize: 4096})
+			if n, err := countRecords(w); err != nil || n != 1 {
+				t.Fatalf("replayed %d records: %v, want 1", n, err)
+			}
+			// The next record replaces the torn one
+			if err := w.LogSample(1, prompb.Sample{Timestamp: 2}); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := countRecords(w); err != nil || n != 2 {
+				t.Fatalf("replayed %d records after appending: %v, want 2", n, err)
+			}
+		})
+	}
+}
+
+// TestReplayTornSealed checks that a torn record in a segment followed by
+// another one is reported as corruption, as writing went on after it
+func TestReplayTornSealed(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, Options{Dir: dir, SegmentSize: 4096})
+	for i := 0; w.current.id == 0; i++ {
+		if err := w.LogSample(1, prompb.Sample{Timestamp: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cp := crashCopy(t, dir)
+	appendFile(t, filepath.Join(cp, segmentName(0)), recordHeader(100)[:5])
+
+	w, err := New(Options{Dir: cp, SegmentSize: 4096})
+	if err == nil {
+		defer w.Close()
+		_, err = countRecords(w)
+	}
+	var corrupt *CorruptionError
+	if !errors.As(err, &corrupt) || corrupt.Segment != 0 {
+		t.Fatalf("replay: %v, want a corruption in segment 0", err)
+	}
+}
+
+// BenchmarkReplaySegments reads sealed segments holding 64MB of sample
+// records, through a memory mapping and through buffered reads
+func BenchmarkReplaySegments(b *testing.B) {
+	w, err := New(Options{Dir: b.TempDir(), SegmentSize: 16 << 20, SyncPolicy: SyncNever})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer w.Close()
+	refs := make([]uint64, 1000)
+	samples := make([]prompb.Sample, 1000)
+	for i := 0; w.current.id < 4; i++ {
+		for j := range samples {
+			refs[j] = uint64(j + 1)
+			samples[j] = prompb.Sample{Timestamp: int64(i), Value: float64(j)}
+		}
+		if err := w.LogSamples(refs, samples); err != nil {
+			b.Fatal(err)
+		}
+	}
+	var sealed []*segment
+	var size int64
+	for _, seg := range w.segments {
+		if seg != w.current {
+			sealed = append(sealed, seg)
+			size += seg.offset
+		}
+	}
+
+	read := func(b *testing.B, rr *recordReader) {
+		for {
+			_, _, _, err := rr.next()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.Run("mmap", func(b *testing.B) {
+		b.SetBytes(size)
+		for i := 0; i < b.N; i++ {
+			for _, seg := range sealed {
+				m, err := mmapFile(seg.file, seg.offset)
+				if err != nil {
+					b.Skip("memory mapping unavailable:", err)
+				}
+				read(b, newMappedRecordReader(m, seg.id, seg.start))
+				munmap(m)
+			}
+		}
+	})
+	b.Run("buffered", func(b *testing.B) {
+		b.SetBytes(size)
+		for i := 0; i < b.N; i++ {
+			for _, seg := range sealed {
+				read(b, newRecordReader(seg.file, seg.id, seg.start, seg.offset))
+			}
+		}
+	})
+}
+
+// TestReplayPadding checks that the zero padding of a preallocated segment
+// ends its records, and that a stray byte in it is reported as corruption
+// up to which Repair cuts the segment
+func TestReplayPadding(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, Options{Dir: dir, SegmentSize: 4096, Preallocate: true})
+	for i := 1; i <= 10; i++ {
+		if err := w.LogSample(1, prompb.Sample{Timestamp: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	end := w.current.offset
+
+	for _, tc := range []struct {
+		name  string
+		stray int64 // offset of a non-zero byte in the padding, 0 for none
+	}{
+		{name: "zeros"},
+		{name: "stray byte", stray: end + 100},
+		{name: "stray last byte", stray: 4095},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cp := crashCopy(t, dir)
+			path := filepath.Join(cp, segmentName(0))
+			if tc.stray > 0 {
+				f, err := os.OpenFile(path, os.O_WRONLY, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := f.WriteAt([]byte{1}, tc.stray); err != nil {
+					t.Fatal(err)
+				}
+				f.Close()
+			}
+
+			w := openWAL(t, Options{Dir: cp, SegmentSize: 4096})
+			n, err := countRecords(w)
+			if tc.stray == 0 {
+				if err != nil || n != 10 {
+					t.Fatalf("replayed %d records: %v, want 10", n, err)
+				}
+				if w.current.offset != end {
+					t.Fatalf("appending continues at offset %d, want %d", w.current.offset, end)
+				}
+				return
+			}
+			var corrupt *CorruptionError
+			if !errors.As(err, &corrupt) || corrupt.Offset != end {
+				t.Fatalf("replay: %v, want a corruption at offset %d", err, end)
+			}
+
+			if err := w.Repair(); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := countRecords(w); err != nil || n != 10 {
+				t.Fatalf("replayed %d records after repair: %v, want 10", n, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// Defaults for retrying transient write errors
+const (
+	defaultWriteRetries = 3
+	defaultRetryBackoff = 10 * time.Millisecond
+)
+
+// isTransient reports whether a filesystem error is likely to go away when
+// the operation is repeated. Anything else, e.g. ENOSPC, fails immediately.
+func isTransient(err error) bool {
+	return errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN)
+}
+
+// retry runs op until it succeeds, fails with a non-transient error or the
+// retry budget is exhausted, doubling the backoff between attempts.
+func (w *WAL) retry(op func() error) error {
+	backoff := w.retryBackoff
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || !isTransient(err) || attempt >= w.writeRetries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// writeFull writes b to the current segment, resuming after partial writes
+// that were interrupted by a transient error.
+func (w *WAL) writeFull(b []byte) error {
+	return w.retry(func() error {
+		n, err := w.current.file.Write(b)
+		w.current.offset += int64(n)
+		b = b[n:]
+		return err
+	})
+}
+
+// writeRecord writes the header and payload of a record to the current
+// segment. If that fails after part of the record was written, the segment
+// is cut back to where the record started, so the next record does not
+// follow a torn one in the middle of the segment.
+func (w *WAL) writeRecord(header, data []byte) error {
+	seg, start := w.current, w.current.offset
+	err := w.writeFull(header)
+	if err == nil {
+		err = w.writeFull(data)
+	}
+	if err == nil || seg.offset == start {
+		return err
+	}
+	if terr := w.retry(func() error { return seg.truncate(start) }); terr != nil {
+		return fmt.Errorf("%w, cutting off the partial record: %v", err, terr)
+	}
+	return err
+}
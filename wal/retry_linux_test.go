@@ -0,0 +1,63 @@
+package wal
+
+import (
+	"errors"
+	"os/signal"
+	"syscall"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// limitFileSize makes writes beyond size fail with EFBIG, after writing
+// what still fits, until the test ends
+func limitFileSize(t *testing.T, size int64) {
+	t.Helper()
+	var old syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_FSIZE, &old); err != nil {
+		t.Fatal(err)
+	}
+	signal.Ignore(syscall.SIGXFSZ)
+	lim := syscall.Rlimit{Cur: uint64(size), Max: old.Max}
+	if err := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &lim); err != nil {
+		t.Skip("cannot limit the file size:", err)
+	}
+	t.Cleanup(func() {
+		syscall.Setrlimit(syscall.RLIMIT_FSIZE, &old)
+		signal.Reset(syscall.SIGXFSZ)
+	})
+}
+
+func TestPartialWrite(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, Options{Dir: dir})
+	for i := 1; i <= 10; i++ {
+		if err := w.LogSample(1, prompb.Sample{Timestamp: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	end := w.current.offset
+
+	t.Run("torn", func(t *testing.T) {
+		// The header fits, the payload doesn't
+		limitFileSize(t, end+headerSize+2)
+		err := w.LogSample(1, prompb.Sample{Timestamp: 11})
+		if !errors.Is(err, syscall.EFBIG) {
+			t.Fatalf("write beyond the file size limit: %v, want %v", err, syscall.EFBIG)
+		}
+	})
+	if w.current.offset != end {
+		t.Fatalf("segment ends at %d after the failed write, want %d", w.current.offset, end)
+	}
+
+	if err := w.LogSample(1, prompb.Sample{Timestamp: 12}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	w = openWAL(t, Options{Dir: dir})
+	if n, err := countRecords(w); err != nil || n != 11 {
+		t.Fatalf("replayed %d records: %v, want 11", n, err)
+	}
+}
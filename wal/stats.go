@@ -0,0 +1,57 @@
+package wal
+
+import "time"
+
+// Stats is a point-in-time summary of the WAL
+type Stats struct {
+	Segments        int
+	ActiveSegments  int
+	SealedSegments  int   // full segments not checkpointed yet
+	FlushedSegments int   // checkpointed segments Clean has not removed yet
+	SizeBytes       int64 // total size of all segments
+	CurrentSegment  int   // id of the segment being written to
+	CurrentOffset   int64 // write offset within the current segment
+
+	// Time of the last successful checkpoint, zero if there was none since
+	// the WAL was opened
+	LastCheckpoint time.Time
+
+	// Since the WAL was opened, segments sealed for a new one and fsyncs
+	// with their total duration
+	SegmentRotations uint64
+	Fsyncs           uint64
+	FsyncDuration    time.Duration
+}
+
+// Stats returns the current WAL statistics
+func (w *WAL) Stats() Stats {
+	if w == nil {
+		return Stats{}
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	st := Stats{
+		Segments:         len(w.segments),
+		LastCheckpoint:   w.lastCheckpoint,
+		SegmentRotations: w.rotations,
+		Fsyncs:           w.fsyncs,
+		FsyncDuration:    w.fsyncTime,
+	}
+	if w.current != nil {
+		st.CurrentSegment = w.current.id
+		st.CurrentOffset = w.current.offset
+	}
+	for _, seg := range w.segments {
+		st.SizeBytes += seg.offset
+		switch seg.state {
+		case SegmentActive:
+			st.ActiveSegments++
+		case SegmentSealed:
+			st.SealedSegments++
+		case SegmentFlushed:
+			st.FlushedSegments++
+		}
+	}
+	return st
+}
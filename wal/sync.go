@@ -0,0 +1,217 @@
+package wal
+
+import (
+	"errors"
+	"math"
+	"os"
+	"time"
+)
+
+// SyncPolicy decides when written records are fsynced to disk, trading
+// durability for throughput:
+//
+//   - SyncAlways syncs after every record. A record is durable once the
+//     write returns, at the cost of one fsync per write.
+//   - SyncInterval(d) syncs from a background goroutine every d. Records
+//     written within the last d can be lost on a machine crash, though not
+//     on a crash of the process alone.
+//   - SyncNever leaves flushing to the operating system, which may lose an
+//     unbounded amount of recent records on a machine crash.
+//   - SyncGroupCommit queues records of concurrent writers, which a
+//     background goroutine writes in batches with one fsync per batch. A
+//     record is durable once the write returns, as with SyncAlways, but
+//     concurrent writers share the fsync.
+type SyncPolicy struct {
+	interval time.Duration
+	never    bool
+	group    bool
+}
+
+var (
+	// SyncAlways syncs after every record. It is the default.
+	SyncAlways = SyncPolicy{}
+	// SyncNever never syncs explicitly
+	SyncNever = SyncPolicy{never: true}
+	// SyncGroupCommit batches the records of concurrent writers into one
+	// fsync
+	SyncGroupCommit = SyncPolicy{group: true}
+)
+
+// ErrClosed is returned for group committed writes to a closed WAL
+var ErrClosed = errors.New("wal: closed")
+
+// maxCommitBatch bounds the records written before a group commit syncs
+const maxCommitBatch = 1024
+
+// SyncInterval syncs written records every d. A non-positive d is SyncAlways.
+func SyncInterval(d time.Duration) SyncPolicy {
+	if d <= 0 {
+		return SyncAlways
+	}
+	return SyncPolicy{interval: d}
+}
+
+// String describes the policy
+func (p SyncPolicy) String() string {
+	switch {
+	case p.never:
+		return "never"
+	case p.interval > 0:
+		return "interval " + p.interval.String()
+	case p.group:
+		return "group commit"
+	default:
+		return "always"
+	}
+}
+
+// syncLocked syncs the current segment after a record was written,
+// according to the policy. Records written outside of a group commit, such
+// as checkpoints, are synced right away under SyncGroupCommit. w.mtx must
+// be held.
+func (w *WAL) syncLocked() error {
+	switch {
+	case w.syncPolicy.never:
+		return nil
+	case w.syncPolicy.interval > 0:
+		w.dirty = true
+		return nil
+	}
+	return w.syncFile(w.current.file)
+}
+
+// syncFile fsyncs a segment file, retrying transient errors, and accounts
+// for the time it took. w.mtx must be held.
+func (w *WAL) syncFile(f *os.File) error {
+	start := time.Now()
+	err := w.retry(f.Sync)
+	w.fsyncs++
+	w.fsyncTime += time.Since(start)
+	return err
+}
+
+// flushDirtyLocked syncs the current segment if it has unsynced records.
+// w.mtx must be held.
+func (w *WAL) flushDirtyLocked() error {
+	if !w.dirty {
+		return nil
+	}
+	if err := w.syncFile(w.current.file); err != nil {
+		return err
+	}
+	w.dirty = false
+	return nil
+}
+
+// Flush syncs the current segment right away, whatever the policy, so all
+// records written before the call are durable once it returns. It lets
+// writers under SyncInterval or SyncNever make single writes durable
+// without paying for an fsync on every write. Each call costs an fsync
+// though, which takes milliseconds on most disks, and blocks writers to
+// the WAL while it runs. Under SyncNever, records of segments sealed since
+// the last Flush are not covered.
+func (w *WAL) Flush() error {
+	if w == nil {
+		return nil
+	}
+	if w.readOnly {
+		return ErrReadOnly
+	}
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if err := w.syncFile(w.current.file); err != nil {
+		return err
+	}
+	w.dirty = false
+	return nil
+}
+
+// syncLoop periodically syncs the WAL for SyncInterval policies until
+// stopSync is closed. Failures are reported by the next write.
+func (w *WAL) syncLoop(interval time.Duration) {
+	defer close(w.syncDone)
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-w.stopSync:
+			return
+		case <-t.C:
+			w.mtx.Lock()
+			if err := w.flushDirtyLocked(); err != nil && w.syncErr == nil {
+				w.syncErr = err
+			}
+			w.mtx.Unlock()
+		}
+	}
+}
+
+// commitRequest is a record queued for the group commit loop
+type commitRequest struct {
+	typ  byte
+	data []byte
+	maxt int64 // newest sample timestamp, math.MinInt64 if there is none
+	done chan error
+}
+
+// commit queues a record for the group commit loop and waits until it is
+// written and synced
+func (w *WAL) commit(typ byte, data []byte, maxt int64) error {
+	req := &commitRequest{typ: typ, data: data, maxt: maxt, done: make(chan error, 1)}
+	select {
+	case w.commits <- req:
+	case <-w.syncDone:
+		return ErrClosed
+	}
+	return <-req.done
+}
+
+// commitLoop writes queued records for SyncGroupCommit until stopSync is
+// closed. Records queued while a batch is synced make up the next batch.
+func (w *WAL) commitLoop() {
+	defer close(w.syncDone)
+
+	for {
+		var batch []*commitRequest
+		select {
+		case <-w.stopSync:
+			return
+		case req := <-w.commits:
+			batch = append(batch, req)
+		}
+	drain:
+		for len(batch) < maxCommitBatch {
+			select {
+			case req := <-w.commits:
+				batch = append(batch, req)
+			default:
+				break drain
+			}
+		}
+
+		errs := make([]error, len(batch))
+		w.mtx.Lock()
+		for i, req := range batch {
+			errs[i] = w.appendLocked(req.typ, req.data)
+			// Even a failed write may have left the record behind
+			w.current.maxTime = max(w.current.maxTime, req.maxt)
+			w.dirty = true
+		}
+		syncErr := w.flushDirtyLocked()
+		w.mtx.Unlock()
+
+		for i, req := range batch {
+			if errs[i] == nil {
+				errs[i] = syncErr
+			}
+			req.done <- errs[i]
+		}
+	}
+}
+
+// noMaxTime is the maxt of records without samples
+const noMaxTime = math.MinInt64
@@ -2,8 +2,10 @@ package wal
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
+	"io"
 	"math"
 	"os"
 	"path/filepath"
@@ -13,6 +15,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/golang/snappy"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/prompb"
 )
@@ -27,11 +30,22 @@ const (
 type segment struct {
 	id     int
 	file   *os.File
-	offset int64  // Current write offset
+	offset int64  // Current write offset, the end of the last record
 	state  string // Segment state
+
+	// Format version from the segment header, and the offset of the first
+	// record after it
+	version byte
+	start   int64
+
+	// Newest sample or histogram timestamp in the segment, math.MaxInt64
+	// while unknown for a loaded segment that was not replayed yet
+	maxTime int64
 }
 
 // WAL is a write ahead log for durably storing samples before they are written to the head block.
+// A nil *WAL is a disabled one: writes are discarded, there is nothing to
+// replay and its stats are zero.
 type WAL struct {
 	mtx sync.Mutex
 
@@ -43,57 +57,264 @@ type WAL struct {
 
 	dir         string
 	segmentSize int64
+	compress    bool        // snappy compress record payloads
+	fileMode    os.FileMode // permission of created segment files
+	readOnly    bool        // segments are opened for reading only
+	preallocate bool        // new segments are created at their full size
+
+	// Flushed segments Clean keeps, newest first
+	minRetained int
+
+	// Retry budget for transient write errors
+	writeRetries int
+	retryBackoff time.Duration
+
+	// When records are synced, see SyncPolicy
+	syncPolicy SyncPolicy
+	dirty      bool          // records were written since the last sync
+	syncErr    error         // failure of the last background sync
+	stopSync   chan struct{} // closed to stop the interval sync or group commit loop
+	syncDone   chan struct{} // closed once the loop exited
+
+	// Records queued for the group commit loop
+	commits chan *commitRequest
 
 	// Last successful checkpoint
 	lastCheckpoint time.Time
+
+	// Segments below this id are flushed according to the checkpoint file,
+	// and the newest checkpoint time, math.MinInt64 without any
+	flushedBefore  int
+	checkpointMaxt int64
+
+	// Segments below this id are replaced by the checkpoint records file of
+	// the same id, which replays read instead. It is 0 without one, e.g. for
+	// WALs checkpointed before such files were written.
+	checkpointed int
+
+	// Serializes CheckpointBefore, which writes the records file without
+	// holding mtx
+	checkpointMtx sync.Mutex
+
+	// Callbacks on segment creation and checkpoints
+	hooks Hooks
+
+	// Segment rotations and fsyncs with their total duration, guarded by mtx
+	rotations uint64
+	fsyncs    uint64
+	fsyncTime time.Duration
+
+	// Lock on the directory, held until Close
+	lock *os.File
 }
 
 // Options for configuring the WAL.
 type Options struct {
 	// Directory to store WAL files
 	Dir string
-	// Segment size (default 128MB)
+	// Segment size (default 128MB). Segments are rotated before a record
+	// would exceed it.
 	SegmentSize int64
+	// WriteRetries is how often a write or sync failing with a transient
+	// error is retried before giving up (default 3, negative disables retries)
+	WriteRetries int
+	// RetryBackoff is the initial delay between retries, doubled on every
+	// attempt (default 10ms)
+	RetryBackoff time.Duration
+	// SyncPolicy decides when records are fsynced (default SyncAlways)
+	SyncPolicy SyncPolicy
+	// MinRetainedSegments is how many of the newest flushed segments Clean
+	// keeps around, e.g. for debugging (default 1, negative keeps none)
+	MinRetainedSegments int
+	// Compress snappy compresses record payloads. Segments may mix
+	// compressed and uncompressed records, so it can be toggled across
+	// restarts.
+	Compress bool
+	// Verify reads every record of every segment when opening, failing
+	// with a CorruptionError on the first one that cannot be read, e.g.
+	// after a disk incident. Otherwise corruption only shows on replay.
+	Verify bool
+	// FileMode is the permission of segment and lock files created by the
+	// WAL (default 0644). Existing files keep their mode.
+	FileMode os.FileMode
+	// DirMode is the permission of the WAL directory if it is created
+	// (default 0755)
+	DirMode os.FileMode
+	// ReadOnly opens the segments of an existing WAL for reading only,
+	// e.g. for tools inspecting a copy of a data directory. Nothing is
+	// created, locked or truncated, and all writes fail with ErrReadOnly.
+	ReadOnly bool
+	// Preallocate creates segments at their full size, so appending does
+	// not grow the file and fragment it. The zero padding after the last
+	// record is cut off when the segment is sealed or the WAL is closed.
+	Preallocate bool
+	// Hooks are called on segment creation and checkpoints
+	Hooks Hooks
+}
+
+// Hooks are optional callbacks the WAL invokes on events of interest, e.g.
+// for monitoring. Each call runs in its own goroutine so a slow hook never
+// holds up writes, which also means calls may arrive out of order.
+type Hooks struct {
+	// SegmentCreated is called with the id of every segment created,
+	// including the first one of an empty WAL
+	SegmentCreated func(id int)
+	// Checkpoint is called after every checkpoint record written, with the
+	// time up to which it states samples were persisted
+	Checkpoint func(maxt int64)
 }
 
+// ErrReadOnly is returned for writes to a WAL opened with Options.ReadOnly
+var ErrReadOnly = errors.New("wal: read-only")
+
+// ErrEmptyLabels is returned by LogSeries for a series without labels,
+// which no replay could tell apart from another
+var ErrEmptyLabels = errors.New("wal: empty label set")
+
+// Default permissions of WAL files and directories
+const (
+	defaultFileMode os.FileMode = 0644
+	defaultDirMode  os.FileMode = 0755
+)
+
 // Record types
 const (
-	RecordSeries     byte = 1
-	RecordSamples    byte = 2
-	RecordCheckpoint byte = 3
+	RecordSeries          byte = 1
+	RecordSamples         byte = 2
+	RecordCheckpoint      byte = 3
+	RecordSequence        byte = 4
+	RecordHistograms      byte = 5
+	RecordExemplars       byte = 6
+	RecordMetadata        byte = 7
+	RecordTombstones      byte = 8
+	RecordFloatHistograms byte = 9
 )
 
+// sampleSize is the encoded size of a (ref, timestamp, value) triple
+const sampleSize = 24
+
+// FormatVersion is the version of the record payload formats written by
+// this package. Version 0 records, written before versioning, carry full
+// label sets instead of series references in sample and sequence records.
+const FormatVersion byte = 1
+
 // Record header format:
-// | type (1b) | length (8b) | CRC32 (4b) | payload ... |
+// | version (4 bits) type (4 bits) | length (8b) | CRC32 (4b) | payload ... |
+//
+// Compressed records set the top bit of the first byte, leaving 3 bits for
+// the version, and are followed by the compression type:
+// | 1 version (3 bits) type (4 bits) | compression (1b) | length (8b) | CRC32 (4b) | payload ... |
+//
+// Length and CRC cover the payload as stored, i.e. compressed.
+
+// Compression types of compressed records
+const (
+	compressionNone   byte = 0
+	compressionSnappy byte = 1
+)
+
+// compressedFlag marks a record header carrying a compression type
+const compressedFlag byte = 0x80
 
 // New creates a new WAL in the given directory.
 func New(opts Options) (*WAL, error) {
-	if err := os.MkdirAll(opts.Dir, 0777); err != nil {
-		return nil, err
+	if opts.FileMode == 0 {
+		opts.FileMode = defaultFileMode
+	}
+	if opts.DirMode == 0 {
+		opts.DirMode = defaultDirMode
+	}
+	if !opts.ReadOnly {
+		if err := os.MkdirAll(opts.Dir, opts.DirMode); err != nil {
+			return nil, err
+		}
 	}
 
 	if opts.SegmentSize == 0 {
 		opts.SegmentSize = 128 * 1024 * 1024
 	}
+	if opts.WriteRetries == 0 {
+		opts.WriteRetries = defaultWriteRetries
+	}
+	if opts.RetryBackoff == 0 {
+		opts.RetryBackoff = defaultRetryBackoff
+	}
+	if opts.MinRetainedSegments == 0 {
+		opts.MinRetainedSegments = 1
+	}
+
+	// Read-only WALs take no lock, as that would create the lock file
+	var lock *os.File
+	if !opts.ReadOnly {
+		var err error
+		if lock, err = lockDir(opts.Dir, opts.FileMode); err != nil {
+			return nil, err
+		}
+	}
 
 	w := &WAL{
-		dir:         opts.Dir,
-		segmentSize: opts.SegmentSize,
-		segments:    make(map[int]*segment),
+		lock:         lock,
+		dir:          opts.Dir,
+		segmentSize:  opts.SegmentSize,
+		segments:     make(map[int]*segment),
+		writeRetries: opts.WriteRetries,
+		retryBackoff: opts.RetryBackoff,
+		syncPolicy:   opts.SyncPolicy,
+		minRetained:  max(opts.MinRetainedSegments, 0),
+		compress:     opts.Compress,
+		fileMode:     opts.FileMode,
+		readOnly:     opts.ReadOnly,
+		preallocate:  opts.Preallocate,
+		hooks:        opts.Hooks,
+
+		checkpointMaxt: math.MinInt64,
 	}
 
 	// Load existing segments
 	if err := w.loadSegments(); err != nil {
+		unlockDir(lock)
+		return nil, err
+	}
+	if err := w.loadCheckpointFile(); err != nil {
+		for _, seg := range w.segments {
+			seg.file.Close()
+		}
+		unlockDir(lock)
 		return nil, err
 	}
+	if opts.Verify {
+		if err := w.verify(); err != nil {
+			for _, seg := range w.segments {
+				seg.file.Close()
+			}
+			unlockDir(lock)
+			return nil, err
+		}
+	}
+
+	if opts.ReadOnly {
+		return w, nil
+	}
 
 	// Create initial segment if none exists
 	if len(w.segments) == 0 {
 		if err := w.newSegment(0); err != nil {
+			unlockDir(lock)
 			return nil, err
 		}
 	}
 
+	if d := opts.SyncPolicy.interval; d > 0 {
+		w.stopSync = make(chan struct{})
+		w.syncDone = make(chan struct{})
+		go w.syncLoop(d)
+	} else if opts.SyncPolicy.group {
+		w.stopSync = make(chan struct{})
+		w.syncDone = make(chan struct{})
+		w.commits = make(chan *commitRequest)
+		go w.commitLoop()
+	}
+
 	return w, nil
 }
 
@@ -110,17 +331,17 @@ func (w *WAL) loadSegments() error {
 
 		// Parse segment ID from filename
 		name := f.Name()
-		if !strings.HasPrefix(name, "segment-") {
-			continue
-		}
-		idStr := strings.TrimPrefix(name, "segment-")
-		id, err := strconv.Atoi(idStr)
-		if err != nil {
+		id, ok := parseSegmentName(name)
+		if !ok {
 			continue
 		}
 
 		// Open segment file
-		file, err := os.OpenFile(filepath.Join(w.dir, name), os.O_RDWR, 0666)
+		flag := os.O_RDWR
+		if w.readOnly {
+			flag = os.O_RDONLY
+		}
+		file, err := os.OpenFile(filepath.Join(w.dir, name), flag, 0)
 		if err != nil {
 			return err
 		}
@@ -132,12 +353,42 @@ func (w *WAL) loadSegments() error {
 			return err
 		}
 
+		version, start, err := readSegmentHeader(file, id, info.Size())
+		if errors.Is(err, errShortHeader) {
+			// Created right before a crash, the header is written again
+			version, start, err = SegmentVersion, segmentHeaderSize, nil
+			if w.readOnly {
+				start = info.Size()
+			} else if err = writeSegmentHeader(file); err == nil {
+				info, err = file.Stat()
+			}
+		}
+		if err != nil {
+			file.Close()
+			return err
+		}
+
+		// New records go after the existing ones, not after the padding of
+		// a preallocated segment
+		end, err := dataEnd(file, id, start, info.Size())
+		if err != nil {
+			file.Close()
+			return err
+		}
+		if _, err := file.Seek(end, io.SeekStart); err != nil {
+			file.Close()
+			return err
+		}
+
 		// Create segment
 		seg := &segment{
-			id:     id,
-			file:   file,
-			offset: info.Size(),
-			state:  SegmentSealed,
+			id:      id,
+			file:    file,
+			offset:  end,
+			state:   SegmentSealed,
+			version: version,
+			start:   start,
+			maxTime: math.MaxInt64,
 		}
 
 		w.segments[id] = seg
@@ -155,109 +406,237 @@ func (w *WAL) loadSegments() error {
 	return nil
 }
 
+// segmentName returns the file name of a segment
+func segmentName(id int) string {
+	return fmt.Sprintf("segment-%08d", id)
+}
+
+// parseSegmentName returns the id of a segment file name
+func parseSegmentName(name string) (int, bool) {
+	if !strings.HasPrefix(name, "segment-") {
+		return 0, false
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(name, "segment-"))
+	return id, err == nil
+}
+
 func (w *WAL) newSegment(id int) error {
-	name := fmt.Sprintf("segment-%08d", id)
-	f, err := os.OpenFile(filepath.Join(w.dir, name), os.O_CREATE|os.O_RDWR, 0666)
+	f, err := os.OpenFile(filepath.Join(w.dir, segmentName(id)), os.O_CREATE|os.O_RDWR, w.fileMode)
 	if err != nil {
 		return err
 	}
+	if w.preallocate {
+		if err := preallocate(f, w.segmentSize); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.retry(func() error { return writeSegmentHeader(f) }); err != nil {
+		f.Close()
+		return err
+	}
 
 	seg := &segment{
-		id:     id,
-		file:   f,
-		state:  SegmentActive,
-		offset: 0,
+		id:      id,
+		file:    f,
+		state:   SegmentActive,
+		offset:  segmentHeaderSize,
+		version: SegmentVersion,
+		start:   segmentHeaderSize,
+		maxTime: math.MinInt64,
 	}
 
 	if w.current != nil {
+		if err := w.current.trim(); err != nil {
+			f.Close()
+			return err
+		}
 		w.current.state = SegmentSealed
+		w.rotations++
 	}
 
 	w.segments[id] = seg
 	w.current = seg
 
+	if fn := w.hooks.SegmentCreated; fn != nil {
+		go fn(id)
+	}
 	return nil
 }
 
 func (w *WAL) write(typ byte, data []byte) error {
+	if w.readOnly {
+		return ErrReadOnly
+	}
+	if w.commits != nil {
+		return w.commit(typ, data, noMaxTime)
+	}
+
 	w.mtx.Lock()
 	defer w.mtx.Unlock()
+	return w.writeLocked(typ, data)
+}
 
-	// Check if we need to rotate segment
-	if w.current.offset >= w.segmentSize {
-		if err := w.newSegment(w.current.id + 1); err != nil {
-			return err
-		}
+// writeSamples writes a record of samples whose newest timestamp is maxt
+func (w *WAL) writeSamples(typ byte, data []byte, maxt int64) error {
+	if w.readOnly {
+		return ErrReadOnly
 	}
+	if w.commits != nil {
+		return w.commit(typ, data, maxt)
+	}
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
 
-	// Write record header
-	header := make([]byte, 13) // type(1) + length(8) + crc32(4)
-	header[0] = typ
-	binary.BigEndian.PutUint64(header[1:9], uint64(len(data)))
-	crc := crc32.ChecksumIEEE(data)
-	binary.BigEndian.PutUint32(header[9:13], crc)
+	err := w.writeLocked(typ, data)
+	// A failed write may have left the record behind if it could not be
+	// cut off again
+	w.current.maxTime = max(w.current.maxTime, maxt)
+	return err
+}
 
-	// Write header
-	n, err := w.current.file.Write(header)
-	if err != nil {
+// writeLocked appends a record to the current segment and syncs it
+// according to the policy, w.mtx must be held
+func (w *WAL) writeLocked(typ byte, data []byte) error {
+	if err := w.appendLocked(typ, data); err != nil {
 		return err
 	}
-	w.current.offset += int64(n)
+	return w.syncLocked()
+}
 
-	// Write data
-	n, err = w.current.file.Write(data)
-	if err != nil {
+// appendLocked appends a record to the current segment without syncing it,
+// w.mtx must be held
+func (w *WAL) appendLocked(typ byte, data []byte) error {
+	if err := w.syncErr; err != nil {
+		w.syncErr = nil
 		return err
 	}
-	w.current.offset += int64(n)
 
-	return w.current.file.Sync()
+	header, data := encodeRecord(typ, data, w.compress)
+
+	// Rotate if the record does not fit, so records never straddle the
+	// segment size. A record larger than a whole segment is written alone
+	// into a fresh segment, which then grows beyond the size.
+	if w.current.offset > w.current.start && w.current.offset+int64(len(header)+len(data)) > w.segmentSize {
+		// Records still unsynced must not be left behind in the old segment
+		if err := w.flushDirtyLocked(); err != nil {
+			return err
+		}
+		if err := w.newSegment(w.current.id + 1); err != nil {
+			return err
+		}
+	}
+
+	return w.writeRecord(header, data)
+}
+
+// encodeRecord returns the header of a record and its payload as stored,
+// snappy compressed if compress is set
+func encodeRecord(typ byte, data []byte, compress bool) (header, payload []byte) {
+	if compress {
+		data = snappy.Encode(nil, data)
+		header = make([]byte, headerSize+1) // type(1) + compression(1) + length(8) + crc32(4)
+		header[0] = compressedFlag | FormatVersion<<4 | typ
+		header[1] = compressionSnappy
+	} else {
+		header = make([]byte, headerSize) // type(1) + length(8) + crc32(4)
+		header[0] = FormatVersion<<4 | typ
+	}
+	n := len(header)
+	binary.BigEndian.PutUint64(header[n-12:n-4], uint64(len(data)))
+	binary.BigEndian.PutUint32(header[n-4:], crc32.ChecksumIEEE(data))
+	return header, data
 }
 
-// Checkpoint marks all segments up to the current one as flushed
-func (w *WAL) Checkpoint() error {
+// Checkpoint writes a checkpoint record stating that all samples up to
+// maxt were persisted outside the WAL, e.g. compacted into a block, so a
+// replay may skip them. The segments holding only such samples are flushed
+// through FlushableBefore and CheckpointBefore.
+func (w *WAL) Checkpoint(maxt int64) error {
+	if w == nil {
+		return nil
+	}
+	if w.readOnly {
+		return ErrReadOnly
+	}
+
 	w.mtx.Lock()
 	defer w.mtx.Unlock()
 
-	// Write checkpoint record
-	if err := w.write(RecordCheckpoint, nil); err != nil {
+	buf := binary.BigEndian.AppendUint64(make([]byte, 0, 8), uint64(maxt))
+	if err := w.writeLocked(RecordCheckpoint, buf); err != nil {
 		return err
 	}
+	w.lastCheckpoint = time.Now()
+	w.checkpointMaxt = max(w.checkpointMaxt, maxt)
+	if fn := w.hooks.Checkpoint; fn != nil {
+		go fn(maxt)
+	}
+	return nil
+}
 
-	// Mark all segments except current as flushed
-	for _, seg := range w.segments {
-		if seg.id < w.current.id {
-			seg.state = SegmentFlushed
-		}
+// FlushableBefore returns the id up to which, exclusively, the oldest
+// segments are sealed and only hold samples before mint, so they can be
+// flushed by CheckpointBefore. ok is false if there is no such segment,
+// which is always the case for a read-only WAL.
+func (w *WAL) FlushableBefore(mint int64) (upto int, ok bool) {
+	if w == nil || w.readOnly {
+		return 0, false
 	}
 
-	w.lastCheckpoint = time.Now()
-	return nil
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	ids := make([]int, 0, len(w.segments))
+	for id := range w.segments {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		seg := w.segments[id]
+		if seg.state == SegmentFlushed {
+			continue
+		}
+		if seg == w.current || seg.maxTime >= mint {
+			return id, ok
+		}
+		ok = true
+	}
+	return w.current.id, ok
 }
 
-// Clean removes segments that have been checkpointed
+// Clean removes segments that have been checkpointed, except for the
+// newest MinRetainedSegments of them
 func (w *WAL) Clean() error {
+	if w == nil {
+		return nil
+	}
+	if w.readOnly {
+		return ErrReadOnly
+	}
+
 	w.mtx.Lock()
 	defer w.mtx.Unlock()
 
-	var toDelete []int
+	var flushed []int
 	for id, seg := range w.segments {
 		if seg.state == SegmentFlushed {
-			toDelete = append(toDelete, id)
+			flushed = append(flushed, id)
 		}
 	}
-
-	// Sort segment IDs to delete oldest first
-	sort.Ints(toDelete)
-
-	// Keep at least one old segment
-	if len(toDelete) > 0 {
-		toDelete = toDelete[:len(toDelete)-1]
+	if len(flushed) <= w.minRetained {
+		return nil
 	}
 
+	// Delete the oldest ones
+	sort.Ints(flushed)
+	toDelete := flushed[:len(flushed)-w.minRetained]
+
 	for _, id := range toDelete {
 		seg := w.segments[id]
-		name := filepath.Join(w.dir, fmt.Sprintf("segment-%08d", id))
+		name := filepath.Join(w.dir, segmentName(id))
 
 		// Close and delete file
 		seg.file.Close()
@@ -271,30 +650,183 @@ func (w *WAL) Clean() error {
 	return nil
 }
 
-// LogSeries writes a series record to the WAL.
-func (w *WAL) LogSeries(lset labels.Labels) error {
-	// Encode labels
+// LogSeries writes a series record to the WAL, binding the labels to the
+// reference later sample records use.
+func (w *WAL) LogSeries(ref uint64, lset labels.Labels) error {
+	if lset.IsEmpty() {
+		return ErrEmptyLabels
+	}
+	if w == nil {
+		return nil
+	}
+	return w.write(RecordSeries, encodeSeries(ref, lset))
+}
+
+// encodeSeries encodes the payload of a series record
+func encodeSeries(ref uint64, lset labels.Labels) []byte {
+	buf := binary.BigEndian.AppendUint64(make([]byte, 0, 1024), ref)
+	return appendLabels(buf, lset)
+}
+
+// LogSample writes a sample record to the WAL.
+func (w *WAL) LogSample(ref uint64, sample prompb.Sample) error {
+	if w == nil {
+		return nil
+	}
+	return w.LogSamples([]uint64{ref}, []prompb.Sample{sample})
+}
+
+// LogSamples writes many samples as a single sample record, so they are
+// persisted with one write and one sync. refs[i] is the series of samples[i].
+func (w *WAL) LogSamples(refs []uint64, samples []prompb.Sample) error {
+	if w == nil {
+		return nil
+	}
+	if len(refs) != len(samples) {
+		return fmt.Errorf("wal: %d refs for %d samples", len(refs), len(samples))
+	}
+
+	buf := make([]byte, 0, len(samples)*sampleSize)
+	maxt := int64(math.MinInt64)
+	for i, sample := range samples {
+		buf = binary.BigEndian.AppendUint64(buf, refs[i])
+		buf = appendSample(buf, sample)
+		maxt = max(maxt, sample.Timestamp)
+	}
+
+	return w.writeSamples(RecordSamples, buf, maxt)
+}
+
+// LogHistograms writes native histogram samples with integer counts as a
+// single record. refs[i] is the series of histograms[i].
+func (w *WAL) LogHistograms(refs []uint64, histograms []prompb.Histogram) error {
+	if w == nil {
+		return nil
+	}
+	return w.logHistograms(RecordHistograms, refs, histograms)
+}
+
+// LogFloatHistograms writes native histogram samples with float counts as a
+// single record, which replays tell apart from integer ones by its type
+// alone. refs[i] is the series of histograms[i].
+func (w *WAL) LogFloatHistograms(refs []uint64, histograms []prompb.Histogram) error {
+	if w == nil {
+		return nil
+	}
+	return w.logHistograms(RecordFloatHistograms, refs, histograms)
+}
+
+func (w *WAL) logHistograms(typ byte, refs []uint64, histograms []prompb.Histogram) error {
+	if len(refs) != len(histograms) {
+		return fmt.Errorf("wal: %d refs for %d histograms", len(refs), len(histograms))
+	}
+
 	buf := make([]byte, 0, 1024)
+	maxt := int64(math.MinInt64)
+	for i := range histograms {
+		b, err := histograms[i].Marshal()
+		if err != nil {
+			return err
+		}
+		buf = binary.BigEndian.AppendUint64(buf, refs[i])
+		buf = binary.AppendUvarint(buf, uint64(len(b)))
+		buf = append(buf, b...)
+		maxt = max(maxt, histograms[i].Timestamp)
+	}
 
-	// Write labels length
-	buf = binary.AppendVarint(buf, int64(len(lset)))
+	return w.writeSamples(typ, buf, maxt)
+}
 
-	// Write each label
-	for _, l := range lset {
-		buf = binary.AppendVarint(buf, int64(len(l.Name)))
-		buf = append(buf, l.Name...)
-		buf = binary.AppendVarint(buf, int64(len(l.Value)))
-		buf = append(buf, l.Value...)
+// LogExemplars writes exemplars as a single record. refs[i] is the series
+// of exemplars[i].
+func (w *WAL) LogExemplars(refs []uint64, exemplars []prompb.Exemplar) error {
+	if w == nil {
+		return nil
+	}
+	if len(refs) != len(exemplars) {
+		return fmt.Errorf("wal: %d refs for %d exemplars", len(refs), len(exemplars))
 	}
 
-	return w.write(RecordSeries, buf)
+	return w.write(RecordExemplars, encodeExemplars(refs, exemplars))
 }
 
-// LogSample writes a sample record to the WAL.
-func (w *WAL) LogSample(lset labels.Labels, sample prompb.Sample) error {
-	// First encode labels
+// encodeExemplars encodes the payload of an exemplars record
+func encodeExemplars(refs []uint64, exemplars []prompb.Exemplar) []byte {
 	buf := make([]byte, 0, 1024)
+	for i, e := range exemplars {
+		buf = binary.BigEndian.AppendUint64(buf, refs[i])
+		buf = appendSample(buf, prompb.Sample{Timestamp: e.Timestamp, Value: e.Value})
+		buf = binary.AppendVarint(buf, int64(len(e.Labels)))
+		for _, l := range e.Labels {
+			buf = binary.AppendVarint(buf, int64(len(l.Name)))
+			buf = append(buf, l.Name...)
+			buf = binary.AppendVarint(buf, int64(len(l.Value)))
+			buf = append(buf, l.Value...)
+		}
+	}
+	return buf
+}
+
+// LogMetadata writes the metadata of a metric family.
+func (w *WAL) LogMetadata(md prompb.MetricMetadata) error {
+	if w == nil {
+		return nil
+	}
+	return w.write(RecordMetadata, encodeMetadata(md))
+}
+
+// encodeMetadata encodes the payload of a metadata record
+func encodeMetadata(md prompb.MetricMetadata) []byte {
+	buf := binary.AppendUvarint(make([]byte, 0, 256), uint64(md.Type))
+	for _, s := range []string{md.MetricFamilyName, md.Help, md.Unit} {
+		buf = binary.AppendVarint(buf, int64(len(s)))
+		buf = append(buf, s...)
+	}
+	return buf
+}
+
+// Tombstone marks the samples of a series in [Mint, Maxt] as deleted
+type Tombstone struct {
+	Ref        uint64
+	Mint, Maxt int64
+}
+
+// LogTombstones writes deletions as a single record.
+func (w *WAL) LogTombstones(stones []Tombstone) error {
+	if w == nil {
+		return nil
+	}
+	return w.write(RecordTombstones, encodeTombstones(stones))
+}
+
+// encodeTombstones encodes the payload of a tombstones record
+func encodeTombstones(stones []Tombstone) []byte {
+	buf := make([]byte, 0, len(stones)*(8+2*binary.MaxVarintLen64))
+	for _, t := range stones {
+		buf = binary.BigEndian.AppendUint64(buf, t.Ref)
+		buf = binary.AppendVarint(buf, t.Mint)
+		buf = binary.AppendVarint(buf, t.Maxt)
+	}
+	return buf
+}
 
+// LogSequence writes the last accepted client sequence of a series.
+func (w *WAL) LogSequence(ref uint64, seq uint64) error {
+	if w == nil {
+		return nil
+	}
+	return w.write(RecordSequence, encodeSequence(ref, seq))
+}
+
+// encodeSequence encodes the payload of a sequence record
+func encodeSequence(ref uint64, seq uint64) []byte {
+	buf := binary.BigEndian.AppendUint64(make([]byte, 0, 8+binary.MaxVarintLen64), ref)
+	return binary.AppendUvarint(buf, seq)
+}
+
+// appendLabels encodes a label set as its length followed by
+// length-prefixed names and values
+func appendLabels(buf []byte, lset labels.Labels) []byte {
 	// Write labels length
 	buf = binary.AppendVarint(buf, int64(len(lset)))
 
@@ -305,22 +837,48 @@ func (w *WAL) LogSample(lset labels.Labels, sample prompb.Sample) error {
 		buf = binary.AppendVarint(buf, int64(len(l.Value)))
 		buf = append(buf, l.Value...)
 	}
+	return buf
+}
 
-	// Then encode sample
-	tbuf := make([]byte, 16)
-	binary.BigEndian.PutUint64(tbuf[:8], uint64(sample.Timestamp))
-	binary.BigEndian.PutUint64(tbuf[8:], math.Float64bits(sample.Value))
-	buf = append(buf, tbuf...)
-
-	return w.write(RecordSamples, buf)
+// appendSample encodes a sample as big endian timestamp and value bits
+func appendSample(buf []byte, sample prompb.Sample) []byte {
+	buf = binary.BigEndian.AppendUint64(buf, uint64(sample.Timestamp))
+	return binary.BigEndian.AppendUint64(buf, math.Float64bits(sample.Value))
 }
 
-// Close closes the WAL.
+// Close closes the WAL and all of its segment files and releases the
+// directory lock. Segments are synced first.
+// Group committed writes arriving afterwards fail with ErrClosed.
 func (w *WAL) Close() error {
+	if w == nil {
+		return nil
+	}
+	if w.stopSync != nil {
+		close(w.stopSync)
+		<-w.syncDone
+		w.stopSync = nil
+	}
+
 	w.mtx.Lock()
 	defer w.mtx.Unlock()
-	if w.current != nil {
-		return w.current.file.Close()
+
+	// Whatever the policy, nothing written is left unsynced
+	var firstErr error
+	for _, seg := range w.segments {
+		if !w.readOnly {
+			if err := seg.trim(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			if err := w.syncFile(seg.file); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		if err := seg.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
-	return nil
+	if err := unlockDir(w.lock); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
 }
@@ -0,0 +1,432 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// openWAL opens a WAL, closing it when the test ends
+func openWAL(t *testing.T, opts Options) *WAL {
+	t.Helper()
+	w, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w
+}
+
+// TestSegmentSize checks that a record going beyond the segment size starts
+// a new segment, and one larger than a whole segment gets one to itself
+func TestSegmentSize(t *testing.T) {
+	dir := t.TempDir()
+	w := openWAL(t, Options{Dir: dir, SegmentSize: 256})
+
+	payloads := [][]byte{
+		bytes.Repeat([]byte{1}, 100),
+		bytes.Repeat([]byte{2}, 100),
+		bytes.Repeat([]byte{3}, 100), // does not fit after the first two
+		bytes.Repeat([]byte{4}, 400), // larger than a segment
+		bytes.Repeat([]byte{5}, 10),
+	}
+	for _, p := range payloads {
+		w.mtx.Lock()
+		err := w.writeLocked(RecordSeries, p)
+		w.mtx.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids, err := ListSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := func(p []byte) int64 { return headerSize + int64(len(p)) }
+	want := []int64{
+		segmentHeaderSize + record(payloads[0]) + record(payloads[1]),
+		segmentHeaderSize + record(payloads[2]),
+		segmentHeaderSize + record(payloads[3]),
+		segmentHeaderSize + record(payloads[4]),
+	}
+	var sizes []int64
+	for _, id := range ids {
+		info, err := os.Stat(filepath.Join(dir, segmentName(id)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, info.Size())
+	}
+	if !reflect.DeepEqual(sizes, want) {
+		t.Fatalf("segment sizes %v, want %v", sizes, want)
+	}
+
+	var got [][]byte
+	if err := w.Replay(func(typ, version byte, data []byte) error {
+		got = append(got, append([]byte(nil), data...))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, payloads) {
+		t.Fatalf("replayed %d records, want the %d written", len(got), len(payloads))
+	}
+}
+
+// TestCompressMixed checks that segments mixing compressed and
+// uncompressed records, as left by toggling Compress across restarts,
+// replay all records unchanged
+func TestCompressMixed(t *testing.T) {
+	dir := t.TempDir()
+	var want [][]byte
+	for i, compress := range []bool{false, true, false} {
+		w, err := New(Options{Dir: dir, Compress: compress})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 3; j++ {
+			p := bytes.Repeat([]byte{byte(i*3 + j)}, 100*(j+1))
+			if err := w.write(RecordSeries, p); err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, p)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := openWAL(t, Options{Dir: dir})
+	var got [][]byte
+	if err := w.Replay(func(typ, version byte, data []byte) error {
+		if typ != RecordSeries || version != FormatVersion {
+			t.Fatalf("record of type %d version %d, want %d version %d", typ, version, RecordSeries, FormatVersion)
+		}
+		got = append(got, append([]byte(nil), data...))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("replayed %d records, want the %d written", len(got), len(want))
+	}
+}
+
+// TestGroupCommit logs samples from concurrent writers under group commit
+// and checks that every acknowledged one is in the WAL
+func TestGroupCommit(t *testing.T) {
+	dir := t.TempDir()
+	w, err := New(Options{Dir: dir, SyncPolicy: SyncGroupCommit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const writers, samples = 8, 100
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(ref uint64) {
+			defer wg.Done()
+			for j := 1; j <= samples; j++ {
+				if err := w.LogSample(ref, prompb.Sample{Timestamp: int64(j), Value: 1}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(uint64(i + 1))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.LogSample(1, prompb.Sample{Timestamp: samples + 1}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("write after close: %v, want %v", err, ErrClosed)
+	}
+
+	w = openWAL(t, Options{Dir: dir})
+	n := 0
+	if err := w.Replay(func(typ, version byte, data []byte) error {
+		if typ == RecordSamples {
+			n++
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != writers*samples {
+		t.Fatalf("replayed %d sample records, want %d", n, writers*samples)
+	}
+}
+
+// BenchmarkLogSamples compares logging samples one record and sync each to
+// logging them in batches of a single record and sync
+func BenchmarkLogSamples(b *testing.B) {
+	for _, batch := range []int{1, 100, 1000} {
+		b.Run("batch="+strconv.Itoa(batch), func(b *testing.B) {
+			w, err := New(Options{Dir: b.TempDir()})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer w.Close()
+
+			refs := make([]uint64, batch)
+			samples := make([]prompb.Sample, batch)
+			b.ResetTimer()
+			for i := 0; i < b.N; i += batch {
+				n := min(batch, b.N-i)
+				for j := 0; j < n; j++ {
+					refs[j] = uint64(j%100 + 1)
+					samples[j] = prompb.Sample{Timestamp: int64(i + j + 1), Value: 1}
+				}
+				if batch == 1 {
+					err = w.LogSample(refs[0], samples[0])
+				} else {
+					err = w.LogSamples(refs[:n], samples[:n])
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSyncPolicy compares the throughput of logging single samples
+// under each sync policy
+func BenchmarkSyncPolicy(b *testing.B) {
+	for _, p := range []SyncPolicy{SyncAlways, SyncInterval(10 * time.Millisecond), SyncNever, SyncGroupCommit} {
+		b.Run(p.String(), func(b *testing.B) {
+			w, err := New(Options{Dir: b.TempDir(), SyncPolicy: p})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer w.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := w.LogSample(1, prompb.Sample{Timestamp: int64(i + 1), Value: 1}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestCleanRetained checks that Clean keeps the newest MinRetainedSegments
+// flushed segments, and removes the older ones only once
+func TestCleanRetained(t *testing.T) {
+	for _, tc := range []struct {
+		retained int
+		want     []int
+	}{
+		{-1, []int{5}},
+		{0, []int{4, 5}}, // the default of 1
+		{1, []int{4, 5}},
+		{3, []int{2, 3, 4, 5}},
+		{10, []int{0, 1, 2, 3, 4, 5}},
+	} {
+		t.Run(strconv.Itoa(tc.retained), func(t *testing.T) {
+			dir := t.TempDir()
+			w := openWAL(t, Options{Dir: dir, SegmentSize: 4096, MinRetainedSegments: tc.retained})
+			for i := 0; w.current.id < 5; i++ {
+				if err := w.LogSample(1, prompb.Sample{Timestamp: int64(i)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.CheckpointBefore(w.current.id, func(*CheckpointWriter) error { return nil }); err != nil {
+				t.Fatal(err)
+			}
+
+			// A second Clean with nothing newly flushed removes nothing
+			for i := 0; i < 2; i++ {
+				if err := w.Clean(); err != nil {
+					t.Fatal(err)
+				}
+				ids, err := ListSegments(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(ids, tc.want) {
+					t.Fatalf("segments %v left by Clean, want %v", ids, tc.want)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCompression logs the series and a scrape worth of samples of
+// targets exporting the same metrics, and reports the WAL bytes per series
+// with and without compression
+func BenchmarkCompression(b *testing.B) {
+	const targets, metrics = 50, 200
+	var series []labels.Labels
+	for i := 0; i < targets; i++ {
+		for j := 0; j < metrics; j++ {
+			series = append(series, labels.FromStrings(
+				labels.MetricName, "http_requests_total_"+strconv.Itoa(j%20),
+				"handler", "/api/v1/"+strconv.Itoa(j/20),
+				"instance", "10.0.0."+strconv.Itoa(i)+":9100",
+				"job", "node",
+				"namespace", "monitoring",
+				"pod", "node-exporter-"+strconv.Itoa(i),
+			))
+		}
+	}
+	refs := make([]uint64, len(series))
+	samples := make([]prompb.Sample, len(series))
+	for i := range series {
+		refs[i] = uint64(i + 1)
+		samples[i] = prompb.Sample{Timestamp: 1_700_000_000_000, Value: float64(i % 7)}
+	}
+
+	for _, compress := range []bool{false, true} {
+		b.Run("compress="+strconv.FormatBool(compress), func(b *testing.B) {
+			var size int64
+			for i := 0; i < b.N; i++ {
+				w, err := New(Options{Dir: b.TempDir(), Compress: compress, SyncPolicy: SyncNever})
+				if err != nil {
+					b.Fatal(err)
+				}
+				for j, l := range series {
+					if err := w.LogSeries(refs[j], l); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := w.LogSamples(refs, samples); err != nil {
+					b.Fatal(err)
+				}
+				size = 0
+				for _, seg := range w.segments {
+					size += seg.offset
+				}
+				w.Close()
+			}
+			b.ReportMetric(float64(size)/float64(len(series)), "bytes/series")
+		})
+	}
+}
+
+// BenchmarkGroupCommit logs single samples from many concurrent writers,
+// each waiting for its record to be synced, with an fsync per record and
+// with the writers sharing them
+func BenchmarkGroupCommit(b *testing.B) {
+	for _, p := range []SyncPolicy{SyncAlways, SyncGroupCommit} {
+		b.Run(p.String(), func(b *testing.B) {
+			w, err := New(Options{Dir: b.TempDir(), SyncPolicy: p})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer w.Close()
+
+			var ref uint64
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				ref := atomic.AddUint64(&ref, 1)
+				for i := int64(1); pb.Next(); i++ {
+					if err := w.LogSample(ref, prompb.Sample{Timestamp: i, Value: 1}); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkPreallocate logs single synced samples into small segments,
+// with and without preallocating them, and reports the 99th percentile
+// latency of a write, which pays for allocating blocks and updating the
+// file size on every sync unless the segment was preallocated
+func BenchmarkPreallocate(b *testing.B) {
+	for _, prealloc := range []bool{false, true} {
+		b.Run("preallocate="+strconv.FormatBool(prealloc), func(b *testing.B) {
+			w, err := New(Options{Dir: b.TempDir(), SegmentSize: 1 << 20, Preallocate: prealloc})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer w.Close()
+
+			latencies := make([]time.Duration, b.N)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				if err := w.LogSample(1, prompb.Sample{Timestamp: int64(i + 1), Value: 1}); err != nil {
+					b.Fatal(err)
+				}
+				latencies[i] = time.Since(start)
+			}
+			b.StopTimer()
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			b.ReportMetric(float64(latencies[b.N*99/100].Nanoseconds()), "p99-ns/op")
+		})
+	}
+}
+
+// TestSegmentHeader checks that segments without a header, as written by
+// older versions, still replay, and that segments of a newer format
+// version are refused
+func TestSegmentHeader(t *testing.T) {
+	dir := t.TempDir()
+	w, err := New(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err := w.LogSample(1, prompb.Sample{Timestamp: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, segmentName(0))
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b[:segmentHeaderSize], segmentHeader()) {
+		t.Fatalf("segment starts with %q, want the header", b[:segmentHeaderSize])
+	}
+
+	if err := os.WriteFile(path, b[segmentHeaderSize:], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w, err = New(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := countRecords(w)
+	w.Close()
+	if err != nil || n != 3 {
+		t.Fatalf("replayed %d records of a segment without header: %v, want 3", n, err)
+	}
+
+	b[len(segmentMagic)] = SegmentVersion + 1
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if w, err = New(Options{Dir: dir}); err == nil {
+		_, err = countRecords(w)
+		w.Close()
+	}
+	if !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("opening a newer segment version: %v, want %v", err, ErrUnsupportedVersion)
+	}
+}